@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"time"
 
 	"github.com/Enigamict/zebraland/pkg/config"
 	"github.com/Enigamict/zebraland/pkg/nebura"
@@ -24,8 +25,161 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// neburaにはBGPとして1本だけ繋いでおく、落ちたら経路は消える
+	// pathはpeerをまたいでBgpRibで選ぶ
+	var nc *nebura.Nclient
+	var rib *nebura.BgpRib
+	if c.Select == "nebura" {
+		nc, err = nebura.NclientRegister("BGP", time.Duration(c.BgpConf.Grace)*time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+		nc.Vrf = c.BgpConf.Vrf
+		rib = nebura.BgpRibInit(nc)
+	}
+
+	// BFDはneburaが動かしているので、peerはneburaに登録する
+	var bfd nebura.PeerBfd
+	if c.BgpConf.Bfd.Enable {
+		bc := nc
+		if bc == nil || bc.Vrf != nebura.VrfDefault {
+			// 経路は入れないのでBFDの登録だけに使う、BFDはデフォルトのVRFでしか登録できない
+			if bc, err = nebura.NclientRegister("", 0); err != nil {
+				log.Fatal(err)
+			}
+		}
+		bfd = bc.Bfd(bfdConf(c.BgpConf.Bfd))
+	}
+
+	neighbor := net.ParseIP(c.BgpConf.PeerPrefix.NeiAddr).To4()
+	networks, err := bgpNetworks(c.BgpConf.Networks)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(c.BgpConf.Listen) > 0 {
+		s, err := bgpServer(c)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.Bfd = bfd
+		s.Networks = networks
+		s.Vrf = c.BgpConf.Vrf
+		s.Nebura = nc
+		s.Rib = rib
+
+		if neighbor == nil {
+			log.Fatal(s.BGPListen())
+		}
+		// 設定したpeerからの接続はDynamic Neighborにしない
+		s.AddStaticPeer(neighbor)
+		go func() {
+			log.Fatal(s.BGPListen())
+		}()
+	}
+
 	for {
-		p := nebura.PeerInit(c.BgpConf.As, net.ParseIP(c.BgpConf.Id).To4(), net.ParseIP(c.BgpConf.PeerPrefix.NeiAddr).To4(), c.Select)
+		p := nebura.PeerInit(c.BgpConf.As, net.ParseIP(c.BgpConf.Id).To4(), neighbor, c.Select)
+		p.Bfd = bfd
+		p.Networks = networks
+		p.Vrf = c.BgpConf.Vrf
+		p.Nebura = nc
+		p.Rib = rib
+		p.RemoteAS = c.BgpConf.PeerPrefix.RemoteAs
+		p.LocalAS = localAS(c.BgpConf.PeerPrefix.LocalAs)
+		p.Confed = confed(c.BgpConf.Confed)
+		p.ExtMsg = c.BgpConf.PeerPrefix.ExtMsg
+		p.LinkState = c.BgpConf.PeerPrefix.LinkState
 		p.BGPConectActive()
 	}
 }
+
+func bgpServer(c config.Conf) (*nebura.BgpServer, error) {
+	s := nebura.BgpServerInit(c.BgpConf.As, net.ParseIP(c.BgpConf.Id).To4())
+	s.Confed = confed(c.BgpConf.Confed)
+
+	groups := make(map[string]*nebura.PeerGroup)
+	for _, g := range c.BgpConf.PeerGroups {
+		pg := &nebura.PeerGroup{
+			Name:     g.Name,
+			RemoteAS: g.RemoteAs,
+			HoldTime: g.HoldTime,
+			Select:   c.Select,
+			LocalAS:  localAS(g.LocalAs),
+			ExtMsg:   g.ExtMsg,
+		}
+		for _, i := range g.Import {
+			_, n, err := net.ParseCIDR(i)
+			if err != nil {
+				return nil, err
+			}
+			pg.Import = append(pg.Import, n)
+		}
+		groups[g.Name] = pg
+	}
+
+	for _, l := range c.BgpConf.Listen {
+		_, n, err := net.ParseCIDR(l.Range)
+		if err != nil {
+			return nil, err
+		}
+		g, ok := groups[l.PeerGroup]
+		if !ok {
+			return nil, fmt.Errorf("peergroup %s not found", l.PeerGroup)
+		}
+		s.AddListenRange(n, g)
+	}
+
+	return s, nil
+}
+
+func bgpNetworks(networks []string) ([]nebura.NLRIPrefix, error) {
+	var prefixes []nebura.NLRIPrefix
+	for _, s := range networks {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		if n.IP.To4() == nil {
+			return nil, fmt.Errorf("network %s: not ipv4", s)
+		}
+		ones, _ := n.Mask.Size()
+		prefixes = append(prefixes, nebura.NLRIPrefix{Len: uint8(ones), NLRI: n.IP.To4()})
+	}
+	return prefixes, nil
+}
+
+func confed(c config.ConfedConf) *nebura.Confed {
+	if c.Id == 0 {
+		return nil
+	}
+	return &nebura.Confed{
+		ID:    c.Id,
+		Peers: c.Peers,
+	}
+}
+
+func localAS(l config.LocalAsConf) *nebura.LocalAS {
+	if l.As == 0 {
+		return nil
+	}
+	return &nebura.LocalAS{
+		AS:        l.As,
+		NoPrepend: l.NoPrepend,
+		ReplaceAS: l.ReplaceAs,
+	}
+}
+
+func bfdConf(b config.BfdConf) nebura.BfdConf {
+	conf := nebura.BfdDefaultConf
+	if b.MinTx != 0 {
+		conf.DesiredMinTx = b.MinTx * 1000
+	}
+	if b.MinRx != 0 {
+		conf.RequiredMinRx = b.MinRx * 1000
+	}
+	if b.Multiplier != 0 {
+		conf.DetectMult = b.Multiplier
+	}
+	return conf
+}
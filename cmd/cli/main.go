@@ -1,23 +1,281 @@
 package main
 
-import "github.com/Enigamict/zebraland/pkg/nebura"
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
 
-func main() {
+	"github.com/Enigamict/zebraland/pkg/config"
+	"github.com/Enigamict/zebraland/pkg/nebura"
+)
 
-	//var argconfig string
-	//for i, v := range os.Args {
-	//	fmt.Printf("args[%d] -> %s\n", i, v)
-	//	argconfig = v
-	//}
+func main() {
 
-	//a, _ := config.ReadConfig(argconfig)
 	n := nebura.NclientInit()
-	//fmt.Printf("aa:%v:aa", a.IPPrefixAdd.DstAddr)
-	//n.SendNclientIPv6Route(a.IPPrefixAdd.DstAddr, a.IPPrefixAdd.SrcAddr,
-	//	uint8(a.IPPrefixAdd.DstAddrLen), uint8(a.IPPrefixAdd.Index))
-	n.SendNclientXdp(0, "veth2")
-	//n.SendNclientSeg6Add(a.Seg6Add.EncapAddr, a.Seg6Add.Segs)
-
-	//n.SendNclientSRendAction(a.EndActionAdd.EndAction, a.EndActionAdd.NextHop,
-	//	a.EndActionAdd.EncapAddr)
+
+	if len(os.Args) < 2 {
+		if err := n.SendNclientXdp(0, "veth2"); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if os.Args[1] == "lsgraph" {
+		g, err := n.LsGraphGet()
+		if err != nil {
+			log.Fatal(err)
+		}
+		buf, _ := json.MarshalIndent(g, "", "  ")
+		fmt.Printf("%s\n", buf)
+		return
+	}
+
+	// cli monitor [protocol]
+	if os.Args[1] == "monitor" {
+		var proto string
+		if len(os.Args) > 2 {
+			proto = os.Args[2]
+		}
+		err := n.Subscribe(proto, 0, func(e nebura.RouteEvent) {
+			op := "add"
+			if e.Delete {
+				op = "delete"
+			}
+			fmt.Printf("%s %s %s/%d via %s\n", op, e.Route.RoutingProtocol,
+				e.Route.Prefix, e.Route.PrefixLen, e.Route.Nexthop)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		select {}
+	}
+
+	// cli [add|delete|replace] config.yaml
+	op := "add"
+	switch os.Args[1] {
+	case "add", "delete", "replace":
+		op = os.Args[1]
+	}
+
+	var argconfig string
+	for i, v := range os.Args {
+		fmt.Printf("args[%d] -> %s\n", i, v)
+		argconfig = v
+	}
+
+	a, err := config.ReadConfig(argconfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// 経路はconfigのVRFに入れる
+	n.Vrf = a.IPPrefixAdd.Vrf
+	if a.StaticRoute.DstAddr != "" {
+		n.Vrf = a.StaticRoute.Vrf
+	}
+
+	switch op {
+	case "delete":
+		err = routeDelete(n, a)
+	case "replace":
+		err = routeReplace(n, a)
+	default:
+		err = routeAdd(n, a)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func routeAdd(n *nebura.Nclient, a config.Conf) error {
+	switch {
+	case a.VrfConf.Name != "":
+		return vrfAdd(n, a.VrfConf)
+	case len(a.PbrConf) > 0:
+		return pbrSend(a.PbrConf, n.SendNclientRuleAdd)
+	case len(a.MplsConf.Labels) > 0 || len(a.MplsConf.Push) > 0:
+		return mplsSend(a.MplsConf, n.SendNclientMplsAdd, n.SendNclientMplsPushAdd)
+	case a.StaticRoute.DstAddr != "":
+		return n.SendNclientStaticRoute(a.StaticRoute.DstAddr, a.StaticRoute.NextHop,
+			uint8(a.StaticRoute.DstAddrLen), a.StaticRoute.Bfd)
+	case a.IPPrefixAdd.DstAddr != "":
+		return n.SendNclientIPv6Route(a.IPPrefixAdd.DstAddr, a.IPPrefixAdd.SrcAddr,
+			uint8(a.IPPrefixAdd.DstAddrLen), uint32(a.IPPrefixAdd.Index))
+	case len(a.Seg6Add.Segs) > 0:
+		prefix, plen, err := seg6Prefix(a.Seg6Add.EncapAddr)
+		if err != nil {
+			return err
+		}
+		return n.SendNclientSeg6Add(prefix, plen, a.Seg6Add.Segs, a.Seg6Add.Mode)
+	case a.EndActionAdd.EndAction != "":
+		return n.SendNclientSRendAction(a.EndActionAdd.EndAction, a.EndActionAdd.NextHop,
+			a.EndActionAdd.EncapAddr)
+	case a.TcConf.Inter != "":
+		return n.SendNclientTcNetem(a.TcConf.Inter, a.TcConf.Ms)
+	}
+	log.Printf("no config")
+	return nil
+}
+
+func routeDelete(n *nebura.Nclient, a config.Conf) error {
+	switch {
+	case a.VrfConf.Name != "":
+		return n.SendNclientVrfDelete(a.VrfConf.Name)
+	case len(a.PbrConf) > 0:
+		return pbrSend(a.PbrConf, n.SendNclientRuleDelete)
+	case len(a.MplsConf.Labels) > 0 || len(a.MplsConf.Push) > 0:
+		return mplsDelete(n, a.MplsConf)
+	case a.StaticRoute.DstAddr != "":
+		return n.SendNclientStaticRouteDelete(a.StaticRoute.DstAddr, uint8(a.StaticRoute.DstAddrLen))
+	case a.IPPrefixAdd.DstAddr != "":
+		return n.SendNclientIPv6RouteDelete(a.IPPrefixAdd.DstAddr, uint8(a.IPPrefixAdd.DstAddrLen))
+	case len(a.Seg6Add.Segs) > 0:
+		prefix, plen, err := seg6Prefix(a.Seg6Add.EncapAddr)
+		if err != nil {
+			return err
+		}
+		return n.SendNclientSeg6Delete(prefix, plen)
+	case a.EndActionAdd.EndAction != "":
+		return n.SendNclientSRendActionDelete(a.EndActionAdd.EncapAddr)
+	}
+	log.Printf("no config")
+	return nil
+}
+
+func routeReplace(n *nebura.Nclient, a config.Conf) error {
+	switch {
+	case len(a.PbrConf) > 0:
+		return pbrSend(a.PbrConf, n.SendNclientRuleReplace)
+	case len(a.MplsConf.Labels) > 0 || len(a.MplsConf.Push) > 0:
+		return mplsSend(a.MplsConf, n.SendNclientMplsReplace, n.SendNclientMplsPushReplace)
+	case a.IPPrefixAdd.DstAddr != "":
+		return n.SendNclientIPv6RouteReplace(a.IPPrefixAdd.DstAddr, a.IPPrefixAdd.SrcAddr,
+			uint8(a.IPPrefixAdd.DstAddrLen), uint32(a.IPPrefixAdd.Index))
+	case len(a.Seg6Add.Segs) > 0:
+		prefix, plen, err := seg6Prefix(a.Seg6Add.EncapAddr)
+		if err != nil {
+			return err
+		}
+		return n.SendNclientSeg6Replace(prefix, plen, a.Seg6Add.Segs, a.Seg6Add.Mode)
+	case a.EndActionAdd.EndAction != "":
+		return n.SendNclientSRendActionReplace(a.EndActionAdd.EndAction, a.EndActionAdd.NextHop,
+			a.EndActionAdd.EncapAddr)
+	}
+	log.Printf("no config")
+	return nil
+}
+
+// seg6Prefix はprefix長がなければ今まで通り/24にする
+func seg6Prefix(encapaddr string) (string, uint8, error) {
+	if !strings.Contains(encapaddr, "/") {
+		return encapaddr, 24, nil
+	}
+	_, ipnet, err := net.ParseCIDR(encapaddr)
+	if err != nil {
+		return "", 0, err
+	}
+	plen, _ := ipnet.Mask.Size()
+	return ipnet.IP.String(), uint8(plen), nil
+}
+
+// vrfAdd はVRFを作ってinterfaceを入れる
+func vrfAdd(n *nebura.Nclient, v config.VrfConf) error {
+	if err := n.SendNclientVrfAdd(v.Name, v.Table); err != nil {
+		return err
+	}
+	for _, inter := range v.Interfaces {
+		if err := n.SendNclientVrfBind(v.Name, inter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pbrSend はconfigのruleを順番にfで送る
+func pbrSend(rules []config.PbrConf, f func(nebura.PbrRule) error) error {
+	for _, c := range rules {
+		p, err := pbrRule(c)
+		if err != nil {
+			return err
+		}
+		if err := f(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pbrRule(c config.PbrConf) (nebura.PbrRule, error) {
+	p := nebura.PbrRule{
+		Priority: c.Priority,
+		Mark:     c.Mark,
+		Mask:     c.Mask,
+		Iif:      c.Iif,
+		Dscp:     c.Dscp,
+		Table:    c.Table,
+	}
+
+	switch c.Family {
+	case "":
+	case "ipv4":
+		p.Family = nebura.AfiIPv4
+	case "ipv6":
+		p.Family = nebura.AfiIPv6
+	default:
+		return p, fmt.Errorf("pbr: unknown family %q", c.Family)
+	}
+
+	var err error
+	if p.Src, err = pbrPrefix(c.Src); err != nil {
+		return p, err
+	}
+	if p.Dst, err = pbrPrefix(c.Dst); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+func pbrPrefix(s string) (nebura.Prefix, error) {
+	if s == "" {
+		return nebura.Prefix{}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nebura.Prefix{}, err
+	}
+	plen, _ := ipnet.Mask.Size()
+	return nebura.Prefix{Prefix: ipnet.IP, PrefixLen: uint8(plen)}, nil
+}
+
+// mplsSend はlabelの経路をlabel、pushの経路をpushで送る
+func mplsSend(c config.MplsConf, label func(uint32, []uint32, string) error,
+	push func(string, uint8, []uint32, string) error) error {
+	for _, l := range c.Labels {
+		if err := label(l.In, l.Out, l.NextHop); err != nil {
+			return err
+		}
+	}
+	for _, p := range c.Push {
+		if err := push(p.DstAddr, uint8(p.DstAddrLen), p.Labels, p.NextHop); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mplsDelete(n *nebura.Nclient, c config.MplsConf) error {
+	for _, l := range c.Labels {
+		if err := n.SendNclientMplsDelete(l.In); err != nil {
+			return err
+		}
+	}
+	for _, p := range c.Push {
+		if err := n.SendNclientMplsPushDelete(p.DstAddr, uint8(p.DstAddrLen)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,10 +1,25 @@
 package main
 
 import (
+	"flag"
+	"time"
+
 	"github.com/Enigamict/zebraland/pkg/nebura"
 )
 
 func main() {
 
-	nebura.NserverStart()
+	// 起動時にkernelに残っていた経路を消すまでの秒数
+	reconcile := flag.Uint("reconcile", 60, "seconds to keep stale routes after start")
+	// kernelに書き込まずにログに出すだけ
+	dryRun := flag.Bool("dry-run", false, "do not touch the kernel")
+	flag.Parse()
+
+	var fib nebura.Fib
+	if *dryRun {
+		fib = nebura.MemFibInit()
+	}
+
+	nebura.FibReconcileTime = time.Duration(*reconcile) * time.Second
+	nebura.NserverStart(fib)
 }
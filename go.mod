@@ -2,11 +2,13 @@ module github.com/Enigamict/zebraland
 
 go 1.19
 
-require gopkg.in/yaml.v2 v2.4.0
+require (
+	github.com/cilium/ebpf v0.10.0
+	github.com/vishvananda/netlink v1.1.0
+	gopkg.in/yaml.v2 v2.4.0
+)
 
 require (
-	github.com/cilium/ebpf v0.10.0 // indirect
-	github.com/vishvananda/netlink v1.1.0 // indirect
 	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
 	golang.org/x/sys v0.2.0 // indirect
 )
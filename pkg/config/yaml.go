@@ -17,11 +17,32 @@ type IPPrefixAdd struct {
 	DstAddr    string `yaml:"dstaddr"`
 	DstAddrLen int    `yaml:"dstaddr_len"`
 	Index      int    `yaml:"index"`
+	Vrf        uint32 `yaml:"vrf"` // VRFのtable、0ならデフォルト
 }
 
+// Seg6Add のencapaddrは"10.0.0.0/24"のようにprefix長を付ける、付けなければ今まで通り/24
 type Seg6Add struct {
-	Segs      string `yaml:"segs"`
-	EncapAddr string `yaml:"encapaddr"`
+	Segs      Seg6Segs `yaml:"segs"`
+	EncapAddr string   `yaml:"encapaddr"`
+	Mode      string   `yaml:"mode"` // inline, encap, encap.red, l2encap、空ならencap
+}
+
+// Seg6Segs は通る順のsegment、1つなら文字列でも書ける
+type Seg6Segs []string
+
+func (s *Seg6Segs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var seg string
+	if err := unmarshal(&seg); err == nil {
+		*s = Seg6Segs{seg}
+		return nil
+	}
+
+	var segs []string
+	if err := unmarshal(&segs); err != nil {
+		return err
+	}
+	*s = segs
+	return nil
 }
 
 type EndActionAdd struct {
@@ -30,15 +51,105 @@ type EndActionAdd struct {
 	NextHop   string `yaml:"nexthop"`
 }
 
+type StaticRouteAdd struct {
+	DstAddr    string `yaml:"dstaddr"`
+	DstAddrLen int    `yaml:"dstaddr_len"`
+	NextHop    string `yaml:"nexthop"`
+	Bfd        bool   `yaml:"bfd"`
+	Vrf        uint32 `yaml:"vrf"`
+}
+
+type VrfConf struct {
+	Name       string   `yaml:"name"`
+	Table      uint32   `yaml:"table"`
+	Interfaces []string `yaml:"interfaces"`
+}
+
+// PbrConf はpolicy routingのrule、src, dstはCIDRで空なら見ない
+type PbrConf struct {
+	Priority uint32 `yaml:"priority"`
+	Family   string `yaml:"family"` // "ipv4"か"ipv6"、src, dstがあれば不要
+	Src      string `yaml:"src"`
+	Dst      string `yaml:"dst"`
+	Mark     uint32 `yaml:"fwmark"`
+	Mask     uint32 `yaml:"fwmask"`
+	Iif      string `yaml:"iif"`
+	Dscp     uint8  `yaml:"dscp"` // IPv4で8以上はkernel 6.13以降
+	Table    uint32 `yaml:"table"`
+}
+
+// MplsConf はlabelの経路とpushの経路
+type MplsConf struct {
+	Labels []MplsLabelConf `yaml:"labels"`
+	Push   []MplsPushConf  `yaml:"push"`
+}
+
+// MplsLabelConf はoutが空ならpop、popでnexthopも空ならこのノードで引き直す
+type MplsLabelConf struct {
+	In      uint32   `yaml:"in"`
+	Out     []uint32 `yaml:"out"`
+	NextHop string   `yaml:"nexthop"`
+}
+
+type MplsPushConf struct {
+	DstAddr    string   `yaml:"dstaddr"`
+	DstAddrLen int      `yaml:"dstaddr_len"`
+	Labels     []uint32 `yaml:"labels"` // 先頭が一番外側
+	NextHop    string   `yaml:"nexthop"`
+}
+
+type BfdConf struct {
+	Enable     bool   `yaml:"enable"`
+	MinTx      uint32 `yaml:"min_tx"` // ms
+	MinRx      uint32 `yaml:"min_rx"` // ms
+	Multiplier uint8  `yaml:"multiplier"`
+}
+
 type PeerConf struct {
-	Select     string     `yaml:"select"`
-	Id         string     `yaml:"id"`
-	As         uint16     `yaml:"as"`
-	PeerPrefix PeerPrefix `yaml:"peer"`
+	Select     string          `yaml:"select"`
+	Id         string          `yaml:"id"`
+	As         uint16          `yaml:"as"`
+	PeerPrefix PeerPrefix      `yaml:"peer"`
+	Bfd        BfdConf         `yaml:"bfd"`
+	PeerGroups []PeerGroupConf `yaml:"peergroups"`
+	Listen     []ListenConf    `yaml:"listen"`
+	Confed     ConfedConf      `yaml:"confederation"`
+	Grace      uint32          `yaml:"nebura_grace"` // 秒、bgpが落ちてもneburaが経路を残す時間
+	Networks   []string        `yaml:"networks"`     // 広告するprefix、CIDR
+	Vrf        uint32          `yaml:"vrf"`          // 経路を入れるVRFのtable、0ならデフォルト
+}
+
+type ConfedConf struct {
+	Id    uint16   `yaml:"id"`
+	Peers []uint16 `yaml:"peers"`
+}
+
+type LocalAsConf struct {
+	As        uint16 `yaml:"as"`
+	NoPrepend bool   `yaml:"no_prepend"`
+	ReplaceAs bool   `yaml:"replace_as"`
+}
+
+type PeerGroupConf struct {
+	Name     string      `yaml:"name"`
+	RemoteAs uint16      `yaml:"remote_as"`
+	HoldTime uint16      `yaml:"holdtime"`
+	Import   []string    `yaml:"import"`
+	LocalAs  LocalAsConf `yaml:"local_as"`
+	ExtMsg   bool        `yaml:"extended_message"`
+}
+
+type ListenConf struct {
+	Range     string `yaml:"range"`
+	PeerGroup string `yaml:"peergroup"`
 }
 
 type PeerPrefix struct {
-	NeiAddr string `yaml:"neiaddr"`
+	NeiAddr   string      `yaml:"neiaddr"`
+	RemoteAs  uint16      `yaml:"remote_as"`
+	LocalAs   LocalAsConf `yaml:"local_as"`
+	ExtMsg    bool        `yaml:"extended_message"`
+	LinkState bool        `yaml:"link_state"`
 }
 
 type Data struct {
@@ -46,12 +157,16 @@ type Data struct {
 }
 
 type Conf struct {
-	Select       string       `yaml:"select"`
-	IPPrefixAdd  IPPrefixAdd  `yaml:"ipconfig"`
-	Seg6Add      Seg6Add      `yaml:"srv6config"`
-	EndActionAdd EndActionAdd `yaml:"srv6endconfig"`
-	TcConf       TcSetConf    `yaml:"tcconfig"`
-	BgpConf      PeerConf     `yaml:"bgpconfig"`
+	Select       string         `yaml:"select"`
+	IPPrefixAdd  IPPrefixAdd    `yaml:"ipconfig"`
+	Seg6Add      Seg6Add        `yaml:"srv6config"`
+	EndActionAdd EndActionAdd   `yaml:"srv6endconfig"`
+	StaticRoute  StaticRouteAdd `yaml:"staticconfig"`
+	TcConf       TcSetConf      `yaml:"tcconfig"`
+	BgpConf      PeerConf       `yaml:"bgpconfig"`
+	VrfConf      VrfConf        `yaml:"vrfconfig"`
+	PbrConf      []PbrConf      `yaml:"pbrconfig"`
+	MplsConf     MplsConf       `yaml:"mplsconfig"`
 }
 
 func ReadConfig(pass string) (Conf, error) {
@@ -0,0 +1,741 @@
+package nebura
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Single-hop BFD (RFC 5880/5881)
+
+type BfdState uint8
+
+const (
+	BfdStateAdminDown BfdState = 0
+	BfdStateDown      BfdState = 1
+	BfdStateInit      BfdState = 2
+	BfdStateUp        BfdState = 3
+)
+
+const (
+	BfdPort       = 3784
+	bfdVersion    = 1
+	bfdPacketSize = 24
+	bfdSrcPortMin = 49152
+	bfdSrcPortMax = 65535
+	bfdTTL        = 255
+	bfdSlowTx     = 1000000 // Up以外では1秒以上で送る (usec)
+)
+
+const (
+	bfdDiagNone          uint8 = 0
+	bfdDiagDetectExpired uint8 = 1
+	bfdDiagNeighborDown  uint8 = 3
+	bfdDiagAdminDown     uint8 = 7
+)
+
+const (
+	bfdFlagPoll       uint8 = 0x20
+	bfdFlagFinal      uint8 = 0x10
+	bfdFlagCPI        uint8 = 0x08
+	bfdFlagAuth       uint8 = 0x04
+	bfdFlagDemand     uint8 = 0x02
+	bfdFlagMultipoint uint8 = 0x01
+)
+
+func (s BfdState) String() string {
+	switch s {
+	case BfdStateAdminDown:
+		return "AdminDown"
+	case BfdStateDown:
+		return "Down"
+	case BfdStateInit:
+		return "Init"
+	case BfdStateUp:
+		return "Up"
+	}
+	return "Unknown"
+}
+
+type BfdPacket struct {
+	Diag              uint8
+	State             BfdState
+	Flags             uint8
+	DetectMult        uint8
+	MyDisc            uint32
+	YourDisc          uint32
+	DesiredMinTx      uint32
+	RequiredMinRx     uint32
+	RequiredMinEchoRx uint32
+}
+
+// BfdConf timers are in microseconds
+type BfdConf struct {
+	DesiredMinTx  uint32
+	RequiredMinRx uint32
+	DetectMult    uint8
+}
+
+var BfdDefaultConf = BfdConf{
+	DesiredMinTx:  300000,
+	RequiredMinRx: 300000,
+	DetectMult:    3,
+}
+
+type BfdSession struct {
+	mu                 sync.Mutex
+	Peer               net.IP
+	Local              net.IP
+	State              BfdState
+	RemoteState        BfdState
+	LocalDisc          uint32
+	RemoteDisc         uint32
+	LocalDiag          uint8
+	DetectMult         uint8
+	RemoteDetectMult   uint8
+	DesiredMinTx       uint32
+	RequiredMinRx      uint32
+	RemoteDesiredMinTx uint32
+	RemoteMinRx        uint32
+	poll               bool
+	conn               net.PacketConn
+	detect             *time.Timer
+	clients            map[int]func(bool)
+	events             []bfdEvent // まだclientに通知していない遷移、古い順
+	sendNow            chan uint8
+	notifyNow          chan struct{}
+	done               chan struct{}
+}
+
+// bfdEvent はUpかDownへの遷移1回分の通知
+type bfdEvent struct {
+	up  bool
+	cbs []func(bool)
+}
+
+// Bfd は3784番ポートで受信する
+// ポートはホストで1つしか持てないのでneburaだけが動かし、bgpなどはnebura経由で登録する
+// ポートはセッションがある間だけ持つ
+type Bfd struct {
+	mu       sync.Mutex
+	conf     BfdConf
+	sessions map[string]*BfdSession
+	discs    map[uint32]*BfdSession
+	conns    []*net.UDPConn
+	nextID   int
+}
+
+func (p *BfdPacket) writeTo() ([]byte, error) {
+	buf := make([]byte, bfdPacketSize)
+	buf[0] = bfdVersion<<5 | p.Diag&0x1f
+	buf[1] = uint8(p.State)<<6 | p.Flags&0x3f
+	buf[2] = p.DetectMult
+	buf[3] = bfdPacketSize
+	binary.BigEndian.PutUint32(buf[4:8], p.MyDisc)
+	binary.BigEndian.PutUint32(buf[8:12], p.YourDisc)
+	binary.BigEndian.PutUint32(buf[12:16], p.DesiredMinTx)
+	binary.BigEndian.PutUint32(buf[16:20], p.RequiredMinRx)
+	binary.BigEndian.PutUint32(buf[20:24], p.RequiredMinEchoRx)
+	return buf, nil
+}
+
+// RFC 5880 6.8.6 の受信チェック
+func BfdPacketParse(data []byte) (*BfdPacket, error) {
+	if len(data) < bfdPacketSize {
+		return nil, fmt.Errorf("bfd: short packet %d", len(data))
+	}
+	if data[0]>>5 != bfdVersion {
+		return nil, fmt.Errorf("bfd: bad version %d", data[0]>>5)
+	}
+
+	length := int(data[3])
+	if length < bfdPacketSize || length > len(data) {
+		return nil, fmt.Errorf("bfd: bad length %d", length)
+	}
+
+	p := &BfdPacket{
+		Diag:              data[0] & 0x1f,
+		State:             BfdState(data[1] >> 6),
+		Flags:             data[1] & 0x3f,
+		DetectMult:        data[2],
+		MyDisc:            binary.BigEndian.Uint32(data[4:8]),
+		YourDisc:          binary.BigEndian.Uint32(data[8:12]),
+		DesiredMinTx:      binary.BigEndian.Uint32(data[12:16]),
+		RequiredMinRx:     binary.BigEndian.Uint32(data[16:20]),
+		RequiredMinEchoRx: binary.BigEndian.Uint32(data[20:24]),
+	}
+
+	if p.DetectMult == 0 {
+		return nil, fmt.Errorf("bfd: detect mult is zero")
+	}
+	if p.Flags&bfdFlagMultipoint != 0 {
+		return nil, fmt.Errorf("bfd: multipoint is set")
+	}
+	if p.MyDisc == 0 {
+		return nil, fmt.Errorf("bfd: my discriminator is zero")
+	}
+	if p.YourDisc == 0 && p.State != BfdStateDown && p.State != BfdStateAdminDown {
+		return nil, fmt.Errorf("bfd: your discriminator is zero in state %s", p.State)
+	}
+	if p.Flags&bfdFlagAuth != 0 {
+		return nil, fmt.Errorf("bfd: authentication not supported")
+	}
+	return p, nil
+}
+
+func BfdInit(conf BfdConf) *Bfd {
+	return &Bfd{
+		conf:     conf,
+		sessions: make(map[string]*BfdSession),
+		discs:    make(map[uint32]*BfdSession),
+	}
+}
+
+// listen は最初のセッションを作る時に呼ぶ、b.muを取った状態で呼ぶ
+// 他のプロセスがポートを持っていればエラーにする
+func (b *Bfd) listen() error {
+	var conns []*net.UDPConn
+	for _, network := range []string{"udp4", "udp6"} {
+		conn, err := bfdListen(network)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return fmt.Errorf("bfd: listen %s: %w", network, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	b.conns = conns
+	for _, conn := range conns {
+		go b.recvLoop(conn)
+	}
+	log.Printf("BFD start...\n")
+	return nil
+}
+
+// close は最後のセッションが消えた時に呼ぶ、b.muを取った状態で呼ぶ
+func (b *Bfd) close() {
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+	log.Printf("BFD stop...\n")
+}
+
+// 受信側はTTL/Hop Limitを確認するためにRECVTTLを立てる (RFC 5881 5)
+func bfdListen(network string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if network == "udp4" {
+					serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTTL, 1)
+				} else {
+					serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+
+	addr := fmt.Sprintf(":%d", BfdPort)
+	pc, err := lc.ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+func bfdRecvTTL(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1
+	}
+	for _, m := range msgs {
+		if (m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TTL) ||
+			(m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_HOPLIMIT) {
+			if len(m.Data) < 4 {
+				return -1
+			}
+			// int型で入ってくるが値は1byteに収まるのでエンディアンに依らず取れる
+			return int(m.Data[0]) | int(m.Data[3])
+		}
+	}
+	return -1
+}
+
+func (b *Bfd) recvLoop(conn *net.UDPConn) {
+	buf := make([]byte, 512)
+	oob := make([]byte, 128)
+
+	for {
+		n, oobn, _, addr, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("bfd: read err %v", err)
+			}
+			return
+		}
+
+		if bfdRecvTTL(oob[:oobn]) != bfdTTL {
+			continue
+		}
+
+		pkt, err := BfdPacketParse(buf[:n])
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+
+		s := b.lookup(pkt.YourDisc, addr.IP)
+		if s == nil {
+			continue
+		}
+		s.recv(pkt)
+	}
+}
+
+func (b *Bfd) lookup(disc uint32, peer net.IP) *BfdSession {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if disc != 0 {
+		return b.discs[disc]
+	}
+	return b.sessions[bfdKey(peer)]
+}
+
+func bfdKey(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.String()
+}
+
+// Register はpeerとのBFDセッションに登録し、UpとDownの遷移をcbに通知する
+// 同じpeerに対するセッションは共有される
+// cbはセッションごとに1つのgoroutineから遷移の順に呼ばれる
+func (b *Bfd) Register(peer net.IP, local net.IP, cb func(up bool)) (int, error) {
+	return b.RegisterConf(peer, local, b.conf, cb)
+}
+
+// RegisterConf はRegisterと同じで、セッションを作る時はconfのタイマーを使う
+// セッションが既にあればそのタイマーのまま
+func (b *Bfd) RegisterConf(peer net.IP, local net.IP, conf BfdConf, cb func(up bool)) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := bfdKey(peer)
+	s, ok := b.sessions[key]
+	if !ok {
+		if b.conns == nil {
+			if err := b.listen(); err != nil {
+				return 0, err
+			}
+		}
+		var err error
+		s, err = b.newSession(peer, local, conf)
+		if err != nil {
+			if len(b.sessions) == 0 {
+				b.close()
+			}
+			return 0, err
+		}
+		b.sessions[key] = s
+		b.discs[s.LocalDisc] = s
+		go s.run()
+		go s.notifyLoop()
+	}
+
+	b.nextID++
+	s.mu.Lock()
+	s.clients[b.nextID] = cb
+	s.mu.Unlock()
+
+	log.Printf("BFD Register peer %s id %d", key, b.nextID)
+	return b.nextID, nil
+}
+
+// Unregister で最後の登録者がいなくなったらAdminDownを送ってセッションを消す
+func (b *Bfd) Unregister(peer net.IP, id int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := bfdKey(peer)
+	s, ok := b.sessions[key]
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	delete(s.clients, id)
+	last := len(s.clients) == 0
+	s.mu.Unlock()
+
+	if !last {
+		return
+	}
+
+	delete(b.sessions, key)
+	delete(b.discs, s.LocalDisc)
+	s.stop()
+	if len(b.sessions) == 0 {
+		b.close()
+	}
+}
+
+func (b *Bfd) State(peer net.IP) BfdState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.sessions[bfdKey(peer)]
+	if !ok {
+		return BfdStateDown
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.State
+}
+
+func (b *Bfd) newDisc() uint32 {
+	for {
+		d := rand.Uint32()
+		if _, ok := b.discs[d]; d != 0 && !ok {
+			return d
+		}
+	}
+}
+
+func (b *Bfd) newSession(peer net.IP, local net.IP, conf BfdConf) (*BfdSession, error) {
+	if local == nil {
+		var err error
+		local, err = bfdLocalAddr(peer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := bfdDial(local)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BfdSession{
+		Peer:          peer,
+		Local:         local,
+		State:         BfdStateDown,
+		RemoteState:   BfdStateDown,
+		LocalDisc:     b.newDisc(),
+		DetectMult:    conf.DetectMult,
+		DesiredMinTx:  conf.DesiredMinTx,
+		RequiredMinRx: conf.RequiredMinRx,
+		RemoteMinRx:   1,
+		conn:          conn,
+		clients:       make(map[int]func(bool)),
+		sendNow:       make(chan uint8, 1),
+		notifyNow:     make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	return s, nil
+}
+
+// 経路から送信元アドレスを決める (UDPなのでパケットは送られない)
+func bfdLocalAddr(peer net.IP) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(peer.String(), fmt.Sprint(BfdPort)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// 送信側は49152-65535の送信元ポートとTTL 255を使う (RFC 5881 4, 5)
+func bfdDial(local net.IP) (net.PacketConn, error) {
+	network := "udp4"
+	if local.To4() == nil {
+		network = "udp6"
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if network == "udp4" {
+					serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, bfdTTL)
+				} else {
+					serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, bfdTTL)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+
+	start := bfdSrcPortMin + rand.Intn(bfdSrcPortMax-bfdSrcPortMin+1)
+	for i := 0; i <= bfdSrcPortMax-bfdSrcPortMin; i++ {
+		port := bfdSrcPortMin + (start-bfdSrcPortMin+i)%(bfdSrcPortMax-bfdSrcPortMin+1)
+		addr := net.JoinHostPort(local.String(), fmt.Sprint(port))
+		conn, err := lc.ListenPacket(context.Background(), network, addr)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("bfd: no source port available")
+}
+
+func (s *BfdSession) txInterval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.DesiredMinTx
+	if s.State != BfdStateUp && tx < bfdSlowTx {
+		tx = bfdSlowTx
+	}
+	if s.RemoteMinRx > tx {
+		tx = s.RemoteMinRx
+	}
+
+	// 75%から100%のジッタを入れる (RFC 5880 6.8.7)
+	jitter := 0.75 + rand.Float64()*0.25
+	if s.DetectMult == 1 {
+		jitter = 0.75 + rand.Float64()*0.15
+	}
+	return time.Duration(float64(tx)*jitter) * time.Microsecond
+}
+
+func (s *BfdSession) run() {
+	for {
+		t := time.NewTimer(s.txInterval())
+		var flags uint8
+		select {
+		case <-s.done:
+			t.Stop()
+			return
+		case flags = <-s.sendNow:
+			t.Stop()
+		case <-t.C:
+		}
+		s.send(flags)
+	}
+}
+
+func (s *BfdSession) stop() {
+	s.mu.Lock()
+	if s.detect != nil {
+		s.detect.Stop()
+	}
+	s.State = BfdStateAdminDown
+	s.LocalDiag = bfdDiagAdminDown
+	s.mu.Unlock()
+
+	s.send(0)
+	close(s.done)
+	s.conn.Close()
+}
+
+func (s *BfdSession) send(flags uint8) error {
+	s.mu.Lock()
+
+	// 相手が受信を望まない場合は送らない
+	if s.RemoteDisc != 0 && s.RemoteMinRx == 0 && flags&bfdFlagFinal == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+
+	tx := s.DesiredMinTx
+	if s.State != BfdStateUp && tx < bfdSlowTx {
+		tx = bfdSlowTx
+	}
+	if s.poll && flags&bfdFlagFinal == 0 {
+		flags |= bfdFlagPoll
+	}
+
+	p := &BfdPacket{
+		Diag:          s.LocalDiag,
+		State:         s.State,
+		Flags:         flags,
+		DetectMult:    s.DetectMult,
+		MyDisc:        s.LocalDisc,
+		YourDisc:      s.RemoteDisc,
+		DesiredMinTx:  tx,
+		RequiredMinRx: s.RequiredMinRx,
+	}
+	addr := &net.UDPAddr{IP: s.Peer, Port: BfdPort}
+	s.mu.Unlock()
+
+	buf, _ := p.writeTo()
+	_, err := s.conn.WriteTo(buf, addr)
+	return err
+}
+
+func (s *BfdSession) recv(p *BfdPacket) {
+	s.mu.Lock()
+
+	s.RemoteDisc = p.MyDisc
+	s.RemoteState = p.State
+	s.RemoteDetectMult = p.DetectMult
+	s.RemoteDesiredMinTx = p.DesiredMinTx
+	s.RemoteMinRx = p.RequiredMinRx
+
+	if p.Flags&bfdFlagFinal != 0 {
+		s.poll = false
+	}
+
+	if s.State == BfdStateAdminDown {
+		s.mu.Unlock()
+		return
+	}
+
+	s.resetDetect()
+
+	old := s.State
+	if p.State == BfdStateAdminDown {
+		if s.State != BfdStateDown {
+			s.LocalDiag = bfdDiagNeighborDown
+			s.State = BfdStateDown
+		}
+	} else {
+		switch s.State {
+		case BfdStateDown:
+			if p.State == BfdStateDown {
+				s.State = BfdStateInit
+			} else if p.State == BfdStateInit {
+				s.State = BfdStateUp
+			}
+		case BfdStateInit:
+			if p.State == BfdStateInit || p.State == BfdStateUp {
+				s.State = BfdStateUp
+			}
+		case BfdStateUp:
+			if p.State == BfdStateDown {
+				s.LocalDiag = bfdDiagNeighborDown
+				s.State = BfdStateDown
+			}
+		}
+	}
+
+	// Upになったら送信間隔を変えるのでPollで知らせる
+	if old != BfdStateUp && s.State == BfdStateUp {
+		s.LocalDiag = bfdDiagNone
+		s.poll = true
+	}
+
+	changed := old != s.State
+	s.transition(old)
+	s.mu.Unlock()
+
+	if p.Flags&bfdFlagPoll != 0 {
+		s.kick(bfdFlagFinal)
+	} else if changed {
+		s.kick(0)
+	}
+	s.notify()
+}
+
+// s.muを取った状態で呼ぶ
+func (s *BfdSession) resetDetect() {
+	rx := s.RequiredMinRx
+	if s.RemoteDesiredMinTx > rx {
+		rx = s.RemoteDesiredMinTx
+	}
+	d := time.Duration(s.RemoteDetectMult) * time.Duration(rx) * time.Microsecond
+
+	if s.detect == nil {
+		s.detect = time.AfterFunc(d, s.expire)
+		return
+	}
+	s.detect.Reset(d)
+}
+
+func (s *BfdSession) expire() {
+	s.mu.Lock()
+	old := s.State
+	if s.State == BfdStateInit || s.State == BfdStateUp {
+		s.LocalDiag = bfdDiagDetectExpired
+		s.State = BfdStateDown
+	}
+	s.RemoteDisc = 0
+	s.RemoteMinRx = 1
+	s.poll = false
+	changed := old != s.State
+	s.transition(old)
+	s.mu.Unlock()
+
+	if changed {
+		log.Printf("BFD peer %s detect time expired", s.Peer.String())
+		s.kick(0)
+	}
+	s.notify()
+}
+
+// transition はUpになったかUpでなくなった時に通知をs.eventsに積む
+// 積む順番がs.muで決まるので、recvとexpireが同時に走っても遷移の順に通知される
+// s.muを取った状態で呼ぶ
+func (s *BfdSession) transition(old BfdState) {
+	if old == s.State {
+		return
+	}
+	log.Printf("BFD peer %s: %s -> %s", s.Peer.String(), old, s.State)
+
+	if old != BfdStateUp && s.State != BfdStateUp {
+		return
+	}
+
+	ev := bfdEvent{up: s.State == BfdStateUp}
+	for _, cb := range s.clients {
+		ev.cbs = append(ev.cbs, cb)
+	}
+	s.events = append(s.events, ev)
+}
+
+// notify はnotifyLoopを起こす
+func (s *BfdSession) notify() {
+	select {
+	case s.notifyNow <- struct{}{}:
+	default:
+	}
+}
+
+// notifyLoop は積まれた通知を古い順に1つずつclientに渡す
+// cbがブロックしてもrecvLoopとrunは止まらない
+func (s *BfdSession) notifyLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.notifyNow:
+		}
+
+		s.mu.Lock()
+		events := s.events
+		s.events = nil
+		s.mu.Unlock()
+
+		for _, ev := range events {
+			for _, cb := range ev.cbs {
+				cb(ev.up)
+			}
+		}
+	}
+}
+
+func (s *BfdSession) kick(flags uint8) {
+	select {
+	case s.sendNow <- flags:
+	default:
+	}
+}
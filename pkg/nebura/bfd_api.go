@@ -0,0 +1,252 @@
+package nebura
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// neburaのBFDをクライアントから使う
+// BFDのポートはホストで1つしか持てないので、bgpなどは自分でBFDを動かさずにneburaに登録する
+// 登録するとUpとDownの遷移がbfdUpdateで送られる、切断すると登録は消える
+
+type bfdBody struct {
+	Peer  net.IP
+	Local net.IP   // nilならneburaが経路から決める
+	Conf  *BfdConf // nilならneburaの設定
+}
+
+func (b *bfdBody) writeTo() ([]byte, error) {
+	buf := appendTlvIP(nil, tlvNexthop, b.Peer)
+	if b.Local != nil {
+		buf = appendTlvIP(buf, tlvLocal, b.Local)
+	}
+	if b.Conf != nil {
+		buf = appendTlvU32(buf, tlvMinTx, b.Conf.DesiredMinTx)
+		buf = appendTlvU32(buf, tlvMinRx, b.Conf.RequiredMinRx)
+		buf = appendTlvU8(buf, tlvMult, b.Conf.DetectMult)
+	}
+	return buf, nil
+}
+
+type bfdUpdateBody struct {
+	Peer net.IP
+	Up   bool
+}
+
+func (b *bfdUpdateBody) writeTo() ([]byte, error) {
+	var up uint8
+	if b.Up {
+		up = 1
+	}
+	buf := appendTlvIP(nil, tlvNexthop, b.Peer)
+	return appendTlvU8(buf, tlvBfd, up), nil
+}
+
+func bfdConfDecode(t tlvs, conf BfdConf) (BfdConf, error) {
+	var err error
+	if t.has(tlvMinTx) {
+		if conf.DesiredMinTx, err = t.u32(tlvMinTx); err != nil {
+			return conf, err
+		}
+	}
+	if t.has(tlvMinRx) {
+		if conf.RequiredMinRx, err = t.u32(tlvMinRx); err != nil {
+			return conf, err
+		}
+	}
+	if t.has(tlvMult) {
+		if conf.DetectMult, err = t.u8(tlvMult); err != nil {
+			return conf, err
+		}
+		if conf.DetectMult == 0 {
+			return conf, &tlvError{Type: tlvMult, Msg: "zero"}
+		}
+	}
+	return conf, nil
+}
+
+// BfdRegister はsのクライアントにpeerの遷移を送るように登録する
+func (ns *Nserver) BfdRegister(s *NservSession, t tlvs) error {
+	peer, err := t.ip(tlvNexthop)
+	if err != nil {
+		return err
+	}
+	var local net.IP
+	if t.has(tlvLocal) {
+		if local, err = t.ip(tlvLocal); err != nil {
+			return err
+		}
+	}
+	conf, err := bfdConfDecode(t, ns.Bfd.conf)
+	if err != nil {
+		return err
+	}
+
+	key := bfdKey(peer)
+	if _, ok := s.bfds[key]; ok {
+		return fmt.Errorf("bfd %s: %w", key, ErrRouteExists)
+	}
+
+	id, err := ns.Bfd.RegisterConf(peer, local, conf, func(up bool) {
+		ns.ceventChan <- NservBfdUpdate{s, peer, up}
+	})
+	if err != nil {
+		return err
+	}
+	s.bfds[key] = id
+	log.Printf("Nebura session %d BFD register %s\n", s.ID, key)
+	return nil
+}
+
+func (ns *Nserver) BfdUnregister(s *NservSession, t tlvs) error {
+	peer, err := t.ip(tlvNexthop)
+	if err != nil {
+		return err
+	}
+
+	key := bfdKey(peer)
+	id, ok := s.bfds[key]
+	if !ok {
+		return fmt.Errorf("bfd %s: %w", key, ErrRouteNotFound)
+	}
+	delete(s.bfds, key)
+	ns.Bfd.Unregister(peer, id)
+	return nil
+}
+
+// bfdFlush はsessionが閉じた時にsの登録を全部消す
+func (ns *Nserver) bfdFlush(s *NservSession) {
+	for key, id := range s.bfds {
+		ns.Bfd.Unregister(net.ParseIP(key), id)
+	}
+	s.bfds = make(map[string]int)
+}
+
+// NservBfdUpdate はsが登録したpeerのBFDがUpかDownになった
+type NservBfdUpdate struct {
+	s    *NservSession
+	peer net.IP
+	up   bool
+}
+
+func (n NservBfdUpdate) NecliEvent(ns *Nserver) error {
+	if _, ok := n.s.bfds[bfdKey(n.peer)]; !ok {
+		// 登録をやめた後に届いた通知
+		return nil
+	}
+
+	// 通知はSequence 0で送る
+	notify := &ApiHeader{Version: n.s.Version}
+	if err := n.s.write(notify, bfdUpdate, &bfdUpdateBody{Peer: n.peer, Up: n.up}); err != nil {
+		return fmt.Errorf("nebura session %d BFD: %w", n.s.ID, err)
+	}
+	return nil
+}
+
+// BfdRegister はneburaのBFDにpeerを登録し、UpとDownの遷移をcbで受け取る
+// 同じpeerを何度登録してもneburaには1回だけ登録する
+// cbは受信のgoroutineから呼ばれるので、cb内でneburaにリクエストを送らないこと
+func (n *Nclient) BfdRegister(peer net.IP, local net.IP, conf BfdConf, cb func(up bool)) (int, error) {
+	key := bfdKey(peer)
+
+	n.nmu.Lock()
+	if n.bfd == nil {
+		n.bfd = make(map[string]map[int]func(bool))
+	}
+	cbs, ok := n.bfd[key]
+	if !ok {
+		cbs = make(map[int]func(bool))
+		n.bfd[key] = cbs
+	}
+	n.bfdID++
+	id := n.bfdID
+	cbs[id] = cb
+	n.nmu.Unlock()
+
+	if ok {
+		return id, nil
+	}
+
+	body := &bfdBody{Peer: peer, Local: local, Conf: &conf}
+	if err := n.sendNclientAPI(bfdRegister, body); err != nil {
+		n.bfdRemove(key, id)
+		return 0, err
+	}
+	return id, nil
+}
+
+// BfdUnregister は最後の登録がなくなったらneburaからも消す
+func (n *Nclient) BfdUnregister(peer net.IP, id int) error {
+	if !n.bfdRemove(bfdKey(peer), id) {
+		return nil
+	}
+	return n.sendNclientAPI(bfdUnregister, &bfdBody{Peer: peer})
+}
+
+// bfdRemove はidの登録を消して、peerの登録がなくなったらtrueを返す
+func (n *Nclient) bfdRemove(key string, id int) bool {
+	defer n.nmu.Unlock()
+	n.nmu.Lock()
+
+	cbs, ok := n.bfd[key]
+	if !ok {
+		return false
+	}
+	delete(cbs, id)
+	if len(cbs) > 0 {
+		return false
+	}
+	delete(n.bfd, key)
+	return true
+}
+
+func (n *Nclient) bfdEvent(data []byte) {
+	t, err := tlvDecode(data)
+	if err != nil {
+		log.Printf("nebura BFD: %v", err)
+		return
+	}
+	peer, err := t.ip(tlvNexthop)
+	if err != nil {
+		log.Printf("nebura BFD: %v", err)
+		return
+	}
+	up, err := t.u8(tlvBfd)
+	if err != nil {
+		log.Printf("nebura BFD: %v", err)
+		return
+	}
+
+	n.nmu.Lock()
+	var cbs []func(bool)
+	for _, cb := range n.bfd[bfdKey(peer)] {
+		cbs = append(cbs, cb)
+	}
+	n.nmu.Unlock()
+
+	for _, cb := range cbs {
+		cb(up == 1)
+	}
+}
+
+// nclientBfd はNclientをPeerBfdとして使う
+type nclientBfd struct {
+	n    *Nclient
+	conf BfdConf
+}
+
+// Bfd はneburaのBFDにconfのタイマーで登録するPeerBfdを返す
+func (n *Nclient) Bfd(conf BfdConf) PeerBfd {
+	return &nclientBfd{n: n, conf: conf}
+}
+
+func (b *nclientBfd) Register(peer net.IP, local net.IP, cb func(up bool)) (int, error) {
+	return b.n.BfdRegister(peer, local, b.conf, cb)
+}
+
+func (b *nclientBfd) Unregister(peer net.IP, id int) {
+	if err := b.n.BfdUnregister(peer, id); err != nil {
+		log.Printf("BFD Unregister peer %s: %v", peer.String(), err)
+	}
+}
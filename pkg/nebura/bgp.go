@@ -6,6 +6,8 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/Enigamict/zebraland/pkg/zebra"
 )
@@ -13,20 +15,42 @@ import (
 type BgpType uint8
 
 const (
-	BgpOpenType      = 1
-	BgpUpdateType    = 2
-	BgpKeepAliveType = 4
+	BgpOpenType         = 1
+	BgpUpdateType       = 2
+	BgpNotificationType = 3
+	BgpKeepAliveType    = 4
+)
+
+// NOTIFICATIONのError CodeとSubcode (RFC 4271 4.5)
+const (
+	bgpErrHeader uint8 = 1
+
+	bgpErrNotSync      uint8 = 1
+	bgpErrBadMsgLength uint8 = 2
+	bgpErrBadMsgType   uint8 = 3
 )
 
 const (
 	bgpHederSize  = 19
 	bgpMarkerSize = 16
+
+	// 種類ごとの最小の長さ (RFC 4271 4.2 - 4.5)
+	bgpOpenMinSize         = 29
+	bgpUpdateMinSize       = 23
+	bgpKeepAliveSize       = 19
+	bgpNotificationMinSize = 21
 )
 
 type BgpMsg interface {
 	writeTo() ([]byte, error)
 }
 
+// PeerBfd はpeerをBFDで見るところ、普通はNclient.Bfdでneburaに登録する
+type PeerBfd interface {
+	Register(peer net.IP, local net.IP, cb func(up bool)) (int, error)
+	Unregister(peer net.IP, id int)
+}
+
 type Peer struct {
 	AS        uint16
 	IdenTifer net.IP
@@ -35,6 +59,21 @@ type Peer struct {
 	State     string
 	TestState chan uint8
 	Conn      net.Conn
+	Bfd       PeerBfd
+	bfdID     int
+	RemoteAS  uint16
+	HoldTime  uint16
+	Import    []*net.IPNet
+	Confed    *Confed
+	LocalAS   *LocalAS
+	ExtMsg    bool
+	LinkState bool
+	Networks  []NLRIPrefix // Establishedになったら広告するprefix
+	Vrf       uint32       // zebraで経路を入れるVRF、0ならデフォルト
+	Nebura    *Nclient     // 経路を入れるneburaのクライアント、nilなら都度繋ぐ
+	Rib       *BgpRib      // nilならpathを持たずにそのままneburaに入れる
+	holdTime  uint16
+	extMsg    bool
 }
 
 type Hdr struct {
@@ -49,27 +88,27 @@ type Message struct {
 }
 
 type Open struct {
-	Version        uint8
-	MyAS           uint16
-	HoldTime       uint16
-	BgpIdenTifer   net.IP
-	OptParamLength uint8
-	OptParm        []byte
+	Version      uint8
+	MyAS         uint16
+	HoldTime     uint16
+	BgpIdenTifer net.IP
+	OptParm      []byte
 }
 
 type KeepAlive struct {
 }
 
+type Notification struct {
+	Code    uint8
+	Subcode uint8
+	Data    []byte
+}
+
 type NLRIPrefix struct {
 	Len  uint8
 	NLRI net.IP
 }
 
-type Update struct {
-	Nexthop net.IP
-	NLRI    NLRIPrefix
-}
-
 // FSM部分をcallbackにするか、fsm.stateをchanelにしてstate管理
 func (p *Peer) BGPEventLoop() error {
 
@@ -94,11 +133,39 @@ func (p *Peer) BGPConectActive() error {
 		log.Fatal(err)
 	}
 
+	if p.Bfd != nil {
+		p.BfdRegister()
+		defer p.Bfd.Unregister(p.NeiAdrees, p.bfdID)
+	}
+
 	p.BGPEventLoop()
 
 	return nil
 }
 
+// BFDがDownしたらHold Timerを待たずにセッションを落とす
+func (p *Peer) BfdRegister() error {
+	local := p.Conn.LocalAddr().(*net.TCPAddr).IP
+
+	id, err := p.Bfd.Register(p.NeiAdrees, local, func(up bool) {
+		if up {
+			log.Printf("BFD Up peer %s\n", p.NeiAdrees.String())
+			return
+		}
+		log.Printf("BFD Down peer %s, session close\n", p.NeiAdrees.String())
+		p.SetState("Idle")
+		p.Conn.Close()
+	})
+
+	if err != nil {
+		log.Printf("BFD Register err %v", err)
+		return err
+	}
+
+	p.bfdID = id
+	return nil
+}
+
 func PeerInit(as uint16, iden net.IP, peer net.IP, routing string) *Peer {
 
 	p := &Peer{
@@ -108,6 +175,7 @@ func PeerInit(as uint16, iden net.IP, peer net.IP, routing string) *Peer {
 		State:     "Idle",
 		TestState: make(chan uint8),
 		NeiAdrees: peer,
+		HoldTime:  180,
 	}
 	return p
 }
@@ -129,8 +197,12 @@ func (m *Message) writeTo() ([]byte, error) {
 	var msgbuf []byte
 	var headerbuf []byte
 
+	msgbuf, err := m.Msg.writeTo()
+	if err != nil {
+		return nil, err
+	}
+	m.Hdr.Len = uint16(bgpHederSize + len(msgbuf))
 	headerbuf, _ = m.Hdr.writeTo()
-	msgbuf, _ = m.Msg.writeTo()
 
 	buf = append(buf, headerbuf...)
 	buf = append(buf, msgbuf...)
@@ -146,7 +218,8 @@ func (m *Open) writeTo() ([]byte, error) {
 	binary.BigEndian.PutUint16(buf[3:5], m.HoldTime)
 
 	buf = append(buf, m.BgpIdenTifer...)
-	buf = append(buf, m.OptParamLength)
+	buf = append(buf, uint8(len(m.OptParm)))
+	buf = append(buf, m.OptParm...)
 	return buf, nil
 }
 
@@ -154,62 +227,189 @@ func (k *KeepAlive) writeTo() ([]byte, error) {
 	return nil, nil
 }
 
+func (n *Notification) writeTo() ([]byte, error) {
+	return append([]byte{n.Code, n.Subcode}, n.Data...), nil
+}
+
 const Hdrlen = 19
 const OpenHdrlen = 10
 
-func (p *Peer) SendMsg(len uint16, bgpType uint8, m BgpMsg) error {
+func (p *Peer) SendMsg(bgpType uint8, m BgpMsg) error {
 
 	s := &Message{
 		Hdr: Hdr{
-			Len:  len,
 			Type: bgpType,
 		},
 		Msg: m,
 	}
 
-	buf, _ := s.writeTo()
-	p.Conn.Write(buf)
-	return nil
+	buf, err := s.writeTo()
+	if err != nil {
+		return err
+	}
+
+	max := BgpMsgMax
+	if bgpType == BgpUpdateType {
+		max = p.msgMax()
+	}
+	if len(buf) > max {
+		return fmt.Errorf("bgp: message size %d exceeds %d", len(buf), max)
+	}
+
+	_, err = p.Conn.Write(buf)
+	return err
 }
 
 func (p *Peer) BgpSendOpenMsg() error {
 
 	Open := &Open{
-		Version:        uint8(4),
-		MyAS:           uint16(p.AS),
-		HoldTime:       uint16(180),
-		BgpIdenTifer:   p.IdenTifer,
-		OptParamLength: uint8(0),
+		Version:      uint8(4),
+		MyAS:         p.openAS(),
+		HoldTime:     p.HoldTime,
+		BgpIdenTifer: p.IdenTifer,
+		OptParm:      p.openCapabilities(),
 	}
 
-	p.SendMsg(bgpHederSize+10, uint8(BgpOpenType), Open)
+	p.SendMsg(uint8(BgpOpenType), Open)
 	return nil
 }
 
 func (p *Peer) BgpSendkeepAliveMsg() error {
 
-	p.SendMsg(bgpHederSize, uint8(BgpKeepAliveType), &KeepAlive{})
+	p.SendMsg(uint8(BgpKeepAliveType), &KeepAlive{})
 	return nil
 }
 
-func BgpupdateParse(data []byte, routing string) error {
+// Importが空なら全て受け取る
+func (p *Peer) importAccept(prefix net.IP, plen uint8) bool {
+	if len(p.Import) == 0 {
+		return true
+	}
 
-	b := &Update{
-		Nexthop: prefixPadding(data[18:22]),
-		NLRI: NLRIPrefix{
-			Len:  uint8(data[22]),
-			NLRI: prefixPadding(data[23:27]),
-		},
+	for _, n := range p.Import {
+		ones, _ := n.Mask.Size()
+		if n.Contains(prefix) && int(plen) >= ones {
+			return true
+		}
 	}
+	return false
+}
+
+func (p *Peer) BgpupdateParse(data []byte) error {
 
-	switch routing {
+	b, err := BgpUpdateDecode(data)
+	if err != nil {
+		return err
+	}
+
+	if len(b.NLRI) != 0 || b.MpReach != nil {
+		b.AsPath, err = p.ImportAsPath(b.AsPath)
+		if err != nil {
+			log.Printf("BGP Update denied: %v\n", err)
+			return nil
+		}
+	}
+
+	for _, w := range b.Withdrawn {
+		p.routeSend(w, nil, true)
+	}
+
+	for _, nlri := range b.NLRI {
+		if !p.importAccept(nlri.NLRI, nlri.Len) {
+			log.Printf("BGP Update %s/%d denied by import policy\n", nlri.NLRI.String(), nlri.Len)
+			continue
+		}
+		p.routeSend(nlri, p.bgpPath(b), false)
+	}
+
+	if b.MpUnreach != nil && b.MpUnreach.AFI == AfiLinkState && b.MpUnreach.SAFI == SafiLinkState {
+		p.lsSend(b.MpUnreach.NLRI, nil, true)
+	}
+	if b.MpReach != nil && b.MpReach.AFI == AfiLinkState && b.MpReach.SAFI == SafiLinkState {
+		p.lsSend(b.MpReach.NLRI, b.LinkState, false)
+	}
+	return nil
+}
+
+// BGP-LSはneburaのグラフに送る
+func (p *Peer) lsSend(data []byte, attr []byte, withdraw bool) {
+	if p.Select != "nebura" {
+		return
+	}
+
+	if _, err := LsNLRISplit(data); err != nil {
+		log.Printf("BGP-LS %v\n", err)
+		return
+	}
+
+	n, done := p.nebura()
+	defer done()
+
+	if err := n.SendNclientLsUpdate(data, attr, withdraw); err != nil {
+		log.Printf("BGP-LS %v\n", err)
+	}
+}
+
+func (p *Peer) nebura() (*Nclient, func()) {
+	if p.Nebura != nil {
+		return p.Nebura, func() {}
+	}
+
+	n := NclientInit()
+	log.Printf("Nebura Conect...\n")
+	return n, func() { n.Close() }
+}
+
+// bgpPath はUPDATEの属性からBgpRibで比べるpathを作る
+// 外部のpeerから来たLOCAL_PREFは使わない (RFC 4271 5.1.5)
+func (p *Peer) bgpPath(u *Update) *BgpPath {
+	path := &BgpPath{
+		Nexthop:    u.Nexthop,
+		LocalPref:  bgpDefaultLocalPref,
+		AsPathLen:  u.AsPath.length(),
+		Origin:     u.Origin,
+		Med:        u.Med,
+		NeighborAS: u.AsPath.neighborAS(),
+	}
+	if p.isIBGP() || p.isConfedPeer() {
+		path.LocalPref = u.LocalPref
+	}
+	return path
+}
+
+// withdrawならpathはnil
+func (p *Peer) routeSend(nlri NLRIPrefix, path *BgpPath, withdraw bool) {
+	var nexthop net.IP
+	if path != nil {
+		nexthop = path.Nexthop
+	}
+
+	switch p.Select {
 	case "nebura":
-		var n = NclientInit()
-		log.Printf("Nebura Conect...\n")
-		n.SendNclientIPv4Route(b.NLRI.NLRI, b.Nexthop, b.NLRI.Len, 0)
+		if p.Rib != nil {
+			p.Rib.Update(p.NeiAdrees, nlri, path, withdraw)
+			return
+		}
+
+		n, done := p.nebura()
+		defer done()
+
+		var err error
+		if withdraw {
+			err = n.SendNclientIPv4RouteDelete(nlri.NLRI, nlri.Len)
+		} else {
+			// 同じprefixが再広告されることがあるのでReplaceで入れる
+			err = n.SendNclientIPv4RouteReplace(nlri.NLRI, nexthop, nlri.Len)
+		}
+		if err != nil {
+			log.Printf("Nebura %s/%d: %v\n", nlri.NLRI.String(), nlri.Len, err)
+		}
 	case "zebra":
+		if withdraw {
+			return // TODO: zebraのRouteDelete
+		}
 
-		c, err := zebra.ZebraClientInit()
+		c, err := zebra.ZebraClientInit(p.Vrf)
 
 		if err != nil {
 			log.Fatal(err)
@@ -218,36 +418,86 @@ func BgpupdateParse(data []byte, routing string) error {
 		log.Printf("Zebra Conect...\n")
 
 		c.SendHello()
-		c.SendRouteAdd(b.NLRI.NLRI.String(), b.Nexthop.String())
+		c.SendRouteAdd(nlri.NLRI.String(), nexthop.String())
 
 	default:
 		fmt.Printf("Routing Software no Select\n")
 	}
-	return nil
 }
 
 const BgpMsgMax = 4096
+const BgpExtMsgMax = 65535 // RFC 8654
+
+// OPENとKEEPALIVEは拡張メッセージでも4096を超えない
+func (p *Peer) msgMax() int {
+	if p.extMsg {
+		return BgpExtMsgMax
+	}
+	return BgpMsgMax
+}
+
+// bgpHdrCheck はヘッダのMarkerと長さを見て、おかしければNOTIFICATIONのSubcodeを返す
+// OPENとKEEPALIVEは拡張メッセージでも4096を超えない (RFC 8654 3)
+func (p *Peer) bgpHdrCheck(header []byte) (uint8, error) {
+	for i := 0; i < bgpMarkerSize; i++ {
+		if header[i] != 0xFF {
+			return bgpErrNotSync, fmt.Errorf("bgp: bad marker")
+		}
+	}
+
+	size := int(binary.BigEndian.Uint16(header[16:18]))
+	max := BgpMsgMax
+	min := bgpHederSize
+	switch header[18] {
+	case BgpOpenType:
+		min = bgpOpenMinSize
+	case BgpUpdateType:
+		min = bgpUpdateMinSize
+		max = p.msgMax()
+	case BgpNotificationType:
+		min = bgpNotificationMinSize
+	case BgpKeepAliveType:
+		min = bgpKeepAliveSize
+		max = bgpKeepAliveSize
+	default:
+		return bgpErrBadMsgType, fmt.Errorf("bgp: bad message type %d", header[18])
+	}
+	if size < min || size > max {
+		return bgpErrBadMsgLength, fmt.Errorf("bgp: bad message length %d type %d", size, header[18])
+	}
+	return 0, nil
+}
 
+// BgpHdrRead はメッセージを1つ読んで処理する
+// ヘッダがおかしいとストリームの区切りがわからなくなるので、NOTIFICATIONを送ってエラーを返す
 func (p *Peer) BgpHdrRead(conn net.Conn) error {
 	var header [bgpHederSize]byte
 	if _, err := io.ReadFull(conn, header[:]); err != nil {
-		return nil
+		return err
 	}
 
-	for i := 0; i < 16; i++ {
-		if header[i] != 0xFF {
-			return nil
+	if sub, err := p.bgpHdrCheck(header[:]); err != nil {
+		n := &Notification{Code: bgpErrHeader, Subcode: sub}
+		switch sub {
+		case bgpErrBadMsgLength:
+			n.Data = header[16:18]
+		case bgpErrBadMsgType:
+			n.Data = header[18:19]
+		}
+		if serr := p.SendMsg(BgpNotificationType, n); serr != nil {
+			log.Printf("BGP Notification send: %v\n", serr)
 		}
+		return err
 	}
 
 	size := binary.BigEndian.Uint16(header[16:18])
-	if size < bgpHederSize || size > BgpMsgMax {
-		return nil
-	}
-
 	buf := make([]byte, size-bgpHederSize)
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		return nil
+		return err
+	}
+
+	if p.holdTime != 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(p.holdTime) * time.Second))
 	}
 
 	TypeCode := uint8(header[18])
@@ -256,16 +506,17 @@ func (p *Peer) BgpHdrRead(conn net.Conn) error {
 		switch TypeCode {
 		case BgpOpenType:
 			log.Printf("BGP Open Recv...\n")
-			p.BgpSendOpenMsg()
-			return nil
+			return p.ParseBgpOpen(buf)
 		case BgpKeepAliveType:
 			log.Printf("BGP KeepAlive Recv...\n")
 			p.ParseBgpKeepAlive(buf)
 			return nil
 		case BgpUpdateType:
 			log.Printf("BGP Update Recv...\n")
-			BgpupdateParse(buf, p.Select)
+			p.BgpupdateParse(buf)
 			return nil
+		case BgpNotificationType:
+			return fmt.Errorf("bgp: notification code %d subcode %d", buf[0], buf[1])
 		default:
 			log.Printf("BGP Unknown...\n")
 			return nil
@@ -275,31 +526,158 @@ func (p *Peer) BgpHdrRead(conn net.Conn) error {
 
 }
 
+// peerStateMu はBFDのコールバックなど別のgoroutineからStateを変える時に取る
+var peerStateMu sync.Mutex
+
 func (p *Peer) SetState(s string) {
-	defer r.mu.Unlock()
-	r.mu.Lock()
+	defer peerStateMu.Unlock()
+	peerStateMu.Lock()
 	p.State = s
 }
 
 func (p *Peer) ParseBgpOpen(data []byte) error {
 
+	if len(data) < OpenHdrlen {
+		return fmt.Errorf("bgp: short open message")
+	}
+
+	as := binary.BigEndian.Uint16(data[1:3])
+	hold := binary.BigEndian.Uint16(data[3:5])
+
+	if p.RemoteAS != 0 && as != p.RemoteAS {
+		return fmt.Errorf("bgp: peer %s bad AS %d, expected %d", p.NeiAdrees.String(), as, p.RemoteAS)
+	}
+	// peer-groupでASを決めていなければOPENのASをそのまま使う
+	// iBGPかどうかはこのASで決まる
+	if p.RemoteAS == 0 {
+		p.RemoteAS = as
+	}
+
+	caps, err := openCapabilitiesParse(data[OpenHdrlen-1:])
+	if err != nil {
+		return err
+	}
+
+	// 両方がExtended Messageを広告したら使う
+	if _, ok := caps[capExtendedMessage]; ok && p.ExtMsg {
+		p.extMsg = true
+		log.Printf("BGP Extended Message negotiated peer %s\n", p.NeiAdrees.String())
+	}
+
+	// Hold Timeは小さい方を使う
+	p.holdTime = p.HoldTime
+	if hold < p.holdTime {
+		p.holdTime = hold
+	}
+
 	p.BgpSendOpenMsg()
 	return nil
 }
 
+const (
+	openParamCapability uint8 = 2
+)
+
+const (
+	capMultiProtocol   uint8 = 1
+	capExtendedMessage uint8 = 6
+)
+
+func (p *Peer) openCapabilities() []byte {
+	var caps []byte
+	if p.ExtMsg {
+		caps = append(caps, capExtendedMessage, 0)
+	}
+	if p.LinkState {
+		// MPを広告するとIPv4 unicastも明示する必要がある
+		caps = append(caps, capMultiProtocol, 4, 0, 1, 0, 1)
+		caps = append(caps, capMultiProtocol, 4, uint8(AfiLinkState>>8), uint8(AfiLinkState&0xff), 0, SafiLinkState)
+	}
+
+	if len(caps) == 0 {
+		return nil
+	}
+	return append([]byte{openParamCapability, uint8(len(caps))}, caps...)
+}
+
+func openCapabilitiesParse(data []byte) (map[uint8][]byte, error) {
+	caps := make(map[uint8][]byte)
+
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, fmt.Errorf("bgp: bad optional parameter length")
+	}
+	data = data[1 : 1+int(data[0])]
+
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, fmt.Errorf("bgp: short optional parameter")
+		}
+		ptype, param := data[0], data[2:2+int(data[1])]
+		data = data[2+int(data[1]):]
+
+		if ptype != openParamCapability {
+			continue
+		}
+
+		for len(param) > 0 {
+			if len(param) < 2 || len(param) < 2+int(param[1]) {
+				return nil, fmt.Errorf("bgp: short capability")
+			}
+			caps[param[0]] = param[2 : 2+int(param[1])]
+			param = param[2+int(param[1]):]
+		}
+	}
+	return caps, nil
+}
+
 func (p *Peer) ParseBgpKeepAlive(data []byte) error {
 
-	p.SetState("Estab")
-	log.Printf("State Estab...\n")
+	peerStateMu.Lock()
+	estab := p.State == "Estab"
+	p.State = "Estab"
+	peerStateMu.Unlock()
+
 	p.BgpSendkeepAliveMsg()
+	if !estab {
+		log.Printf("State Estab...\n")
+		p.advertise()
+	}
 	return nil
 }
 
+// advertise はEstablishedになった時にNetworksを自分が起点の経路として広告する
+func (p *Peer) advertise() {
+	if len(p.Networks) == 0 {
+		return
+	}
+
+	var nexthop net.IP
+	if a, ok := p.Conn.LocalAddr().(*net.TCPAddr); ok {
+		nexthop = a.IP.To4()
+	}
+	if nexthop == nil {
+		nexthop = p.IdenTifer
+	}
+
+	// 全部同じ属性なので1つを共有する、encodeAttrsは書き換えない
+	attrs := &RouteAttrs{Origin: 0, Nexthop: nexthop}
+	routes := make([]AdvRoute, 0, len(p.Networks))
+	for _, n := range p.Networks {
+		routes = append(routes, AdvRoute{Prefix: n, Attrs: attrs})
+	}
+
+	if err := p.BgpSendUpdate(routes); err != nil {
+		log.Printf("BGP Update send: %v\n", err)
+	}
+}
+
 func (p *Peer) BgpRecvMsg() {
 	for {
 		err := p.BgpHdrRead(p.Conn)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("BGP Session close: %v\n", err)
+			p.Conn.Close()
+			return
 		}
 	}
 
@@ -0,0 +1,226 @@
+package nebura
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	asSet            uint8 = 1
+	asSequence       uint8 = 2
+	asConfedSequence uint8 = 3 // RFC 5065
+	asConfedSet      uint8 = 4
+)
+
+const asSegmentMax = 255
+
+type AsPathSegment struct {
+	Type uint8
+	AS   []uint16
+}
+
+type AsPath []AsPathSegment
+
+func AsPathDecode(data []byte) (AsPath, error) {
+	var path AsPath
+
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("bgp: short as_path segment")
+		}
+
+		seg := AsPathSegment{Type: data[0]}
+		if seg.Type < asSet || seg.Type > asConfedSet {
+			return nil, fmt.Errorf("bgp: bad as_path segment type %d", seg.Type)
+		}
+
+		n := int(data[1])
+		if len(data) < 2+n*2 {
+			return nil, fmt.Errorf("bgp: as_path segment overflow")
+		}
+		for i := 0; i < n; i++ {
+			seg.AS = append(seg.AS, binary.BigEndian.Uint16(data[2+i*2:]))
+		}
+
+		path = append(path, seg)
+		data = data[2+n*2:]
+	}
+	return path, nil
+}
+
+func (path AsPath) writeTo() ([]byte, error) {
+	var buf []byte
+
+	for _, seg := range path {
+		if len(seg.AS) > asSegmentMax {
+			return nil, fmt.Errorf("bgp: as_path segment too long")
+		}
+		buf = append(buf, seg.Type, uint8(len(seg.AS)))
+		for _, as := range seg.AS {
+			buf = binary.BigEndian.AppendUint16(buf, as)
+		}
+	}
+	return buf, nil
+}
+
+func (path AsPath) Contains(as uint16) bool {
+	for _, seg := range path {
+		for _, a := range seg.AS {
+			if a == as {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (path AsPath) hasConfed() bool {
+	for _, seg := range path {
+		if seg.Type == asConfedSequence || seg.Type == asConfedSet {
+			return true
+		}
+	}
+	return false
+}
+
+// confedのセグメントを全て取り除く、confedの外に出す時に使う (RFC 5065 5.3)
+func (path AsPath) stripConfed() AsPath {
+	var out AsPath
+	for _, seg := range path {
+		if seg.Type == asConfedSequence || seg.Type == asConfedSet {
+			continue
+		}
+		out = append(out, seg)
+	}
+	return out
+}
+
+// length は経路選択に使う長さ、AS_SETは1つ、confedのセグメントは数えない (RFC 4271 9.1.2.2, RFC 5065 5.3)
+func (path AsPath) length() int {
+	var n int
+	for _, seg := range path {
+		switch seg.Type {
+		case asSequence:
+			n += len(seg.AS)
+		case asSet:
+			n++
+		}
+	}
+	return n
+}
+
+// neighborAS はMEDを比べるAS、confedのセグメントを除いた最初のAS
+// 空なら自分のASの中の経路なので0
+func (path AsPath) neighborAS() uint16 {
+	for _, seg := range path {
+		if (seg.Type == asSequence || seg.Type == asSet) && len(seg.AS) > 0 {
+			return seg.AS[0]
+		}
+	}
+	return 0
+}
+
+// 先頭が同じ種類のSEQUENCEならそこに、違えば新しいセグメントを作って入れる
+func (path AsPath) prepend(segType uint8, as uint16) AsPath {
+	if len(path) > 0 && path[0].Type == segType && len(path[0].AS) < asSegmentMax {
+		seg := AsPathSegment{
+			Type: segType,
+			AS:   append([]uint16{as}, path[0].AS...),
+		}
+		return append(AsPath{seg}, path[1:]...)
+	}
+
+	return append(AsPath{{Type: segType, AS: []uint16{as}}}, path...)
+}
+
+// Confederation と local-as の設定
+
+type Confed struct {
+	ID    uint16
+	Peers []uint16
+}
+
+type LocalAS struct {
+	AS        uint16
+	NoPrepend bool
+	ReplaceAS bool
+}
+
+func (c *Confed) member(as uint16) bool {
+	if c == nil {
+		return false
+	}
+	for _, a := range c.Peers {
+		if a == as {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Peer) isIBGP() bool {
+	return p.RemoteAS == p.AS
+}
+
+func (p *Peer) isConfedPeer() bool {
+	return !p.isIBGP() && p.Confed.member(p.RemoteAS)
+}
+
+// OPENで名乗るAS
+func (p *Peer) openAS() uint16 {
+	if p.LocalAS != nil && p.LocalAS.AS != 0 {
+		return p.LocalAS.AS
+	}
+	if p.Confed != nil && p.Confed.ID != 0 && !p.isIBGP() && !p.isConfedPeer() {
+		return p.Confed.ID
+	}
+	return p.AS
+}
+
+// 受信したAS_PATHのループ検出とlocal-asの付与
+func (p *Peer) ImportAsPath(path AsPath) (AsPath, error) {
+	if !p.isIBGP() && !p.isConfedPeer() && path.hasConfed() {
+		return nil, fmt.Errorf("bgp: confed segment from external peer %s", p.NeiAdrees.String())
+	}
+
+	if path.Contains(p.AS) {
+		return nil, fmt.Errorf("bgp: as_path loop AS %d", p.AS)
+	}
+	if p.Confed != nil && p.Confed.ID != 0 && path.Contains(p.Confed.ID) {
+		return nil, fmt.Errorf("bgp: as_path loop confed AS %d", p.Confed.ID)
+	}
+	if p.LocalAS != nil && p.LocalAS.AS != 0 && path.Contains(p.LocalAS.AS) {
+		return nil, fmt.Errorf("bgp: as_path loop local AS %d", p.LocalAS.AS)
+	}
+
+	// local-asはeBGPのpeerにだけ使う、ExportAsPathと同じ
+	if p.LocalAS != nil && p.LocalAS.AS != 0 && !p.LocalAS.NoPrepend && !p.isIBGP() && !p.isConfedPeer() {
+		path = path.prepend(asSequence, p.LocalAS.AS)
+	}
+	return path, nil
+}
+
+// 送信するAS_PATHを作る
+func (p *Peer) ExportAsPath(path AsPath) AsPath {
+	switch {
+	case p.isIBGP():
+		return path
+	case p.isConfedPeer():
+		return path.prepend(asConfedSequence, p.AS)
+	}
+
+	path = path.stripConfed()
+
+	as := p.AS
+	if p.Confed != nil && p.Confed.ID != 0 {
+		as = p.Confed.ID
+	}
+
+	if p.LocalAS != nil && p.LocalAS.AS != 0 {
+		if !p.LocalAS.ReplaceAS {
+			path = path.prepend(asSequence, as)
+		}
+		return path.prepend(asSequence, p.LocalAS.AS)
+	}
+	return path.prepend(asSequence, as)
+}
@@ -0,0 +1,155 @@
+package nebura
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func asSeq(as ...uint16) AsPathSegment {
+	return AsPathSegment{Type: asSequence, AS: as}
+}
+
+func asConfedSeq(as ...uint16) AsPathSegment {
+	return AsPathSegment{Type: asConfedSequence, AS: as}
+}
+
+// AS 65000はconfed 100のメンバーで、65010が同じconfedのpeer
+func asPathTestPeer(remote uint16, local *LocalAS) *Peer {
+	p := PeerInit(65000, net.ParseIP("1.1.1.1").To4(), net.ParseIP("10.0.0.1").To4(), "")
+	p.RemoteAS = remote
+	p.Confed = &Confed{ID: 100, Peers: []uint16{65010}}
+	p.LocalAS = local
+	return p
+}
+
+var asPathTestLocalAS = []struct {
+	name  string
+	local *LocalAS
+}{
+	{"no local-as", nil},
+	{"local-as", &LocalAS{AS: 64999}},
+	{"local-as no-prepend", &LocalAS{AS: 64999, NoPrepend: true}},
+	{"local-as replace-as", &LocalAS{AS: 64999, ReplaceAS: true}},
+	{"local-as no-prepend replace-as", &LocalAS{AS: 64999, NoPrepend: true, ReplaceAS: true}},
+}
+
+func TestImportAsPath(t *testing.T) {
+	peers := []struct {
+		name   string
+		remote uint16
+		in     AsPath
+	}{
+		{"ibgp", 65000, AsPath{asSeq(65001)}},
+		{"confed peer", 65010, AsPath{asConfedSeq(65010), asSeq(65001)}},
+		{"ebgp", 65001, AsPath{asSeq(65001, 65002)}},
+	}
+
+	// [peer][local-as]
+	want := [][]AsPath{
+		{
+			{asSeq(65001)},
+			{asSeq(65001)},
+			{asSeq(65001)},
+			{asSeq(65001)},
+			{asSeq(65001)},
+		},
+		{
+			{asConfedSeq(65010), asSeq(65001)},
+			{asConfedSeq(65010), asSeq(65001)},
+			{asConfedSeq(65010), asSeq(65001)},
+			{asConfedSeq(65010), asSeq(65001)},
+			{asConfedSeq(65010), asSeq(65001)},
+		},
+		{
+			{asSeq(65001, 65002)},
+			{asSeq(64999, 65001, 65002)},
+			{asSeq(65001, 65002)},
+			{asSeq(64999, 65001, 65002)},
+			{asSeq(65001, 65002)},
+		},
+	}
+
+	for i, pt := range peers {
+		for j, lt := range asPathTestLocalAS {
+			p := asPathTestPeer(pt.remote, lt.local)
+			got, err := p.ImportAsPath(pt.in)
+			if err != nil {
+				t.Errorf("%s %s: %v", pt.name, lt.name, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, want[i][j]) {
+				t.Errorf("%s %s: import %v, want %v", pt.name, lt.name, got, want[i][j])
+			}
+		}
+	}
+}
+
+func TestImportAsPathLoop(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote uint16
+		path   AsPath
+	}{
+		{"own as", 65001, AsPath{asSeq(65001, 65000)}},
+		{"confed id", 65001, AsPath{asSeq(65001, 100)}},
+		{"local as", 65001, AsPath{asSeq(65001, 64999)}},
+		{"confed segment from ebgp", 65001, AsPath{asConfedSeq(65011), asSeq(65001)}},
+	}
+
+	for _, tt := range tests {
+		p := asPathTestPeer(tt.remote, &LocalAS{AS: 64999, NoPrepend: true})
+		if got, err := p.ImportAsPath(tt.path); err == nil {
+			t.Errorf("%s: accepted %v", tt.name, got)
+		}
+	}
+}
+
+func TestExportAsPath(t *testing.T) {
+	// confedの別のメンバーから受け取った経路
+	in := AsPath{asConfedSeq(65011), asSeq(65001)}
+
+	peers := []struct {
+		name   string
+		remote uint16
+	}{
+		{"ibgp", 65000},
+		{"confed peer", 65010},
+		{"ebgp", 65002},
+	}
+
+	// [peer][local-as]
+	want := [][]AsPath{
+		{
+			{asConfedSeq(65011), asSeq(65001)},
+			{asConfedSeq(65011), asSeq(65001)},
+			{asConfedSeq(65011), asSeq(65001)},
+			{asConfedSeq(65011), asSeq(65001)},
+			{asConfedSeq(65011), asSeq(65001)},
+		},
+		{
+			{asConfedSeq(65000, 65011), asSeq(65001)},
+			{asConfedSeq(65000, 65011), asSeq(65001)},
+			{asConfedSeq(65000, 65011), asSeq(65001)},
+			{asConfedSeq(65000, 65011), asSeq(65001)},
+			{asConfedSeq(65000, 65011), asSeq(65001)},
+		},
+		{
+			{asSeq(100, 65001)},
+			{asSeq(64999, 100, 65001)},
+			{asSeq(64999, 100, 65001)},
+			{asSeq(64999, 65001)},
+			{asSeq(64999, 65001)},
+		},
+	}
+
+	for i, pt := range peers {
+		for j, lt := range asPathTestLocalAS {
+			p := asPathTestPeer(pt.remote, lt.local)
+			got := p.ExportAsPath(in)
+			if !reflect.DeepEqual(got, want[i][j]) {
+				t.Errorf("%s %s: export %v, want %v", pt.name, lt.name, got, want[i][j])
+			}
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package nebura
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"sync"
+)
+
+// BgpRib はpeerごとに受け取ったpathを持ち、届くnexthopのpathからbestを選んでneburaに入れる
+// nexthopはneburaのNHTに登録して、届かなくなったらそのpathを使わない
+// bestはRFC 4271 9.1.2.2の順に選ぶ、最後はnexthopのmetricが小さいもの、peerのアドレスが小さいもの
+
+// BgpPath はpeerから受け取ったpathのうちbestを選ぶのに使う属性
+type BgpPath struct {
+	Nexthop    net.IP
+	LocalPref  uint32
+	AsPathLen  int
+	Origin     uint8
+	Med        uint32
+	NeighborAS uint16 // MEDはこのASが同じpathの間だけ比べる
+}
+
+func (a *BgpPath) equal(b *BgpPath) bool {
+	return a.Nexthop.Equal(b.Nexthop) && a.LocalPref == b.LocalPref && a.AsPathLen == b.AsPathLen &&
+		a.Origin == b.Origin && a.Med == b.Med && a.NeighborAS == b.NeighborAS
+}
+
+type bgpRibKey struct {
+	prefix string
+	plen   uint8
+}
+
+type BgpRib struct {
+	mu     sync.Mutex // pathの変更とneburaへのリクエストは1つずつ
+	nebura *Nclient
+	paths  map[bgpRibKey]map[string]*BgpPath // prefixごとのpeerのpath
+	best   map[bgpRibKey]net.IP              // neburaに入れたnexthop
+	refs   map[string]int                    // nexthopを使っているpathの数
+
+	// NHTの通知は受信のgoroutineから来るのでmuとは別に持つ
+	nmu   sync.Mutex
+	nht   map[string]NexthopState
+	dirty map[string]bool
+	kick  chan struct{}
+}
+
+func BgpRibInit(n *Nclient) *BgpRib {
+	b := &BgpRib{
+		nebura: n,
+		paths:  make(map[bgpRibKey]map[string]*BgpPath),
+		best:   make(map[bgpRibKey]net.IP),
+		refs:   make(map[string]int),
+		nht:    make(map[string]NexthopState),
+		dirty:  make(map[string]bool),
+		kick:   make(chan struct{}, 1),
+	}
+
+	go b.nhtLoop()
+	return b
+}
+
+// Update はpeerから来た経路の変更、withdrawならpeerのpathを消す
+func (b *BgpRib) Update(peer net.IP, nlri NLRIPrefix, path *BgpPath, withdraw bool) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+
+	key := bgpRibKey{nlri.NLRI.String(), nlri.Len}
+	paths, ok := b.paths[key]
+	if !ok {
+		paths = make(map[string]*BgpPath)
+		b.paths[key] = paths
+	}
+
+	old, had := paths[peer.String()]
+	switch {
+	case withdraw:
+		delete(paths, peer.String())
+		if had {
+			b.unref(old.Nexthop)
+		}
+	case had && old.equal(path):
+	default:
+		if !had || !old.Nexthop.Equal(path.Nexthop) {
+			if had {
+				b.unref(old.Nexthop)
+			}
+			b.ref(path.Nexthop)
+		}
+		paths[peer.String()] = path
+	}
+
+	b.selectBest(key)
+}
+
+func (b *BgpRib) ref(nh net.IP) {
+	b.refs[nh.String()]++
+	if b.refs[nh.String()] > 1 {
+		return
+	}
+
+	if err := b.nebura.NexthopRegister(nh, b.nexthopChanged); err != nil {
+		// NHTが使えなければ今まで通り届くものとして扱う
+		log.Printf("BGP NHT register %s: %v\n", nh.String(), err)
+		b.nmu.Lock()
+		b.nht[nh.String()] = NexthopState{Nexthop: nh, Reachable: true}
+		b.nmu.Unlock()
+	}
+}
+
+func (b *BgpRib) unref(nh net.IP) {
+	b.refs[nh.String()]--
+	if b.refs[nh.String()] > 0 {
+		return
+	}
+
+	delete(b.refs, nh.String())
+	b.nmu.Lock()
+	delete(b.nht, nh.String())
+	b.nmu.Unlock()
+
+	if err := b.nebura.NexthopUnregister(nh); err != nil {
+		log.Printf("BGP NHT unregister %s: %v\n", nh.String(), err)
+	}
+}
+
+// nexthopChanged はNHTの通知、受信のgoroutineから呼ばれるのでnhtLoopに任せる
+func (b *BgpRib) nexthopChanged(st NexthopState) {
+	b.nmu.Lock()
+	_, known := b.nht[st.Nexthop.String()]
+	b.nht[st.Nexthop.String()] = st
+	if known {
+		b.dirty[st.Nexthop.String()] = true
+	}
+	b.nmu.Unlock()
+
+	if !known {
+		// 登録した時の状態、選び直しはUpdateでする
+		return
+	}
+	log.Printf("BGP NHT %s reachable %v metric %d\n", st.Nexthop.String(), st.Reachable, st.Metric)
+
+	select {
+	case b.kick <- struct{}{}:
+	default:
+	}
+}
+
+// nhtLoop は状態が変わったnexthopを使っているprefixのbestを選び直す
+func (b *BgpRib) nhtLoop() {
+	for range b.kick {
+		b.nmu.Lock()
+		dirty := b.dirty
+		b.dirty = make(map[string]bool)
+		b.nmu.Unlock()
+
+		b.mu.Lock()
+		for key, paths := range b.paths {
+			for _, path := range paths {
+				if dirty[path.Nexthop.String()] {
+					b.selectBest(key)
+					break
+				}
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// bgpCandidate はbestの候補、metricはNHTで分かったnexthopまでのIGPのコスト
+type bgpCandidate struct {
+	peer   net.IP
+	path   *BgpPath
+	metric uint32
+}
+
+// bgpKeep はcsのうちbetterが他のどれにも負けないものだけ残す
+func bgpKeep(cs []bgpCandidate, better func(a, b *bgpCandidate) bool) []bgpCandidate {
+	var out []bgpCandidate
+	for i := range cs {
+		lose := false
+		for j := range cs {
+			if better(&cs[j], &cs[i]) {
+				lose = true
+				break
+			}
+		}
+		if !lose {
+			out = append(out, cs[i])
+		}
+	}
+	return out
+}
+
+// bgpBestPath はRFC 4271 9.1.2.2の順に候補を減らして1つ選ぶ
+// MEDは同じneighbor ASのpathの間だけ比べる
+func bgpBestPath(cs []bgpCandidate) *bgpCandidate {
+	steps := []func(a, b *bgpCandidate) bool{
+		func(a, b *bgpCandidate) bool { return a.path.LocalPref > b.path.LocalPref },
+		func(a, b *bgpCandidate) bool { return a.path.AsPathLen < b.path.AsPathLen },
+		func(a, b *bgpCandidate) bool { return a.path.Origin < b.path.Origin },
+		func(a, b *bgpCandidate) bool {
+			return a.path.NeighborAS == b.path.NeighborAS && a.path.Med < b.path.Med
+		},
+		func(a, b *bgpCandidate) bool { return a.metric < b.metric },
+		func(a, b *bgpCandidate) bool { return bytes.Compare(a.peer, b.peer) < 0 },
+	}
+	for _, better := range steps {
+		cs = bgpKeep(cs, better)
+	}
+	if len(cs) == 0 {
+		return nil
+	}
+	return &cs[0]
+}
+
+func (b *BgpRib) selectBest(key bgpRibKey) {
+	// NHTは届かないpathを外すのとIGPのコストで比べるのに使う
+	var cs []bgpCandidate
+	b.nmu.Lock()
+	for peer, path := range b.paths[key] {
+		st := b.nht[path.Nexthop.String()]
+		if !st.Reachable {
+			continue
+		}
+		cs = append(cs, bgpCandidate{peer: net.ParseIP(peer), path: path, metric: st.Metric})
+	}
+	b.nmu.Unlock()
+
+	var best net.IP
+	if c := bgpBestPath(cs); c != nil {
+		best = c.path.Nexthop
+	}
+
+	if len(b.paths[key]) == 0 {
+		delete(b.paths, key)
+	}
+
+	prefix := net.ParseIP(key.prefix)
+	cur, installed := b.best[key]
+
+	var err error
+	switch {
+	case best == nil && !installed:
+		return
+	case best == nil:
+		log.Printf("BGP %s/%d no reachable path, withdraw\n", key.prefix, key.plen)
+		delete(b.best, key)
+		err = b.nebura.SendNclientIPv4RouteDelete(prefix, key.plen)
+	case installed && best.Equal(cur):
+		return
+	default:
+		log.Printf("BGP %s/%d best via %s\n", key.prefix, key.plen, best.String())
+		b.best[key] = best
+		err = b.nebura.SendNclientIPv4RouteReplace(prefix, best, key.plen)
+	}
+	if err != nil {
+		log.Printf("Nebura %s/%d: %v\n", key.prefix, key.plen, err)
+	}
+}
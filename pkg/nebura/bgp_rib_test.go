@@ -0,0 +1,98 @@
+package nebura
+
+import (
+	"net"
+	"testing"
+)
+
+func bgpTestCandidate(peer string, metric uint32, path BgpPath) bgpCandidate {
+	path.Nexthop = net.ParseIP(peer)
+	return bgpCandidate{peer: net.ParseIP(peer), path: &path, metric: metric}
+}
+
+func TestBgpBestPath(t *testing.T) {
+	def := BgpPath{LocalPref: bgpDefaultLocalPref, AsPathLen: 2, NeighborAS: 65001}
+
+	tests := []struct {
+		name string
+		cs   []bgpCandidate
+		want string
+	}{
+		{
+			name: "local pref before igp metric",
+			cs: []bgpCandidate{
+				bgpTestCandidate("10.0.0.1", 1, def),
+				bgpTestCandidate("10.0.0.2", 100, BgpPath{LocalPref: 200, AsPathLen: 2, NeighborAS: 65001}),
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name: "shorter as path",
+			cs: []bgpCandidate{
+				bgpTestCandidate("10.0.0.1", 1, BgpPath{LocalPref: bgpDefaultLocalPref, AsPathLen: 3, NeighborAS: 65001}),
+				bgpTestCandidate("10.0.0.2", 100, def),
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name: "lower origin",
+			cs: []bgpCandidate{
+				bgpTestCandidate("10.0.0.1", 1, BgpPath{LocalPref: bgpDefaultLocalPref, AsPathLen: 2, Origin: 2, NeighborAS: 65001}),
+				bgpTestCandidate("10.0.0.2", 100, def),
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name: "med within the same neighbor as",
+			cs: []bgpCandidate{
+				bgpTestCandidate("10.0.0.1", 1, BgpPath{LocalPref: bgpDefaultLocalPref, AsPathLen: 2, Med: 50, NeighborAS: 65001}),
+				bgpTestCandidate("10.0.0.2", 100, BgpPath{LocalPref: bgpDefaultLocalPref, AsPathLen: 2, Med: 10, NeighborAS: 65001}),
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name: "med not compared across neighbor as",
+			cs: []bgpCandidate{
+				bgpTestCandidate("10.0.0.1", 1, BgpPath{LocalPref: bgpDefaultLocalPref, AsPathLen: 2, Med: 50, NeighborAS: 65001}),
+				bgpTestCandidate("10.0.0.2", 100, BgpPath{LocalPref: bgpDefaultLocalPref, AsPathLen: 2, Med: 10, NeighborAS: 65002}),
+			},
+			want: "10.0.0.1",
+		},
+		{
+			name: "igp metric then peer address",
+			cs: []bgpCandidate{
+				bgpTestCandidate("10.0.0.3", 10, def),
+				bgpTestCandidate("10.0.0.2", 10, def),
+				bgpTestCandidate("10.0.0.1", 20, def),
+			},
+			want: "10.0.0.2",
+		},
+	}
+
+	for _, tt := range tests {
+		best := bgpBestPath(tt.cs)
+		if best == nil || !best.peer.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("%s: best %v, want %s", tt.name, best, tt.want)
+		}
+	}
+	if bgpBestPath(nil) != nil {
+		t.Errorf("best of no path is not nil")
+	}
+}
+
+func TestAsPathLength(t *testing.T) {
+	path := AsPath{
+		{Type: asConfedSequence, AS: []uint16{65010, 65011}},
+		{Type: asSequence, AS: []uint16{65001, 65002}},
+		{Type: asSet, AS: []uint16{65003, 65004}},
+	}
+	if n := path.length(); n != 3 {
+		t.Errorf("length %d, want 3", n)
+	}
+	if as := path.neighborAS(); as != 65001 {
+		t.Errorf("neighbor as %d, want 65001", as)
+	}
+	if as := (AsPath{}).neighborAS(); as != 0 {
+		t.Errorf("neighbor as of empty path %d, want 0", as)
+	}
+}
@@ -0,0 +1,163 @@
+package nebura
+
+import (
+	"log"
+	"net"
+	"sync"
+)
+
+// PeerGroup はDynamic Neighborで作られるPeerのテンプレート
+type PeerGroup struct {
+	Name     string
+	RemoteAS uint16
+	HoldTime uint16
+	Select   string
+	Import   []*net.IPNet
+	LocalAS  *LocalAS
+	ExtMsg   bool
+}
+
+type ListenRange struct {
+	Prefix *net.IPNet
+	Group  *PeerGroup
+}
+
+type BgpServer struct {
+	mu        sync.Mutex
+	AS        uint16
+	IdenTifer net.IP
+	Ranges    []ListenRange
+	Peers     map[string]*Peer
+	static    map[string]bool // 設定したpeer、自分から繋ぐのでrangeにあっても受け付けない
+	Bfd       PeerBfd
+	Confed    *Confed
+	Networks  []NLRIPrefix
+	Vrf       uint32
+	Nebura    *Nclient
+	Rib       *BgpRib
+}
+
+func BgpServerInit(as uint16, iden net.IP) *BgpServer {
+	return &BgpServer{
+		AS:        as,
+		IdenTifer: iden,
+		Peers:     make(map[string]*Peer),
+		static:    make(map[string]bool),
+	}
+}
+
+// AddStaticPeer は設定したpeerのアドレスを登録する
+// 同じneighborとDynamic Neighborでもう1本セッションを張らないようにする
+func (s *BgpServer) AddStaticPeer(addr net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.static[addr.String()] = true
+}
+
+func (s *BgpServer) AddListenRange(prefix *net.IPNet, g *PeerGroup) {
+	s.Ranges = append(s.Ranges, ListenRange{
+		Prefix: prefix,
+		Group:  g,
+	})
+}
+
+// 一番長くマッチしたrangeのPeerGroupを返す
+func (s *BgpServer) rangeMatch(addr net.IP) *PeerGroup {
+	var group *PeerGroup
+	best := -1
+
+	for _, r := range s.Ranges {
+		ones, _ := r.Prefix.Mask.Size()
+		if r.Prefix.Contains(addr) && ones > best {
+			best = ones
+			group = r.Group
+		}
+	}
+	return group
+}
+
+func (s *BgpServer) BGPListen() error {
+	lis, err := net.Listen("tcp", ":179")
+	if err != nil {
+		return err
+	}
+	log.Printf("BGP Listen Dynamic Neighbor...\n")
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			log.Printf("BGP Accept err %v", err)
+			continue
+		}
+
+		addr := conn.RemoteAddr().(*net.TCPAddr).IP
+		if v4 := addr.To4(); v4 != nil {
+			addr = v4
+		}
+
+		g := s.rangeMatch(addr)
+		if g == nil {
+			log.Printf("BGP %s is not in listen range, close\n", addr.String())
+			conn.Close()
+			continue
+		}
+
+		p, ok := s.newPeer(addr, g, conn)
+		if !ok {
+			log.Printf("BGP %s session already exists or is a static peer, close\n", addr.String())
+			conn.Close()
+			continue
+		}
+
+		go s.peerRun(p)
+	}
+}
+
+func (s *BgpServer) newPeer(addr net.IP, g *PeerGroup, conn net.Conn) (*Peer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Peers[addr.String()]; ok {
+		return nil, false
+	}
+	if s.static[addr.String()] {
+		return nil, false
+	}
+
+	p := PeerInit(s.AS, s.IdenTifer, addr, g.Select)
+	p.RemoteAS = g.RemoteAS
+	if g.HoldTime != 0 {
+		p.HoldTime = g.HoldTime
+	}
+	p.Import = g.Import
+	p.LocalAS = g.LocalAS
+	p.ExtMsg = g.ExtMsg
+	p.Confed = s.Confed
+	p.Networks = s.Networks
+	p.Vrf = s.Vrf
+	p.Bfd = s.Bfd
+	p.Nebura = s.Nebura
+	p.Rib = s.Rib
+	p.Conn = conn
+
+	s.Peers[addr.String()] = p
+	log.Printf("BGP Dynamic Neighbor %s peer-group %s\n", addr.String(), g.Name)
+	return p, true
+}
+
+func (s *BgpServer) peerRun(p *Peer) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.Peers, p.NeiAdrees.String())
+		s.mu.Unlock()
+	}()
+
+	p.SetState("Active")
+	if p.Bfd != nil {
+		p.BfdRegister()
+		defer p.Bfd.Unregister(p.NeiAdrees, p.bfdID)
+	}
+
+	p.BGPEventLoop()
+}
@@ -0,0 +1,122 @@
+package nebura
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func bgpTestServer(t *testing.T) (*BgpServer, map[string]*PeerGroup) {
+	t.Helper()
+	s := BgpServerInit(65000, net.ParseIP("1.1.1.1").To4())
+
+	groups := make(map[string]*PeerGroup)
+	for _, r := range []struct{ prefix, group string }{
+		{"10.0.0.0/8", "wide"},
+		{"10.1.0.0/16", "narrow"},
+		{"10.1.2.0/24", "host"},
+		{"2001:db8::/32", "v6"},
+	} {
+		_, n, err := net.ParseCIDR(r.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := &PeerGroup{Name: r.group, HoldTime: 90}
+		groups[r.group] = g
+		s.AddListenRange(n, g)
+	}
+	return s, groups
+}
+
+func TestBgpServerRangeMatch(t *testing.T) {
+	s, groups := bgpTestServer(t)
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"10.200.0.1", "wide"},
+		{"10.1.200.1", "narrow"},
+		{"10.1.2.3", "host"},
+		{"2001:db8::1", "v6"},
+		{"192.0.2.1", ""},
+		{"2001:db9::1", ""},
+	}
+
+	for _, tt := range tests {
+		addr := net.ParseIP(tt.addr)
+		if v4 := addr.To4(); v4 != nil {
+			addr = v4
+		}
+		g := s.rangeMatch(addr)
+		switch {
+		case tt.want == "" && g != nil:
+			t.Errorf("%s matched %s, want no match", tt.addr, g.Name)
+		case tt.want != "" && g != groups[tt.want]:
+			t.Errorf("%s matched %v, want %s", tt.addr, g, tt.want)
+		}
+	}
+}
+
+// 設定したpeerと同じアドレスからはDynamic Neighborを作らない
+func TestBgpServerStaticPeer(t *testing.T) {
+	s, groups := bgpTestServer(t)
+	static := net.ParseIP("10.1.2.3").To4()
+	s.AddStaticPeer(static)
+
+	if _, ok := s.newPeer(static, groups["host"], nil); ok {
+		t.Errorf("dynamic session created for static peer %s", static)
+	}
+
+	dyn := net.ParseIP("10.1.2.4").To4()
+	if _, ok := s.newPeer(dyn, groups["host"], nil); !ok {
+		t.Fatalf("dynamic session for %s rejected", dyn)
+	}
+	if _, ok := s.newPeer(dyn, groups["host"], nil); ok {
+		t.Errorf("second dynamic session created for %s", dyn)
+	}
+}
+
+func bgpTestOpen(as uint16) []byte {
+	return []byte{4, uint8(as >> 8), uint8(as), 0, 90, 2, 2, 2, 2, 0}
+}
+
+// RemoteASのないpeer-groupではOPENのASでiBGPかどうかを決める
+func TestBgpOpenRemoteAS(t *testing.T) {
+	s, groups := bgpTestServer(t)
+
+	for _, tt := range []struct {
+		as   uint16
+		ibgp bool
+	}{
+		{65000, true},
+		{65001, false},
+	} {
+		local, remote := net.Pipe()
+		go io.Copy(io.Discard, remote)
+
+		p, ok := s.newPeer(net.ParseIP("10.0.0.1").To4(), groups["wide"], local)
+		if !ok {
+			t.Fatal("peer not created")
+		}
+		if err := p.ParseBgpOpen(bgpTestOpen(tt.as)); err != nil {
+			t.Fatal(err)
+		}
+		if p.RemoteAS != tt.as || p.isIBGP() != tt.ibgp {
+			t.Errorf("open as %d: remote as %d ibgp %v, want %d %v", tt.as, p.RemoteAS, p.isIBGP(), tt.as, tt.ibgp)
+		}
+
+		local.Close()
+		remote.Close()
+		s.mu.Lock()
+		delete(s.Peers, p.NeiAdrees.String())
+		s.mu.Unlock()
+	}
+
+	// peer-groupのASと違えば受け付けない
+	groups["narrow"].RemoteAS = 65002
+	p, _ := s.newPeer(net.ParseIP("10.1.0.1").To4(), groups["narrow"], nil)
+	if err := p.ParseBgpOpen(bgpTestOpen(65003)); err == nil {
+		t.Errorf("open from as 65003 accepted for remote-as 65002")
+	}
+}
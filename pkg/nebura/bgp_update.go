@@ -0,0 +1,402 @@
+package nebura
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+)
+
+const (
+	attrFlagOptional   uint8 = 0x80
+	attrFlagTransitive uint8 = 0x40
+	attrFlagPartial    uint8 = 0x20
+	attrFlagExtLen     uint8 = 0x10
+)
+
+const (
+	attrOrigin    uint8 = 1
+	attrAsPath    uint8 = 2
+	attrNexthop   uint8 = 3
+	attrMed       uint8 = 4
+	attrLocalPref uint8 = 5
+	attrMpReach   uint8 = 14
+	attrMpUnreach uint8 = 15
+	attrLinkState uint8 = 29
+)
+
+type PathAttr struct {
+	Flags uint8
+	Type  uint8
+	Value []byte
+}
+
+type MpNLRI struct {
+	AFI     uint16
+	SAFI    uint8
+	Nexthop net.IP
+	NLRI    []byte
+}
+
+// bgpDefaultLocalPref はLOCAL_PREFがない時の値
+const bgpDefaultLocalPref = 100
+
+type Update struct {
+	Withdrawn []NLRIPrefix
+	Attrs     []PathAttr
+	Origin    uint8
+	AsPath    AsPath
+	Nexthop   net.IP
+	Med       uint32 // なければ0
+	LocalPref uint32 // なければbgpDefaultLocalPref
+	NLRI      []NLRIPrefix
+	MpReach   *MpNLRI
+	MpUnreach *MpNLRI
+	LinkState []byte
+}
+
+func (a *PathAttr) writeTo() ([]byte, error) {
+	var buf []byte
+
+	flags := a.Flags &^ attrFlagExtLen
+	if len(a.Value) > 255 {
+		flags |= attrFlagExtLen
+	}
+
+	buf = append(buf, flags, a.Type)
+	if flags&attrFlagExtLen != 0 {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(a.Value)))
+	} else {
+		buf = append(buf, uint8(len(a.Value)))
+	}
+	return append(buf, a.Value...), nil
+}
+
+func decodePrefixes(data []byte) ([]NLRIPrefix, error) {
+	var prefixes []NLRIPrefix
+
+	for len(data) > 0 {
+		plen := data[0]
+		if plen > 32 {
+			return nil, fmt.Errorf("bgp: bad prefix length %d", plen)
+		}
+		blen := (int(plen) + 7) / 8
+		if len(data) < 1+blen {
+			return nil, fmt.Errorf("bgp: short prefix")
+		}
+
+		ip := make(net.IP, 4)
+		copy(ip, data[1:1+blen])
+		prefixes = append(prefixes, NLRIPrefix{
+			Len:  plen,
+			NLRI: ip,
+		})
+		data = data[1+blen:]
+	}
+	return prefixes, nil
+}
+
+func decodePathAttrs(data []byte) ([]PathAttr, error) {
+	var attrs []PathAttr
+
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, fmt.Errorf("bgp: short path attribute")
+		}
+
+		a := PathAttr{
+			Flags: data[0],
+			Type:  data[1],
+		}
+
+		var alen, hlen int
+		if a.Flags&attrFlagExtLen != 0 {
+			if len(data) < 4 {
+				return nil, fmt.Errorf("bgp: short path attribute")
+			}
+			alen = int(binary.BigEndian.Uint16(data[2:4]))
+			hlen = 4
+		} else {
+			alen = int(data[2])
+			hlen = 3
+		}
+
+		if len(data) < hlen+alen {
+			return nil, fmt.Errorf("bgp: path attribute %d overflow", a.Type)
+		}
+		a.Value = data[hlen : hlen+alen]
+		attrs = append(attrs, a)
+		data = data[hlen+alen:]
+	}
+	return attrs, nil
+}
+
+func BgpUpdateDecode(data []byte) (*Update, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("bgp: short update")
+	}
+
+	u := &Update{LocalPref: bgpDefaultLocalPref}
+
+	wlen := int(binary.BigEndian.Uint16(data[0:2]))
+	if len(data) < 2+wlen+2 {
+		return nil, fmt.Errorf("bgp: bad withdrawn length %d", wlen)
+	}
+
+	var err error
+	if u.Withdrawn, err = decodePrefixes(data[2 : 2+wlen]); err != nil {
+		return nil, err
+	}
+	data = data[2+wlen:]
+
+	alen := int(binary.BigEndian.Uint16(data[0:2]))
+	if len(data) < 2+alen {
+		return nil, fmt.Errorf("bgp: bad path attribute length %d", alen)
+	}
+
+	if u.Attrs, err = decodePathAttrs(data[2 : 2+alen]); err != nil {
+		return nil, err
+	}
+	if u.NLRI, err = decodePrefixes(data[2+alen:]); err != nil {
+		return nil, err
+	}
+
+	for _, a := range u.Attrs {
+		switch a.Type {
+		case attrOrigin:
+			if len(a.Value) == 1 {
+				u.Origin = a.Value[0]
+			}
+		case attrAsPath:
+			if u.AsPath, err = AsPathDecode(a.Value); err != nil {
+				return nil, err
+			}
+		case attrNexthop:
+			if len(a.Value) != 4 {
+				return nil, fmt.Errorf("bgp: bad nexthop length %d", len(a.Value))
+			}
+			u.Nexthop = prefixPadding(a.Value)
+		case attrMed:
+			if len(a.Value) != 4 {
+				return nil, fmt.Errorf("bgp: bad med length %d", len(a.Value))
+			}
+			u.Med = binary.BigEndian.Uint32(a.Value)
+		case attrLocalPref:
+			if len(a.Value) != 4 {
+				return nil, fmt.Errorf("bgp: bad local_pref length %d", len(a.Value))
+			}
+			u.LocalPref = binary.BigEndian.Uint32(a.Value)
+		case attrMpReach:
+			if u.MpReach, err = mpReachDecode(a.Value); err != nil {
+				return nil, err
+			}
+		case attrMpUnreach:
+			if len(a.Value) < 3 {
+				return nil, fmt.Errorf("bgp: short mp_unreach_nlri")
+			}
+			u.MpUnreach = &MpNLRI{
+				AFI:  binary.BigEndian.Uint16(a.Value[0:2]),
+				SAFI: a.Value[2],
+				NLRI: a.Value[3:],
+			}
+		case attrLinkState:
+			u.LinkState = a.Value
+		}
+	}
+
+	return u, nil
+}
+
+func mpReachDecode(data []byte) (*MpNLRI, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("bgp: short mp_reach_nlri")
+	}
+
+	m := &MpNLRI{
+		AFI:  binary.BigEndian.Uint16(data[0:2]),
+		SAFI: data[2],
+	}
+
+	nhlen := int(data[3])
+	if len(data) < 4+nhlen+1 {
+		return nil, fmt.Errorf("bgp: bad mp_reach_nlri nexthop length %d", nhlen)
+	}
+	m.Nexthop = net.IP(data[4 : 4+nhlen])
+	m.NLRI = data[4+nhlen+1:] // reserved 1byte
+	return m, nil
+}
+
+func encodePrefix(p NLRIPrefix) []byte {
+	blen := (int(p.Len) + 7) / 8
+	buf := []byte{p.Len}
+	return append(buf, p.NLRI.To4()[:blen]...)
+}
+
+func (u *Update) writeTo() ([]byte, error) {
+	var wbuf, abuf, nbuf []byte
+
+	for _, w := range u.Withdrawn {
+		wbuf = append(wbuf, encodePrefix(w)...)
+	}
+	for _, a := range u.Attrs {
+		b, _ := a.writeTo()
+		abuf = append(abuf, b...)
+	}
+	for _, n := range u.NLRI {
+		nbuf = append(nbuf, encodePrefix(n)...)
+	}
+
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(wbuf)))
+	buf = append(buf, wbuf...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(abuf)))
+	buf = append(buf, abuf...)
+	return append(buf, nbuf...), nil
+}
+
+// RouteAttrs は広告する経路の属性
+type RouteAttrs struct {
+	Origin    uint8
+	AsPath    AsPath
+	Nexthop   net.IP
+	Med       uint32
+	HasMed    bool   // falseならMEDを付けない、0でも送れるように
+	LocalPref uint32 // 0ならbgpDefaultLocalPref
+}
+
+type AdvRoute struct {
+	Prefix   NLRIPrefix
+	Attrs    *RouteAttrs
+	Withdraw bool
+}
+
+// encodeAttrs はpeerに送る属性を作る、aは複数の経路で共有されるので書き換えない
+func (p *Peer) encodeAttrs(a *RouteAttrs) ([]PathAttr, error) {
+	path, err := p.ExportAsPath(a.AsPath).writeTo()
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []PathAttr{
+		{Flags: attrFlagTransitive, Type: attrOrigin, Value: []byte{a.Origin}},
+		{Flags: attrFlagTransitive, Type: attrAsPath, Value: path},
+		{Flags: attrFlagTransitive, Type: attrNexthop, Value: a.Nexthop.To4()},
+	}
+	if a.HasMed {
+		attrs = append(attrs, PathAttr{
+			Flags: attrFlagOptional,
+			Type:  attrMed,
+			Value: binary.BigEndian.AppendUint32(nil, a.Med),
+		})
+	}
+	// LOCAL_PREFはiBGPとconfed内だけ
+	if p.isIBGP() || p.isConfedPeer() {
+		lp := a.LocalPref
+		if lp == 0 {
+			lp = bgpDefaultLocalPref
+		}
+		attrs = append(attrs, PathAttr{
+			Flags: attrFlagTransitive,
+			Type:  attrLocalPref,
+			Value: binary.BigEndian.AppendUint32(nil, lp),
+		})
+	}
+	return attrs, nil
+}
+
+// BuildUpdates は同じ属性を持つprefixを1つのUPDATEにまとめ、
+// ネゴシエーションしたメッセージサイズに収まるように分割する
+func (p *Peer) BuildUpdates(routes []AdvRoute) ([]*Update, error) {
+	var updates []*Update
+
+	// 4 = withdrawn長 + path attribute長
+	room := p.msgMax() - bgpHederSize - 4
+
+	var withdrawn []NLRIPrefix
+	wsize := 0
+	for _, r := range routes {
+		if !r.Withdraw {
+			continue
+		}
+		size := len(encodePrefix(r.Prefix))
+		if wsize+size > room {
+			updates = append(updates, &Update{Withdrawn: withdrawn})
+			withdrawn, wsize = nil, 0
+		}
+		withdrawn = append(withdrawn, r.Prefix)
+		wsize += size
+	}
+	if len(withdrawn) != 0 {
+		updates = append(updates, &Update{Withdrawn: withdrawn})
+	}
+
+	type group struct {
+		attrs    []PathAttr
+		size     int
+		prefixes []NLRIPrefix
+	}
+	var order []string
+	groups := make(map[string]*group)
+
+	for _, r := range routes {
+		if r.Withdraw {
+			continue
+		}
+
+		attrs, err := p.encodeAttrs(r.Attrs)
+		if err != nil {
+			return nil, err
+		}
+
+		var key []byte
+		for _, a := range attrs {
+			b, _ := a.writeTo()
+			key = append(key, b...)
+		}
+
+		g, ok := groups[string(key)]
+		if !ok {
+			g = &group{attrs: attrs, size: len(key)}
+			groups[string(key)] = g
+			order = append(order, string(key))
+		}
+		g.prefixes = append(g.prefixes, r.Prefix)
+	}
+
+	for _, k := range order {
+		g := groups[k]
+		if g.size >= room {
+			return nil, fmt.Errorf("bgp: path attributes too large %d", g.size)
+		}
+
+		u := &Update{Attrs: g.attrs}
+		size := g.size
+		for _, prefix := range g.prefixes {
+			plen := len(encodePrefix(prefix))
+			if size+plen > room {
+				updates = append(updates, u)
+				u = &Update{Attrs: g.attrs}
+				size = g.size
+			}
+			u.NLRI = append(u.NLRI, prefix)
+			size += plen
+		}
+		updates = append(updates, u)
+	}
+
+	return updates, nil
+}
+
+func (p *Peer) BgpSendUpdate(routes []AdvRoute) error {
+	updates, err := p.BuildUpdates(routes)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range updates {
+		if err := p.SendMsg(uint8(BgpUpdateType), u); err != nil {
+			return err
+		}
+	}
+	log.Printf("BGP Update Send %d routes in %d messages\n", len(routes), len(updates))
+	return nil
+}
@@ -0,0 +1,193 @@
+package nebura
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func bgpTestPrefix(i int) NLRIPrefix {
+	return NLRIPrefix{Len: 24, NLRI: net.IPv4(10, byte(i>>8), byte(i), 0).To4()}
+}
+
+func bgpTestPeer(remote uint16) *Peer {
+	p := PeerInit(65000, net.ParseIP("1.1.1.1").To4(), net.ParseIP("10.0.0.1").To4(), "")
+	p.RemoteAS = remote
+	return p
+}
+
+func updateAttr(u *Update, typ uint8) (PathAttr, bool) {
+	for _, a := range u.Attrs {
+		if a.Type == typ {
+			return a, true
+		}
+	}
+	return PathAttr{}, false
+}
+
+func TestBuildUpdatesGroup(t *testing.T) {
+	p := bgpTestPeer(65000)
+	nh := net.ParseIP("192.0.2.1").To4()
+	a := &RouteAttrs{Nexthop: nh}
+	b := &RouteAttrs{Nexthop: nh, Med: 0, HasMed: true}
+	c := &RouteAttrs{Nexthop: nh, LocalPref: 200}
+
+	routes := []AdvRoute{
+		{Prefix: bgpTestPrefix(1), Attrs: a},
+		{Prefix: bgpTestPrefix(2), Attrs: b},
+		{Prefix: bgpTestPrefix(3), Withdraw: true},
+		{Prefix: bgpTestPrefix(4), Attrs: a},
+		{Prefix: bgpTestPrefix(5), Attrs: c},
+		{Prefix: bgpTestPrefix(6), Withdraw: true},
+		// 別のポインタでも属性が同じならまとめる
+		{Prefix: bgpTestPrefix(7), Attrs: &RouteAttrs{Nexthop: nh}},
+	}
+
+	updates, err := p.BuildUpdates(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]int{{3, 6}, {1, 4, 7}, {2}, {5}}
+	if len(updates) != len(want) {
+		t.Fatalf("%d updates, want %d", len(updates), len(want))
+	}
+	for i, u := range updates {
+		prefixes := u.NLRI
+		if i == 0 {
+			prefixes = u.Withdrawn
+		}
+		if len(prefixes) != len(want[i]) {
+			t.Errorf("update %d: %v, want prefixes %v", i, prefixes, want[i])
+			continue
+		}
+		for j, n := range want[i] {
+			if !prefixes[j].NLRI.Equal(bgpTestPrefix(n).NLRI) {
+				t.Errorf("update %d prefix %d: %v, want %v", i, j, prefixes[j], bgpTestPrefix(n))
+			}
+		}
+	}
+
+	// MEDは0でもHasMedなら付ける
+	if _, ok := updateAttr(updates[1], attrMed); ok {
+		t.Errorf("med sent without HasMed")
+	}
+	if med, ok := updateAttr(updates[2], attrMed); !ok || !bytes.Equal(med.Value, []byte{0, 0, 0, 0}) {
+		t.Errorf("med 0 not sent: %v", med)
+	}
+
+	// iBGPではLOCAL_PREFのデフォルトを送るが、呼び出し側の属性は変えない
+	lp, ok := updateAttr(updates[1], attrLocalPref)
+	if !ok || !bytes.Equal(lp.Value, []byte{0, 0, 0, bgpDefaultLocalPref}) {
+		t.Errorf("local pref %v, want %d", lp, bgpDefaultLocalPref)
+	}
+	if a.LocalPref != 0 {
+		t.Errorf("caller attrs modified: local pref %d", a.LocalPref)
+	}
+
+	// eBGPにはLOCAL_PREFを送らない
+	updates, err = bgpTestPeer(65001).BuildUpdates(routes[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := updateAttr(updates[0], attrLocalPref); ok {
+		t.Errorf("local pref sent to ebgp peer")
+	}
+}
+
+func TestBuildUpdatesSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		extMsg   bool
+		max      int
+		withdraw bool
+		routes   int
+	}{
+		{"4096", false, BgpMsgMax, false, 3000},
+		{"4096 withdraw", false, BgpMsgMax, true, 3000},
+		{"65535", true, BgpExtMsgMax, false, 40000},
+		{"65535 withdraw", true, BgpExtMsgMax, true, 40000},
+	}
+
+	for _, tt := range tests {
+		p := bgpTestPeer(65001)
+		p.extMsg = tt.extMsg
+		attrs := &RouteAttrs{Nexthop: net.ParseIP("192.0.2.1").To4()}
+
+		var routes []AdvRoute
+		for i := 0; i < tt.routes; i++ {
+			routes = append(routes, AdvRoute{Prefix: bgpTestPrefix(i), Attrs: attrs, Withdraw: tt.withdraw})
+		}
+
+		updates, err := p.BuildUpdates(routes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		total := 0
+		for i, u := range updates {
+			buf, err := (&Message{Hdr: Hdr{Type: BgpUpdateType}, Msg: u}).writeTo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buf) > tt.max {
+				t.Errorf("%s: update %d is %d bytes, max %d", tt.name, i, len(buf), tt.max)
+			}
+			// 最後以外はもう1つ入れると超える
+			if i < len(updates)-1 && len(buf)+4 <= tt.max {
+				t.Errorf("%s: update %d is %d bytes, room left for a prefix", tt.name, i, len(buf))
+			}
+			total += len(u.NLRI) + len(u.Withdrawn)
+		}
+		if total != tt.routes {
+			t.Errorf("%s: %d prefixes in %d updates, want %d", tt.name, total, len(updates), tt.routes)
+		}
+		if len(updates) < 2 {
+			t.Errorf("%s: not split, %d updates", tt.name, len(updates))
+		}
+	}
+}
+
+// ヘッダがおかしければNOTIFICATIONを送ってセッションを閉じる
+func TestBgpHdrReadError(t *testing.T) {
+	marker := bytes.Repeat([]byte{0xff}, bgpMarkerSize)
+	hdr := func(m []byte, size uint16, typ uint8) []byte {
+		return append(append(append([]byte{}, m...), byte(size>>8), byte(size)), typ)
+	}
+
+	tests := []struct {
+		name string
+		hdr  []byte
+		want []byte // NOTIFICATIONの中身
+	}{
+		{"bad marker", hdr(make([]byte, bgpMarkerSize), 19, BgpKeepAliveType), []byte{bgpErrHeader, bgpErrNotSync}},
+		{"short", hdr(marker, 18, BgpUpdateType), []byte{bgpErrHeader, bgpErrBadMsgLength, 0, 18}},
+		{"too long", hdr(marker, 4097, BgpUpdateType), []byte{bgpErrHeader, bgpErrBadMsgLength, 0x10, 0x01}},
+		{"long keepalive", hdr(marker, 20, BgpKeepAliveType), []byte{bgpErrHeader, bgpErrBadMsgLength, 0, 20}},
+		{"bad type", hdr(marker, 19, 9), []byte{bgpErrHeader, bgpErrBadMsgType, 9}},
+	}
+
+	for _, tt := range tests {
+		local, remote := net.Pipe()
+		p := bgpTestPeer(65001)
+		p.Conn = local
+
+		go remote.Write(tt.hdr)
+		errc := make(chan error, 1)
+		go func() { errc <- p.BgpHdrRead(local) }()
+
+		buf := make([]byte, bgpHederSize+len(tt.want))
+		if _, err := io.ReadFull(remote, buf); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if buf[18] != BgpNotificationType || !bytes.Equal(buf[bgpHederSize:], tt.want) {
+			t.Errorf("%s: sent %v, want notification %v", tt.name, buf, tt.want)
+		}
+		if err := <-errc; err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+		local.Close()
+		remote.Close()
+	}
+}
@@ -0,0 +1,575 @@
+package nebura
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+)
+
+// BGP-LS (RFC 9552)
+
+const (
+	AfiLinkState  uint16 = 16388
+	SafiLinkState uint8  = 71
+)
+
+const (
+	lsNLRINode       uint16 = 1
+	lsNLRILink       uint16 = 2
+	lsNLRIPrefixIPv4 uint16 = 3
+	lsNLRIPrefixIPv6 uint16 = 4
+)
+
+// NLRI Descriptor TLV
+const (
+	lsLocalNodeDesc   uint16 = 256
+	lsRemoteNodeDesc  uint16 = 257
+	lsLinkID          uint16 = 258
+	lsIPv4IfAddr      uint16 = 259
+	lsIPv4NeighAddr   uint16 = 260
+	lsIPv6IfAddr      uint16 = 261
+	lsIPv6NeighAddr   uint16 = 262
+	lsMultiTopologyID uint16 = 263
+	lsOspfRouteType   uint16 = 264
+	lsIPReachability  uint16 = 265
+	lsAS              uint16 = 512
+	lsBgpLsID         uint16 = 513
+	lsOspfArea        uint16 = 514
+	lsIgpRouterID     uint16 = 515
+)
+
+// BGP-LS Attribute TLV
+const (
+	lsNodeFlag       uint16 = 1024
+	lsNodeName       uint16 = 1026
+	lsIsisArea       uint16 = 1027
+	lsLocalRouterID4 uint16 = 1028
+	lsLocalRouterID6 uint16 = 1029
+	lsSrCapabilities uint16 = 1034
+	lsAdminGroup     uint16 = 1088
+	lsMaxLinkBw      uint16 = 1089
+	lsMaxResvBw      uint16 = 1090
+	lsTeMetric       uint16 = 1092
+	lsIgpMetric      uint16 = 1095
+	lsAdjSID         uint16 = 1099
+	lsPrefixMetric   uint16 = 1155
+	lsPrefixSID      uint16 = 1158
+	lsSIDLabel       uint16 = 1161
+)
+
+type LsTLV struct {
+	Type  uint16
+	Value []byte
+}
+
+type LsNodeDesc struct {
+	AS          uint32
+	BgpLsID     uint32
+	OspfArea    uint32
+	IgpRouterID []byte
+}
+
+type LsNode struct {
+	ID         string
+	Protocol   uint8
+	Identifier uint64
+	Desc       LsNodeDesc
+	Name       string
+	Flags      uint8
+	IsisArea   []byte
+	RouterID   net.IP
+	RouterIDv6 net.IP
+	Srgb       []LsSrgb
+}
+
+// LsSrgb はSR Capabilitiesに入っているSRGBの1つの範囲
+type LsSrgb struct {
+	Base  uint32
+	Range uint32
+}
+
+type LsLink struct {
+	ID         string
+	Protocol   uint8
+	Identifier uint64
+	LocalNode  string
+	RemoteNode string
+	LocalID    uint32
+	RemoteID   uint32
+	LocalAddr  net.IP
+	RemoteAddr net.IP
+	MTID       uint16
+	IgpMetric  uint32
+	TeMetric   uint32
+	AdminGroup uint32
+	MaxBw      float32
+	MaxResvBw  float32
+	AdjSID     []uint32
+}
+
+type LsPrefix struct {
+	ID         string
+	Protocol   uint8
+	Identifier uint64
+	Node       string
+	Prefix     string
+	MTID       uint16
+	RouteType  uint8
+	Metric     uint32
+	PrefixSID  uint32
+}
+
+type LsGraph struct {
+	mu       sync.Mutex
+	Nodes    map[string]*LsNode
+	Links    map[string]*LsLink
+	Prefixes map[string]*LsPrefix
+}
+
+// LsGraphSnapshot はAPIで返すグラフ
+type LsGraphSnapshot struct {
+	Nodes    []LsNode
+	Links    []LsLink
+	Prefixes []LsPrefix
+}
+
+func LsGraphInit() *LsGraph {
+	return &LsGraph{
+		Nodes:    make(map[string]*LsNode),
+		Links:    make(map[string]*LsLink),
+		Prefixes: make(map[string]*LsPrefix),
+	}
+}
+
+func lsTLVParse(data []byte) ([]LsTLV, error) {
+	var tlvs []LsTLV
+
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("bgp-ls: short tlv")
+		}
+		t := binary.BigEndian.Uint16(data[0:2])
+		l := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+l {
+			return nil, fmt.Errorf("bgp-ls: tlv %d overflow", t)
+		}
+		tlvs = append(tlvs, LsTLV{Type: t, Value: data[4 : 4+l]})
+		data = data[4+l:]
+	}
+	return tlvs, nil
+}
+
+// LsNLRISplit はMP_REACH/MP_UNREACHのNLRI部分を1つずつに分ける
+func LsNLRISplit(data []byte) ([][]byte, error) {
+	var nlri [][]byte
+
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("bgp-ls: short nlri")
+		}
+		l := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+l {
+			return nil, fmt.Errorf("bgp-ls: nlri overflow")
+		}
+		nlri = append(nlri, data[:4+l])
+		data = data[4+l:]
+	}
+	return nlri, nil
+}
+
+func lsUint32(v []byte) uint32 {
+	if len(v) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+func lsUint24(v []byte) uint32 {
+	if len(v) < 3 {
+		return 0
+	}
+	return uint32(v[0])<<16 | uint32(v[1])<<8 | uint32(v[2])
+}
+
+func lsFloat32(v []byte) float32 {
+	return math.Float32frombits(lsUint32(v))
+}
+
+// SID/Labelは3byteならラベル、4byteならインデックス
+func lsSID(v []byte) uint32 {
+	if len(v) == 3 {
+		return lsUint24(v) & 0xfffff
+	}
+	return lsUint32(v)
+}
+
+func lsNodeDescParse(data []byte) (LsNodeDesc, error) {
+	var d LsNodeDesc
+
+	tlvs, err := lsTLVParse(data)
+	if err != nil {
+		return d, err
+	}
+	for _, t := range tlvs {
+		switch t.Type {
+		case lsAS:
+			d.AS = lsUint32(t.Value)
+		case lsBgpLsID:
+			d.BgpLsID = lsUint32(t.Value)
+		case lsOspfArea:
+			d.OspfArea = lsUint32(t.Value)
+		case lsIgpRouterID:
+			d.IgpRouterID = append([]byte(nil), t.Value...)
+		}
+	}
+	return d, nil
+}
+
+func lsNodeID(proto uint8, id uint64, d LsNodeDesc) string {
+	return fmt.Sprintf("%d:%d:%d:%d:%s", proto, id, d.AS, d.BgpLsID, hex.EncodeToString(d.IgpRouterID))
+}
+
+func lsPrefixParse(v []byte, v6 bool) (string, error) {
+	if len(v) < 1 {
+		return "", fmt.Errorf("bgp-ls: short prefix")
+	}
+	size := 4
+	if v6 {
+		size = 16
+	}
+	plen := int(v[0])
+	blen := (plen + 7) / 8
+	if plen > size*8 || len(v) < 1+blen {
+		return "", fmt.Errorf("bgp-ls: bad prefix length %d", plen)
+	}
+	ip := make(net.IP, size)
+	copy(ip, v[1:1+blen])
+	n := &net.IPNet{IP: ip, Mask: net.CIDRMask(plen, size*8)}
+	return n.String(), nil
+}
+
+// Update はNLRI 1つとBGP-LS Attributeをグラフに反映する
+func (g *LsGraph) Update(nlri []byte, attr []byte, withdraw bool) error {
+	if len(nlri) < 4+9 {
+		return fmt.Errorf("bgp-ls: short nlri")
+	}
+
+	nlriType := binary.BigEndian.Uint16(nlri[0:2])
+	proto := nlri[4]
+	ident := binary.BigEndian.Uint64(nlri[5:13])
+
+	desc, err := lsTLVParse(nlri[13:])
+	if err != nil {
+		return err
+	}
+	attrs, err := lsTLVParse(attr)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch nlriType {
+	case lsNLRINode:
+		return g.nodeUpdate(proto, ident, desc, attrs, withdraw)
+	case lsNLRILink:
+		return g.linkUpdate(proto, ident, desc, attrs, withdraw)
+	case lsNLRIPrefixIPv4, lsNLRIPrefixIPv6:
+		return g.prefixUpdate(proto, ident, desc, attrs, withdraw, nlriType == lsNLRIPrefixIPv6)
+	}
+	return fmt.Errorf("bgp-ls: unknown nlri type %d", nlriType)
+}
+
+func (g *LsGraph) nodeUpdate(proto uint8, ident uint64, desc []LsTLV, attrs []LsTLV, withdraw bool) error {
+	n := &LsNode{
+		Protocol:   proto,
+		Identifier: ident,
+	}
+
+	for _, t := range desc {
+		if t.Type == lsLocalNodeDesc {
+			d, err := lsNodeDescParse(t.Value)
+			if err != nil {
+				return err
+			}
+			n.Desc = d
+		}
+	}
+	n.ID = lsNodeID(proto, ident, n.Desc)
+
+	if withdraw {
+		delete(g.Nodes, n.ID)
+		return nil
+	}
+
+	for _, t := range attrs {
+		switch t.Type {
+		case lsNodeFlag:
+			if len(t.Value) > 0 {
+				n.Flags = t.Value[0]
+			}
+		case lsNodeName:
+			n.Name = string(t.Value)
+		case lsIsisArea:
+			n.IsisArea = append([]byte(nil), t.Value...)
+		case lsLocalRouterID4:
+			n.RouterID = net.IP(append([]byte(nil), t.Value...))
+		case lsLocalRouterID6:
+			n.RouterIDv6 = net.IP(append([]byte(nil), t.Value...))
+		case lsSrCapabilities:
+			srgb, err := lsSrgbParse(t.Value)
+			if err != nil {
+				return err
+			}
+			n.Srgb = srgb
+		}
+	}
+
+	g.Nodes[n.ID] = n
+	return nil
+}
+
+// lsSrgbParse はSR Capabilitiesの範囲を全部返す (RFC 9085 2.1.2)
+// flags(1) reserved(1) のあとに range(3) SID/Label sub-TLV が繰り返される
+func lsSrgbParse(v []byte) ([]LsSrgb, error) {
+	if len(v) < 2 {
+		return nil, fmt.Errorf("bgp-ls: short sr capabilities")
+	}
+
+	var srgb []LsSrgb
+	data := v[2:]
+	for len(data) > 0 {
+		if len(data) < 3+4 {
+			return nil, fmt.Errorf("bgp-ls: short srgb")
+		}
+		r := LsSrgb{Range: lsUint24(data[0:3])}
+		t := binary.BigEndian.Uint16(data[3:5])
+		l := int(binary.BigEndian.Uint16(data[5:7]))
+		if len(data) < 7+l {
+			return nil, fmt.Errorf("bgp-ls: srgb sub-tlv %d overflow", t)
+		}
+		if t == lsSIDLabel {
+			r.Base = lsSID(data[7 : 7+l])
+		}
+		srgb = append(srgb, r)
+		data = data[7+l:]
+	}
+	return srgb, nil
+}
+
+func (g *LsGraph) linkUpdate(proto uint8, ident uint64, desc []LsTLV, attrs []LsTLV, withdraw bool) error {
+	l := &LsLink{
+		Protocol:   proto,
+		Identifier: ident,
+	}
+
+	for _, t := range desc {
+		switch t.Type {
+		case lsLocalNodeDesc, lsRemoteNodeDesc:
+			d, err := lsNodeDescParse(t.Value)
+			if err != nil {
+				return err
+			}
+			if t.Type == lsLocalNodeDesc {
+				l.LocalNode = lsNodeID(proto, ident, d)
+			} else {
+				l.RemoteNode = lsNodeID(proto, ident, d)
+			}
+		case lsLinkID:
+			if len(t.Value) >= 8 {
+				l.LocalID = lsUint32(t.Value[0:4])
+				l.RemoteID = lsUint32(t.Value[4:8])
+			}
+		case lsIPv4IfAddr, lsIPv6IfAddr:
+			l.LocalAddr = net.IP(append([]byte(nil), t.Value...))
+		case lsIPv4NeighAddr, lsIPv6NeighAddr:
+			l.RemoteAddr = net.IP(append([]byte(nil), t.Value...))
+		case lsMultiTopologyID:
+			if len(t.Value) >= 2 {
+				l.MTID = binary.BigEndian.Uint16(t.Value) & 0x0fff
+			}
+		}
+	}
+	l.ID = fmt.Sprintf("%s-%s:%d:%d:%s:%s:%d", l.LocalNode, l.RemoteNode,
+		l.LocalID, l.RemoteID, l.LocalAddr, l.RemoteAddr, l.MTID)
+
+	if withdraw {
+		delete(g.Links, l.ID)
+		return nil
+	}
+
+	for _, t := range attrs {
+		switch t.Type {
+		case lsAdminGroup:
+			l.AdminGroup = lsUint32(t.Value)
+		case lsMaxLinkBw:
+			l.MaxBw = lsFloat32(t.Value)
+		case lsMaxResvBw:
+			l.MaxResvBw = lsFloat32(t.Value)
+		case lsTeMetric:
+			l.TeMetric = lsUint32(t.Value)
+		case lsIgpMetric:
+			// 1-3byteの可変長
+			var m uint32
+			for _, b := range t.Value {
+				m = m<<8 | uint32(b)
+			}
+			l.IgpMetric = m
+		case lsAdjSID:
+			// flags(1) weight(1) reserved(2) SID/Label
+			if len(t.Value) > 4 {
+				l.AdjSID = append(l.AdjSID, lsSID(t.Value[4:]))
+			}
+		}
+	}
+
+	g.Links[l.ID] = l
+	return nil
+}
+
+func (g *LsGraph) prefixUpdate(proto uint8, ident uint64, desc []LsTLV, attrs []LsTLV, withdraw bool, v6 bool) error {
+	p := &LsPrefix{
+		Protocol:   proto,
+		Identifier: ident,
+	}
+
+	for _, t := range desc {
+		switch t.Type {
+		case lsLocalNodeDesc:
+			d, err := lsNodeDescParse(t.Value)
+			if err != nil {
+				return err
+			}
+			p.Node = lsNodeID(proto, ident, d)
+		case lsMultiTopologyID:
+			if len(t.Value) >= 2 {
+				p.MTID = binary.BigEndian.Uint16(t.Value) & 0x0fff
+			}
+		case lsOspfRouteType:
+			if len(t.Value) > 0 {
+				p.RouteType = t.Value[0]
+			}
+		case lsIPReachability:
+			prefix, err := lsPrefixParse(t.Value, v6)
+			if err != nil {
+				return err
+			}
+			p.Prefix = prefix
+		}
+	}
+	p.ID = fmt.Sprintf("%s-%s:%d", p.Node, p.Prefix, p.MTID)
+
+	if withdraw {
+		delete(g.Prefixes, p.ID)
+		return nil
+	}
+
+	for _, t := range attrs {
+		switch t.Type {
+		case lsPrefixMetric:
+			p.Metric = lsUint32(t.Value)
+		case lsPrefixSID:
+			// flags(1) algorithm(1) reserved(2) SID/Index
+			if len(t.Value) > 4 {
+				p.PrefixSID = lsSID(t.Value[4:])
+			}
+		}
+	}
+
+	g.Prefixes[p.ID] = p
+	return nil
+}
+
+func (g *LsGraph) Snapshot() LsGraphSnapshot {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var s LsGraphSnapshot
+	for _, n := range g.Nodes {
+		s.Nodes = append(s.Nodes, *n)
+	}
+	for _, l := range g.Links {
+		s.Links = append(s.Links, *l)
+	}
+	for _, p := range g.Prefixes {
+		s.Prefixes = append(s.Prefixes, *p)
+	}
+
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].ID < s.Nodes[j].ID })
+	sort.Slice(s.Links, func(i, j int) bool { return s.Links[i].ID < s.Links[j].ID })
+	sort.Slice(s.Prefixes, func(i, j int) bool { return s.Prefixes[i].ID < s.Prefixes[j].ID })
+	return s
+}
+
+const (
+	lsKindNode   uint8 = 1
+	lsKindLink   uint8 = 2
+	lsKindPrefix uint8 = 3
+)
+
+// グラフは大きくなるのでnode/link/prefix 1つずつに分けて送る
+func (s *LsGraphSnapshot) encode() ([][]byte, error) {
+	var bufs [][]byte
+
+	add := func(kind uint8, v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		bufs = append(bufs, append([]byte{kind}, b...))
+		return nil
+	}
+
+	for i := range s.Nodes {
+		if err := add(lsKindNode, &s.Nodes[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range s.Links {
+		if err := add(lsKindLink, &s.Links[i]); err != nil {
+			return nil, err
+		}
+	}
+	for i := range s.Prefixes {
+		if err := add(lsKindPrefix, &s.Prefixes[i]); err != nil {
+			return nil, err
+		}
+	}
+	return bufs, nil
+}
+
+func (s *LsGraphSnapshot) decode(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("bgp-ls: empty graph element")
+	}
+
+	switch data[0] {
+	case lsKindNode:
+		var n LsNode
+		if err := json.Unmarshal(data[1:], &n); err != nil {
+			return err
+		}
+		s.Nodes = append(s.Nodes, n)
+	case lsKindLink:
+		var l LsLink
+		if err := json.Unmarshal(data[1:], &l); err != nil {
+			return err
+		}
+		s.Links = append(s.Links, l)
+	case lsKindPrefix:
+		var p LsPrefix
+		if err := json.Unmarshal(data[1:], &p); err != nil {
+			return err
+		}
+		s.Prefixes = append(s.Prefixes, p)
+	default:
+		return fmt.Errorf("bgp-ls: unknown graph element %d", data[0])
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package nebura
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Fib はkernelへの書き込み、書き込めなかったらエラーを返す
+type Fib interface {
+	RouteAdd(rt *RIBPrefix) error // 同じprefixがあれば置き換える
+	RouteDelete(rt *RIBPrefix) error
+	Seg6Add(rt *Seg6Route) error
+	Seg6Delete(rt *Seg6Route) error
+	Seg6LocalAdd(rt *Seg6LocalRoute) error
+	Seg6LocalDelete(rt *Seg6LocalRoute) error
+	MplsAdd(rt *MplsLabelRoute) error // 同じlabelがあれば置き換える
+	MplsDelete(rt *MplsLabelRoute) error
+	MplsPushAdd(rt *MplsPushRoute) error // 同じprefixがあれば置き換える
+	MplsPushDelete(rt *MplsPushRoute) error
+	NetemAdd(index int, latency string) error
+	XdpAttach(index int, prog uint8) error
+	VrfAdd(name string, table uint32) (int, error) // VRFデバイスのindexを返す
+	VrfDelete(name string) error
+	VrfBind(index int, vrfIndex int) error // vrfIndexが0ならVRFから外す
+	RuleAdd(p *PbrRule) error
+	RuleDelete(p *PbrRule) error
+}
+
+// NetlinkFib はvishvananda/netlinkでkernelに書き込む
+type NetlinkFib struct{}
+
+func NetlinkFibInit() *NetlinkFib {
+	return &NetlinkFib{}
+}
+
+func fibPrefix(prefix net.IP, plen uint8) *net.IPNet {
+	bits := 8 * net.IPv6len
+	if v4 := prefix.To4(); v4 != nil {
+		prefix = v4
+		bits = 8 * net.IPv4len
+	}
+	mask := net.CIDRMask(int(plen), bits)
+	return &net.IPNet{IP: prefix.Mask(mask), Mask: mask}
+}
+
+// fibOif はaddrに届くinterfaceを返す
+func fibOif(addr net.IP) (int, error) {
+	routes, err := netlink.RouteGet(addr)
+	if err != nil {
+		return 0, fmt.Errorf("fib: no route to %s: %w", addr.String(), err)
+	}
+	if len(routes) == 0 || routes[0].LinkIndex == 0 {
+		return 0, fmt.Errorf("fib: no interface for %s", addr.String())
+	}
+	return routes[0].LinkIndex, nil
+}
+
+// fibNexthop は再帰で解決したnexthopがあればそれを使う
+func fibNexthop(rt *RIBPrefix) net.IP {
+	if rt.Resolved != nil {
+		return rt.Resolved
+	}
+	return rt.Nexthop
+}
+
+// fibPaths はFIBに入れるnexthopを返す、ECMPでは届くものだけ
+func fibPaths(rt *RIBPrefix) []RIBNexthop {
+	if len(rt.Multipath) == 0 {
+		return []RIBNexthop{{Nexthop: rt.Nexthop, Resolved: fibNexthop(rt), Index: rt.Index}}
+	}
+
+	var paths []RIBNexthop
+	if rt.Resolved != nil {
+		paths = append(paths, RIBNexthop{Nexthop: rt.Nexthop, Resolved: rt.Resolved, Index: rt.Index})
+	}
+	for _, m := range rt.Multipath {
+		if m.Resolved != nil {
+			paths = append(paths, m)
+		}
+	}
+	return paths
+}
+
+func fibRoute(rt *RIBPrefix) *netlink.Route {
+	route := &netlink.Route{
+		Dst:       fibPrefix(rt.Prefix, rt.PrefixLen),
+		Gw:        fibNexthop(rt),
+		LinkIndex: rt.Index,
+		Protocol:  rtprotNebura,
+		Table:     int(fibTable(rt.VrfID)),
+	}
+
+	paths := fibPaths(rt)
+	if len(paths) < 2 {
+		return route
+	}
+	route.Gw, route.LinkIndex = nil, 0
+	for _, p := range paths {
+		route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{
+			Gw:        p.Resolved,
+			LinkIndex: p.Index,
+		})
+	}
+	return route
+}
+
+func (f *NetlinkFib) RouteAdd(rt *RIBPrefix) error {
+	if err := netlink.RouteReplace(fibRoute(rt)); err != nil {
+		return fmt.Errorf("fib: add %s/%d: %w", rt.Prefix.String(), rt.PrefixLen, err)
+	}
+	return nil
+}
+
+func (f *NetlinkFib) RouteDelete(rt *RIBPrefix) error {
+	if err := netlink.RouteDel(fibRoute(rt)); err != nil {
+		return fmt.Errorf("fib: delete %s/%d: %w", rt.Prefix.String(), rt.PrefixLen, err)
+	}
+	return nil
+}
+
+// seg6Srh はSRHのSegment Listの順にする
+// Segment List[0]が最後のsegmentで、Segments Left, Last Entryは最初のsegmentを指す
+// nl.EncodeSEG6Encapは並べ替えずにSegments LeftとLast Entryをlen-1にするので逆順にして渡す
+// inlineではkernelがSegment List[0]を元の宛先で上書きするので、その分を空けておく
+func seg6Srh(segs []net.IP, mode uint8) []net.IP {
+	var srh []net.IP
+	if mode == Seg6ModeInline {
+		srh = append(srh, net.IPv6zero)
+	}
+	for i := len(segs) - 1; i >= 0; i-- {
+		srh = append(srh, segs[i].To16())
+	}
+	return srh
+}
+
+// encapの経路は最初のsegmentに向かうinterfaceから出す
+func seg6Route(rt *Seg6Route) (*netlink.Route, error) {
+	oif, err := fibOif(rt.Segs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &netlink.Route{
+		Dst:       fibPrefix(rt.Prefix, rt.PrefixLen),
+		LinkIndex: oif,
+		Protocol:  rtprotNebura,
+		Table:     syscall.RT_TABLE_MAIN,
+		Encap: &netlink.SEG6Encap{
+			Mode:     int(rt.Mode),
+			Segments: seg6Srh(rt.Segs, rt.Mode),
+		},
+	}, nil
+}
+
+func (f *NetlinkFib) Seg6Add(rt *Seg6Route) error {
+	route, err := seg6Route(rt)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("fib: seg6 add %s: %w", seg6Key(rt.Prefix, rt.PrefixLen), err)
+	}
+	return nil
+}
+
+func (f *NetlinkFib) Seg6Delete(rt *Seg6Route) error {
+	route := &netlink.Route{
+		Dst:      fibPrefix(rt.Prefix, rt.PrefixLen),
+		Protocol: rtprotNebura,
+		Table:    syscall.RT_TABLE_MAIN,
+	}
+	if err := netlink.RouteDel(route); err != nil {
+		return fmt.Errorf("fib: seg6 delete %s: %w", seg6Key(rt.Prefix, rt.PrefixLen), err)
+	}
+	return nil
+}
+
+// End.DX4はnexthopに向かうinterfaceに付ける
+func seg6LocalRoute(rt *Seg6LocalRoute) (*netlink.Route, error) {
+	encap := &netlink.SEG6LocalEncap{}
+
+	switch rt.EndAction {
+	case EndDX4:
+		encap.Action = nl.SEG6_LOCAL_ACTION_END_DX4
+		encap.Flags[nl.SEG6_LOCAL_NH4] = true
+		encap.InAddr = rt.Nexthop
+	default:
+		return nil, fmt.Errorf("seg6local: unsupported end action %d", rt.EndAction)
+	}
+
+	oif, err := fibOif(rt.Nexthop)
+	if err != nil {
+		return nil, err
+	}
+
+	return &netlink.Route{
+		Dst:       fibPrefix(rt.Sid, 128),
+		LinkIndex: oif,
+		Protocol:  rtprotNebura,
+		Table:     syscall.RT_TABLE_MAIN,
+		Encap:     encap,
+	}, nil
+}
+
+func (f *NetlinkFib) Seg6LocalAdd(rt *Seg6LocalRoute) error {
+	route, err := seg6LocalRoute(rt)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("fib: seg6local add %s: %w", rt.Sid.String(), err)
+	}
+	return nil
+}
+
+func (f *NetlinkFib) Seg6LocalDelete(rt *Seg6LocalRoute) error {
+	route := &netlink.Route{
+		Dst:      fibPrefix(rt.Sid, 128),
+		Protocol: rtprotNebura,
+		Table:    syscall.RT_TABLE_MAIN,
+	}
+	if err := netlink.RouteDel(route); err != nil {
+		return fmt.Errorf("fib: seg6local delete %s: %w", rt.Sid.String(), err)
+	}
+	return nil
+}
+
+// netemLatency は"100ms"のような文字列をusecにする、単位がなければusec
+func netemLatency(s string) (uint32, error) {
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(v), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("netem: bad latency %q", s)
+	}
+	return uint32(d / time.Microsecond), nil
+}
+
+func (f *NetlinkFib) NetemAdd(index int, latency string) error {
+	us, err := netemLatency(latency)
+	if err != nil {
+		return err
+	}
+
+	qdisc := netlink.NewNetem(netlink.QdiscAttrs{
+		LinkIndex: index,
+		Parent:    netlink.HANDLE_ROOT,
+	}, netlink.NetemQdiscAttrs{
+		Latency: us,
+		Limit:   1000,
+	})
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		return fmt.Errorf("fib: netem %d: %w", index, err)
+	}
+	return nil
+}
+
+// VrfAdd は同じtableのVRFデバイスが既にあればそれを使う
+func (f *NetlinkFib) VrfAdd(name string, table uint32) (int, error) {
+	if link, err := netlink.LinkByName(name); err == nil {
+		vrf, ok := link.(*netlink.Vrf)
+		if !ok || vrf.Table != table {
+			return 0, fmt.Errorf("fib: vrf %s: %w", name, syscall.EEXIST)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return 0, fmt.Errorf("fib: vrf %s up: %w", name, err)
+		}
+		return link.Attrs().Index, nil
+	}
+
+	vrf := &netlink.Vrf{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		Table:     table,
+	}
+	if err := netlink.LinkAdd(vrf); err != nil {
+		return 0, fmt.Errorf("fib: vrf %s add: %w", name, err)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return 0, fmt.Errorf("fib: vrf %s: %w", name, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return 0, fmt.Errorf("fib: vrf %s up: %w", name, err)
+	}
+	return link.Attrs().Index, nil
+}
+
+func (f *NetlinkFib) VrfDelete(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("fib: vrf %s: %w", name, err)
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("fib: vrf %s delete: %w", name, err)
+	}
+	return nil
+}
+
+func (f *NetlinkFib) VrfBind(index int, vrfIndex int) error {
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return fmt.Errorf("fib: link %d: %w", index, err)
+	}
+	if vrfIndex == 0 {
+		err = netlink.LinkSetNoMaster(link)
+	} else {
+		err = netlink.LinkSetMasterByIndex(link, vrfIndex)
+	}
+	if err != nil {
+		return fmt.Errorf("fib: vrf bind %s: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+const XdpDrop uint8 = 0
+
+// XdpAttach はprogのXDPプログラムをSKBモードでinterfaceに付ける
+func (f *NetlinkFib) XdpAttach(index int, prog uint8) error {
+	if prog != XdpDrop {
+		return fmt.Errorf("xdp: unknown program %d", prog)
+	}
+
+	var collect struct {
+		Prog *ebpf.Program `ebpf:"xdp_drop"`
+	}
+	spec, err := LoadXdpProg()
+	if err != nil {
+		return fmt.Errorf("xdp: %w", err)
+	}
+	if err := spec.LoadAndAssign(&collect, nil); err != nil {
+		return fmt.Errorf("xdp: %w", err)
+	}
+	defer collect.Prog.Close() // 付けた後はkernelが持っている
+
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return fmt.Errorf("xdp: link %d: %w", index, err)
+	}
+	if err := netlink.LinkSetXdpFdWithFlags(link, collect.Prog.FD(), nl.XDP_FLAGS_SKB_MODE); err != nil {
+		return fmt.Errorf("xdp: attach %s: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+package nebura
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// FibResultHook は非同期に書き込んだ経路の結果を返す
+type FibResultHook func(rt RIBPrefix, add bool, err error)
+
+// FibAsync は経路を後でまとめて書き込むFib、RouteAdd, RouteDeleteは積むだけで結果はhookで返す
+type FibAsync interface {
+	Fib
+	SetResultHook(f FibResultHook)
+}
+
+// ACKを待たずに送るメッセージの数、多すぎるとACKが受信バッファに入りきらない
+const fibBatchWindow = 256
+
+type fibBatchOp struct {
+	rt     RIBPrefix
+	add    bool
+	nh     *fibNexthopObj // nilでなければnexthop objectのメッセージ
+	merged []*fibBatchOp  // 送る前にこのopにまとめられたもの
+}
+
+// ErrFibSuperseded は送る前に同じprefixへの後の書き込みにまとめられた結果
+var ErrFibSuperseded = errors.New("fib: superseded by a later write")
+
+// fibSocket はBatchFibが使うnetlink socket
+type fibSocket interface {
+	Send(req *nl.NetlinkRequest) error
+	Receive() ([]syscall.NetlinkMessage, error)
+	Close()
+}
+
+type nlFibSocket struct {
+	*nl.NetlinkSocket
+}
+
+func (s nlFibSocket) Receive() ([]syscall.NetlinkMessage, error) {
+	msgs, _, err := s.NetlinkSocket.Receive()
+	return msgs, err
+}
+
+func nlFibSocketOpen() (fibSocket, error) {
+	sock, err := nl.Subscribe(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	return nlFibSocket{sock}, nil
+}
+
+// BatchFib は1本のnetlink socketで経路をまとめて送り、ACKはSequenceで別のgoroutineが受け取る
+// 送る前に同じprefixへの変更が来たら最後のものだけ送る
+// kernelがnexthop objectを使えれば経路はobjectを指す
+// 経路以外はNetlinkFibで書き込む
+type BatchFib struct {
+	*NetlinkFib
+
+	sock fibSocket
+	open func() (fibSocket, error) // reopenで使う
+	nh   *fibNexthopTable          // nilならnexthopを経路に直接書く
+
+	mu    sync.Mutex
+	queue map[string]*fibBatchOp
+	order []string
+	kick  chan struct{}
+
+	pmu     sync.Mutex // sockの入れ替えもこれで守る
+	pending map[uint32]*fibBatchOp
+	window  chan struct{}
+
+	result FibResultHook
+}
+
+func BatchFibInit() (*BatchFib, error) {
+	sock, err := nlFibSocketOpen()
+	if err != nil {
+		return nil, fmt.Errorf("fib: %w", err)
+	}
+
+	nh, err := fibNexthopTableInit()
+	if err != nil {
+		log.Printf("%v, nexthop object disabled", err)
+		nh = nil
+	}
+
+	f := batchFibInit(sock, nlFibSocketOpen, nh)
+	go f.writeLoop()
+	go f.ackLoop()
+	return f, nil
+}
+
+func batchFibInit(sock fibSocket, open func() (fibSocket, error), nh *fibNexthopTable) *BatchFib {
+	return &BatchFib{
+		NetlinkFib: NetlinkFibInit(),
+		sock:       sock,
+		open:       open,
+		nh:         nh,
+		queue:      make(map[string]*fibBatchOp),
+		kick:       make(chan struct{}, 1),
+		pending:    make(map[uint32]*fibBatchOp),
+		window:     make(chan struct{}, fibBatchWindow),
+	}
+}
+
+// SetResultHook は書き込む前に呼ぶ
+func (f *BatchFib) SetResultHook(hook FibResultHook) {
+	f.result = hook
+}
+
+func (f *BatchFib) enqueue(rt *RIBPrefix, add bool) {
+	key := memPrefix(rt)
+
+	op := &fibBatchOp{rt: *rt, add: add}
+
+	f.mu.Lock()
+	if old, ok := f.queue[key]; !ok {
+		f.order = append(f.order, key)
+	} else {
+		// まとめられた方の結果もwriteLoopからhookで返す
+		log.Printf("FIB coalesce %s\n", key)
+		op.merged = append(old.merged, old)
+		old.merged = nil
+	}
+	f.queue[key] = op
+	f.mu.Unlock()
+
+	select {
+	case f.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (f *BatchFib) RouteAdd(rt *RIBPrefix) error {
+	f.enqueue(rt, true)
+	return nil
+}
+
+func (f *BatchFib) RouteDelete(rt *RIBPrefix) error {
+	f.enqueue(rt, false)
+	return nil
+}
+
+func (f *BatchFib) report(op *fibBatchOp, err error) {
+	if err != nil && !errors.Is(err, ErrFibSuperseded) {
+		log.Printf("FIB %s: %v", memPrefix(&op.rt), err)
+	}
+	if f.result != nil {
+		f.result(op.rt, op.add, err)
+	}
+}
+
+func (f *BatchFib) writeLoop() {
+	for range f.kick {
+		f.mu.Lock()
+		queue, order := f.queue, f.order
+		f.queue = make(map[string]*fibBatchOp)
+		f.order = nil
+		f.mu.Unlock()
+
+		for _, key := range order {
+			op := queue[key]
+			for _, m := range op.merged {
+				f.report(m, ErrFibSuperseded)
+			}
+			op.merged = nil
+			f.send(op)
+		}
+	}
+}
+
+func (f *BatchFib) send(op *fibBatchOp) {
+	if f.nh == nil {
+		req, err := fibBatchRequest(&op.rt, op.add, 0)
+		if err != nil {
+			f.report(op, err)
+			return
+		}
+		f.write(op, req)
+		return
+	}
+
+	// objectは経路より先に作り、経路が指さなくなってから消す
+	id, before, after, changed := f.nh.update(&op.rt, op.add)
+	for _, obj := range before {
+		f.sendNexthop(obj, true)
+	}
+	if changed {
+		req, err := fibBatchRequest(&op.rt, op.add, id)
+		if err != nil {
+			f.report(op, err)
+		} else {
+			f.write(op, req)
+		}
+	} else {
+		// 指しているobjectが同じなら経路はそのまま
+		f.report(op, nil)
+	}
+	for _, obj := range after {
+		f.sendNexthop(obj, false)
+	}
+}
+
+func (f *BatchFib) write(op *fibBatchOp, req *nl.NetlinkRequest) {
+	f.window <- struct{}{}
+	f.pmu.Lock()
+	f.pending[req.Seq] = op
+	sock := f.sock
+	f.pmu.Unlock()
+
+	if err := sock.Send(req); err != nil {
+		// socketを開き直した時にはもう失敗にしてある
+		f.pmu.Lock()
+		_, ok := f.pending[req.Seq]
+		delete(f.pending, req.Seq)
+		f.pmu.Unlock()
+		if ok {
+			<-f.window
+			f.report(op, fmt.Errorf("fib: send: %w", err))
+		}
+	}
+}
+
+// ackLoop はNLMSG_ERRORのSequenceで送った経路を探して結果を返す
+func (f *BatchFib) ackLoop() {
+	for {
+		f.pmu.Lock()
+		sock := f.sock
+		f.pmu.Unlock()
+
+		msgs, err := sock.Receive()
+		if err != nil {
+			log.Printf("FIB receive: %v", err)
+			f.reopen(sock, err)
+			continue
+		}
+
+		for _, m := range msgs {
+			if m.Header.Type != syscall.NLMSG_ERROR || len(m.Data) < 4 {
+				continue
+			}
+
+			f.pmu.Lock()
+			op, ok := f.pending[m.Header.Seq]
+			delete(f.pending, m.Header.Seq)
+			f.pmu.Unlock()
+			if !ok {
+				continue
+			}
+			<-f.window
+
+			errno := syscall.Errno(-int32(nl.NativeEndian().Uint32(m.Data[0:4])))
+			f.ack(op, errno)
+		}
+	}
+}
+
+// ack はkernelが返したerrnoを書き込みの結果にする
+func (f *BatchFib) ack(op *fibBatchOp, errno syscall.Errno) {
+	if op.nh != nil {
+		f.nexthopResult(op, errno)
+		return
+	}
+	if errno != 0 && op.add && f.nh != nil {
+		f.nh.forget(&op.rt)
+	}
+
+	var err error
+	switch {
+	case errno == 0:
+	case !op.add && errno == syscall.ESRCH:
+		// 送る前にまとめられたaddは入っていない
+	case op.add:
+		err = fmt.Errorf("fib: add %s: %w", memPrefix(&op.rt), errno)
+	default:
+		err = fmt.Errorf("fib: delete %s: %w", memPrefix(&op.rt), errno)
+	}
+	f.report(op, err)
+}
+
+// reopen は受信できなくなったsocketを新しいものに替える
+// ENOBUFSではACKが落ちていてどの書き込みが入ったか分からないので、待っていたものは全部失敗にする
+// 失敗はhookでRibに返るので、windowが埋まったまま止まることはない
+func (f *BatchFib) reopen(old fibSocket, err error) {
+	errno := syscall.EIO
+	errors.As(err, &errno)
+
+	var sock fibSocket
+	for {
+		if sock, err = f.open(); err == nil {
+			break
+		}
+		log.Printf("FIB reopen: %v", err)
+		time.Sleep(time.Second)
+	}
+
+	f.pmu.Lock()
+	f.sock = sock
+	pending := f.pending
+	f.pending = make(map[uint32]*fibBatchOp)
+	f.pmu.Unlock()
+	old.Close()
+
+	if len(pending) > 0 {
+		log.Printf("FIB socket reopened, %d writes failed\n", len(pending))
+	}
+	for _, op := range pending {
+		<-f.window
+		f.ack(op, errno)
+	}
+}
+
+// nhidが0でなければnexthopの代わりにobjectを指す
+func fibBatchRequest(rt *RIBPrefix, add bool, nhid uint32) (*nl.NetlinkRequest, error) {
+	var req *nl.NetlinkRequest
+	var msg *nl.RtMsg
+	if add {
+		req = nl.NewNetlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE|syscall.NLM_F_ACK)
+		msg = nl.NewRtMsg()
+	} else {
+		req = nl.NewNetlinkRequest(syscall.RTM_DELROUTE, syscall.NLM_F_ACK)
+		msg = nl.NewRtDelMsg()
+	}
+
+	dst := fibPrefix(rt.Prefix, rt.PrefixLen)
+	family := nl.GetIPFamily(dst.IP)
+
+	msg.Family = uint8(family)
+	msg.Dst_len = rt.PrefixLen
+	msg.Protocol = rtprotNebura
+	table := fibTable(rt.VrfID)
+	if table < 256 {
+		msg.Table = uint8(table)
+	} else {
+		// rtmsgのtableは8bitなので大きいIDはRTA_TABLEで渡す
+		msg.Table = syscall.RT_TABLE_UNSPEC
+	}
+	req.AddData(msg)
+
+	req.AddData(nl.NewRtAttr(syscall.RTA_DST, dst.IP))
+	if table >= 256 {
+		req.AddData(nl.NewRtAttr(syscall.RTA_TABLE, nl.Uint32Attr(table)))
+	}
+	if nhid != 0 {
+		req.AddData(nl.NewRtAttr(rtaNhID, nl.Uint32Attr(nhid)))
+		return req, nil
+	}
+
+	// ECMPはNetlinkFibと同じくRTA_MULTIPATHで全部のnexthopを入れる
+	if paths := fibPaths(rt); len(paths) >= 2 {
+		mp, err := fibMultipath(rt, paths, family)
+		if err != nil {
+			return nil, err
+		}
+		req.AddData(nl.NewRtAttr(syscall.RTA_MULTIPATH, mp))
+		return req, nil
+	}
+
+	if nh := fibNexthop(rt); nh != nil {
+		gw, err := fibGateway(rt, nh, family)
+		if err != nil {
+			return nil, err
+		}
+		req.AddData(nl.NewRtAttr(syscall.RTA_GATEWAY, gw))
+	}
+	if rt.Index != 0 {
+		req.AddData(nl.NewRtAttr(syscall.RTA_OIF, nl.Uint32Attr(uint32(rt.Index))))
+	}
+	return req, nil
+}
+
+func fibGateway(rt *RIBPrefix, nh net.IP, family int) (net.IP, error) {
+	gw := nh.To4()
+	if family == nl.FAMILY_V6 {
+		gw = nh.To16()
+	}
+	if gw == nil {
+		return nil, fmt.Errorf("fib: %s: nexthop %s family mismatch", memPrefix(rt), nh.String())
+	}
+	return gw, nil
+}
+
+// fibMultipath はRTA_MULTIPATHの中身を作る
+// rtnexthop len(2) flags(1) hops(1) ifindex(4) のあとにRTA_GATEWAYが続くのを繰り返す
+func fibMultipath(rt *RIBPrefix, paths []RIBNexthop, family int) ([]byte, error) {
+	var buf []byte
+	for _, p := range paths {
+		gw, err := fibGateway(rt, p.Resolved, family)
+		if err != nil {
+			return nil, err
+		}
+		attr := nl.NewRtAttr(syscall.RTA_GATEWAY, gw).Serialize()
+
+		rtnh := make([]byte, 8)
+		nl.NativeEndian().PutUint16(rtnh[0:2], uint16(len(rtnh)+len(attr)))
+		nl.NativeEndian().PutUint32(rtnh[4:8], uint32(p.Index))
+		buf = append(buf, rtnh...)
+		buf = append(buf, attr...)
+	}
+	return buf, nil
+}
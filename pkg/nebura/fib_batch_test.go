@@ -0,0 +1,234 @@
+package nebura
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// fakeFibSock は送ったリクエストを溜めて、ACKはテストから入れる
+type fakeFibSock struct {
+	sent chan *nl.NetlinkRequest
+	recv chan []syscall.NetlinkMessage
+	errs chan error
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func fakeFibSockInit() *fakeFibSock {
+	return &fakeFibSock{
+		sent: make(chan *nl.NetlinkRequest, 2*fibBatchWindow),
+		recv: make(chan []syscall.NetlinkMessage, 16),
+		errs: make(chan error, 1),
+	}
+}
+
+func (s *fakeFibSock) Send(req *nl.NetlinkRequest) error {
+	s.sent <- req
+	return nil
+}
+
+func (s *fakeFibSock) Receive() ([]syscall.NetlinkMessage, error) {
+	select {
+	case msgs := <-s.recv:
+		return msgs, nil
+	case err := <-s.errs:
+		return nil, err
+	}
+}
+
+func (s *fakeFibSock) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+func (s *fakeFibSock) ack(seq uint32, errno syscall.Errno) {
+	data := make([]byte, 4)
+	nl.NativeEndian().PutUint32(data, uint32(-int32(errno)))
+	s.recv <- []syscall.NetlinkMessage{{
+		Header: syscall.NlMsghdr{Type: syscall.NLMSG_ERROR, Seq: seq},
+		Data:   data,
+	}}
+}
+
+func (s *fakeFibSock) next(t *testing.T) *nl.NetlinkRequest {
+	t.Helper()
+	select {
+	case req := <-s.sent:
+		return req
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no request sent")
+	}
+	return nil
+}
+
+func (s *fakeFibSock) idle(t *testing.T) {
+	t.Helper()
+	select {
+	case req := <-s.sent:
+		t.Fatalf("unexpected request type %d", req.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type fibBatchResult struct {
+	rt  RIBPrefix
+	add bool
+	err error
+}
+
+func batchFibTest(sock *fakeFibSock, open func() (fibSocket, error)) (*BatchFib, chan fibBatchResult) {
+	results := make(chan fibBatchResult, 2*fibBatchWindow)
+	f := batchFibInit(sock, open, nil)
+	f.SetResultHook(func(rt RIBPrefix, add bool, err error) {
+		results <- fibBatchResult{rt, add, err}
+	})
+	return f, results
+}
+
+func batchFibRoute(prefix string, nexthop string) *RIBPrefix {
+	_, dst, _ := net.ParseCIDR(prefix)
+	plen, _ := dst.Mask.Size()
+	return &RIBPrefix{
+		Prefix:          dst.IP,
+		PrefixLen:       uint8(plen),
+		Nexthop:         net.ParseIP(nexthop).To4(),
+		Resolved:        net.ParseIP(nexthop).To4(),
+		Index:           2,
+		RoutingProtocol: "BGP",
+	}
+}
+
+func batchFibResult(t *testing.T, results chan fibBatchResult) fibBatchResult {
+	t.Helper()
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no result reported")
+	}
+	return fibBatchResult{}
+}
+
+// 送る前にまとめられた書き込みもhookに返る
+func TestBatchFibCoalesce(t *testing.T) {
+	sock := fakeFibSockInit()
+	f, results := batchFibTest(sock, nil)
+
+	f.RouteAdd(batchFibRoute("192.0.2.0/24", "10.0.0.1"))
+	f.RouteAdd(batchFibRoute("192.0.2.0/24", "10.0.0.2"))
+	f.RouteAdd(batchFibRoute("198.51.100.0/24", "10.0.0.1"))
+	f.RouteDelete(batchFibRoute("198.51.100.0/24", "10.0.0.1"))
+	go f.writeLoop()
+	go f.ackLoop()
+
+	// 順番は最初に積んだprefixの順
+	r := batchFibResult(t, results)
+	if !errors.Is(r.err, ErrFibSuperseded) || !r.add || !r.rt.Nexthop.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("first add reported %v %v via %s, want superseded", r.err, r.add, r.rt.Nexthop)
+	}
+	add := sock.next(t)
+	if add.Type != syscall.RTM_NEWROUTE {
+		t.Errorf("request type %d, want RTM_NEWROUTE", add.Type)
+	}
+
+	r = batchFibResult(t, results)
+	if !errors.Is(r.err, ErrFibSuperseded) || !r.add || r.rt.PrefixLen != 24 ||
+		!r.rt.Prefix.Equal(net.ParseIP("198.51.100.0")) {
+		t.Errorf("add before delete reported %v %v %s, want superseded", r.err, r.add, memPrefix(&r.rt))
+	}
+	del := sock.next(t)
+	if del.Type != syscall.RTM_DELROUTE {
+		t.Errorf("request type %d, want RTM_DELROUTE", del.Type)
+	}
+	sock.idle(t)
+
+	sock.ack(add.Seq, 0)
+	r = batchFibResult(t, results)
+	if r.err != nil || !r.add || !r.rt.Nexthop.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("last add reported %v %v via %s, want success via 10.0.0.2", r.err, r.add, r.rt.Nexthop)
+	}
+	// addは入っていなかったのでkernelはESRCHを返すが、消えているので成功
+	sock.ack(del.Seq, syscall.ESRCH)
+	if r = batchFibResult(t, results); r.err != nil || r.add {
+		t.Errorf("delete reported %v %v, want success", r.err, r.add)
+	}
+}
+
+// ACKを待っている書き込みがwindowを超えたら、ACKが来るまで次を送らない
+func TestBatchFibWindow(t *testing.T) {
+	sock := fakeFibSockInit()
+	f, results := batchFibTest(sock, nil)
+
+	for i := 0; i <= fibBatchWindow; i++ {
+		f.RouteAdd(batchFibRoute(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256), "192.0.2.1"))
+	}
+	go f.writeLoop()
+	go f.ackLoop()
+
+	var reqs []*nl.NetlinkRequest
+	for i := 0; i < fibBatchWindow; i++ {
+		reqs = append(reqs, sock.next(t))
+	}
+	sock.idle(t)
+
+	sock.ack(reqs[0].Seq, syscall.EEXIST)
+	if r := batchFibResult(t, results); !errors.Is(r.err, syscall.EEXIST) {
+		t.Errorf("result %v, want EEXIST", r.err)
+	}
+	last := sock.next(t)
+
+	for _, req := range append(reqs[1:], last) {
+		sock.ack(req.Seq, 0)
+	}
+	for i := 0; i < fibBatchWindow; i++ {
+		if r := batchFibResult(t, results); r.err != nil {
+			t.Errorf("result %s %v", memPrefix(&r.rt), r.err)
+		}
+	}
+}
+
+// 受信できなくなったらsocketを開き直し、ACKを待っていた書き込みは失敗にする
+func TestBatchFibReopen(t *testing.T) {
+	sock := fakeFibSockInit()
+	sock2 := fakeFibSockInit()
+	open := func() (fibSocket, error) { return sock2, nil }
+	f, results := batchFibTest(sock, open)
+
+	f.RouteAdd(batchFibRoute("192.0.2.0/24", "10.0.0.1"))
+	f.RouteDelete(batchFibRoute("198.51.100.0/24", "10.0.0.1"))
+	go f.writeLoop()
+	go f.ackLoop()
+	sock.next(t)
+	sock.next(t)
+
+	sock.errs <- syscall.ENOBUFS
+	for i := 0; i < 2; i++ {
+		if r := batchFibResult(t, results); !errors.Is(r.err, syscall.ENOBUFS) {
+			t.Errorf("pending %s reported %v, want ENOBUFS", memPrefix(&r.rt), r.err)
+		}
+	}
+	sock.mu.Lock()
+	closed := sock.closed
+	sock.mu.Unlock()
+	if !closed {
+		t.Errorf("old socket not closed")
+	}
+
+	// windowは空いていて、次は新しいsocketに送る
+	f.RouteAdd(batchFibRoute("203.0.113.0/24", "10.0.0.1"))
+	req := sock2.next(t)
+	sock.idle(t)
+	sock2.ack(req.Seq, 0)
+	if r := batchFibResult(t, results); r.err != nil {
+		t.Errorf("write after reopen: %v", r.err)
+	}
+}
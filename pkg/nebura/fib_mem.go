@@ -0,0 +1,266 @@
+package nebura
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// MemFib はkernelを触らずに書き込みを記録する、テストやdry-run用
+type MemFib struct {
+	mu     sync.Mutex
+	ops    []FibOp
+	routes map[string]RIBPrefix
+	seg6   map[string]Seg6Route
+	local  map[string]Seg6LocalRoute
+	mpls   map[uint32]MplsLabelRoute
+	push   map[string]MplsPushRoute
+	vrfs   map[string]int
+	rules  map[string]PbrRule
+}
+
+// FibOp はMemFibに来た書き込み1つ
+type FibOp struct {
+	Op    string // "route add", "seg6 delete" など
+	Key   string // prefix, SID, interfaceのindex
+	Value string
+}
+
+func MemFibInit() *MemFib {
+	return &MemFib{
+		routes: make(map[string]RIBPrefix),
+		seg6:   make(map[string]Seg6Route),
+		local:  make(map[string]Seg6LocalRoute),
+		mpls:   make(map[uint32]MplsLabelRoute),
+		push:   make(map[string]MplsPushRoute),
+		vrfs:   make(map[string]int),
+		rules:  make(map[string]PbrRule),
+	}
+}
+
+func (f *MemFib) record(op, key, value string) {
+	f.ops = append(f.ops, FibOp{Op: op, Key: key, Value: value})
+	log.Printf("FIB(mem) %s %s %s\n", op, key, value)
+}
+
+// Ops は今までの書き込みを順番に返す
+func (f *MemFib) Ops() []FibOp {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	return append([]FibOp(nil), f.ops...)
+}
+
+// Routes は今入っている経路を返す
+func (f *MemFib) Routes() []RIBPrefix {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	var routes []RIBPrefix
+	for _, v := range f.routes {
+		routes = append(routes, v)
+	}
+	return routes
+}
+
+// memPrefix はデフォルト以外のVRFの経路には"vrf ID "を付ける
+func memPrefix(rt *RIBPrefix) string {
+	if rt.VrfID != VrfDefault {
+		return fmt.Sprintf("vrf %d %s/%d", rt.VrfID, rt.Prefix.String(), rt.PrefixLen)
+	}
+	return fmt.Sprintf("%s/%d", rt.Prefix.String(), rt.PrefixLen)
+}
+
+func (f *MemFib) RouteAdd(rt *RIBPrefix) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	key := memPrefix(rt)
+	f.routes[key] = *rt
+	var via []string
+	for _, p := range fibPaths(rt) {
+		via = append(via, p.Resolved.String())
+	}
+	f.record("route add", key, strings.Join(via, ","))
+	return nil
+}
+
+func (f *MemFib) RouteDelete(rt *RIBPrefix) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	key := memPrefix(rt)
+	if _, ok := f.routes[key]; !ok {
+		return fmt.Errorf("fib: delete %s: %w", key, ErrRouteNotFound)
+	}
+	delete(f.routes, key)
+	f.record("route delete", key, "")
+	return nil
+}
+
+func (f *MemFib) Seg6Add(rt *Seg6Route) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	key := seg6Key(rt.Prefix, rt.PrefixLen)
+	f.seg6[key] = *rt
+	f.record("seg6 add", key, seg6ModeString(rt.Mode)+" "+seg6SegsString(rt.Segs))
+	return nil
+}
+
+func (f *MemFib) Seg6Delete(rt *Seg6Route) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	key := seg6Key(rt.Prefix, rt.PrefixLen)
+	if _, ok := f.seg6[key]; !ok {
+		return fmt.Errorf("fib: seg6 delete %s: %w", key, ErrRouteNotFound)
+	}
+	delete(f.seg6, key)
+	f.record("seg6 delete", key, "")
+	return nil
+}
+
+func (f *MemFib) Seg6LocalAdd(rt *Seg6LocalRoute) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	if rt.EndAction != EndDX4 {
+		return fmt.Errorf("seg6local: unsupported end action %d", rt.EndAction)
+	}
+	key := rt.Sid.String()
+	f.local[key] = *rt
+	f.record("seg6local add", key, rt.Nexthop.String())
+	return nil
+}
+
+func (f *MemFib) Seg6LocalDelete(rt *Seg6LocalRoute) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	key := rt.Sid.String()
+	if _, ok := f.local[key]; !ok {
+		return fmt.Errorf("fib: seg6local delete %s: %w", key, ErrRouteNotFound)
+	}
+	delete(f.local, key)
+	f.record("seg6local delete", key, "")
+	return nil
+}
+
+func (f *MemFib) MplsAdd(rt *MplsLabelRoute) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	f.mpls[rt.Label] = *rt
+	f.record("mpls add", fmt.Sprint(rt.Label), rt.String())
+	return nil
+}
+
+func (f *MemFib) MplsDelete(rt *MplsLabelRoute) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	if _, ok := f.mpls[rt.Label]; !ok {
+		return fmt.Errorf("fib: mpls delete %d: %w", rt.Label, ErrRouteNotFound)
+	}
+	delete(f.mpls, rt.Label)
+	f.record("mpls delete", fmt.Sprint(rt.Label), "")
+	return nil
+}
+
+func (f *MemFib) MplsPushAdd(rt *MplsPushRoute) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	key := mplsPushKey(rt.Prefix, rt.PrefixLen)
+	f.push[key] = *rt
+	f.record("mpls push add", key, rt.String())
+	return nil
+}
+
+func (f *MemFib) MplsPushDelete(rt *MplsPushRoute) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	key := mplsPushKey(rt.Prefix, rt.PrefixLen)
+	if _, ok := f.push[key]; !ok {
+		return fmt.Errorf("fib: mpls push delete %s: %w", key, ErrRouteNotFound)
+	}
+	delete(f.push, key)
+	f.record("mpls push delete", key, "")
+	return nil
+}
+
+func (f *MemFib) NetemAdd(index int, latency string) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	if _, err := netemLatency(latency); err != nil {
+		return err
+	}
+	f.record("netem add", fmt.Sprint(index), latency)
+	return nil
+}
+
+func (f *MemFib) XdpAttach(index int, prog uint8) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	if prog != XdpDrop {
+		return fmt.Errorf("xdp: unknown program %d", prog)
+	}
+	f.record("xdp attach", fmt.Sprint(index), fmt.Sprint(prog))
+	return nil
+}
+
+// VrfAdd はkernelのindexの代わりにtableを返す
+func (f *MemFib) VrfAdd(name string, table uint32) (int, error) {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	f.vrfs[name] = int(table)
+	f.record("vrf add", name, fmt.Sprint(table))
+	return int(table), nil
+}
+
+func (f *MemFib) VrfDelete(name string) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	if _, ok := f.vrfs[name]; !ok {
+		return fmt.Errorf("fib: vrf delete %s: %w", name, ErrVrfNotFound)
+	}
+	delete(f.vrfs, name)
+	f.record("vrf delete", name, "")
+	return nil
+}
+
+func (f *MemFib) VrfBind(index int, vrfIndex int) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	f.record("vrf bind", fmt.Sprint(index), fmt.Sprint(vrfIndex))
+	return nil
+}
+
+func (f *MemFib) RuleAdd(p *PbrRule) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	f.rules[p.String()] = *p
+	f.record("rule add", fmt.Sprint(p.Priority), p.String())
+	return nil
+}
+
+func (f *MemFib) RuleDelete(p *PbrRule) error {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	if _, ok := f.rules[p.String()]; !ok {
+		return fmt.Errorf("fib: rule delete %s: %w", p.String(), ErrRouteNotFound)
+	}
+	delete(f.rules, p.String())
+	f.record("rule delete", fmt.Sprint(p.Priority), p.String())
+	return nil
+}
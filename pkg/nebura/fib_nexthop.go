@@ -0,0 +1,353 @@
+package nebura
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// kernelのnexthop object (Linux 5.3以降)
+// 経路はnexthopを直接持たずにNHA_IDでobjectを指す
+// objectはプロトコルとnexthopごとに1つ作るので、nexthopの解決が変わってもobjectを1つ書き換えるだけで済む
+// ECMPの経路はobjectをまとめたgroupを指す
+
+// vishvananda/netlink v1.1.0にないので定義する
+const (
+	rtmNewNexthop = 104
+	rtmDelNexthop = 105
+	rtmGetNexthop = 106
+
+	nhaID      = 1
+	nhaGroup   = 2
+	nhaOif     = 5
+	nhaGateway = 6
+
+	rtaNhID = 30
+)
+
+// nhMsg はstruct nhmsg
+type nhMsg struct {
+	Family   uint8
+	Scope    uint8
+	Protocol uint8
+	Resvd    uint8
+	Flags    uint32
+}
+
+func (m *nhMsg) Len() int {
+	return 8
+}
+
+func (m *nhMsg) Serialize() []byte {
+	b := make([]byte, 8)
+	b[0], b[1], b[2], b[3] = m.Family, m.Scope, m.Protocol, m.Resvd
+	nl.NativeEndian().PutUint32(b[4:], m.Flags)
+	return b
+}
+
+// fibNexthopObj はkernelに入れたnexthop object、membersがあればgroup
+type fibNexthopObj struct {
+	id      uint32
+	key     string
+	gw      net.IP
+	index   int
+	members []*fibNexthopObj
+	refs    int // 指している経路とgroupの数
+}
+
+func (obj *fibNexthopObj) String() string {
+	if obj.members != nil {
+		return fmt.Sprintf("nhid %d group", obj.id)
+	}
+	return fmt.Sprintf("nhid %d via %s dev %d", obj.id, obj.gw.String(), obj.index)
+}
+
+// fibNexthopTable はBatchFibのwriteLoopから使う、ACKの失敗はackLoopから来る
+type fibNexthopTable struct {
+	mu     sync.Mutex
+	nextID uint32
+	objs   map[string]*fibNexthopObj
+	routes map[string]*fibNexthopObj // 経路のprefixと指しているobject
+	dirty  map[string]bool           // kernelと違うかもしれないので次は必ず書く経路
+	stale  []uint32                  // 前に動いていたneburaが残したobject
+}
+
+// fibNexthopTableInit はkernelのobjectをdumpして、使われていないIDから使う
+// kernelがnexthop objectを知らなければエラーを返す
+func fibNexthopTableInit() (*fibNexthopTable, error) {
+	req := nl.NewNetlinkRequest(rtmGetNexthop, syscall.NLM_F_DUMP)
+	req.AddData(&nhMsg{})
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, rtmNewNexthop)
+	if err != nil {
+		return nil, fmt.Errorf("fib: nexthop dump: %w", err)
+	}
+
+	t := &fibNexthopTable{
+		nextID: 1,
+		objs:   make(map[string]*fibNexthopObj),
+		routes: make(map[string]*fibNexthopObj),
+		dirty:  make(map[string]bool),
+	}
+	for _, m := range msgs {
+		if len(m) < 8 {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[8:])
+		if err != nil {
+			continue
+		}
+		for _, a := range attrs {
+			if a.Attr.Type != nhaID || len(a.Value) != 4 {
+				continue
+			}
+			id := nl.NativeEndian().Uint32(a.Value)
+			if id >= t.nextID {
+				t.nextID = id + 1
+			}
+			if m[2] == rtprotNebura {
+				t.stale = append(t.stale, id)
+			}
+		}
+	}
+	return t, nil
+}
+
+func (t *fibNexthopTable) alloc() uint32 {
+	id := t.nextID
+	t.nextID++
+	return id
+}
+
+// single はrtと同じVRF、同じプロトコルの経路がpに使うobjectを返す、作ったか中身を変えたらtrue
+func (t *fibNexthopTable) single(rt *RIBPrefix, p RIBNexthop) (*fibNexthopObj, bool) {
+	key := fmt.Sprintf("%d %s %s", rt.VrfID, rt.RoutingProtocol, p.Nexthop.String())
+
+	obj, ok := t.objs[key]
+	if !ok {
+		obj = &fibNexthopObj{id: t.alloc(), key: key, gw: p.Resolved, index: p.Index}
+		t.objs[key] = obj
+		return obj, true
+	}
+	if obj.gw.Equal(p.Resolved) && obj.index == p.Index {
+		return obj, false
+	}
+
+	// 同じobjectを指している経路はこれだけで全部変わる
+	obj.gw, obj.index = p.Resolved, p.Index
+	return obj, true
+}
+
+// group はmembersをまとめたobjectを返す、作ったらtrue
+func (t *fibNexthopTable) group(members []*fibNexthopObj) (*fibNexthopObj, bool) {
+	var ids []string
+	for _, m := range members {
+		ids = append(ids, fmt.Sprint(m.id))
+	}
+	sort.Strings(ids)
+	key := "group " + strings.Join(ids, ",")
+
+	if obj, ok := t.objs[key]; ok {
+		return obj, false
+	}
+	obj := &fibNexthopObj{id: t.alloc(), key: key, members: members}
+	for _, m := range members {
+		m.refs++
+	}
+	t.objs[key] = obj
+	return obj, true
+}
+
+// release はobjを指すものが1つ減った時に呼び、消すobjectを消す順に返す
+func (t *fibNexthopTable) release(obj *fibNexthopObj) []*fibNexthopObj {
+	if obj == nil {
+		return nil
+	}
+	obj.refs--
+	if obj.refs > 0 {
+		return nil
+	}
+
+	// dropした後なら同じkeyで作り直したobjectが入っている
+	if t.objs[obj.key] == obj {
+		delete(t.objs, obj.key)
+	}
+	del := []*fibNexthopObj{obj}
+	for _, m := range obj.members {
+		del = append(del, t.release(m)...)
+	}
+	return del
+}
+
+// update は経路を書く前に呼ぶ
+// 経路が指すID、経路より先に書くobject、経路の後に消すobject、経路を書く必要があるかを返す
+func (t *fibNexthopTable) update(rt *RIBPrefix, add bool) (uint32, []*fibNexthopObj, []*fibNexthopObj, bool) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	key := memPrefix(rt)
+	old := t.routes[key]
+	dirty := t.dirty[key]
+	delete(t.dirty, key)
+
+	paths := fibPaths(rt)
+	if !add || rt.Nexthop == nil || len(paths) == 0 {
+		// objectを指している経路はgatewayを付けて消そうとしてもマッチしない
+		var id uint32
+		if !add && old != nil {
+			id = old.id
+		}
+		delete(t.routes, key)
+		return id, nil, t.release(old), true
+	}
+
+	var before, members []*fibNexthopObj
+	for _, p := range paths {
+		obj, changed := t.single(rt, p)
+		if changed {
+			before = append(before, obj)
+		}
+		members = append(members, obj)
+	}
+
+	obj := members[0]
+	if len(members) > 1 {
+		g, created := t.group(members)
+		if created {
+			before = append(before, g)
+		}
+		obj = g
+	}
+
+	if obj == old {
+		return obj.id, before, nil, dirty
+	}
+	obj.refs++
+	t.routes[key] = obj
+	return obj.id, before, t.release(old), true
+}
+
+// drop は書き込めなかったobjectを忘れて、次に使う時に作り直す
+func (t *fibNexthopTable) drop(obj *fibNexthopObj) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	if t.objs[obj.key] == obj {
+		delete(t.objs, obj.key)
+	}
+}
+
+// forget は経路がkernelにないかもしれない時に呼ぶ、次のRouteAddで必ず書く
+func (t *fibNexthopTable) forget(rt *RIBPrefix) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	t.dirty[memPrefix(rt)] = true
+}
+
+func fibNexthopRequest(obj *fibNexthopObj, add bool) *nl.NetlinkRequest {
+	if !add {
+		req := nl.NewNetlinkRequest(rtmDelNexthop, syscall.NLM_F_ACK)
+		req.AddData(&nhMsg{})
+		req.AddData(nl.NewRtAttr(nhaID, nl.Uint32Attr(obj.id)))
+		return req
+	}
+
+	req := nl.NewNetlinkRequest(rtmNewNexthop, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE|syscall.NLM_F_ACK)
+	msg := &nhMsg{Protocol: rtprotNebura}
+
+	if obj.members != nil {
+		// groupのfamilyはAF_UNSPEC、weightは0で1
+		var grp []byte
+		for _, m := range obj.members {
+			b := make([]byte, 8)
+			nl.NativeEndian().PutUint32(b, m.id)
+			grp = append(grp, b...)
+		}
+		req.AddData(msg)
+		req.AddData(nl.NewRtAttr(nhaID, nl.Uint32Attr(obj.id)))
+		req.AddData(nl.NewRtAttr(nhaGroup, grp))
+		return req
+	}
+
+	gw := obj.gw.To4()
+	msg.Family = nl.FAMILY_V4
+	if gw == nil {
+		gw = obj.gw.To16()
+		msg.Family = nl.FAMILY_V6
+	}
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(nhaID, nl.Uint32Attr(obj.id)))
+	req.AddData(nl.NewRtAttr(nhaGateway, gw))
+	req.AddData(nl.NewRtAttr(nhaOif, nl.Uint32Attr(uint32(obj.index))))
+	return req
+}
+
+// sendNexthop はobjectの追加か削除をACKを待たずに送る
+func (f *BatchFib) sendNexthop(obj *fibNexthopObj, add bool) {
+	if add {
+		log.Printf("FIB nexthop add %s\n", obj.String())
+	} else {
+		log.Printf("FIB nexthop delete %s\n", obj.String())
+	}
+	f.write(&fibBatchOp{nh: obj, add: add}, fibNexthopRequest(obj, add))
+}
+
+func (f *BatchFib) nexthopResult(op *fibBatchOp, errno syscall.Errno) {
+	switch {
+	case errno == 0:
+		return
+	case !op.add && errno == syscall.ENOENT:
+		return
+	}
+
+	log.Printf("FIB nexthop %s: %v", op.nh.String(), errno)
+	if op.add {
+		f.nh.drop(op.nh)
+	}
+}
+
+// forget はkernelから消された経路を入れ直す前に呼ぶ
+func (f *BatchFib) forget(rt *RIBPrefix) {
+	if f.nh != nil {
+		f.nh.forget(rt)
+	}
+}
+
+func (f *BatchFib) staleNexthops() int {
+	if f.nh == nil {
+		return 0
+	}
+	return len(f.nh.stale)
+}
+
+// nexthopReconcile は前のneburaが残したobjectを消す
+// 残っていた経路は入れ直したか消したので、もう指されていない
+func (f *BatchFib) nexthopReconcile() int {
+	if f.nh == nil {
+		return 0
+	}
+
+	var cnt int
+	for _, id := range f.nh.stale {
+		req := nl.NewNetlinkRequest(rtmDelNexthop, syscall.NLM_F_ACK)
+		req.AddData(&nhMsg{})
+		req.AddData(nl.NewRtAttr(nhaID, nl.Uint32Attr(id)))
+		if _, err := req.Execute(syscall.NETLINK_ROUTE, 0); err != nil {
+			if !errors.Is(err, syscall.ENOENT) {
+				log.Printf("FIB reconcile nhid %d: %v", id, err)
+			}
+			continue
+		}
+		cnt++
+	}
+	f.nh.stale = nil
+	return cnt
+}
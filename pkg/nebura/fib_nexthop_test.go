@@ -0,0 +1,155 @@
+package nebura
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func fibNexthopTableTest() *fibNexthopTable {
+	return &fibNexthopTable{
+		nextID: 1,
+		objs:   make(map[string]*fibNexthopObj),
+		routes: make(map[string]*fibNexthopObj),
+		dirty:  make(map[string]bool),
+	}
+}
+
+// fibNexthopRoute はnexthopsで解決済みの経路、2つ以上ならECMP
+// 10.0.X.1のinterfaceはX+2にする
+func fibNexthopRoute(prefix string, proto string, nexthops ...string) *RIBPrefix {
+	rt := batchFibRoute(prefix, nexthops[0])
+	rt.RoutingProtocol = proto
+	rt.Index = int(rt.Nexthop[2]) + 2
+	for _, nh := range nexthops[1:] {
+		ip := net.ParseIP(nh).To4()
+		rt.Multipath = append(rt.Multipath, RIBNexthop{Nexthop: ip, Resolved: ip, Index: int(ip[2]) + 2})
+	}
+	return rt
+}
+
+func fibNexthopIDs(objs []*fibNexthopObj) string {
+	var ids []uint32
+	for _, obj := range objs {
+		ids = append(ids, obj.id)
+	}
+	return fmt.Sprint(ids)
+}
+
+// fibNexthopUpdate はupdateの結果が期待通りか確かめて経路が指すIDを返す
+func fibNexthopUpdate(t *testing.T, nt *fibNexthopTable, rt *RIBPrefix, add bool,
+	before string, after string, changed bool) uint32 {
+	t.Helper()
+	id, b, a, c := nt.update(rt, add)
+	if fibNexthopIDs(b) != before || fibNexthopIDs(a) != after || c != changed {
+		t.Errorf("%s add %v: before %s after %s changed %v, want %s %s %v", memPrefix(rt), add,
+			fibNexthopIDs(b), fibNexthopIDs(a), c, before, after, changed)
+	}
+	return id
+}
+
+// 同じプロトコルとnexthopの経路は1つのobjectを共有し、最後の経路が消えたらobjectも消す
+func TestFibNexthopShare(t *testing.T) {
+	nt := fibNexthopTableTest()
+	a := fibNexthopRoute("198.51.100.0/24", "BGP", "10.0.0.1")
+	b := fibNexthopRoute("203.0.113.0/24", "BGP", "10.0.0.1")
+
+	if id := fibNexthopUpdate(t, nt, a, true, "[1]", "[]", true); id != 1 {
+		t.Errorf("route a nhid %d, want 1", id)
+	}
+	if id := fibNexthopUpdate(t, nt, b, true, "[]", "[]", true); id != 1 {
+		t.Errorf("route b nhid %d, want 1", id)
+	}
+	if refs := nt.objs["0 BGP 10.0.0.1"].refs; refs != 2 {
+		t.Errorf("refs %d, want 2", refs)
+	}
+
+	// 同じなら書かない、forgetした後は書く
+	fibNexthopUpdate(t, nt, a, true, "[]", "[]", false)
+	nt.forget(a)
+	fibNexthopUpdate(t, nt, a, true, "[]", "[]", true)
+
+	// 別のプロトコルは別のobject
+	ospf := fibNexthopRoute("192.0.2.0/24", "ospf", "10.0.0.1")
+	if id := fibNexthopUpdate(t, nt, ospf, true, "[2]", "[]", true); id != 2 {
+		t.Errorf("ospf route nhid %d, want 2", id)
+	}
+
+	// 解決が変わったらobjectだけ書き換えて、経路は書かない
+	a.Resolved = net.ParseIP("10.0.1.1").To4()
+	a.Index = 3
+	fibNexthopUpdate(t, nt, a, true, "[1]", "[]", false)
+	if obj := nt.objs["0 BGP 10.0.0.1"]; !obj.gw.Equal(a.Resolved) || obj.index != 3 {
+		t.Errorf("object %s, want via 10.0.1.1 dev 3", obj)
+	}
+
+	// 削除はobjectのIDで消す
+	if id := fibNexthopUpdate(t, nt, a, false, "[]", "[]", true); id != 1 {
+		t.Errorf("delete nhid %d, want 1", id)
+	}
+	fibNexthopUpdate(t, nt, b, false, "[]", "[1]", true)
+	fibNexthopUpdate(t, nt, ospf, false, "[]", "[2]", true)
+	if len(nt.objs) != 0 || len(nt.routes) != 0 {
+		t.Errorf("left objects %v routes %v", nt.objs, nt.routes)
+	}
+}
+
+// ECMPの経路はgroupを指し、groupはmemberのobjectを指す
+func TestFibNexthopGroup(t *testing.T) {
+	nt := fibNexthopTableTest()
+	c := fibNexthopRoute("198.51.100.0/24", "BGP", "10.0.0.1", "10.0.1.1")
+	d := fibNexthopRoute("203.0.113.0/24", "BGP", "10.0.1.1", "10.0.0.1")
+
+	// memberを先に作ってからgroup
+	if id := fibNexthopUpdate(t, nt, c, true, "[1 2 3]", "[]", true); id != 3 {
+		t.Errorf("route c nhid %d, want group 3", id)
+	}
+	// memberの順番が違っても同じgroup
+	if id := fibNexthopUpdate(t, nt, d, true, "[]", "[]", true); id != 3 {
+		t.Errorf("route d nhid %d, want group 3", id)
+	}
+	g := nt.objs["group 1,2"]
+	if g == nil || g.refs != 2 {
+		t.Fatalf("group %v, want 2 refs", g)
+	}
+	for _, m := range g.members {
+		if m.refs != 1 {
+			t.Errorf("member %s refs %d, want 1", m, m.refs)
+		}
+	}
+
+	// groupからsingleに移っても、groupはdがまだ使っている
+	single := fibNexthopRoute("198.51.100.0/24", "BGP", "10.0.0.1")
+	if id := fibNexthopUpdate(t, nt, single, true, "[]", "[]", true); id != 1 {
+		t.Errorf("route c nhid %d, want 1", id)
+	}
+
+	// groupを先に消して、どこからも指されなくなったmemberを後に消す
+	fibNexthopUpdate(t, nt, d, false, "[]", "[3 2]", true)
+	if _, ok := nt.objs["0 BGP 10.0.0.1"]; !ok {
+		t.Errorf("member still used by route c removed")
+	}
+	fibNexthopUpdate(t, nt, single, false, "[]", "[1]", true)
+	if len(nt.objs) != 0 {
+		t.Errorf("left objects %v", nt.objs)
+	}
+}
+
+// 書き込めなかったobjectを忘れた後、古いobjectの解放で作り直したobjectは消えない
+func TestFibNexthopDrop(t *testing.T) {
+	nt := fibNexthopTableTest()
+	a := fibNexthopRoute("198.51.100.0/24", "BGP", "10.0.0.1")
+	b := fibNexthopRoute("203.0.113.0/24", "BGP", "10.0.0.1")
+	e := fibNexthopRoute("192.0.2.0/24", "BGP", "10.0.0.1")
+
+	fibNexthopUpdate(t, nt, a, true, "[1]", "[]", true)
+	nt.drop(nt.objs["0 BGP 10.0.0.1"])
+	if id := fibNexthopUpdate(t, nt, b, true, "[2]", "[]", true); id != 2 {
+		t.Errorf("route b nhid %d, want new object 2", id)
+	}
+
+	fibNexthopUpdate(t, nt, a, false, "[]", "[1]", true)
+	if id := fibNexthopUpdate(t, nt, e, true, "[]", "[]", true); id != 2 {
+		t.Errorf("route e nhid %d, want shared object 2", id)
+	}
+}
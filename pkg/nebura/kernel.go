@@ -0,0 +1,521 @@
+package nebura
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// kernelのrouting tableをnetlinkで監視する
+// kernelとconnectedの経路はRibに取り込み、neburaが入れた経路が消されたら入れ直す
+// main tableはデフォルトのVRF、それ以外はtableと同じIDのVRFのRibに取り込む
+
+// neburaが入れる経路のprotocol (RTPROT_BGP)
+const rtprotNebura = 0xba
+
+type (
+	// NservKernelRoute はkernelの経路の変更
+	NservKernelRoute struct {
+		u netlink.RouteUpdate
+	}
+	// NservKernelLink はinterfaceの状態の変更
+	NservKernelLink struct {
+		u netlink.LinkUpdate
+	}
+	// NservKernelAddr はinterfaceのアドレスの変更
+	NservKernelAddr struct {
+		u netlink.AddrUpdate
+	}
+	// NservKernelRule はpolicy routingのruleの変更
+	NservKernelRule struct {
+		u pbrRuleUpdate
+	}
+	// NservKernelResync は監視を始めた時にdumpしたkernelの経路
+	NservKernelResync struct {
+		routes []netlink.Route
+	}
+)
+
+// KernelMonitorStart はroute, link, addr, ruleのgroupをsubscribeしてイベントとして渡す
+// subscribeしてから今の経路をdumpして取り込み、dumpになかったkernelの経路は消す
+func (n *Nserver) KernelMonitorStart() error {
+	done := make(chan struct{})
+
+	routes := make(chan netlink.RouteUpdate, 64)
+	links := make(chan netlink.LinkUpdate, 64)
+	addrs := make(chan netlink.AddrUpdate, 64)
+	rules := make(chan pbrRuleUpdate, 64)
+
+	cberr := func(err error) {
+		log.Printf("kernel monitor: %v", err)
+	}
+
+	err := netlink.RouteSubscribeWithOptions(routes, done, netlink.RouteSubscribeOptions{
+		ErrorCallback: cberr,
+	})
+	if err != nil {
+		return err
+	}
+	err = netlink.LinkSubscribeWithOptions(links, done, netlink.LinkSubscribeOptions{
+		ErrorCallback: cberr,
+	})
+	if err != nil {
+		close(done)
+		return err
+	}
+	err = netlink.AddrSubscribeWithOptions(addrs, done, netlink.AddrSubscribeOptions{
+		ErrorCallback: cberr,
+	})
+	if err != nil {
+		close(done)
+		return err
+	}
+	if err = pbrRuleSubscribe(rules, done); err != nil {
+		close(done)
+		return err
+	}
+
+	// ListExistingのdumpは終わりが分からないので自分でdumpする
+	// dump中の変更はsubscribeした方に溜まっていて、resyncの後に処理される
+	dump, err := netlink.RouteListFiltered(netlink.FAMILY_ALL,
+		&netlink.Route{Table: syscall.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		close(done)
+		return err
+	}
+	n.ceventChan <- NservKernelResync{dump}
+
+	go func() {
+		n.kernelMonitor(routes, links, addrs, rules)
+		close(done)
+		n.kernelMonitorRestart()
+	}()
+
+	log.Printf("Kernel monitor start...\n")
+	return nil
+}
+
+// kernelMonitor はどれかのsubscribeが切れたら戻る
+// 通知が多すぎて受信バッファが溢れると(ENOBUFS)切れる
+func (n *Nserver) kernelMonitor(routes chan netlink.RouteUpdate, links chan netlink.LinkUpdate,
+	addrs chan netlink.AddrUpdate, rules chan pbrRuleUpdate) {
+	for {
+		select {
+		case u, ok := <-routes:
+			if !ok {
+				return
+			}
+			n.ceventChan <- NservKernelRoute{u}
+		case u, ok := <-links:
+			if !ok {
+				return
+			}
+			n.ceventChan <- NservKernelLink{u}
+		case u, ok := <-addrs:
+			if !ok {
+				return
+			}
+			n.ceventChan <- NservKernelAddr{u}
+		case u, ok := <-rules:
+			if !ok {
+				return
+			}
+			n.ceventChan <- NservKernelRule{u}
+		}
+	}
+}
+
+// subscribeし直して経路をdumpし直す
+func (n *Nserver) kernelMonitorRestart() {
+	log.Printf("Kernel monitor lost, resync\n")
+	for {
+		err := n.KernelMonitorStart()
+		if err == nil {
+			return
+		}
+		log.Printf("kernel monitor: %v", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func kernelRouteProtocol(rt *netlink.Route) string {
+	if rt.Protocol == syscall.RTPROT_KERNEL {
+		return "connected"
+	}
+	return "kernel"
+}
+
+// kernelRoutePrefix はdefault routeのようにDstがない時はgatewayからfamilyを決める
+func kernelRoutePrefix(rt *netlink.Route) (net.IP, uint8, bool) {
+	if rt.Dst != nil {
+		plen, _ := rt.Dst.Mask.Size()
+		return rt.Dst.IP, uint8(plen), true
+	}
+	switch {
+	case rt.Gw == nil:
+		return nil, 0, false
+	case rt.Gw.To4() != nil:
+		return net.IPv4zero, 0, true
+	}
+	return net.IPv6zero, 0, true
+}
+
+// kernelRouteVrf は取り込むkernelの経路のVRFとprefixを返す
+func (ns *Nserver) kernelRouteVrf(rt *netlink.Route) (*Vrf, net.IP, uint8, bool) {
+	// VRFのtableのunicastだけ見る、SRv6の経路はSeg6Tableで持っている
+	if rt.Type != syscall.RTN_UNICAST || rt.Encap != nil {
+		return nil, nil, 0, false
+	}
+	v, ok := ns.vrfs.get(tableVrf(uint32(rt.Table)))
+	if !ok || rt.Table == syscall.RT_TABLE_UNSPEC {
+		return nil, nil, 0, false
+	}
+	prefix, plen, ok := kernelRoutePrefix(rt)
+	if !ok {
+		return nil, nil, 0, false
+	}
+	// link-localはinterfaceごとに同じprefixになるので取り込まない
+	if prefix.IsLinkLocalUnicast() {
+		return nil, nil, 0, false
+	}
+	return v, prefix, plen, true
+}
+
+// kernelRIBPrefix はmultipathの経路なら最初のpathをNexthopに、残りをMultipathに入れる
+func kernelRIBPrefix(rt *netlink.Route, prefix net.IP, plen uint8) RIBPrefix {
+	r := RIBPrefix{
+		Prefix:          prefix,
+		PrefixLen:       plen,
+		Nexthop:         rt.Gw,
+		Index:           rt.LinkIndex,
+		RoutingProtocol: kernelRouteProtocol(rt),
+		Metric:          uint32(rt.Priority),
+	}
+	for i, nh := range rt.MultiPath {
+		if i == 0 {
+			r.Nexthop = nh.Gw
+			r.Index = nh.LinkIndex
+			continue
+		}
+		r.Multipath = append(r.Multipath, RIBNexthop{Nexthop: nh.Gw, Index: nh.LinkIndex})
+	}
+	return r
+}
+
+func (n NservKernelRoute) NecliEvent(ns *Nserver) error {
+	rt := &n.u.Route
+
+	v, prefix, plen, ok := ns.kernelRouteVrf(rt)
+	if !ok {
+		return nil
+	}
+	rib := v.Rib
+
+	if rt.Protocol == rtprotNebura {
+		if n.u.Type == syscall.RTM_DELROUTE {
+			ns.kernelRouteLost(rib, prefix, plen)
+		}
+		return nil
+	}
+
+	r := kernelRIBPrefix(rt, prefix, plen)
+	if n.u.Type == syscall.RTM_DELROUTE {
+		// 同じprefixで別のinterfaceの経路なら消さない
+		old, ok := rib.Get(prefix, plen, r.RoutingProtocol, "")
+		if !ok || old.Index != r.Index {
+			return nil
+		}
+		return rib.Delete(prefix, plen, r.RoutingProtocol, "")
+	}
+
+	return rib.Replace(r)
+}
+
+// kernelRouteKey はresyncでdumpにあった経路の印
+type kernelRouteKey struct {
+	vrf    uint32
+	prefix string
+	proto  string
+}
+
+// NecliEvent はdumpの経路を取り込み、監視が切れている間に消えたkernelの経路を消す
+func (n NservKernelResync) NecliEvent(ns *Nserver) error {
+	seen := make(map[kernelRouteKey]bool)
+	for i := range n.routes {
+		rt := &n.routes[i]
+		v, prefix, plen, ok := ns.kernelRouteVrf(rt)
+		if !ok || rt.Protocol == rtprotNebura {
+			continue
+		}
+		r := kernelRIBPrefix(rt, prefix, plen)
+		seen[kernelRouteKey{v.ID, fmt.Sprintf("%s/%d", prefix, plen), r.RoutingProtocol}] = true
+		if err := v.Rib.Replace(r); err != nil {
+			log.Printf("kernel resync %s/%d: %v", prefix, plen, err)
+		}
+	}
+
+	var cnt int
+	for _, v := range ns.vrfs.list() {
+		var stale []RIBPrefix
+		v.Rib.Walk(func(r RIBPrefix, selected bool) {
+			key := kernelRouteKey{v.ID, fmt.Sprintf("%s/%d", r.Prefix, r.PrefixLen), r.RoutingProtocol}
+			if !fibManaged(&r) && !seen[key] {
+				stale = append(stale, r)
+			}
+		})
+		for _, r := range stale {
+			v.Rib.Delete(r.Prefix, r.PrefixLen, r.RoutingProtocol, r.Owner)
+		}
+		cnt += len(stale)
+	}
+	if cnt > 0 {
+		log.Printf("Kernel resync removed %d routes\n", cnt)
+	}
+	return nil
+}
+
+// kernelTableSync は作る前からあったVRFのtableの経路を取り込む
+// 監視を始めた時のdumpではVRFがまだなかったので読み捨てている
+func (ns *Nserver) kernelTableSync(v *Vrf) error {
+	filter := &netlink.Route{Table: int(fibTable(v.ID))}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+
+	for _, rt := range routes {
+		u := netlink.RouteUpdate{Type: syscall.RTM_NEWROUTE, Route: rt}
+		if err := (NservKernelRoute{u}).NecliEvent(ns); err != nil {
+			log.Printf("kernel vrf %s: %v", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// kernelRouteLost はneburaが入れた経路がkernelから消された時に呼ぶ
+// RibのbestがまだneburaのものならKernelReinstallで入れ直す
+func (ns *Nserver) kernelRouteLost(rib *Rib, prefix net.IP, plen uint8) {
+	best, ok := rib.Best(prefix, plen)
+	if !ok || !fibManaged(&best) {
+		// nebura自身が消した
+		return
+	}
+
+	if !ns.KernelReinstall {
+		log.Printf("Kernel removed %s %s/%d, not reinstalled\n", best.RoutingProtocol, prefix.String(), plen)
+		return
+	}
+	log.Printf("Kernel removed %s %s/%d, reinstall\n", best.RoutingProtocol, prefix.String(), plen)
+	if f, ok := ns.Fib.(fibNexthopOwner); ok {
+		f.forget(&best)
+	}
+	if err := ns.Fib.RouteAdd(&best); err != nil {
+		log.Printf("Kernel reinstall: %v", err)
+	}
+}
+
+// kernelFlushIndex はinterfaceがdownした時にそのinterfaceのkernel, connectedの経路を消す
+// IPv4ではkernelは消した経路を通知してこない
+func kernelFlushIndex(rib *Rib, index int) int {
+	var routes []RIBPrefix
+	rib.Walk(func(v RIBPrefix, selected bool) {
+		if !fibManaged(&v) && v.Index == index {
+			routes = append(routes, v)
+		}
+	})
+
+	for _, v := range routes {
+		rib.Delete(v.Prefix, v.PrefixLen, v.RoutingProtocol, v.Owner)
+	}
+	return len(routes)
+}
+
+func (n NservKernelLink) NecliEvent(ns *Nserver) error {
+	attrs := n.u.Link.Attrs()
+
+	if n.u.Header.Type == syscall.RTM_DELLINK || attrs.Flags&net.FlagUp == 0 {
+		// interfaceがどのVRFにいたかは分からないので全部見る
+		var cnt int
+		for _, v := range ns.vrfs.list() {
+			cnt += kernelFlushIndex(v.Rib, attrs.Index)
+		}
+		if cnt > 0 {
+			log.Printf("Kernel link %s down, %d routes removed\n", attrs.Name, cnt)
+		}
+	}
+	return nil
+}
+
+// アドレスが消えたらconnectedの経路を消す、追加はrouteの通知で取り込む
+func (n NservKernelAddr) NecliEvent(ns *Nserver) error {
+	if n.u.NewAddr {
+		return nil
+	}
+
+	plen, _ := n.u.LinkAddress.Mask.Size()
+	prefix := n.u.LinkAddress.IP.Mask(n.u.LinkAddress.Mask)
+
+	for _, v := range ns.vrfs.list() {
+		old, ok := v.Rib.Get(prefix, uint8(plen), "connected", "")
+		if !ok || old.Index != n.u.LinkIndex {
+			continue
+		}
+		return v.Rib.Delete(prefix, uint8(plen), "connected", "")
+	}
+	return nil
+}
+
+// FibReconcileTime は起動してからkernelに残っていたneburaの経路を消すまでの時間
+// この間にクライアントが入れ直した経路は残る
+var FibReconcileTime = 60 * time.Second
+
+// fibNexthopOwner はkernelのnexthop objectを持つFib
+type fibNexthopOwner interface {
+	forget(rt *RIBPrefix)  // 経路がkernelから消された
+	staleNexthops() int    // 前のneburaが残したobjectの数
+	nexthopReconcile() int // 残っていたobjectを消す
+}
+
+// NservFibReconcile はFibReconcileTime後に送られる
+type NservFibReconcile struct {
+	stale []netlink.Route
+	rules []PbrRule
+}
+
+// fibStaleRoutes は前に動いていたneburaが入れてkernelに残っている経路を全部のtableから返す
+func fibStaleRoutes() ([]netlink.Route, error) {
+	filter := &netlink.Route{
+		Table:    syscall.RT_TABLE_UNSPEC,
+		Protocol: rtprotNebura,
+	}
+	return netlink.RouteListFiltered(netlink.FAMILY_ALL, filter,
+		netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+}
+
+// FibReconcileStart は起動時に呼ぶ、残っていた経路はクライアントが戻ってくるまでそのまま使う
+func (n *Nserver) FibReconcileStart() error {
+	stale, err := fibStaleRoutes()
+	if err != nil {
+		return err
+	}
+	rules, err := pbrStaleRules()
+	if err != nil {
+		return err
+	}
+	var nhs int
+	if f, ok := n.Fib.(fibNexthopOwner); ok {
+		nhs = f.staleNexthops()
+	}
+	if len(stale) == 0 && len(rules) == 0 && nhs == 0 {
+		return nil
+	}
+
+	log.Printf("FIB %d stale routes, %d rules, %d nexthops, reconcile after %v\n",
+		len(stale), len(rules), nhs, FibReconcileTime)
+	time.AfterFunc(FibReconcileTime, func() {
+		n.ceventChan <- NservFibReconcile{stale, rules}
+	})
+	return nil
+}
+
+// SRv6の経路はSeg6Table、MPLSのpushはMplsTable、それ以外はtableのVRFのRibのbestにあれば残す
+func (ns *Nserver) fibKeep(rt *netlink.Route, prefix net.IP, plen uint8) bool {
+	switch rt.Encap.(type) {
+	case *netlink.SEG6Encap:
+		return ns.Seg6.has(prefix, plen)
+	case *netlink.SEG6LocalEncap:
+		return ns.Seg6.hasLocal(prefix)
+	case *netlink.MPLSEncap:
+		return ns.Mpls.hasPush(prefix, plen)
+	}
+	v, ok := ns.vrfs.get(tableVrf(uint32(rt.Table)))
+	if !ok {
+		return false
+	}
+	best, ok := v.Rib.Best(prefix, plen)
+	return ok && fibManaged(&best)
+}
+
+// fibMplsReconcile はMplsTableにないlabelの経路を消す
+func (ns *Nserver) fibMplsReconcile(rt *netlink.Route) bool {
+	label := uint32(*rt.MPLSDst)
+	if ns.Mpls.has(label) {
+		return false
+	}
+	if err := ns.Fib.MplsDelete(&MplsLabelRoute{Label: label}); err != nil {
+		if !errors.Is(err, syscall.ESRCH) && !errors.Is(err, syscall.ENOENT) {
+			log.Printf("FIB reconcile mpls %d: %v", label, err)
+		}
+		return false
+	}
+	return true
+}
+
+// Ribのbestになっていない経路はkernelから消す
+func (n NservFibReconcile) NecliEvent(ns *Nserver) error {
+	var cnt int
+
+	for i := range n.stale {
+		rt := &n.stale[i]
+		if rt.MPLSDst != nil {
+			if ns.fibMplsReconcile(rt) {
+				cnt++
+			}
+			continue
+		}
+		prefix, plen, ok := kernelRoutePrefix(rt)
+		if !ok {
+			continue
+		}
+		if ns.fibKeep(rt, prefix, plen) {
+			continue
+		}
+
+		// nexthop objectを指す経路はgatewayを付けるとマッチしないのでprefixで消す
+		del := &netlink.Route{
+			Dst:      rt.Dst,
+			Table:    rt.Table,
+			Protocol: rt.Protocol,
+		}
+		if rt.Dst == nil {
+			del.Gw = rt.Gw
+		}
+		if err := netlink.RouteDel(del); err != nil {
+			if !errors.Is(err, syscall.ESRCH) {
+				log.Printf("FIB reconcile %s/%d: %v", prefix.String(), plen, err)
+			}
+			continue
+		}
+		cnt++
+	}
+
+	// 経路を消してからobjectを消す
+	var nhs int
+	if f, ok := ns.Fib.(fibNexthopOwner); ok {
+		nhs = f.nexthopReconcile()
+	}
+
+	// PbrTableにないruleを消す
+	var rules int
+	for i := range n.rules {
+		p := &n.rules[i]
+		if _, ok := ns.Pbr.get(p); ok {
+			continue
+		}
+		if err := pbrRuleExecute(p, false); err != nil {
+			if !errors.Is(err, syscall.ENOENT) {
+				log.Printf("FIB reconcile rule %s: %v", p.String(), err)
+			}
+			continue
+		}
+		rules++
+	}
+
+	log.Printf("FIB reconcile removed %d stale routes, %d rules, %d nexthops\n", cnt, rules, nhs)
+	return nil
+}
@@ -0,0 +1,163 @@
+package nebura
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func kernelRouteUpdate(typ uint16, prefix string, index int) NservKernelRoute {
+	_, dst, _ := net.ParseCIDR(prefix)
+	return NservKernelRoute{netlink.RouteUpdate{
+		Type: typ,
+		Route: netlink.Route{
+			Dst:       dst,
+			LinkIndex: index,
+			Table:     syscall.RT_TABLE_MAIN,
+			Protocol:  syscall.RTPROT_KERNEL,
+			Type:      syscall.RTN_UNICAST,
+		},
+	}}
+}
+
+// 300と44 (300&0xff) のinterfaceを区別する
+func TestKernelRouteIfIndex(t *testing.T) {
+	ns, err := NserverInit(MemFibInit(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rib := &ns.Rib
+	prefix := net.ParseIP("10.0.0.0").To4()
+
+	if err := kernelRouteUpdate(syscall.RTM_NEWROUTE, "10.0.0.0/24", 300).NecliEvent(ns); err != nil {
+		t.Fatal(err)
+	}
+	rt, ok := rib.Get(prefix, 24, "connected", "")
+	if !ok || rt.Index != 300 {
+		t.Fatalf("connected route %v %v, want dev 300", rt, ok)
+	}
+
+	// 別のinterfaceの経路が消えても残る
+	kernelRouteUpdate(syscall.RTM_DELROUTE, "10.0.0.0/24", 44).NecliEvent(ns)
+	if _, ok := rib.Get(prefix, 24, "connected", ""); !ok {
+		t.Fatalf("route removed by delete on dev 44")
+	}
+
+	addr := NservKernelAddr{netlink.AddrUpdate{
+		LinkAddress: net.IPNet{IP: net.ParseIP("10.0.0.1").To4(), Mask: net.CIDRMask(24, 32)},
+		LinkIndex:   44,
+	}}
+	addr.NecliEvent(ns)
+	if _, ok := rib.Get(prefix, 24, "connected", ""); !ok {
+		t.Fatalf("route removed by address delete on dev 44")
+	}
+
+	if cnt := kernelFlushIndex(rib, 44); cnt != 0 {
+		t.Fatalf("flush dev 44 removed %d routes", cnt)
+	}
+	if cnt := kernelFlushIndex(rib, 300); cnt != 1 {
+		t.Fatalf("flush dev 300 removed %d routes, want 1", cnt)
+	}
+}
+
+// multipathの経路は全部のpathを取り込む
+func TestKernelRouteMultipath(t *testing.T) {
+	ns, err := NserverInit(MemFibInit(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rib := &ns.Rib
+	_, dst, _ := net.ParseCIDR("192.0.2.0/24")
+
+	u := NservKernelRoute{netlink.RouteUpdate{
+		Type: syscall.RTM_NEWROUTE,
+		Route: netlink.Route{
+			Dst:      dst,
+			Table:    syscall.RT_TABLE_MAIN,
+			Protocol: syscall.RTPROT_BOOT,
+			Type:     syscall.RTN_UNICAST,
+			MultiPath: []*netlink.NexthopInfo{
+				{LinkIndex: 2, Gw: net.ParseIP("10.0.0.1").To4()},
+				{LinkIndex: 3, Gw: net.ParseIP("10.0.1.1").To4()},
+				{LinkIndex: 4, Gw: net.ParseIP("10.0.2.1").To4()},
+			},
+		},
+	}}
+	if err := u.NecliEvent(ns); err != nil {
+		t.Fatal(err)
+	}
+
+	rt, ok := rib.Get(dst.IP, 24, "kernel", "")
+	if !ok {
+		t.Fatalf("multipath route not imported")
+	}
+	if !rt.Nexthop.Equal(net.ParseIP("10.0.0.1")) || rt.Index != 2 {
+		t.Errorf("first path via %s dev %d, want via 10.0.0.1 dev 2", rt.Nexthop, rt.Index)
+	}
+	if len(rt.Multipath) != 2 || !rt.Multipath[0].Nexthop.Equal(net.ParseIP("10.0.1.1")) ||
+		rt.Multipath[0].Index != 3 || !rt.Multipath[1].Nexthop.Equal(net.ParseIP("10.0.2.1")) ||
+		rt.Multipath[1].Index != 4 {
+		t.Errorf("multipath %v, want 10.0.1.1 dev 3 and 10.0.2.1 dev 4", rt.Multipath)
+	}
+
+	u.u.Type = syscall.RTM_DELROUTE
+	if err := u.NecliEvent(ns); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rib.Get(dst.IP, 24, "kernel", ""); ok {
+		t.Errorf("multipath route not removed")
+	}
+}
+
+// resyncはdumpの経路を入れて、dumpになかったkernelの経路だけ消す
+func TestKernelResync(t *testing.T) {
+	ns, err := NserverInit(MemFibInit(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rib := &ns.Rib
+
+	for _, p := range []string{"10.0.0.0/24", "10.0.1.0/24"} {
+		if err := kernelRouteUpdate(syscall.RTM_NEWROUTE, p, 2).NecliEvent(ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bgp := RIBPrefix{
+		Prefix:          net.ParseIP("198.51.100.0").To4(),
+		PrefixLen:       24,
+		Nexthop:         net.ParseIP("10.0.0.1").To4(),
+		RoutingProtocol: "BGP",
+		Owner:           "BGP",
+	}
+	if err := rib.Add(bgp); err != nil {
+		t.Fatal(err)
+	}
+
+	// 監視が切れている間に10.0.1.0/24が消えて10.0.2.0/24ができた
+	var dump []netlink.Route
+	for _, p := range []string{"10.0.0.0/24", "10.0.2.0/24"} {
+		dump = append(dump, kernelRouteUpdate(syscall.RTM_NEWROUTE, p, 2).u.Route)
+	}
+	if err := (NservKernelResync{dump}).NecliEvent(ns); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix string
+		proto  string
+		owner  string
+		want   bool
+	}{
+		{"10.0.0.0", "connected", "", true},
+		{"10.0.1.0", "connected", "", false},
+		{"10.0.2.0", "connected", "", true},
+		{"198.51.100.0", "BGP", "BGP", true},
+	}
+	for _, tt := range tests {
+		if _, ok := rib.Get(net.ParseIP(tt.prefix).To4(), 24, tt.proto, tt.owner); ok != tt.want {
+			t.Errorf("%s/24 %s present %v, want %v", tt.prefix, tt.proto, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,563 @@
+package nebura
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// MPLS
+// labelの経路 (AF_MPLS) はswapかpop、IPの経路にlabelを積むpushはencapの経路で入れる
+// kernelのMPLSのtableは1つだけなのでデフォルトのVRFでだけ使える
+// kernelでmpls_router, mpls_iptunnelを読み込み、net.mpls.platform_labelsと
+// 受けるinterfaceのnet.mpls.conf.<if>.inputを設定しておくこと
+
+// vishvananda/netlink v1.1.0はRTA_VIAを組み立てられないのでlabelの経路は自分で組み立てる
+const (
+	rtaVia    = 18
+	rtaNewdst = 19
+)
+
+const (
+	mplsLabelMin   = 16 // 0から15は予約されている
+	mplsLabelMax   = 1<<20 - 1
+	mplsLabelStack = 30 // kernelのMAX_NEW_LABELS
+)
+
+// MplsLabelRoute は受けたlabelの経路、Outが空ならpopする
+// popでNexthopもなければlabelを外してこのノードで引き直す
+type MplsLabelRoute struct {
+	Label   uint32
+	Out     []uint32
+	Nexthop net.IP
+	Owner   string
+}
+
+// MplsPushRoute はprefixに向かうパケットにLabelsを積んでNexthopに送る経路
+type MplsPushRoute struct {
+	Prefix    net.IP
+	PrefixLen uint8
+	Labels    []uint32 // 先頭が一番外側
+	Nexthop   net.IP
+	Owner     string
+}
+
+func mplsStackString(labels []uint32) string {
+	s := make([]string, len(labels))
+	for i, l := range labels {
+		s[i] = fmt.Sprint(l)
+	}
+	return strings.Join(s, "/")
+}
+
+func (rt *MplsLabelRoute) String() string {
+	s := fmt.Sprintf("%d", rt.Label)
+	if len(rt.Out) == 0 {
+		s += " pop"
+	} else {
+		s += " swap " + mplsStackString(rt.Out)
+	}
+	if rt.Nexthop != nil {
+		s += " via " + rt.Nexthop.String()
+	}
+	return s
+}
+
+func (rt *MplsPushRoute) String() string {
+	return fmt.Sprintf("%s/%d push %s via %s", rt.Prefix.String(), rt.PrefixLen,
+		mplsStackString(rt.Labels), rt.Nexthop.String())
+}
+
+func mplsStackValid(labels []uint32) error {
+	if len(labels) > mplsLabelStack {
+		return fmt.Errorf("mpls: %d labels too deep", len(labels))
+	}
+	for _, l := range labels {
+		if l > mplsLabelMax {
+			return fmt.Errorf("mpls: bad label %d", l)
+		}
+	}
+	return nil
+}
+
+func (rt *MplsLabelRoute) validate() error {
+	if rt.Label < mplsLabelMin || rt.Label > mplsLabelMax {
+		return fmt.Errorf("mpls: bad label %d", rt.Label)
+	}
+	if len(rt.Out) > 0 && rt.Nexthop == nil {
+		return fmt.Errorf("mpls: swap %d needs nexthop", rt.Label)
+	}
+	return mplsStackValid(rt.Out)
+}
+
+func (rt *MplsPushRoute) validate() error {
+	if len(rt.Labels) == 0 {
+		return fmt.Errorf("mpls: push %s/%d no labels", rt.Prefix.String(), rt.PrefixLen)
+	}
+	if (rt.Prefix.To4() == nil) != (rt.Nexthop.To4() == nil) {
+		// kernelはencapの経路でもgatewayのfamilyが違うと受け付けない
+		return fmt.Errorf("mpls: push %s/%d nexthop family mismatch", rt.Prefix.String(), rt.PrefixLen)
+	}
+	return mplsStackValid(rt.Labels)
+}
+
+func mplsLabels(labels []uint32) []int {
+	s := make([]int, len(labels))
+	for i, l := range labels {
+		s[i] = int(l)
+	}
+	return s
+}
+
+// mplsRouteRequest はlabelの経路を追加か削除するメッセージ
+func mplsRouteRequest(rt *MplsLabelRoute, add bool) (*nl.NetlinkRequest, error) {
+	var req *nl.NetlinkRequest
+	if add {
+		req = nl.NewNetlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE|syscall.NLM_F_ACK)
+	} else {
+		req = nl.NewNetlinkRequest(syscall.RTM_DELROUTE, syscall.NLM_F_ACK)
+	}
+
+	msg := &nl.RtMsg{}
+	msg.Family = nl.FAMILY_MPLS
+	msg.Dst_len = 20
+	msg.Table = syscall.RT_TABLE_MAIN
+	msg.Protocol = rtprotNebura
+	msg.Scope = syscall.RT_SCOPE_UNIVERSE
+	msg.Type = syscall.RTN_UNICAST
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(syscall.RTA_DST, nl.EncodeMPLSStack(int(rt.Label))))
+	if !add {
+		return req, nil
+	}
+
+	if len(rt.Out) > 0 {
+		req.AddData(nl.NewRtAttr(rtaNewdst, nl.EncodeMPLSStack(mplsLabels(rt.Out)...)))
+	}
+
+	var oif int
+	if rt.Nexthop != nil {
+		var err error
+		if oif, err = fibOif(rt.Nexthop); err != nil {
+			return nil, err
+		}
+
+		// struct rtvia: familyのあとにアドレス
+		via := make([]byte, 2)
+		nl.NativeEndian().PutUint16(via, syscall.AF_INET6)
+		addr := rt.Nexthop.To16()
+		if v4 := rt.Nexthop.To4(); v4 != nil {
+			nl.NativeEndian().PutUint16(via, syscall.AF_INET)
+			addr = v4
+		}
+		req.AddData(nl.NewRtAttr(rtaVia, append(via, addr...)))
+	} else {
+		// popしてこのノードで引き直す
+		lo, err := net.InterfaceByName("lo")
+		if err != nil {
+			return nil, err
+		}
+		oif = lo.Index
+	}
+
+	b := make([]byte, 4)
+	nl.NativeEndian().PutUint32(b, uint32(oif))
+	req.AddData(nl.NewRtAttr(syscall.RTA_OIF, b))
+	return req, nil
+}
+
+func (f *NetlinkFib) MplsAdd(rt *MplsLabelRoute) error {
+	req, err := mplsRouteRequest(rt, true)
+	if err != nil {
+		return err
+	}
+	if _, err := req.Execute(syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("fib: mpls add %s: %w", rt.String(), err)
+	}
+	return nil
+}
+
+func (f *NetlinkFib) MplsDelete(rt *MplsLabelRoute) error {
+	req, err := mplsRouteRequest(rt, false)
+	if err != nil {
+		return err
+	}
+	if _, err := req.Execute(syscall.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("fib: mpls delete %d: %w", rt.Label, err)
+	}
+	return nil
+}
+
+// pushの経路はnexthopに向かうinterfaceから出す
+func mplsPushRoute(rt *MplsPushRoute) (*netlink.Route, error) {
+	oif, err := fibOif(rt.Nexthop)
+	if err != nil {
+		return nil, err
+	}
+
+	return &netlink.Route{
+		Dst:       fibPrefix(rt.Prefix, rt.PrefixLen),
+		Gw:        rt.Nexthop,
+		LinkIndex: oif,
+		Protocol:  rtprotNebura,
+		Table:     syscall.RT_TABLE_MAIN,
+		Encap:     &netlink.MPLSEncap{Labels: mplsLabels(rt.Labels)},
+	}, nil
+}
+
+func (f *NetlinkFib) MplsPushAdd(rt *MplsPushRoute) error {
+	route, err := mplsPushRoute(rt)
+	if err != nil {
+		return err
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("fib: mpls push add %s: %w", rt.String(), err)
+	}
+	return nil
+}
+
+func (f *NetlinkFib) MplsPushDelete(rt *MplsPushRoute) error {
+	route := &netlink.Route{
+		Dst:      fibPrefix(rt.Prefix, rt.PrefixLen),
+		Protocol: rtprotNebura,
+		Table:    syscall.RT_TABLE_MAIN,
+	}
+	if err := netlink.RouteDel(route); err != nil {
+		return fmt.Errorf("fib: mpls push delete %s/%d: %w", rt.Prefix.String(), rt.PrefixLen, err)
+	}
+	return nil
+}
+
+// MplsTable はneburaが入れたMPLSの経路を持ち、カーネルと揃える
+type MplsTable struct {
+	mu     sync.Mutex
+	fib    Fib
+	labels map[uint32]*MplsLabelRoute
+	push   map[string]*MplsPushRoute
+}
+
+func MplsTableInit(fib Fib) *MplsTable {
+	return &MplsTable{
+		fib:    fib,
+		labels: make(map[uint32]*MplsLabelRoute),
+		push:   make(map[string]*MplsPushRoute),
+	}
+}
+
+func mplsPushKey(prefix net.IP, plen uint8) string {
+	return fibPrefix(prefix, plen).String()
+}
+
+func (t *MplsTable) Add(rt MplsLabelRoute) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	if err := rt.validate(); err != nil {
+		return err
+	}
+	if _, ok := t.labels[rt.Label]; ok {
+		return fmt.Errorf("mpls: %d: %w", rt.Label, ErrRouteExists)
+	}
+
+	if err := t.fib.MplsAdd(&rt); err != nil {
+		return err
+	}
+	t.labels[rt.Label] = &rt
+	log.Printf("MPLS Add %s\n", rt.String())
+	return nil
+}
+
+// Replace は経路がなければ追加する
+func (t *MplsTable) Replace(rt MplsLabelRoute) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	if err := rt.validate(); err != nil {
+		return err
+	}
+	if err := t.fib.MplsAdd(&rt); err != nil { // replace
+		return err
+	}
+	t.labels[rt.Label] = &rt
+	log.Printf("MPLS Replace %s\n", rt.String())
+	return nil
+}
+
+func (t *MplsTable) Delete(label uint32) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	rt, ok := t.labels[label]
+	if !ok {
+		return fmt.Errorf("mpls: %d: %w", label, ErrRouteNotFound)
+	}
+
+	delete(t.labels, label)
+	log.Printf("MPLS Delete %d\n", label)
+	return t.fib.MplsDelete(rt)
+}
+
+func (t *MplsTable) PushAdd(rt MplsPushRoute) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	if err := rt.validate(); err != nil {
+		return err
+	}
+	key := mplsPushKey(rt.Prefix, rt.PrefixLen)
+	if _, ok := t.push[key]; ok {
+		return fmt.Errorf("mpls: push %s: %w", key, ErrRouteExists)
+	}
+
+	if err := t.fib.MplsPushAdd(&rt); err != nil {
+		return err
+	}
+	t.push[key] = &rt
+	log.Printf("MPLS Push Add %s\n", rt.String())
+	return nil
+}
+
+// PushReplace は経路がなければ追加する
+func (t *MplsTable) PushReplace(rt MplsPushRoute) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	if err := rt.validate(); err != nil {
+		return err
+	}
+	key := mplsPushKey(rt.Prefix, rt.PrefixLen)
+	if err := t.fib.MplsPushAdd(&rt); err != nil { // replace
+		return err
+	}
+	t.push[key] = &rt
+	log.Printf("MPLS Push Replace %s\n", rt.String())
+	return nil
+}
+
+func (t *MplsTable) PushDelete(prefix net.IP, plen uint8) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	key := mplsPushKey(prefix, plen)
+	rt, ok := t.push[key]
+	if !ok {
+		return fmt.Errorf("mpls: push %s: %w", key, ErrRouteNotFound)
+	}
+
+	delete(t.push, key)
+	log.Printf("MPLS Push Delete %s\n", key)
+	return t.fib.MplsPushDelete(rt)
+}
+
+func (t *MplsTable) has(label uint32) bool {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	_, ok := t.labels[label]
+	return ok
+}
+
+func (t *MplsTable) hasPush(prefix net.IP, plen uint8) bool {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	_, ok := t.push[mplsPushKey(prefix, plen)]
+	return ok
+}
+
+// DeleteOwner はownerが入れた経路を全部消す
+func (t *MplsTable) DeleteOwner(owner string) int {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	n := 0
+	for label, rt := range t.labels {
+		if rt.Owner != owner {
+			continue
+		}
+		delete(t.labels, label)
+		if err := t.fib.MplsDelete(rt); err != nil {
+			log.Printf("MPLS Delete %d: %v", label, err)
+		}
+		n++
+	}
+	for key, rt := range t.push {
+		if rt.Owner != owner {
+			continue
+		}
+		delete(t.push, key)
+		if err := t.fib.MplsPushDelete(rt); err != nil {
+			log.Printf("MPLS Push Delete %s: %v", key, err)
+		}
+		n++
+	}
+	return n
+}
+
+type mplsBody struct {
+	Label   uint32
+	Out     []uint32
+	Prefix  Prefix
+	Nexthop net.IP
+}
+
+func (b *mplsBody) writeTo() ([]byte, error) {
+	var buf []byte
+
+	if b.Label != 0 {
+		buf = appendTlvU32(buf, tlvLabel, b.Label)
+	}
+	if b.Prefix.Prefix != nil {
+		buf = appendTlvPrefix(buf, tlvPrefix, b.Prefix.Prefix, b.Prefix.PrefixLen)
+	}
+	if len(b.Out) > 0 {
+		buf = appendTlvLabels(buf, tlvLabels, b.Out)
+	}
+	if b.Nexthop != nil {
+		buf = appendTlvIP(buf, tlvNexthop, b.Nexthop)
+	}
+	return buf, nil
+}
+
+// tlvLabelsがなければpop
+func mplsLabelParse(s *NservSession, t tlvs) (MplsLabelRoute, error) {
+	rt := MplsLabelRoute{Owner: s.Protocol}
+	var err error
+
+	if rt.Label, err = t.u32(tlvLabel); err != nil {
+		return rt, err
+	}
+	if t.has(tlvLabels) {
+		if rt.Out, err = t.labels(tlvLabels); err != nil {
+			return rt, err
+		}
+	}
+	if t.has(tlvNexthop) {
+		if rt.Nexthop, err = t.ip(tlvNexthop); err != nil {
+			return rt, err
+		}
+	}
+	return rt, nil
+}
+
+func mplsPushParse(s *NservSession, t tlvs) (MplsPushRoute, error) {
+	rt := MplsPushRoute{Owner: s.Protocol}
+	var err error
+
+	if rt.Prefix, rt.PrefixLen, err = t.prefix(tlvPrefix); err != nil {
+		return rt, err
+	}
+	if rt.Labels, err = t.labels(tlvLabels); err != nil {
+		return rt, err
+	}
+	if rt.Nexthop, err = t.ip(tlvNexthop); err != nil {
+		return rt, err
+	}
+	return rt, nil
+}
+
+func (ns *Nserver) MplsLabelAdd(s *NservSession, t tlvs) error {
+	rt, err := mplsLabelParse(s, t)
+	if err != nil {
+		return err
+	}
+	return ns.Mpls.Add(rt)
+}
+
+func (ns *Nserver) MplsLabelReplace(s *NservSession, t tlvs) error {
+	rt, err := mplsLabelParse(s, t)
+	if err != nil {
+		return err
+	}
+	return ns.Mpls.Replace(rt)
+}
+
+func (ns *Nserver) MplsLabelDelete(t tlvs) error {
+	label, err := t.u32(tlvLabel)
+	if err != nil {
+		return err
+	}
+	return ns.Mpls.Delete(label)
+}
+
+func (ns *Nserver) MplsPushAdd(s *NservSession, t tlvs) error {
+	rt, err := mplsPushParse(s, t)
+	if err != nil {
+		return err
+	}
+	return ns.Mpls.PushAdd(rt)
+}
+
+func (ns *Nserver) MplsPushReplace(s *NservSession, t tlvs) error {
+	rt, err := mplsPushParse(s, t)
+	if err != nil {
+		return err
+	}
+	return ns.Mpls.PushReplace(rt)
+}
+
+func (ns *Nserver) MplsPushDelete(t tlvs) error {
+	prefix, plen, err := t.prefix(tlvPrefix)
+	if err != nil {
+		return err
+	}
+	return ns.Mpls.PushDelete(prefix, plen)
+}
+
+// SendNclientMplsAdd はlabelの経路を入れる、outが空ならpop、popでnexthopが空ならこのノードで引き直す
+func (n *Nclient) SendNclientMplsAdd(label uint32, out []uint32, nexthop string) error {
+	return n.sendNclientMpls(mplsLabelAdd, label, out, nexthop)
+}
+
+func (n *Nclient) SendNclientMplsReplace(label uint32, out []uint32, nexthop string) error {
+	return n.sendNclientMpls(mplsLabelReplace, label, out, nexthop)
+}
+
+func (n *Nclient) sendNclientMpls(rtype uint8, label uint32, out []uint32, nexthop string) error {
+	body := &mplsBody{Label: label, Out: out}
+	if nexthop != "" {
+		if body.Nexthop = net.ParseIP(nexthop); body.Nexthop == nil {
+			return fmt.Errorf("mpls: bad nexthop %q", nexthop)
+		}
+	}
+	return n.sendNclientAPI(rtype, body)
+}
+
+func (n *Nclient) SendNclientMplsDelete(label uint32) error {
+	return n.sendNclientAPI(mplsLabelDelete, &mplsBody{Label: label})
+}
+
+// SendNclientMplsPushAdd はprefixの経路にlabelsを積む、labelsの先頭が一番外側
+func (n *Nclient) SendNclientMplsPushAdd(prefix string, plen uint8, labels []uint32, nexthop string) error {
+	return n.sendNclientMplsPush(mplsPushAdd, prefix, plen, labels, nexthop)
+}
+
+func (n *Nclient) SendNclientMplsPushReplace(prefix string, plen uint8, labels []uint32, nexthop string) error {
+	return n.sendNclientMplsPush(mplsPushReplace, prefix, plen, labels, nexthop)
+}
+
+func (n *Nclient) sendNclientMplsPush(rtype uint8, prefix string, plen uint8, labels []uint32, nexthop string) error {
+	body := &mplsBody{
+		Prefix:  Prefix{Prefix: net.ParseIP(prefix), PrefixLen: plen},
+		Out:     labels,
+		Nexthop: net.ParseIP(nexthop),
+	}
+	if body.Prefix.Prefix == nil || body.Nexthop == nil {
+		return fmt.Errorf("mpls: bad push %s/%d via %s", prefix, plen, nexthop)
+	}
+	return n.sendNclientAPI(rtype, body)
+}
+
+func (n *Nclient) SendNclientMplsPushDelete(prefix string, plen uint8) error {
+	ip := net.ParseIP(prefix)
+	if ip == nil {
+		return fmt.Errorf("mpls: bad prefix %q", prefix)
+	}
+	return n.sendNclientAPI(mplsPushDelete, &mplsBody{Prefix: Prefix{Prefix: ip, PrefixLen: plen}})
+}
@@ -0,0 +1,167 @@
+package nebura
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+func TestMplsStackValid(t *testing.T) {
+	deep := make([]uint32, mplsLabelStack)
+	for i := range deep {
+		deep[i] = uint32(100 + i)
+	}
+
+	tests := []struct {
+		name   string
+		labels []uint32
+		ok     bool
+	}{
+		{"empty", nil, true},
+		{"reserved", []uint32{0, 3}, true},
+		{"max label", []uint32{mplsLabelMax}, true},
+		{"too big", []uint32{100, mplsLabelMax + 1}, false},
+		{"max depth", deep, true},
+		{"too deep", append(deep, 200), false},
+	}
+	for _, tt := range tests {
+		if err := mplsStackValid(tt.labels); (err == nil) != tt.ok {
+			t.Errorf("%s: err %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// mplsRequestAttrs はリクエストのrtmsgとattributeを読む
+func mplsRequestAttrs(t *testing.T, req *nl.NetlinkRequest) (*nl.RtMsg, map[uint16][]byte) {
+	t.Helper()
+	b := req.Serialize()[syscall.SizeofNlMsghdr:]
+	msg := nl.DeserializeRtMsg(b)
+	attrs, err := nl.ParseRouteAttr(b[syscall.SizeofRtMsg:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[uint16][]byte)
+	for _, a := range attrs {
+		m[a.Attr.Type] = a.Value
+	}
+	return msg, m
+}
+
+func TestMplsRouteRequest(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	oif := make([]byte, 4)
+	nl.NativeEndian().PutUint32(oif, uint32(lo.Index))
+
+	via4 := make([]byte, 2)
+	nl.NativeEndian().PutUint16(via4, syscall.AF_INET)
+	via6 := make([]byte, 2)
+	nl.NativeEndian().PutUint16(via6, syscall.AF_INET6)
+
+	tests := []struct {
+		name string
+		rt   MplsLabelRoute
+		add  bool
+		out  []int // nilならRTA_NEWDSTなし
+		via  []byte
+	}{
+		{"swap", MplsLabelRoute{Label: 100, Out: []uint32{200, 300}, Nexthop: net.ParseIP("127.0.0.1")},
+			true, []int{200, 300}, append(via4, 127, 0, 0, 1)},
+		{"swap ipv6", MplsLabelRoute{Label: 101, Out: []uint32{201}, Nexthop: net.ParseIP("::1")},
+			true, []int{201}, append(via6, net.IPv6loopback...)},
+		{"pop", MplsLabelRoute{Label: 102, Nexthop: net.ParseIP("127.0.0.1")},
+			true, nil, append(via4, 127, 0, 0, 1)},
+		// nexthopがなければloから入れて引き直す
+		{"pop local", MplsLabelRoute{Label: 103}, true, nil, nil},
+		{"delete", MplsLabelRoute{Label: 104, Out: []uint32{204}, Nexthop: net.ParseIP("127.0.0.1")},
+			false, nil, nil},
+	}
+	for _, tt := range tests {
+		req, err := mplsRouteRequest(&tt.rt, tt.add)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		wantType := uint16(syscall.RTM_NEWROUTE)
+		if !tt.add {
+			wantType = syscall.RTM_DELROUTE
+		}
+		msg, attrs := mplsRequestAttrs(t, req)
+		if req.Type != wantType || msg.Family != nl.FAMILY_MPLS || msg.Dst_len != 20 ||
+			msg.Protocol != rtprotNebura {
+			t.Errorf("%s: type %d family %d dst_len %d protocol %d", tt.name, req.Type, msg.Family,
+				msg.Dst_len, msg.Protocol)
+		}
+		if dst := nl.DecodeMPLSStack(attrs[syscall.RTA_DST]); len(dst) != 1 || dst[0] != int(tt.rt.Label) {
+			t.Errorf("%s: dst %v, want %d", tt.name, dst, tt.rt.Label)
+		}
+
+		if v, ok := attrs[rtaNewdst]; (tt.out != nil) != ok ||
+			(ok && !reflect.DeepEqual(nl.DecodeMPLSStack(v), tt.out)) {
+			t.Errorf("%s: newdst %v, want %v", tt.name, nl.DecodeMPLSStack(v), tt.out)
+		}
+		if v, ok := attrs[rtaVia]; (tt.via != nil) != ok || !bytes.Equal(v, tt.via) {
+			t.Errorf("%s: via %v, want %v", tt.name, v, tt.via)
+		}
+
+		// deleteはlabelだけ
+		if v, ok := attrs[syscall.RTA_OIF]; tt.add != ok || (ok && !bytes.Equal(v, oif)) {
+			t.Errorf("%s: oif %v, want %v", tt.name, v, oif)
+		}
+	}
+}
+
+func TestMplsDeleteOwner(t *testing.T) {
+	fib := MemFibInit()
+	tbl := MplsTableInit(fib)
+
+	labels := []MplsLabelRoute{
+		{Label: 100, Owner: "ISIS"},
+		{Label: 101, Out: []uint32{200}, Nexthop: net.ParseIP("10.0.0.1"), Owner: "ISIS"},
+		{Label: 102, Owner: "BGP"},
+	}
+	for _, rt := range labels {
+		if err := tbl.Add(rt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	push := []MplsPushRoute{
+		{Prefix: net.ParseIP("10.1.0.0"), PrefixLen: 16, Labels: []uint32{300},
+			Nexthop: net.ParseIP("10.0.0.1"), Owner: "ISIS"},
+		{Prefix: net.ParseIP("10.2.0.0"), PrefixLen: 16, Labels: []uint32{301},
+			Nexthop: net.ParseIP("10.0.0.1"), Owner: "BGP"},
+	}
+	for _, rt := range push {
+		if err := tbl.PushAdd(rt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := tbl.DeleteOwner("ISIS"); n != 3 {
+		t.Errorf("deleted %d routes, want 3", n)
+	}
+	if n := tbl.DeleteOwner("OSPF"); n != 0 {
+		t.Errorf("deleted %d routes of unknown owner", n)
+	}
+
+	for _, rt := range labels {
+		_, inFib := fib.mpls[rt.Label]
+		if want := rt.Owner == "BGP"; tbl.has(rt.Label) != want || inFib != want {
+			t.Errorf("label %d owner %s in table %v fib %v", rt.Label, rt.Owner, tbl.has(rt.Label), inFib)
+		}
+	}
+	for _, rt := range push {
+		_, inFib := fib.push[mplsPushKey(rt.Prefix, rt.PrefixLen)]
+		if want := rt.Owner == "BGP"; tbl.hasPush(rt.Prefix, rt.PrefixLen) != want || inFib != want {
+			t.Errorf("push %s/%d owner %s in table %v fib %v", rt.Prefix, rt.PrefixLen, rt.Owner,
+				tbl.hasPush(rt.Prefix, rt.PrefixLen), inFib)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package nebura
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// nebura APIのメッセージ
+//
+//  0                   1                   2                   3
+//  +-------------------------------+---------------+---------------+
+//  |            Length             |    Version    |     Type      |
+//  +-------------------------------+---------------+---------------+
+//  |                           Sequence                            |
+//  +---------------------------------------------------------------+
+//  |                         VRF ID (version 2から)                |
+//  +---------------------------------------------------------------+
+//  |                         TLVs (Type 1byte, Length 2byte) ...   |
+//
+// Lengthはヘッダを含むメッセージ全体の長さ
+// リクエストには同じSequenceのapiReplyが必ず返る
+// version 1のメッセージはVRF IDがなく、デフォルトのVRFになる
+
+const (
+	NeburaVersion    uint8 = 2
+	NeburaVersionMin uint8 = 1
+)
+
+const NeburaHdrSize = 8
+
+const neburaVrfSize = 4
+
+// hdrSize はversionで変わるヘッダの長さ
+func hdrSize(version uint8) int {
+	if version >= 2 {
+		return NeburaHdrSize + neburaVrfSize
+	}
+	return NeburaHdrSize
+}
+
+const neburaMsgMax = 0xffff
+
+const (
+	apiHello uint8 = 0
+	apiReply uint8 = 0x80
+)
+
+const (
+	tlvVersion   uint8 = 1  // uint8
+	tlvPrefix    uint8 = 2  // prefix長 1byte + アドレス
+	tlvNexthop   uint8 = 3  // アドレス
+	tlvIfIndex   uint8 = 4  // uint32
+	tlvBfd       uint8 = 5  // uint8、BFDの状態では1がUp
+	tlvSegs      uint8 = 6  // IPv6アドレスを並べたもの
+	tlvEndAction uint8 = 7  // uint8
+	tlvSid       uint8 = 8  // IPv6アドレス
+	tlvWithdraw  uint8 = 9  // uint8
+	tlvLsAttr    uint8 = 10 // BGP-LS attribute
+	tlvLsNLRI    uint8 = 11 // BGP-LS NLRIを並べたもの
+	tlvRate      uint8 = 12 // 文字列
+	tlvProType   uint8 = 13 // uint8
+	tlvCode      uint8 = 14 // uint8
+	tlvMessage   uint8 = 15 // 文字列
+	tlvData      uint8 = 16
+	tlvProtocol  uint8 = 17 // 文字列、経路の持ち主
+	tlvGraceTime uint8 = 18 // uint32 秒
+	tlvFamily    uint8 = 19 // uint16 AFI
+	tlvDistance  uint8 = 20 // uint8
+	tlvMetric    uint8 = 21 // uint32
+	tlvReachable uint8 = 22 // uint8
+	tlvResolved  uint8 = 23 // アドレス、直接届くnexthop
+	tlvMultipath uint8 = 24 // IPv6アドレスを並べたもの、IPv4はIPv4-mapped
+	tlvVrfName   uint8 = 25 // 文字列
+	tlvTable     uint8 = 26 // uint32
+	tlvPriority  uint8 = 27 // uint32
+	tlvSrcPrefix uint8 = 28 // prefix長 1byte + アドレス
+	tlvMark      uint8 = 29 // uint32
+	tlvMask      uint8 = 30 // uint32
+	tlvIifName   uint8 = 31 // 文字列
+	tlvDscp      uint8 = 32 // uint8
+	tlvLabel     uint8 = 33 // uint32 MPLSのlabel
+	tlvLabels    uint8 = 34 // uint32のlabelを並べたもの、先頭が一番外側
+	tlvSeg6Mode  uint8 = 35 // uint8 SEG6_IPTUN_MODE_*、なければencap
+	tlvLocal     uint8 = 36 // アドレス、BFDの送信元
+	tlvMinTx     uint8 = 37 // uint32 usec
+	tlvMinRx     uint8 = 38 // uint32 usec
+	tlvMult      uint8 = 39 // uint8
+)
+
+// apiReplyのtlvCode
+const (
+	ApiCodeOK uint8 = iota
+	ApiCodeError
+	ApiCodeBadMessage
+	ApiCodeUnsupportedVersion
+	ApiCodeUnknownType
+	ApiCodeNotFound
+	ApiCodeExists
+)
+
+var (
+	ErrRouteExists   = errors.New("route already exists")
+	ErrRouteNotFound = errors.New("route not found")
+	errUnknownType   = errors.New("unknown message type")
+)
+
+// ApiError はサーバーから返ってきたエラー
+type ApiError struct {
+	Code uint8
+	Msg  string
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("nebura: code %d: %s", e.Code, e.Msg)
+}
+
+func apiErrorCode(err error) uint8 {
+	var tlvErr *tlvError
+	switch {
+	case err == nil:
+		return ApiCodeOK
+	case errors.Is(err, ErrRouteExists):
+		return ApiCodeExists
+	case errors.Is(err, ErrRouteNotFound), errors.Is(err, ErrVrfNotFound):
+		return ApiCodeNotFound
+	case errors.Is(err, errUnknownType):
+		return ApiCodeUnknownType
+	case errors.As(err, &tlvErr):
+		return ApiCodeBadMessage
+	}
+	return ApiCodeError
+}
+
+type ApiHeader struct {
+	Len     uint16
+	Version uint8
+	Type    uint8
+	Seq     uint32
+	VrfID   uint32
+	Body    Body
+}
+
+// lengthはbodyから計算する
+func (api *ApiHeader) writeTo() ([]byte, error) {
+	var body []byte
+
+	if api.Body != nil {
+		var err error
+		if body, err = api.Body.writeTo(); err != nil {
+			return nil, err
+		}
+	}
+
+	size := hdrSize(api.Version) + len(body)
+	if size > neburaMsgMax {
+		return nil, fmt.Errorf("nebura: message too long %d", size)
+	}
+	api.Len = uint16(size)
+
+	buf := binary.BigEndian.AppendUint16(nil, api.Len)
+	buf = append(buf, api.Version, api.Type)
+	buf = binary.BigEndian.AppendUint32(buf, api.Seq)
+	if api.Version >= 2 {
+		buf = binary.BigEndian.AppendUint32(buf, api.VrfID)
+	}
+	return append(buf, body...), nil
+}
+
+func (b *ApiHeader) DecodeApiHdr(data []byte) error {
+	if len(data) < NeburaHdrSize {
+		return fmt.Errorf("nebura: short header")
+	}
+
+	b.Len = binary.BigEndian.Uint16(data[0:2])
+	b.Version = data[2]
+	b.Type = data[3]
+	b.Seq = binary.BigEndian.Uint32(data[4:8])
+
+	if int(b.Len) < hdrSize(b.Version) {
+		return fmt.Errorf("nebura: bad length %d", b.Len)
+	}
+	return nil
+}
+
+// ApiRead は1メッセージ読んでヘッダとbodyを返す
+func ApiRead(r io.Reader) (*ApiHeader, []byte, error) {
+	var header [NeburaHdrSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+
+	hdr := &ApiHeader{}
+	if err := hdr.DecodeApiHdr(header[:]); err != nil {
+		return nil, nil, err
+	}
+
+	buf := make([]byte, int(hdr.Len)-NeburaHdrSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+	if hdr.Version >= 2 {
+		hdr.VrfID = binary.BigEndian.Uint32(buf[:neburaVrfSize])
+		buf = buf[neburaVrfSize:]
+	}
+	return hdr, buf, nil
+}
+
+// TLV
+
+type tlvError struct {
+	Type uint8
+	Msg  string
+}
+
+func (e *tlvError) Error() string {
+	return fmt.Sprintf("nebura: tlv %d: %s", e.Type, e.Msg)
+}
+
+func appendTlv(buf []byte, t uint8, v []byte) []byte {
+	buf = append(buf, t)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(v)))
+	return append(buf, v...)
+}
+
+func appendTlvU8(buf []byte, t uint8, v uint8) []byte {
+	return appendTlv(buf, t, []byte{v})
+}
+
+func appendTlvU32(buf []byte, t uint8, v uint32) []byte {
+	return appendTlv(buf, t, binary.BigEndian.AppendUint32(nil, v))
+}
+
+// IPv4なら4byte、IPv6なら16byteで入れる
+func tlvAddr(ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+func appendTlvIP(buf []byte, t uint8, ip net.IP) []byte {
+	return appendTlv(buf, t, tlvAddr(ip))
+}
+
+func appendTlvLabels(buf []byte, t uint8, labels []uint32) []byte {
+	var v []byte
+	for _, l := range labels {
+		v = binary.BigEndian.AppendUint32(v, l)
+	}
+	return appendTlv(buf, t, v)
+}
+
+func appendTlvPrefix(buf []byte, t uint8, ip net.IP, plen uint8) []byte {
+	return appendTlv(buf, t, append([]byte{plen}, tlvAddr(ip)...))
+}
+
+type tlvs map[uint8][]byte
+
+func tlvDecode(data []byte) (tlvs, error) {
+	t := make(tlvs)
+
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, &tlvError{Msg: "short tlv"}
+		}
+		typ := data[0]
+		size := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+size {
+			return nil, &tlvError{Type: typ, Msg: "overflow"}
+		}
+		if _, ok := t[typ]; ok {
+			return nil, &tlvError{Type: typ, Msg: "duplicate"}
+		}
+		t[typ] = data[3 : 3+size]
+		data = data[3+size:]
+	}
+	return t, nil
+}
+
+func (t tlvs) has(typ uint8) bool {
+	_, ok := t[typ]
+	return ok
+}
+
+func (t tlvs) get(typ uint8) ([]byte, error) {
+	v, ok := t[typ]
+	if !ok {
+		return nil, &tlvError{Type: typ, Msg: "missing"}
+	}
+	return v, nil
+}
+
+func (t tlvs) u8(typ uint8) (uint8, error) {
+	v, err := t.get(typ)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 1 {
+		return 0, &tlvError{Type: typ, Msg: "bad length"}
+	}
+	return v[0], nil
+}
+
+func (t tlvs) u32(typ uint8) (uint32, error) {
+	v, err := t.get(typ)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 4 {
+		return 0, &tlvError{Type: typ, Msg: "bad length"}
+	}
+	return binary.BigEndian.Uint32(v), nil
+}
+
+// afi はAfiIPv4かAfiIPv6のuint16
+func (t tlvs) afi(typ uint8) (uint16, error) {
+	v, err := t.get(typ)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 2 {
+		return 0, &tlvError{Type: typ, Msg: "bad length"}
+	}
+	afi := binary.BigEndian.Uint16(v)
+	if afi != AfiIPv4 && afi != AfiIPv6 {
+		return 0, &tlvError{Type: typ, Msg: "unknown afi"}
+	}
+	return afi, nil
+}
+
+func (t tlvs) ip(typ uint8) (net.IP, error) {
+	v, err := t.get(typ)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != net.IPv4len && len(v) != net.IPv6len {
+		return nil, &tlvError{Type: typ, Msg: "bad address length"}
+	}
+	return net.IP(append([]byte(nil), v...)), nil
+}
+
+func (t tlvs) prefix(typ uint8) (net.IP, uint8, error) {
+	v, err := t.get(typ)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(v) != 1+net.IPv4len && len(v) != 1+net.IPv6len {
+		return nil, 0, &tlvError{Type: typ, Msg: "bad prefix length"}
+	}
+	if int(v[0]) > (len(v)-1)*8 {
+		return nil, 0, &tlvError{Type: typ, Msg: fmt.Sprintf("bad prefix len %d", v[0])}
+	}
+	return net.IP(append([]byte(nil), v[1:]...)), v[0], nil
+}
+
+func (t tlvs) ips(typ uint8) ([]net.IP, error) {
+	v, err := t.get(typ)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) == 0 || len(v)%net.IPv6len != 0 {
+		return nil, &tlvError{Type: typ, Msg: "bad address list"}
+	}
+
+	var ips []net.IP
+	for i := 0; i < len(v); i += net.IPv6len {
+		ips = append(ips, net.IP(append([]byte(nil), v[i:i+net.IPv6len]...)))
+	}
+	return ips, nil
+}
+
+func (t tlvs) labels(typ uint8) ([]uint32, error) {
+	v, err := t.get(typ)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) == 0 || len(v)%4 != 0 {
+		return nil, &tlvError{Type: typ, Msg: "bad label list"}
+	}
+
+	var labels []uint32
+	for i := 0; i < len(v); i += 4 {
+		labels = append(labels, binary.BigEndian.Uint32(v[i:i+4]))
+	}
+	return labels, nil
+}
+
+// apiReplyのbody
+
+type apiReplyBody struct {
+	Code uint8
+	Msg  string
+}
+
+func (b *apiReplyBody) writeTo() ([]byte, error) {
+	buf := appendTlvU8(nil, tlvCode, b.Code)
+	if b.Msg != "" {
+		buf = appendTlv(buf, tlvMessage, []byte(b.Msg))
+	}
+	return buf, nil
+}
+
+// Protocolを入れたクライアントが入れた経路は、切断するとGraceTime後に消える
+type apiHelloBody struct {
+	Version   uint8
+	Protocol  string
+	GraceTime uint32
+}
+
+func (b *apiHelloBody) writeTo() ([]byte, error) {
+	buf := appendTlvU8(nil, tlvVersion, b.Version)
+	if b.Protocol != "" {
+		buf = appendTlv(buf, tlvProtocol, []byte(b.Protocol))
+		buf = appendTlvU32(buf, tlvGraceTime, b.GraceTime)
+	}
+	return buf, nil
+}
+
+type apiDataBody struct {
+	Data []byte
+}
+
+func (b *apiDataBody) writeTo() ([]byte, error) {
+	return appendTlv(nil, tlvData, b.Data), nil
+}
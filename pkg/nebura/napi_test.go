@@ -0,0 +1,293 @@
+package nebura
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestTlvRoundTrip(t *testing.T) {
+	v4 := net.ParseIP("192.0.2.1")
+	v6 := net.ParseIP("2001:db8::1")
+
+	var buf []byte
+	buf = appendTlvU8(buf, tlvVersion, 2)
+	buf = appendTlvU32(buf, tlvIfIndex, 0x01020304)
+	buf = appendTlvIP(buf, tlvNexthop, v4)
+	buf = appendTlvIP(buf, tlvSid, v6)
+	buf = appendTlvPrefix(buf, tlvPrefix, net.ParseIP("198.51.100.0"), 24)
+	buf = appendTlvPrefix(buf, tlvSrcPrefix, net.ParseIP("2001:db8:1::"), 48)
+	buf = appendTlvLabels(buf, tlvLabels, []uint32{16, 1048575})
+	buf = appendTlv(buf, tlvMultipath, append(v4.To16(), v6...))
+	buf = appendTlv(buf, tlvProtocol, []byte("BGP"))
+	buf = appendTlv(buf, tlvData, nil)
+
+	tlv, err := tlvDecode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := tlv.u8(tlvVersion); err != nil || v != 2 {
+		t.Errorf("u8 %d %v, want 2", v, err)
+	}
+	if v, err := tlv.u32(tlvIfIndex); err != nil || v != 0x01020304 {
+		t.Errorf("u32 %#x %v, want 0x01020304", v, err)
+	}
+	// IPv4は4byteで入る
+	if ip, err := tlv.ip(tlvNexthop); err != nil || len(ip) != net.IPv4len || !ip.Equal(v4) {
+		t.Errorf("ip %v %v, want %s in 4 bytes", []byte(ip), err, v4)
+	}
+	if ip, err := tlv.ip(tlvSid); err != nil || !ip.Equal(v6) {
+		t.Errorf("ip %v %v, want %s", ip, err, v6)
+	}
+	if ip, plen, err := tlv.prefix(tlvPrefix); err != nil || plen != 24 || len(ip) != net.IPv4len ||
+		!ip.Equal(net.ParseIP("198.51.100.0")) {
+		t.Errorf("prefix %v/%d %v, want 198.51.100.0/24", ip, plen, err)
+	}
+	if ip, plen, err := tlv.prefix(tlvSrcPrefix); err != nil || plen != 48 || !ip.Equal(net.ParseIP("2001:db8:1::")) {
+		t.Errorf("prefix %v/%d %v, want 2001:db8:1::/48", ip, plen, err)
+	}
+	if l, err := tlv.labels(tlvLabels); err != nil || !reflect.DeepEqual(l, []uint32{16, 1048575}) {
+		t.Errorf("labels %v %v, want [16 1048575]", l, err)
+	}
+	if ips, err := tlv.ips(tlvMultipath); err != nil || len(ips) != 2 || !ips[0].Equal(v4) || !ips[1].Equal(v6) {
+		t.Errorf("ips %v %v, want [%s %s]", ips, err, v4, v6)
+	}
+	if v, err := tlv.get(tlvProtocol); err != nil || string(v) != "BGP" {
+		t.Errorf("get %q %v, want BGP", v, err)
+	}
+	// 長さ0のTLVもあることになる
+	if !tlv.has(tlvData) || len(tlv[tlvData]) != 0 {
+		t.Errorf("empty tlv %v", tlv[tlvData])
+	}
+	if tlv.has(tlvMetric) {
+		t.Errorf("has tlv not sent")
+	}
+
+	// 読んだアドレスはbufと別のメモリ
+	ip, _ := tlv.ip(tlvNexthop)
+	ip[0] = 0
+	if again, _ := tlv.ip(tlvNexthop); !again.Equal(v4) {
+		t.Errorf("ip shares memory with buffer")
+	}
+}
+
+func TestTlvDecodeError(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short", []byte{tlvPrefix, 0}},
+		{"overflow", []byte{tlvPrefix, 0, 5, 24, 10, 0}},
+		{"duplicate", appendTlvU8(appendTlvU8(nil, tlvCode, 0), tlvCode, 1)},
+		{"trailing", append(appendTlvU8(nil, tlvCode, 0), 1)},
+	}
+
+	for _, tt := range tests {
+		_, err := tlvDecode(tt.data)
+		var tlvErr *tlvError
+		if !errors.As(err, &tlvErr) {
+			t.Errorf("%s: err %v, want tlvError", tt.name, err)
+			continue
+		}
+		if apiErrorCode(err) != ApiCodeBadMessage {
+			t.Errorf("%s: code %d, want %d", tt.name, apiErrorCode(err), ApiCodeBadMessage)
+		}
+	}
+}
+
+func TestTlvValueError(t *testing.T) {
+	var buf []byte
+	buf = appendTlv(buf, tlvVersion, []byte{1, 2})
+	buf = appendTlv(buf, tlvIfIndex, []byte{1, 2, 3})
+	buf = appendTlv(buf, tlvNexthop, []byte{10, 0, 0})
+	buf = appendTlv(buf, tlvPrefix, []byte{24, 10, 0, 0})
+	buf = appendTlvPrefix(buf, tlvSrcPrefix, net.ParseIP("10.0.0.0"), 33)
+	buf = appendTlv(buf, tlvMultipath, make([]byte, net.IPv6len+4))
+	buf = appendTlv(buf, tlvSegs, nil)
+	buf = appendTlv(buf, tlvLabels, []byte{0, 0, 16})
+	buf = appendTlv(buf, tlvLabel, nil)
+	buf = appendTlv(buf, tlvFamily, []byte{0, 3})
+	buf = appendTlv(buf, tlvMask, []byte{0, 1, 0})
+
+	tlv, err := tlvDecode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := map[string]error{}
+	_, errs["u8 length"] = tlv.u8(tlvVersion)
+	_, errs["u32 length"] = tlv.u32(tlvIfIndex)
+	_, errs["ip length"] = tlv.ip(tlvNexthop)
+	_, _, errs["prefix length"] = tlv.prefix(tlvPrefix)
+	_, _, errs["prefix len"] = tlv.prefix(tlvSrcPrefix)
+	_, errs["ips length"] = tlv.ips(tlvMultipath)
+	_, errs["ips empty"] = tlv.ips(tlvSegs)
+	_, errs["labels length"] = tlv.labels(tlvLabels)
+	_, errs["labels empty"] = tlv.labels(tlvLabel)
+	_, errs["afi unknown"] = tlv.afi(tlvFamily)
+	_, errs["afi length"] = tlv.afi(tlvMask)
+	_, errs["missing"] = tlv.u8(tlvCode)
+
+	for name, err := range errs {
+		var tlvErr *tlvError
+		if !errors.As(err, &tlvErr) {
+			t.Errorf("%s: err %v, want tlvError", name, err)
+		}
+	}
+}
+
+// クライアントの経路メッセージをサーバーがそのまま読める
+func TestRouteMessageRoundTrip(t *testing.T) {
+	s := &NservSession{Protocol: "BGP"}
+
+	add := &NclientRouteAdd{
+		Nexthop:   net.ParseIP("10.0.0.1").To4(),
+		NLRI:      Prefix{Prefix: net.ParseIP("192.0.2.0").To4(), PrefixLen: 24},
+		Multipath: []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")},
+	}
+	rt, err := ipv4RouteParse(s, staticRouteTlvs(t, add))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rt.Prefix.Equal(add.NLRI.Prefix) || rt.PrefixLen != 24 || !rt.Nexthop.Equal(add.Nexthop) ||
+		rt.RoutingProtocol != "BGP" || rt.Owner != "BGP" {
+		t.Errorf("ipv4 route %+v", rt)
+	}
+	if len(rt.Multipath) != 2 || !rt.Multipath[0].Nexthop.Equal(add.Multipath[0]) ||
+		len(rt.Multipath[1].Nexthop) != net.IPv4len {
+		t.Errorf("ipv4 multipath %v", rt.Multipath)
+	}
+
+	add6 := &NclientIPv6RouteAdd{
+		Nexthop: net.ParseIP("fe80::1"),
+		NLRI:    Prefix{Prefix: net.ParseIP("2001:db8::"), PrefixLen: 32},
+		Index:   300,
+	}
+	rt, err = ipv6RouteParse(&NservSession{}, staticRouteTlvs(t, add6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rt.Prefix.Equal(add6.NLRI.Prefix) || rt.PrefixLen != 32 || !rt.Nexthop.Equal(add6.Nexthop) ||
+		rt.Index != 300 || rt.RoutingProtocol != "static" || rt.Owner != "" {
+		t.Errorf("ipv6 route %+v", rt)
+	}
+
+	// IPv4とIPv6を取り違えたメッセージは受けない
+	if _, err := ipv6RouteParse(s, staticRouteTlvs(t, add)); err == nil {
+		t.Errorf("ipv4 route accepted as ipv6")
+	}
+	if _, err := ipv4RouteParse(s, staticRouteTlvs(t, add6)); err == nil {
+		t.Errorf("ipv6 route accepted as ipv4")
+	}
+
+	del := &NclientRouteDelete{NLRI: Prefix{Prefix: net.ParseIP("192.0.2.0").To4(), PrefixLen: 24}}
+	prefix, plen, err := staticRouteTlvs(t, del).prefix(tlvPrefix)
+	if err != nil || !prefix.Equal(del.NLRI.Prefix) || plen != 24 {
+		t.Errorf("delete prefix %v/%d %v", prefix, plen, err)
+	}
+}
+
+// addは重複で、deleteはなければエラーになり、replaceはどちらでも入る
+func TestNserverRouteReplaceDelete(t *testing.T) {
+	n, fib, path := nserverTest(t)
+	nserverConnected(n, "10.0.0.0/24", 2)
+
+	c, err := NclientDial(path, "BGP", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	prefix := net.ParseIP("192.0.2.0").To4()
+	if err := c.SendNclientIPv4RouteReplace(prefix, net.ParseIP("10.0.0.1").To4(), 24); err != nil {
+		t.Fatal(err)
+	}
+
+	var apiErr *ApiError
+	err = c.SendNclientIPv4Route(prefix, net.ParseIP("10.0.0.2").To4(), 24)
+	if !errors.As(err, &apiErr) || apiErr.Code != ApiCodeExists {
+		t.Errorf("duplicate add: %v, want code %d", err, ApiCodeExists)
+	}
+
+	if err := c.SendNclientIPv4RouteReplace(prefix, net.ParseIP("10.0.0.2").To4(), 24); err != nil {
+		t.Fatal(err)
+	}
+	if rt, ok := memRoute(fib, "192.0.2.0/24"); !ok || !rt.Nexthop.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("replaced route %+v %v, want via 10.0.0.2", rt, ok)
+	}
+
+	if err := c.SendNclientIPv4RouteDelete(prefix, 24); err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendNclientIPv4RouteDelete(prefix, 24)
+	if !errors.As(err, &apiErr) || apiErr.Code != ApiCodeNotFound {
+		t.Errorf("delete missing: %v, want code %d", err, ApiCodeNotFound)
+	}
+}
+
+func TestApiHeaderRoundTrip(t *testing.T) {
+	body := &apiReplyBody{Code: ApiCodeNotFound, Msg: "x"}
+	bodyLen := 3 + 1 + 3 + 1
+
+	for _, v := range []uint8{1, 2} {
+		api := &ApiHeader{Version: v, Type: IPv4RouteAdd, Seq: 0x0a0b0c0d, VrfID: 100, Body: body}
+		buf, err := api.writeTo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) != hdrSize(v)+bodyLen || int(api.Len) != len(buf) {
+			t.Errorf("v%d: %d bytes len %d, want %d", v, len(buf), api.Len, hdrSize(v)+bodyLen)
+		}
+
+		hdr, data, err := ApiRead(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Len != api.Len || hdr.Version != v || hdr.Type != IPv4RouteAdd || hdr.Seq != api.Seq {
+			t.Errorf("v%d: header %+v, want %+v", v, hdr, api)
+		}
+		// version 1にはVRF IDがない
+		want := uint32(100)
+		if v == 1 {
+			want = 0
+		}
+		if hdr.VrfID != want {
+			t.Errorf("v%d: vrf %d, want %d", v, hdr.VrfID, want)
+		}
+
+		tlv, err := tlvDecode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, _ := tlv.u8(tlvCode); code != ApiCodeNotFound || string(tlv[tlvMessage]) != "x" {
+			t.Errorf("v%d: body %v", v, tlv)
+		}
+	}
+}
+
+func TestApiHeaderError(t *testing.T) {
+	hdr := &ApiHeader{}
+	if err := hdr.DecodeApiHdr(make([]byte, NeburaHdrSize-1)); err == nil {
+		t.Errorf("short header decoded")
+	}
+
+	// version 2はVRF IDの分だけ長くないといけない
+	buf, _ := (&ApiHeader{Version: 1}).writeTo()
+	buf[2] = 2
+	if _, _, err := ApiRead(bytes.NewReader(buf)); err == nil {
+		t.Errorf("v2 header without vrf id read")
+	}
+
+	buf, _ = (&ApiHeader{Version: 2, Body: &apiDataBody{Data: make([]byte, 8)}}).writeTo()
+	if _, _, err := ApiRead(bytes.NewReader(buf[:len(buf)-1])); err == nil {
+		t.Errorf("truncated body read")
+	}
+
+	big := &ApiHeader{Version: 2, Body: &apiDataBody{Data: make([]byte, neburaMsgMax)}}
+	if _, err := big.writeTo(); err == nil {
+		t.Errorf("message over %d bytes encoded", neburaMsgMax)
+	}
+}
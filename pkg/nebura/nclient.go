@@ -1,32 +1,49 @@
 package nebura
 
 import (
-	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 type Body interface {
 	writeTo() ([]byte, error)
 }
 
-type ApiHeader struct {
-	Len  uint16
-	Type uint8
-	Body Body
-}
-
 type Prefix struct {
 	PrefixLen uint8
 	Prefix    net.IP
 }
 
 type NclientRouteAdd struct {
-	Nexthop Prefix
+	Nexthop   net.IP
+	NLRI      Prefix
+	Multipath []net.IP
+}
+
+// NclientRouteDelete はIPv4とIPv6の経路削除で使う
+type NclientRouteDelete struct {
+	NLRI Prefix
+}
+
+// NclientSeg6Delete はencapする経路とEnd actionのSIDの削除で使う
+type NclientSeg6Delete struct {
+	Prefix Prefix
+	Sid    net.IP
+}
+
+type NclientStaticRoute struct {
+	Nexthop net.IP
 	NLRI    Prefix
-	Flag    uint8
+	Bfd     uint8
+}
+
+type NclientLsUpdate struct {
+	Withdraw uint8
+	Attr     []byte
+	NLRI     []byte
 }
 
 type NclientXdp struct {
@@ -35,14 +52,15 @@ type NclientXdp struct {
 }
 
 type NclientIPv6RouteAdd struct {
-	Nexthop Prefix
+	Nexthop net.IP
 	NLRI    Prefix
-	Flag    uint8
+	Index   uint32
 }
 
 type NclientSeg6Add struct {
-	EncapPrefix net.IP
-	Segs        net.IP
+	EncapPrefix Prefix
+	Segs        []net.IP
+	Mode        uint8
 }
 
 type NclientSrEndAction struct {
@@ -57,40 +75,109 @@ type NclientTcNetem struct {
 }
 
 type Nclient struct {
-	Type string
-	Conn net.Conn
+	Type    string
+	Conn    net.Conn
+	Version uint8
+	Vrf     uint32     // リクエストを送るVRF、0ならデフォルト
+	mu      sync.Mutex // リクエストは1つずつ
+	seq     uint32
+	resp    chan nclientMsg
+
+	nmu    sync.Mutex
+	notify func(RouteEvent)
+	nht    map[string]func(NexthopState) // 登録したVRFとnexthopごとのcb
+	bfd    map[string]map[int]func(bool) // BFDに登録したpeerごとのcb
+	bfdID  int
+}
+
+type nclientMsg struct {
+	hdr  *ApiHeader
+	data []byte
 }
 
 func (n *NclientRouteAdd) writeTo() ([]byte, error) {
 
 	var buf []byte
 
-	dstBlen := (int(n.NLRI.PrefixLen) + 7) / 8
-	buf = append(buf, n.NLRI.PrefixLen)
-	buf = append(buf, n.NLRI.Prefix[:dstBlen]...)
+	buf = appendTlvPrefix(buf, tlvPrefix, n.NLRI.Prefix, n.NLRI.PrefixLen)
+	buf = appendTlvIP(buf, tlvNexthop, n.Nexthop)
+	if len(n.Multipath) > 0 {
+		var mp []byte
+		for _, nh := range n.Multipath {
+			mp = append(mp, nh.To16()...)
+		}
+		buf = appendTlv(buf, tlvMultipath, mp)
+	}
+
+	return buf, nil
+}
+
+func (n *NclientRouteDelete) writeTo() ([]byte, error) {
+	return appendTlvPrefix(nil, tlvPrefix, n.NLRI.Prefix, n.NLRI.PrefixLen), nil
+}
+
+func (n *NclientSeg6Delete) writeTo() ([]byte, error) {
+	if n.Sid != nil {
+		return appendTlvIP(nil, tlvSid, n.Sid), nil
+	}
+	return appendTlvPrefix(nil, tlvPrefix, n.Prefix.Prefix, n.Prefix.PrefixLen), nil
+}
 
-	buf = append(buf, n.Nexthop.PrefixLen)
-	buf = append(buf, n.Nexthop.Prefix[:dstBlen]...)
-	buf = append(buf, n.Flag)
+func (n *NclientStaticRoute) writeTo() ([]byte, error) {
+
+	var buf []byte
+
+	buf = appendTlvPrefix(buf, tlvPrefix, n.NLRI.Prefix, n.NLRI.PrefixLen)
+	buf = appendTlvIP(buf, tlvNexthop, n.Nexthop)
+	buf = appendTlvU8(buf, tlvBfd, n.Bfd)
+
+	return buf, nil
+}
+
+func (n *NclientLsUpdate) writeTo() ([]byte, error) {
+
+	var buf []byte
+
+	buf = appendTlvU8(buf, tlvWithdraw, n.Withdraw)
+	buf = appendTlv(buf, tlvLsAttr, n.Attr)
+	buf = appendTlv(buf, tlvLsNLRI, n.NLRI)
 
 	return buf, nil
 }
 
+type nclientEmpty struct{}
+
+func (n *nclientEmpty) writeTo() ([]byte, error) {
+	return nil, nil
+}
+
 func (n *NclientIPv6RouteAdd) writeTo() ([]byte, error) {
 
 	var buf []byte
-	buf = append(buf, n.NLRI.Prefix[:]...)
-	buf = append(buf, n.NLRI.PrefixLen)
-	buf = append(buf, n.Nexthop.Prefix[:]...)
+
+	buf = appendTlvPrefix(buf, tlvPrefix, n.NLRI.Prefix, n.NLRI.PrefixLen)
+	buf = appendTlvIP(buf, tlvNexthop, n.Nexthop)
+	if n.Index != 0 {
+		buf = appendTlvU32(buf, tlvIfIndex, n.Index)
+	}
 
 	return buf, nil
 }
 
 func (n *NclientSeg6Add) writeTo() ([]byte, error) {
 
+	var segs []byte
+	for _, s := range n.Segs {
+		if s.To16() == nil {
+			return nil, fmt.Errorf("nebura: bad segment %v", s)
+		}
+		segs = append(segs, s.To16()...)
+	}
+
 	var buf []byte
-	buf = append(buf, n.EncapPrefix...)
-	buf = append(buf, n.Segs...) // segsに合わせて可変長にする必要がある
+	buf = appendTlvPrefix(buf, tlvPrefix, n.EncapPrefix.Prefix, n.EncapPrefix.PrefixLen)
+	buf = appendTlv(buf, tlvSegs, segs)
+	buf = appendTlvU8(buf, tlvSeg6Mode, n.Mode)
 
 	return buf, nil
 }
@@ -98,119 +185,318 @@ func (n *NclientSeg6Add) writeTo() ([]byte, error) {
 func (n *NclientSrEndAction) writeTo() ([]byte, error) {
 	var buf []byte
 
-	buf = append(buf, n.EndAction)
-	buf = append(buf, n.EncapAddr...)
-	buf = append(buf, n.NextHop...)
+	buf = appendTlvU8(buf, tlvEndAction, n.EndAction)
+	buf = appendTlvIP(buf, tlvSid, n.EncapAddr)
+	buf = appendTlvIP(buf, tlvNexthop, n.NextHop)
 
 	return buf, nil
 }
-func (n *NclientTcNetem) writeTo() ([]byte, error) {
 
-	var buf []byte
+func (n *NclientTcNetem) writeTo() ([]byte, error) {
 
-	for i := 0; i < len(n.rate); i++ {
-		buf = append(buf, []byte(n.rate)[i])
+	index, err := net.InterfaceByName(n.inter)
+	if err != nil {
+		return nil, err
 	}
 
-	index, _ := net.InterfaceByName(n.inter)
-	buf = append(buf, byte(index.Index))
+	var buf []byte
+	buf = appendTlv(buf, tlvRate, []byte(n.rate))
+	buf = appendTlvU32(buf, tlvIfIndex, uint32(index.Index))
 	return buf, nil
 }
 
 func (n *NclientXdp) writeTo() ([]byte, error) {
-	var buf []byte
 
-	buf = append(buf, n.ProType)
-	index, _ := net.InterfaceByName(n.Inter)
-	buf = append(buf, byte(index.Index))
+	index, err := net.InterfaceByName(n.Inter)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	buf = appendTlvU8(buf, tlvProType, n.ProType)
+	buf = appendTlvU32(buf, tlvIfIndex, uint32(index.Index))
 	return buf, nil
 }
 
-func (api *ApiHeader) writeTo() ([]byte, error) {
-	var buf []byte
-	buf = make([]byte, 3)
-	binary.BigEndian.PutUint16(buf[0:2], NeburaHdrSize) // 可変になる
-	buf[2] = uint8(api.Type)
+// request はメッセージを送って同じSequenceのapiReplyが返るまで読む
+// reply以外のメッセージはfに渡す
+func (n *Nclient) request(rtype uint8, body Body, f func(t tlvs) error) error {
+	defer n.mu.Unlock()
+	n.mu.Lock()
 
-	hdr, err := api.Body.writeTo()
+	n.seq++
+	api := &ApiHeader{
+		Version: n.Version,
+		Type:    rtype,
+		Seq:     n.seq,
+		VrfID:   n.Vrf,
+		Body:    body,
+	}
 
+	buf, err := api.writeTo()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	log.Printf("Send buf %v...\n", buf)
+	if _, err := n.Conn.Write(buf); err != nil {
+		return err
 	}
 
-	return append(buf, hdr...), nil
+	for {
+		m, ok := <-n.resp
+		if !ok {
+			return fmt.Errorf("nebura: connection closed")
+		}
+		hdr, data := m.hdr, m.data
+		if hdr.Seq != api.Seq {
+			log.Printf("nebura: unexpected seq %d", hdr.Seq)
+			continue
+		}
+
+		t, err := tlvDecode(data)
+		if err != nil {
+			return err
+		}
+
+		if hdr.Type != apiReply {
+			if f == nil {
+				continue
+			}
+			if err := f(t); err != nil {
+				return err
+			}
+			continue
+		}
+
+		code, err := t.u8(tlvCode)
+		if err != nil {
+			return err
+		}
+		if code != ApiCodeOK {
+			return &ApiError{Code: code, Msg: string(t[tlvMessage])}
+		}
+		return nil
+	}
+}
+
+// recvLoop はサーバーからのメッセージを読み、redistributeとNHTとBFDの通知以外をrequestに渡す
+func (n *Nclient) recvLoop() {
+	defer close(n.resp)
+
+	for {
+		hdr, data, err := ApiRead(n.Conn)
+		if err != nil {
+			return
+		}
+
+		switch hdr.Type {
+		case redistAdd, redistDelete:
+			n.routeEvent(hdr, data)
+		case nhtUpdate:
+			n.nexthopEvent(hdr, data)
+		case bfdUpdate:
+			n.bfdEvent(data)
+		default:
+			n.resp <- nclientMsg{hdr, data}
+		}
+	}
 }
 
 func (n *Nclient) sendNclientAPI(rtype uint8, body Body) error {
-	api := &ApiHeader{
-		Len:  NeburaHdrSize,
-		Type: rtype,
-		Body: body,
+	return n.request(rtype, body, nil)
+}
+
+// hello でサーバーとバージョンを合わせる
+func (n *Nclient) hello(proto string, grace time.Duration) error {
+	n.Version = NeburaVersion
+
+	body := &apiHelloBody{
+		Version:   NeburaVersion,
+		Protocol:  proto,
+		GraceTime: uint32(grace / time.Second),
 	}
 
-	buf, _ := api.writeTo()
+	return n.request(apiHello, body, func(t tlvs) error {
+		v, err := t.u8(tlvVersion)
+		if err != nil {
+			return err
+		}
+		if v < NeburaVersionMin || v > NeburaVersion {
+			return fmt.Errorf("nebura: unsupported version %d", v)
+		}
+		n.Version = v
+		return nil
+	})
+}
 
-	log.Printf("Send buf %v...\n", buf)
-	n.Conn.Write(buf)
-	return nil
+func (n *Nclient) SendNclientIPv4Route(prefix net.IP, nexthop net.IP, len uint8) error {
+	return n.sendNclientIPv4Route(IPv4RouteAdd, prefix, nexthop, len)
+}
+
+// SendNclientIPv4RouteReplace は経路がなければ追加する
+func (n *Nclient) SendNclientIPv4RouteReplace(prefix net.IP, nexthop net.IP, len uint8) error {
+	return n.sendNclientIPv4Route(IPv4RouteReplace, prefix, nexthop, len)
+}
+
+func (n *Nclient) sendNclientIPv4Route(rtype uint8, prefix net.IP, nexthop net.IP, len uint8) error {
+
+	body := &NclientRouteAdd{
+		Nexthop: nexthop.To4(),
+		NLRI: Prefix{
+			Prefix:    prefix.To4(),
+			PrefixLen: len,
+		},
+	}
+
+	return n.sendNclientAPI(rtype, body)
 }
 
-func (n *Nclient) SendNclientIPv4Route(prefix net.IP, nexthop net.IP, len uint8, flag uint8) error {
+// SendNclientIPv4RouteMultipath はnexthopsでECMPする経路を入れる、同じprefixがあれば置き換える
+func (n *Nclient) SendNclientIPv4RouteMultipath(prefix net.IP, nexthops []net.IP, plen uint8) error {
+	if len(nexthops) == 0 {
+		return fmt.Errorf("nebura: no nexthop")
+	}
 
 	body := &NclientRouteAdd{
-		Nexthop: Prefix{
-			Prefix:    nexthop,
-			PrefixLen: 24,
+		Nexthop: nexthops[0].To4(),
+		NLRI: Prefix{
+			Prefix:    prefix.To4(),
+			PrefixLen: plen,
+		},
+		Multipath: nexthops[1:],
+	}
+
+	return n.sendNclientAPI(IPv4RouteReplace, body)
+}
+
+func (n *Nclient) SendNclientIPv4RouteDelete(prefix net.IP, len uint8) error {
+
+	body := &NclientRouteDelete{
+		NLRI: Prefix{
+			Prefix:    prefix.To4(),
+			PrefixLen: len,
 		},
+	}
+
+	return n.sendNclientAPI(IPv4RouteDelete, body)
+}
+
+func (n *Nclient) SendNclientStaticRoute(prefix string, nexthop string, len uint8, bfd bool) error {
+
+	body := &NclientStaticRoute{
+		Nexthop: net.ParseIP(nexthop),
 		NLRI: Prefix{
-			Prefix:    prefix,
+			Prefix:    net.ParseIP(prefix),
 			PrefixLen: len,
 		},
-		Flag: flag,
 	}
 
-	NeburaHdrSize = 14
+	if bfd {
+		body.Bfd = 1
+	}
+
+	return n.sendNclientAPI(staticRoute, body)
+}
 
-	n.sendNclientAPI(1, body)
-	return nil
+// SendNclientStaticRouteDelete はstaticの経路を消す、BFDで見ていればそれもやめる
+func (n *Nclient) SendNclientStaticRouteDelete(prefix string, len uint8) error {
+
+	body := &NclientRouteDelete{
+		NLRI: Prefix{
+			Prefix:    net.ParseIP(prefix),
+			PrefixLen: len,
+		},
+	}
 
+	return n.sendNclientAPI(staticRouteDelete, body)
 }
 
-func (n *Nclient) SendNclientIPv6Route(prefix string, nexthop string, len uint8, index uint8) error {
+func (n *Nclient) SendNclientIPv6Route(prefix string, nexthop string, len uint8, index uint32) error {
+	return n.sendNclientIPv6Route(IPv6RouteAdd, prefix, nexthop, len, index)
+}
 
-	NexthopPrefix := net.ParseIP(nexthop).To16()
-	AddPrefix := net.ParseIP(prefix).To16() // TODO: なぜか直接メンバ内でTo16()を実行すると、バイナリが入らないのでここで作ってから入れています
+func (n *Nclient) SendNclientIPv6RouteReplace(prefix string, nexthop string, len uint8, index uint32) error {
+	return n.sendNclientIPv6Route(IPv6RouteReplace, prefix, nexthop, len, index)
+}
+
+func (n *Nclient) sendNclientIPv6Route(rtype uint8, prefix string, nexthop string, len uint8, index uint32) error {
 
 	body := &NclientIPv6RouteAdd{
-		Nexthop: Prefix{
-			Prefix: NexthopPrefix,
-		},
+		Nexthop: net.ParseIP(nexthop).To16(),
 		NLRI: Prefix{
-			Prefix:    AddPrefix,
+			Prefix:    net.ParseIP(prefix).To16(),
 			PrefixLen: len,
 		},
+		Index: index,
 	}
 
-	NeburaHdrSize = 36
+	return n.sendNclientAPI(rtype, body)
+}
+
+func (n *Nclient) SendNclientIPv6RouteDelete(prefix string, len uint8) error {
+
+	body := &NclientRouteDelete{
+		NLRI: Prefix{
+			Prefix:    net.ParseIP(prefix).To16(),
+			PrefixLen: len,
+		},
+	}
 
-	fmt.Printf("hex:%s", hex.Dump(body.Nexthop.Prefix))
-	fmt.Printf("hex:%s", body.Nexthop.Prefix.String())
+	return n.sendNclientAPI(IPv6RouteDelete, body)
+}
 
-	n.sendNclientAPI(2, body)
-	return nil
+// SendNclientSeg6Add はprefix/plenの経路をsegsの順に通るようにencapする
+// modeはip routeと同じ名前 (inline, encap, encap.red, l2encap)、空ならencap
+func (n *Nclient) SendNclientSeg6Add(prefix string, plen uint8, segs []string, mode string) error {
+	return n.sendNclientSeg6(segsAdd, prefix, plen, segs, mode)
+}
 
+func (n *Nclient) SendNclientSeg6Replace(prefix string, plen uint8, segs []string, mode string) error {
+	return n.sendNclientSeg6(segsReplace, prefix, plen, segs, mode)
 }
 
-func (n *Nclient) SendNclientSeg6Add(encapaddr string, segs string) error {
+func (n *Nclient) sendNclientSeg6(rtype uint8, prefix string, plen uint8, segs []string, mode string) error {
+	m, err := Seg6ModeParse(mode)
+	if err != nil {
+		return err
+	}
+
 	body := &NclientSeg6Add{
-		EncapPrefix: net.ParseIP(encapaddr).To4(),
-		Segs:        net.ParseIP(segs).To16(), // まだシングルでしか入れられない
+		EncapPrefix: Prefix{
+			Prefix:    net.ParseIP(prefix),
+			PrefixLen: plen,
+		},
+		Mode: m,
+	}
+	if body.EncapPrefix.Prefix == nil {
+		return fmt.Errorf("seg6: bad prefix %q", prefix)
+	}
+	if len(segs) == 0 {
+		return fmt.Errorf("seg6: no segments")
+	}
+	for _, seg := range segs {
+		ip := net.ParseIP(seg)
+		if ip == nil {
+			return fmt.Errorf("seg6: bad segment %q", seg)
+		}
+		body.Segs = append(body.Segs, ip)
+	}
+
+	return n.sendNclientAPI(rtype, body)
+}
+
+func (n *Nclient) SendNclientSeg6Delete(prefix string, plen uint8) error {
+	ip := net.ParseIP(prefix)
+	if ip == nil {
+		return fmt.Errorf("seg6: bad prefix %q", prefix)
+	}
+
+	body := &NclientSeg6Delete{
+		Prefix: Prefix{Prefix: ip, PrefixLen: plen},
 	}
 
-	NeburaHdrSize = 23
-	fmt.Printf("%v", body)
-	n.sendNclientAPI(3, body)
-	return nil
+	return n.sendNclientAPI(segsDelete, body)
 }
 
 func endActionType(en string) uint8 {
@@ -226,6 +512,14 @@ func endActionType(en string) uint8 {
 }
 
 func (n *Nclient) SendNclientSRendAction(en string, nh string, ea string) error {
+	return n.sendNclientSRendAction(srEndAction, en, nh, ea)
+}
+
+func (n *Nclient) SendNclientSRendActionReplace(en string, nh string, ea string) error {
+	return n.sendNclientSRendAction(srEndActionReplace, en, nh, ea)
+}
+
+func (n *Nclient) sendNclientSRendAction(rtype uint8, en string, nh string, ea string) error {
 
 	body := &NclientSrEndAction{
 		EndAction: endActionType(en),
@@ -233,9 +527,17 @@ func (n *Nclient) SendNclientSRendAction(en string, nh string, ea string) error
 		NextHop:   net.ParseIP(nh).To4(),
 	}
 
-	NeburaHdrSize = 24
-	n.sendNclientAPI(4, body)
-	return nil
+	return n.sendNclientAPI(rtype, body)
+}
+
+// eaはEnd actionを入れたSID
+func (n *Nclient) SendNclientSRendActionDelete(ea string) error {
+
+	body := &NclientSeg6Delete{
+		Sid: net.ParseIP(ea).To16(),
+	}
+
+	return n.sendNclientAPI(srEndActionDelete, body)
 }
 
 func (n *Nclient) SendNclientTcNetem(inter string, rate string) error {
@@ -245,11 +547,7 @@ func (n *Nclient) SendNclientTcNetem(inter string, rate string) error {
 		rate:  rate,
 	}
 
-	NeburaHdrSize = 9
-
-	n.sendNclientAPI(5, body)
-	return nil
-
+	return n.sendNclientAPI(tcNetem, body)
 }
 
 func (n *Nclient) SendNclientXdp(pro uint8, inter string) error {
@@ -259,23 +557,81 @@ func (n *Nclient) SendNclientXdp(pro uint8, inter string) error {
 		Inter:   inter,
 	}
 
-	NeburaHdrSize = 5
+	return n.sendNclientAPI(xdpTest, body)
+}
+
+// nlriはBGP-LS NLRIを並べたもの
+func (n *Nclient) SendNclientLsUpdate(nlri []byte, attr []byte, withdraw bool) error {
 
-	n.sendNclientAPI(6, body)
-	return nil
+	body := &NclientLsUpdate{
+		Attr: attr,
+		NLRI: nlri,
+	}
 
+	if withdraw {
+		body.Withdraw = 1
+	}
+
+	return n.sendNclientAPI(lsUpdate, body)
+}
+
+// LsGraphGet はneburaが持っているBGP-LSのグラフを取得する
+// グラフは複数のメッセージに分けて送られてきて、最後にapiReplyが来る
+func (n *Nclient) LsGraphGet() (*LsGraphSnapshot, error) {
+
+	g := &LsGraphSnapshot{}
+	err := n.request(lsGraphGet, &nclientEmpty{}, func(t tlvs) error {
+		data, err := t.get(tlvData)
+		if err != nil {
+			return err
+		}
+		return g.decode(data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (n *Nclient) Close() error {
+	return n.Conn.Close()
 }
 
 func NclientInit() *Nclient {
-	conn, err := net.Dial("unix", "/tmp/nebura.sock")
+	n, err := NclientRegister("", 0)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	return n
+}
+
+// NclientRegister はprotoとして経路を持つクライアントを作る
+// 切断するとneburaはgrace後にこのプロトコルの経路を消す
+func NclientRegister(proto string, grace time.Duration) (*Nclient, error) {
+	return NclientDial(NeburaSock, proto, grace)
+}
+
+// NclientDial はpathのneburaにNclientRegisterと同じように繋ぐ
+func NclientDial(path string, proto string, grace time.Duration) (*Nclient, error) {
+	conn, err := net.Dial("unix", path)
+
+	if err != nil {
+		return nil, err
+	}
+
 	n := &Nclient{
+		Type: proto,
 		Conn: conn,
+		resp: make(chan nclientMsg, 16),
 	}
+	go n.recvLoop()
 
-	return n
+	if err := n.hello(proto, grace); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return n, nil
 }
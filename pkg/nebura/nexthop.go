@@ -0,0 +1,256 @@
+package nebura
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// nexthopの解決
+// 経路のnexthopをRibで引いて、connectedなら直接、それ以外は引いた経路の解決済みのnexthopを使う
+// 引いた経路が変わったらnexthopを使っている経路を解決し直す
+
+var ErrNexthopUnreachable = errors.New("nexthop unreachable")
+
+type ribRouteKey struct {
+	prefix string
+	plen   uint8
+	proto  string
+	owner  string
+}
+
+func ribRouteKeyOf(rt *RIBPrefix) ribRouteKey {
+	return ribRouteKey{rt.Prefix.String(), rt.PrefixLen, rt.RoutingProtocol, rt.Owner}
+}
+
+// NexthopResolver はnexthopごとにそれを使っている経路を覚えておく
+// VRFごとに1つあり、そのVRFのRibだけで解決する
+type NexthopResolver struct {
+	mu   sync.Mutex
+	rib  *Rib
+	deps map[string]map[ribRouteKey]bool
+}
+
+func NexthopResolverInit(rib *Rib) *NexthopResolver {
+	return &NexthopResolver{
+		rib:  rib,
+		deps: make(map[string]map[ribRouteKey]bool),
+	}
+}
+
+// 解決が必要なのはneburaが入れるnexthopのある経路だけ
+func nexthopRecursive(rt *RIBPrefix) bool {
+	return fibManaged(rt) && rt.Nexthop != nil
+}
+
+// nexthopResolvable はdepのnexthopをvで解決してよいか
+// BGPの経路と同じプロトコルの経路では解決しない、default routeも使わない
+func nexthopResolvable(v, dep *RIBPrefix) bool {
+	switch {
+	case v.PrefixLen == 0:
+		return false
+	case v.RoutingProtocol == "BGP" || v.RoutingProtocol == "iBGP":
+		return false
+	case fibManaged(v) && v.RoutingProtocol == dep.RoutingProtocol:
+		return false
+	case v.PrefixLen == dep.PrefixLen && v.Prefix.Equal(dep.Prefix):
+		return false
+	}
+	return true
+}
+
+// lookup はnhに直接届くnexthopとinterfaceを返す
+func (nr *NexthopResolver) lookup(rt *RIBPrefix) (net.IP, int, error) {
+	nh := rt.Nexthop
+
+	// link-localはinterfaceが決まっていればそのまま使う
+	if nh.IsLinkLocalUnicast() && rt.Index != 0 {
+		return nh, rt.Index, nil
+	}
+
+	v, ok := nr.match(rt)
+	if !ok {
+		if nr.rib.vrf != VrfDefault {
+			return nil, 0, ErrNexthopUnreachable
+		}
+		// Ribにconnectedがない時 (kernelを見ていない時) はinterfaceのアドレスで探す
+		index, err := NexthopPrefixIndex(nh.String())
+		if err != nil {
+			return nil, 0, err
+		}
+		return nh, index, nil
+	}
+	return nexthopVia(nh, &v)
+}
+
+// match はrtのnexthopの解決に使うRibの経路を返す
+func (nr *NexthopResolver) match(rt *RIBPrefix) (RIBPrefix, bool) {
+	return nr.rib.LookupBest(rt.Nexthop, func(v *RIBPrefix) bool {
+		return !nexthopResolvable(v, rt)
+	})
+}
+
+// nexthopVia はvで解決したnhの直接届くnexthopとinterfaceを返す
+func nexthopVia(nh net.IP, v *RIBPrefix) (net.IP, int, error) {
+	switch {
+	case v.Nexthop == nil:
+		// connected
+		return nh, v.Index, nil
+	case !fibManaged(v):
+		// kernelの経路のnexthopは直接届く
+		return v.Nexthop, v.Index, nil
+	case v.Resolved != nil:
+		return v.Resolved, v.Index, nil
+	}
+	return nil, 0, ErrNexthopUnreachable
+}
+
+// Resolve はRibのNexthopHook
+// ECMPの経路はどれか1つでも届けばactive
+func (nr *NexthopResolver) Resolve(rt *RIBPrefix) {
+	if !nexthopRecursive(rt) {
+		return
+	}
+
+	nh, index, err := nr.lookup(rt)
+	if err != nil {
+		rt.Resolved = nil
+		log.Printf("NHT %s/%d via %s: %v\n", rt.Prefix.String(), rt.PrefixLen, rt.Nexthop.String(), err)
+	} else {
+		rt.Resolved = nh
+		rt.Index = index
+	}
+	rt.Inactive = rt.Resolved == nil
+
+	// Multipathは経路のコピーと共有しているので作り直す
+	multipath := make([]RIBNexthop, len(rt.Multipath))
+	for i, m := range rt.Multipath {
+		multipath[i] = RIBNexthop{Nexthop: m.Nexthop}
+		path := *rt
+		path.Nexthop = m.Nexthop
+		path.Index = 0
+		if nh, index, err := nr.lookup(&path); err == nil {
+			multipath[i].Resolved = nh
+			multipath[i].Index = index
+			rt.Inactive = false
+		}
+	}
+	rt.Multipath = multipath
+
+	nr.track(rt)
+}
+
+// ribNexthops はrtが使っているnexthopを全部返す
+func ribNexthops(rt *RIBPrefix) []net.IP {
+	nhs := []net.IP{rt.Nexthop}
+	for _, m := range rt.Multipath {
+		nhs = append(nhs, m.Nexthop)
+	}
+	return nhs
+}
+
+func ribUsesNexthop(rt *RIBPrefix, nh string) bool {
+	for _, v := range ribNexthops(rt) {
+		if v.String() == nh {
+			return true
+		}
+	}
+	return false
+}
+
+// ribSameResolution はaとbのnexthopの解決が同じか
+func ribSameResolution(a, b *RIBPrefix) bool {
+	if a.Inactive != b.Inactive || a.Index != b.Index || !a.Resolved.Equal(b.Resolved) ||
+		len(a.Multipath) != len(b.Multipath) {
+		return false
+	}
+	for i := range a.Multipath {
+		if a.Multipath[i].Index != b.Multipath[i].Index || !a.Multipath[i].Resolved.Equal(b.Multipath[i].Resolved) {
+			return false
+		}
+	}
+	return true
+}
+
+func (nr *NexthopResolver) track(rt *RIBPrefix) {
+	defer nr.mu.Unlock()
+	nr.mu.Lock()
+
+	for _, nh := range ribNexthops(rt) {
+		key := nh.String()
+		if nr.deps[key] == nil {
+			nr.deps[key] = make(map[ribRouteKey]bool)
+		}
+		nr.deps[key][ribRouteKeyOf(rt)] = true
+	}
+}
+
+func (nr *NexthopResolver) untrack(rt *RIBPrefix) {
+	defer nr.mu.Unlock()
+	nr.mu.Lock()
+
+	for _, nh := range ribNexthops(rt) {
+		nr.untrackKey(nh.String(), ribRouteKeyOf(rt))
+	}
+}
+
+func (nr *NexthopResolver) untrackKey(nh string, k ribRouteKey) {
+	delete(nr.deps[nh], k)
+	if len(nr.deps[nh]) == 0 {
+		delete(nr.deps, nh)
+	}
+}
+
+// dependents はprefixに含まれるnexthopを使っている経路を返す
+func (nr *NexthopResolver) dependents(rt *RIBPrefix) map[string][]ribRouteKey {
+	defer nr.mu.Unlock()
+	nr.mu.Lock()
+
+	prefix := fibPrefix(rt.Prefix, rt.PrefixLen)
+	deps := make(map[string][]ribRouteKey)
+	for nh, routes := range nr.deps {
+		if !prefix.Contains(net.ParseIP(nh)) {
+			continue
+		}
+		for k := range routes {
+			deps[nh] = append(deps[nh], k)
+		}
+	}
+	return deps
+}
+
+// Update はRibの経路が変わった時にイベント処理のgoroutineから呼ぶ
+// 変わった経路で解決していた経路を解決し直す、変わった経路を使っている経路がさらに変わることもある
+func (nr *NexthopResolver) Update(rt RIBPrefix, del bool) {
+	if del && nexthopRecursive(&rt) {
+		nr.untrack(&rt)
+	}
+
+	for nh, keys := range nr.dependents(&rt) {
+		for _, k := range keys {
+			if k == ribRouteKeyOf(&rt) {
+				continue
+			}
+
+			cur, ok := nr.rib.Get(net.ParseIP(k.prefix), k.plen, k.proto, k.owner)
+			if !ok || !ribUsesNexthop(&cur, nh) {
+				nr.mu.Lock()
+				nr.untrackKey(nh, k)
+				nr.mu.Unlock()
+				continue
+			}
+
+			next := cur
+			nr.Resolve(&next)
+			if ribSameResolution(&next, &cur) {
+				continue
+			}
+
+			log.Printf("NHT %s/%d via %s changed\n", cur.Prefix.String(), cur.PrefixLen, nh)
+			if err := nr.rib.Replace(cur); err != nil {
+				log.Printf("NHT %s/%d: %v", cur.Prefix.String(), cur.PrefixLen, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package nebura
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func nexthopTestRoute(t *testing.T, prefix string, proto string, nexthop string) RIBPrefix {
+	t.Helper()
+	rt := ribTestRoute(t, prefix, proto)
+	rt.Nexthop = net.ParseIP(nexthop).To4()
+	return rt
+}
+
+// nexthopCheck はRibの経路がviaのnexthop、devのinterfaceで解決されているか確かめる
+// viaが空なら届かない
+func nexthopCheck(t *testing.T, rib *Rib, prefix string, proto string, via string, dev int) {
+	t.Helper()
+	want := ribTestRoute(t, prefix, proto)
+	rt, ok := rib.Get(want.Prefix, want.PrefixLen, proto, "")
+	if !ok {
+		t.Errorf("%s %s not found", proto, prefix)
+		return
+	}
+	if via == "" {
+		if !rt.Inactive || rt.Resolved != nil {
+			t.Errorf("%s %s resolved via %s dev %d, want unreachable", proto, prefix, rt.Resolved, rt.Index)
+		}
+		return
+	}
+	if rt.Inactive || !rt.Resolved.Equal(net.ParseIP(via)) || rt.Index != dev {
+		t.Errorf("%s %s resolved via %s dev %d inactive %v, want via %s dev %d", proto, prefix,
+			rt.Resolved, rt.Index, rt.Inactive, via, dev)
+	}
+}
+
+func nexthopTest(t *testing.T) (*Nserver, *Rib) {
+	t.Helper()
+	ns, err := NserverInit(MemFibInit(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		prefix string
+		index  int
+	}{{"10.0.0.0/24", 2}, {"10.0.1.0/24", 3}} {
+		if err := kernelRouteUpdate(syscall.RTM_NEWROUTE, c.prefix, c.index).NecliEvent(ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ns, &ns.Rib
+}
+
+func TestNexthopRecursive(t *testing.T) {
+	_, rib := nexthopTest(t)
+
+	routes := []RIBPrefix{
+		nexthopTestRoute(t, "172.16.0.0/16", "ospf", "10.0.0.1"),
+		nexthopTestRoute(t, "203.0.113.0/24", "BGP", "172.16.1.1"),
+		// BGPの経路では解決しない
+		nexthopTestRoute(t, "198.51.100.0/24", "BGP", "203.0.113.1"),
+	}
+	for _, rt := range routes {
+		if err := rib.Add(rt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nexthopCheck(t, rib, "172.16.0.0/16", "ospf", "10.0.0.1", 2)
+	nexthopCheck(t, rib, "203.0.113.0/24", "BGP", "10.0.0.1", 2)
+	nexthopCheck(t, rib, "198.51.100.0/24", "BGP", "", 0)
+
+	// ECMPはどれか1つ届けばactive
+	mp := nexthopTestRoute(t, "198.51.100.128/25", "ospf", "172.31.0.1")
+	mp.Multipath = []RIBNexthop{{Nexthop: net.ParseIP("10.0.1.1").To4()}}
+	if err := rib.Add(mp); err != nil {
+		t.Fatal(err)
+	}
+	rt, _ := rib.Get(mp.Prefix, mp.PrefixLen, "ospf", "")
+	if rt.Inactive || rt.Resolved != nil || !rt.Multipath[0].Resolved.Equal(net.ParseIP("10.0.1.1")) ||
+		rt.Multipath[0].Index != 3 {
+		t.Errorf("multipath %+v inactive %v, want only 10.0.1.1 dev 3 resolved", rt.Multipath, rt.Inactive)
+	}
+}
+
+// 解決に使っていた経路が変わると、それを使う経路も解決し直す
+func TestNexthopUpdate(t *testing.T) {
+	_, rib := nexthopTest(t)
+
+	igp := nexthopTestRoute(t, "172.16.0.0/16", "ospf", "10.0.0.1")
+	if err := rib.Add(igp); err != nil {
+		t.Fatal(err)
+	}
+	if err := rib.Add(nexthopTestRoute(t, "203.0.113.0/24", "BGP", "172.16.1.1")); err != nil {
+		t.Fatal(err)
+	}
+	nexthopCheck(t, rib, "203.0.113.0/24", "BGP", "10.0.0.1", 2)
+
+	igp.Nexthop = net.ParseIP("10.0.1.1").To4()
+	if err := rib.Replace(igp); err != nil {
+		t.Fatal(err)
+	}
+	nexthopCheck(t, rib, "203.0.113.0/24", "BGP", "10.0.1.1", 3)
+
+	// より長いprefixができればそちらで解決する
+	if err := rib.Add(nexthopTestRoute(t, "172.16.1.0/24", "static", "10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	nexthopCheck(t, rib, "203.0.113.0/24", "BGP", "10.0.0.1", 2)
+
+	if err := rib.Delete(net.ParseIP("172.16.1.0").To4(), 24, "static", ""); err != nil {
+		t.Fatal(err)
+	}
+	nexthopCheck(t, rib, "203.0.113.0/24", "BGP", "10.0.1.1", 3)
+
+	if err := rib.Delete(igp.Prefix, igp.PrefixLen, "ospf", ""); err != nil {
+		t.Fatal(err)
+	}
+	nexthopCheck(t, rib, "203.0.113.0/24", "BGP", "", 0)
+	if _, ok := rib.Best(net.ParseIP("203.0.113.0").To4(), 24); ok {
+		t.Errorf("unreachable route still in FIB")
+	}
+
+	// 戻ってくればまた解決する
+	if err := rib.Add(igp); err != nil {
+		t.Fatal(err)
+	}
+	nexthopCheck(t, rib, "203.0.113.0/24", "BGP", "10.0.1.1", 3)
+}
+
+// staticの経路は別のstaticの経路や自分自身では解決しない
+func TestNexthopStaticOverStatic(t *testing.T) {
+	_, rib := nexthopTest(t)
+
+	routes := []RIBPrefix{
+		nexthopTestRoute(t, "172.16.0.0/16", "static", "10.0.0.1"),
+		nexthopTestRoute(t, "203.0.113.0/24", "static", "172.16.1.1"),
+		nexthopTestRoute(t, "198.51.100.0/24", "ospf", "172.16.1.1"),
+		nexthopTestRoute(t, "172.17.0.0/16", "ospf", "172.17.0.1"),
+	}
+	for _, rt := range routes {
+		if err := rib.Add(rt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nexthopCheck(t, rib, "172.16.0.0/16", "static", "10.0.0.1", 2)
+	nexthopCheck(t, rib, "203.0.113.0/24", "static", "", 0)
+	nexthopCheck(t, rib, "198.51.100.0/24", "ospf", "10.0.0.1", 2)
+	nexthopCheck(t, rib, "172.17.0.0/16", "ospf", "", 0)
+}
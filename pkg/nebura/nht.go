@@ -0,0 +1,252 @@
+package nebura
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// nexthop tracking (NHT)
+// クライアントはnexthopを登録して、そのnexthopに届くかどうかと解決に使った経路を受け取る
+// 登録するとまず今の状態がnhtUpdateで送られ、そのあとはRibの変更で状態が変わるたびに送られる
+// nexthopはヘッダのVRFのRibで解決する
+
+// NexthopState はNHTで受け取るnexthopの状態
+type NexthopState struct {
+	Nexthop   net.IP
+	Reachable bool
+	Route     Prefix // 解決に使ったRibの経路、届かなければ空
+	Protocol  string
+	Metric    uint32
+	Resolved  net.IP // 直接届くnexthop
+	Index     uint32
+	Vrf       uint32
+}
+
+func (a *NexthopState) equal(b *NexthopState) bool {
+	return a.Reachable == b.Reachable &&
+		a.Route.PrefixLen == b.Route.PrefixLen && a.Route.Prefix.Equal(b.Route.Prefix) &&
+		a.Protocol == b.Protocol && a.Metric == b.Metric &&
+		a.Resolved.Equal(b.Resolved) && a.Index == b.Index
+}
+
+// state はprotoのクライアントから見たnhの状態を返す
+// 解決のルールはRibの経路のnexthopと同じ
+func (nr *NexthopResolver) state(nh net.IP, proto string) NexthopState {
+	st := NexthopState{Nexthop: nh, Vrf: nr.rib.vrf}
+
+	rt := &RIBPrefix{Nexthop: nh, RoutingProtocol: proto}
+	v, ok := nr.match(rt)
+	if !ok {
+		if nr.rib.vrf != VrfDefault {
+			return st
+		}
+		// kernelを見ていない時はinterfaceのアドレスで探す
+		index, err := NexthopPrefixIndex(nh.String())
+		if err != nil {
+			return st
+		}
+		st.Reachable = true
+		st.Protocol = "connected"
+		st.Resolved = nh
+		st.Index = uint32(index)
+		return st
+	}
+
+	resolved, index, err := nexthopVia(nh, &v)
+	if err != nil {
+		return st
+	}
+
+	st.Reachable = true
+	st.Route = Prefix{PrefixLen: v.PrefixLen, Prefix: v.Prefix}
+	st.Protocol = v.RoutingProtocol
+	st.Metric = v.Metric
+	st.Resolved = resolved
+	st.Index = uint32(index)
+	return st
+}
+
+type nhtBody struct {
+	Nexthop net.IP
+}
+
+func (b *nhtBody) writeTo() ([]byte, error) {
+	return appendTlvIP(nil, tlvNexthop, b.Nexthop), nil
+}
+
+type nhtUpdateBody struct {
+	State *NexthopState
+}
+
+func (b *nhtUpdateBody) writeTo() ([]byte, error) {
+	st := b.State
+
+	var buf []byte
+	buf = appendTlvIP(buf, tlvNexthop, st.Nexthop)
+	if !st.Reachable {
+		return appendTlvU8(buf, tlvReachable, 0), nil
+	}
+	buf = appendTlvU8(buf, tlvReachable, 1)
+	if st.Route.Prefix != nil {
+		buf = appendTlvPrefix(buf, tlvPrefix, st.Route.Prefix, st.Route.PrefixLen)
+	}
+	buf = appendTlv(buf, tlvProtocol, []byte(st.Protocol))
+	buf = appendTlvU32(buf, tlvMetric, st.Metric)
+	buf = appendTlvIP(buf, tlvResolved, st.Resolved)
+	buf = appendTlvU32(buf, tlvIfIndex, st.Index)
+	return buf, nil
+}
+
+func nhtUpdateDecode(t tlvs) (NexthopState, error) {
+	var st NexthopState
+	var err error
+
+	if st.Nexthop, err = t.ip(tlvNexthop); err != nil {
+		return st, err
+	}
+	reach, err := t.u8(tlvReachable)
+	if err != nil || reach == 0 {
+		return st, err
+	}
+	st.Reachable = true
+
+	if t.has(tlvPrefix) {
+		if st.Route.Prefix, st.Route.PrefixLen, err = t.prefix(tlvPrefix); err != nil {
+			return st, err
+		}
+	}
+	st.Protocol = string(t[tlvProtocol])
+	if st.Metric, err = t.u32(tlvMetric); err != nil {
+		return st, err
+	}
+	if st.Resolved, err = t.ip(tlvResolved); err != nil {
+		return st, err
+	}
+	if st.Index, err = t.u32(tlvIfIndex); err != nil {
+		return st, err
+	}
+	return st, nil
+}
+
+func nhtKey(vrf uint32, nh net.IP) string {
+	return fmt.Sprintf("%d %s", vrf, nh.String())
+}
+
+// NhtRegister は今の状態を送ってから、以降の変更を送るように登録する
+func (ns *Nserver) NhtRegister(v *Vrf, s *NservSession, req *ApiHeader, t tlvs) error {
+	nh, err := t.ip(tlvNexthop)
+	if err != nil {
+		return err
+	}
+
+	st := v.Nexthop.state(nh, s.routeProtocol())
+	if err := s.write(req, nhtUpdate, &nhtUpdateBody{State: &st}); err != nil {
+		return err
+	}
+
+	s.nhts[nhtKey(v.ID, nh)] = st
+	log.Printf("Nebura session %d NHT register %s vrf %d reachable %v\n", s.ID, nh.String(), v.ID, st.Reachable)
+	return nil
+}
+
+func (ns *Nserver) NhtUnregister(v *Vrf, s *NservSession, t tlvs) error {
+	nh, err := t.ip(tlvNexthop)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.nhts[nhtKey(v.ID, nh)]; !ok {
+		return ErrRouteNotFound
+	}
+
+	delete(s.nhts, nhtKey(v.ID, nh))
+	return nil
+}
+
+// nhtNotify はRibの経路が変わった時に、その経路に含まれるnexthopの状態を見直す
+func (ns *Nserver) nhtNotify(rt RIBPrefix) {
+	ns.mu.Lock()
+	var sessions []*NservSession
+	for _, s := range ns.sessions {
+		sessions = append(sessions, s)
+	}
+	ns.mu.Unlock()
+
+	v, ok := ns.vrfs.get(rt.VrfID)
+	if !ok {
+		return
+	}
+
+	prefix := fibPrefix(rt.Prefix, rt.PrefixLen)
+	for _, s := range sessions {
+		for key, old := range s.nhts {
+			if old.Vrf != rt.VrfID || !prefix.Contains(old.Nexthop) {
+				continue
+			}
+
+			st := v.Nexthop.state(old.Nexthop, s.routeProtocol())
+			if st.equal(&old) {
+				continue
+			}
+			s.nhts[key] = st
+
+			// 通知はSequence 0で送る
+			notify := &ApiHeader{Version: s.Version, VrfID: st.Vrf}
+			if err := s.write(notify, nhtUpdate, &nhtUpdateBody{State: &st}); err != nil {
+				log.Printf("nebura session %d NHT: %v", s.ID, err)
+			}
+		}
+	}
+}
+
+// NexthopRegister はnの今のVRFでnhの状態をfで受け取る、fは登録が返る前に今の状態で1回呼ばれる
+// fはVRFとnexthopごとに持つので、別のnexthopを登録しても前のfはそのまま呼ばれる
+// fは受信のgoroutineから呼ばれるので、f内でneburaにリクエストを送らないこと
+func (n *Nclient) NexthopRegister(nh net.IP, f func(NexthopState)) error {
+	key := nhtKey(n.Vrf, nh)
+
+	n.nmu.Lock()
+	if n.nht == nil {
+		n.nht = make(map[string]func(NexthopState))
+	}
+	n.nht[key] = f
+	n.nmu.Unlock()
+
+	if err := n.sendNclientAPI(nhtRegister, &nhtBody{Nexthop: nh}); err != nil {
+		n.nmu.Lock()
+		delete(n.nht, key)
+		n.nmu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (n *Nclient) NexthopUnregister(nh net.IP) error {
+	n.nmu.Lock()
+	delete(n.nht, nhtKey(n.Vrf, nh))
+	n.nmu.Unlock()
+
+	return n.sendNclientAPI(nhtUnregister, &nhtBody{Nexthop: nh})
+}
+
+func (n *Nclient) nexthopEvent(hdr *ApiHeader, data []byte) {
+	t, err := tlvDecode(data)
+	if err != nil {
+		log.Printf("nebura NHT: %v", err)
+		return
+	}
+	st, err := nhtUpdateDecode(t)
+	if err != nil {
+		log.Printf("nebura NHT: %v", err)
+		return
+	}
+	st.Vrf = hdr.VrfID
+
+	n.nmu.Lock()
+	f := n.nht[nhtKey(st.Vrf, st.Nexthop)]
+	n.nmu.Unlock()
+
+	if f != nil {
+		f(st)
+	}
+}
@@ -1,33 +1,18 @@
 package nebura
 
-/*
-#cgo LDFLAGS: -L. -lnetlink_code
-#include "libnetlink.h"
-#include "netlink_code.h"
-*/
-import "C"
-
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang XdpProg ../bpf/test.c -- -I../bpf_map
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"sync"
-
-	"github.com/cilium/ebpf"
-	"github.com/vishvananda/netlink"
-	"github.com/vishvananda/netlink/nl"
 )
 
 type ApiType uint8
 
-var NeburaHdrSize uint16
-
-var r Rib = Init()
 var RibCount = 0
 var iface string
 
@@ -37,13 +22,30 @@ type (
 	}
 
 	NservClientRead struct {
-		hdr  []byte
+		s    *NservSession
+		hdr  *ApiHeader
 		data []byte
 	}
 	NservClientWrite struct{}
 	NservMsgSend     struct {
-		api  ApiHeader
-		data []byte
+		s   *NservSession
+		api ApiHeader
+		tlv tlvs
+	}
+	// NservClientClose はクライアントが切断した時に送られる
+	NservClientClose struct {
+		s *NservSession
+	}
+	// NservOwnerFlush は切断したクライアントの経路を消す
+	NservOwnerFlush struct {
+		owner string
+	}
+	// NservStaticBfd はBFDで見ているstaticの経路の状態が変わった
+	NservStaticBfd struct {
+		key   staticBfdKey
+		gen   int
+		route RIBPrefix
+		up    bool
 	}
 )
 
@@ -54,331 +56,754 @@ const (
 	srEndAction  uint8 = 4
 	tcNetem      uint8 = 5
 	xdpTest      uint8 = 6 //将来的に変えたいかも
+	staticRoute  uint8 = 7
+	lsUpdate     uint8 = 8
+	lsGraphGet   uint8 = 9
+
+	IPv4RouteDelete    uint8 = 10
+	IPv4RouteReplace   uint8 = 11
+	IPv6RouteDelete    uint8 = 12
+	IPv6RouteReplace   uint8 = 13
+	segsDelete         uint8 = 14
+	segsReplace        uint8 = 15
+	srEndActionDelete  uint8 = 16
+	srEndActionReplace uint8 = 17
+
+	redistSubscribe   uint8 = 18
+	redistUnsubscribe uint8 = 19
+	redistAdd         uint8 = 20 // サーバーから送る
+	redistDelete      uint8 = 21 // サーバーから送る
+
+	nhtRegister   uint8 = 22
+	nhtUnregister uint8 = 23
+	nhtUpdate     uint8 = 24 // サーバーから送る
+
+	vrfAdd    uint8 = 25
+	vrfDelete uint8 = 26
+	vrfBind   uint8 = 27
+
+	ruleAdd     uint8 = 28
+	ruleDelete  uint8 = 29
+	ruleReplace uint8 = 30
+
+	mplsLabelAdd     uint8 = 31
+	mplsLabelDelete  uint8 = 32
+	mplsLabelReplace uint8 = 33
+	mplsPushAdd      uint8 = 34
+	mplsPushDelete   uint8 = 35
+	mplsPushReplace  uint8 = 36
+
+	staticRouteDelete uint8 = 37
+
+	bfdRegister   uint8 = 38
+	bfdUnregister uint8 = 39
+	bfdUpdate     uint8 = 40 // サーバーから送る
 )
 
-type RIBPrefix struct {
-	PrefixLen       uint8
-	Prefix          net.IP
-	Nexthop         net.IP
-	Index           uint8
-	RoutingProtocol string
-}
-
-type Rib struct {
-	mu     *sync.Mutex
-	Preifx map[string][]RIBPrefix // mapでもつ必要性は？ stringだと検索が遅くなる。BGPを0番としてみるともっと早くなるかも?(配列化する?)
-}
-
 type Nserver struct {
-	lis        net.Listener
-	Conn       net.Conn
-	ceventChan chan ClientEvent
-	Rib        Rib
+	lis          net.Listener
+	ceventChan   chan ClientEvent
+	mu           sync.Mutex
+	sessions     map[uint32]*NservSession
+	sessionID    uint32
+	owners       map[string]*nservOwner
+	Rib          Rib
+	Bfd          *Bfd
+	LsGraph      *LsGraph
+	Seg6         *Seg6Table
+	Pbr          *PbrTable
+	Mpls         *MplsTable
+	Fib          Fib
+	fibAsync     bool
+	vrfs         *vrfTable
+	kernel       bool                          // kernelの経路を取り込んでいる
+	staticBfd    map[staticBfdKey]staticBfdReg // イベント処理のgoroutineだけが触る
+	staticBfdGen int
+
+	KernelReinstall bool // kernelから消されたneburaの経路を入れ直す
 }
 
+// NexthopPrefixIndex はprefixを含むアドレスを持っているinterfaceのindexを返す
 func NexthopPrefixIndex(prefix string) (int, error) {
+	ip := net.ParseIP(prefix)
+	if ip == nil {
+		return 0, fmt.Errorf("nexthop: bad address %q", prefix)
+	}
 
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		log.Fatal(err)
-		return 0, nil
+		return 0, err
 	}
 
-	var b bool = false
-	var index int
-
 	for _, i := range ifaces {
 		addrs, err := i.Addrs()
 		if err != nil {
-			log.Fatal(err)
 			continue
 		}
-
 		for _, a := range addrs {
-			if !b {
-				_, ipnet, _ := net.ParseCIDR(a.String())
-				ip := net.ParseIP(prefix)
-				b = ipnet.Contains(ip)
-				index = i.Index
-				break
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.Contains(ip) {
+				return i.Index, nil
 			}
-
 		}
-
 	}
+	return 0, fmt.Errorf("nexthop %s: %w", prefix, ErrNexthopUnreachable)
+}
 
-	return index, nil
+// vrfOnlyDefault はデフォルトのVRFでしか使えないメッセージ
+func vrfOnlyDefault(rtype uint8) bool {
+	switch rtype {
+	case segsAdd, segsReplace, segsDelete, srEndAction, srEndActionReplace, srEndActionDelete,
+		tcNetem, xdpTest, lsUpdate, lsGraphGet, vrfAdd, vrfDelete, vrfBind,
+		ruleAdd, ruleDelete, ruleReplace, mplsLabelAdd, mplsLabelDelete, mplsLabelReplace,
+		mplsPushAdd, mplsPushDelete, mplsPushReplace, bfdRegister, bfdUnregister:
+		return true
+	}
+	return false
 }
 
 func (n NservMsgSend) NecliEvent(ns *Nserver) error {
 
+	v, err := ns.Vrf(n.api.VrfID)
+	if err == nil && v.ID != VrfDefault && vrfOnlyDefault(n.api.Type) {
+		err = fmt.Errorf("type %d: only in default vrf", n.api.Type)
+	}
+	if err != nil {
+		log.Printf("api type %d: %v", n.api.Type, err)
+		return n.s.reply(&n.api, err)
+	}
+
 	switch n.api.Type {
 	case IPv4RouteAdd:
-		NetlinkSendRouteAdd(n.data)
+		err = NetlinkSendRouteAdd(v, n.s, n.tlv)
+	case IPv4RouteReplace:
+		err = NetlinkSendRouteReplace(v, n.s, n.tlv)
+	case IPv4RouteDelete:
+		err = NetlinkSendRouteDelete(v, n.s, n.tlv)
 	case IPv6RouteAdd:
-		NetlinkSendIPv6RouteAdd(n.data)
+		err = NetlinkSendIPv6RouteAdd(v, n.s, n.tlv)
+	case IPv6RouteReplace:
+		err = NetlinkSendIPv6RouteReplace(v, n.s, n.tlv)
+	case IPv6RouteDelete:
+		err = NetlinkSendIPv6RouteDelete(v, n.s, n.tlv)
 	case segsAdd:
-		NetlinkSendSegsAdd(n.data)
+		err = ns.NetlinkSendSegsAdd(n.s, n.tlv)
+	case segsReplace:
+		err = ns.NetlinkSendSegsReplace(n.s, n.tlv)
+	case segsDelete:
+		err = ns.NetlinkSendSegsDelete(n.tlv)
 	case srEndAction:
-		NetlinkSendSrEndAction(n.data)
+		err = ns.NetlinkSendSrEndAction(n.s, n.tlv)
+	case srEndActionReplace:
+		err = ns.NetlinkSendSrEndActionReplace(n.s, n.tlv)
+	case srEndActionDelete:
+		err = ns.NetlinkSendSrEndActionDelete(n.tlv)
 	case tcNetem:
-		NetlinkSendTcNetem(n.data)
+		err = ns.NetlinkSendTcNetem(n.tlv)
 	case xdpTest:
-		XdpSet(n.data)
+		err = ns.XdpSet(n.tlv)
+	case staticRoute:
+		err = ns.NetlinkSendStaticRouteAdd(v, n.s, n.tlv)
+	case staticRouteDelete:
+		err = ns.NetlinkSendStaticRouteDelete(v, n.s, n.tlv)
+	case bfdRegister:
+		err = ns.BfdRegister(n.s, n.tlv)
+	case bfdUnregister:
+		err = ns.BfdUnregister(n.s, n.tlv)
+	case lsUpdate:
+		err = ns.LsUpdate(n.tlv)
+	case lsGraphGet:
+		err = ns.LsGraphSend(n.s, &n.api)
+	case redistSubscribe:
+		err = ns.RedistSubscribe(v, n.s, &n.api, n.tlv)
+	case redistUnsubscribe:
+		err = ns.RedistUnsubscribe(v, n.s, n.tlv)
+	case nhtRegister:
+		err = ns.NhtRegister(v, n.s, &n.api, n.tlv)
+	case nhtUnregister:
+		err = ns.NhtUnregister(v, n.s, n.tlv)
+	case vrfAdd:
+		err = ns.VrfAdd(n.tlv)
+	case vrfDelete:
+		err = ns.VrfDelete(n.tlv)
+	case vrfBind:
+		err = ns.VrfBind(n.tlv)
+	case ruleAdd:
+		err = ns.PbrRuleAdd(n.s, n.tlv)
+	case ruleReplace:
+		err = ns.PbrRuleReplace(n.s, n.tlv)
+	case ruleDelete:
+		err = ns.PbrRuleDelete(n.s, n.tlv)
+	case mplsLabelAdd:
+		err = ns.MplsLabelAdd(n.s, n.tlv)
+	case mplsLabelReplace:
+		err = ns.MplsLabelReplace(n.s, n.tlv)
+	case mplsLabelDelete:
+		err = ns.MplsLabelDelete(n.tlv)
+	case mplsPushAdd:
+		err = ns.MplsPushAdd(n.s, n.tlv)
+	case mplsPushReplace:
+		err = ns.MplsPushReplace(n.s, n.tlv)
+	case mplsPushDelete:
+		err = ns.MplsPushDelete(n.tlv)
 	default:
-		log.Printf("not type")
+		err = fmt.Errorf("type %d: %w", n.api.Type, errUnknownType)
 	}
 
-	return nil
+	if err != nil {
+		log.Printf("api type %d: %v", n.api.Type, err)
+	}
+	return n.s.reply(&n.api, err)
 }
 
 func (n NservClientRead) NecliEvent(ns *Nserver) error {
-	hd := &ApiHeader{}
-	hd.DecodeApiHdr(n.hdr)
+	s := n.s
+	switch {
+	case n.hdr.Type == apiHello:
+		return s.hello(ns, n.hdr, n.data)
+	case s.Version == 0:
+		return s.write(n.hdr, apiReply, &apiReplyBody{
+			Code: ApiCodeBadMessage,
+			Msg:  "hello required",
+		})
+	case n.hdr.Version != s.Version:
+		return s.write(n.hdr, apiReply, &apiReplyBody{
+			Code: ApiCodeUnsupportedVersion,
+			Msg:  fmt.Sprintf("version %d not negotiated", n.hdr.Version),
+		})
+	}
+
+	t, err := tlvDecode(n.data)
+	if err != nil {
+		return n.s.reply(n.hdr, err)
+	}
+
+	return NservMsgSend{n.s, *n.hdr, t}.NecliEvent(ns)
+}
+
+func (n NservClientClose) NecliEvent(ns *Nserver) error {
+	ns.sessionDelete(n.s)
+	return nil
+}
 
-	ns.ceventChan <- NservMsgSend{*hd, n.data}
+func (n NservOwnerFlush) NecliEvent(ns *Nserver) error {
+	ns.ownerFlush(n.owner)
 	return nil
 }
 
+func (n NservStaticBfd) NecliEvent(ns *Nserver) error {
+	if reg, ok := ns.staticBfd[n.key]; !ok || reg.gen != n.gen {
+		// 登録をやめた後に届いた通知
+		return nil
+	}
+	rib := ns.vrfRib(&n.route)
+	if rib == nil {
+		return fmt.Errorf("vrf %d: %w", n.route.VrfID, ErrVrfNotFound)
+	}
+	if !n.up {
+		err := rib.Delete(n.route.Prefix, n.route.PrefixLen, n.route.RoutingProtocol, n.route.Owner)
+		if errors.Is(err, ErrRouteNotFound) {
+			return nil
+		}
+		return err
+	}
+	return rib.Replace(n.route)
+}
+
+// ClientSendEvent はRibを変更するイベントを1つのgoroutineで順番に処理する
 func (n *Nserver) ClientSendEvent() error {
 
 	for {
 		select {
 		case e := <-n.ceventChan:
 			if err := e.NecliEvent(n); err != nil {
-				return err
+				log.Printf("event: %v", err)
 			}
 		}
 	}
 }
 
-func NetlinkSendStaticRouteAdd(data []byte) error {
-	dstPrefixLen := uint8(data[0])
-	dstPrefix := prefixPadding(data[1:5])
-	srcPrefix := prefixPadding(data[6:10])
-
-	index, err := NexthopPrefixIndex(srcPrefix.String())
-
+func (ns *Nserver) NetlinkSendStaticRouteAdd(v *Vrf, s *NservSession, t tlvs) error {
+	dstPrefix, dstPrefixLen, err := t.prefix(tlvPrefix)
 	if err != nil {
-		return nil
+		return err
+	}
+	srcPrefix, err := t.ip(tlvNexthop)
+	if err != nil {
+		return err
+	}
+	if dstPrefix.To4() == nil || srcPrefix.To4() == nil {
+		return fmt.Errorf("static route: not ipv4")
+	}
 
+	var bfd bool
+	if t.has(tlvBfd) {
+		b, err := t.u8(tlvBfd)
+		if err != nil {
+			return err
+		}
+		bfd = b == 1
 	}
 
-	C.ipv4_route_add(C.CString(dstPrefix.String()), C.CString(srcPrefix.String()),
-		C.int(index), C.int(dstPrefixLen), true)
+	// interfaceはNexthopResolverが決める
+	a := RIBPrefix{
+		Prefix:          dstPrefix,
+		PrefixLen:       dstPrefixLen,
+		Nexthop:         srcPrefix,
+		RoutingProtocol: "static",
+		Owner:           s.Protocol,
+		VrfID:           v.ID,
+	}
 
-	return nil
-}
+	key := staticBfdKey{vrf: v.ID, prefix: fmt.Sprintf("%s/%d", dstPrefix, dstPrefixLen), owner: s.Protocol}
+	if reg, ok := ns.staticBfd[key]; ok {
+		if bfd && reg.peer.Equal(srcPrefix) {
+			// 同じ経路は登録済み
+			return nil
+		}
+		// nexthopかBFDの有無が変わったので前の登録はやめる
+		ns.staticBfdUnregister(key)
+		v.Rib.Delete(dstPrefix, dstPrefixLen, "static", s.Protocol)
+	}
 
-func XdpSet(data []byte) error {
-	type Collect struct {
-		Prog *ebpf.Program `ebpf:"xdp_drop"`
+	if !bfd {
+		return v.Rib.Add(a)
 	}
-	fmt.Printf("XDP test")
 
-	link, err := netlink.LinkByName("veth2")
+	// BFDがUpしている間だけ経路を入れる
+	// 通知はRegisterが返る前に来ることがあるので、登録の区別には自分の番号を使う
+	ns.staticBfdGen++
+	gen := ns.staticBfdGen
+	id, err := ns.Bfd.Register(srcPrefix, nil, func(up bool) {
+		ns.ceventChan <- NservStaticBfd{key: key, gen: gen, route: a, up: up}
+	})
 	if err != nil {
-		panic(err)
+		return err
 	}
-	var collect = &Collect{}
-	spec, err := LoadXdpProg() // test用 TODO : SETする用のNetlinkのコードとローダーをかく
+	ns.staticBfd[key] = staticBfdReg{peer: srcPrefix, id: id, gen: gen}
+	return nil
+}
+
+// NetlinkSendStaticRouteDelete はstaticの経路を消して、BFDで見ていればそれもやめる
+func (ns *Nserver) NetlinkSendStaticRouteDelete(v *Vrf, s *NservSession, t tlvs) error {
+	prefix, plen, err := t.prefix(tlvPrefix)
 	if err != nil {
-		panic(err)
-	}
-	if err := spec.LoadAndAssign(collect, nil); err != nil { // アタッチ
-		panic(err)
+		return err
 	}
 
-	if err := netlink.LinkSetXdpFdWithFlags(link, collect.Prog.FD(), nl.XDP_FLAGS_SKB_MODE); err != nil {
-		panic(err)
+	bfd := ns.staticBfdUnregister(staticBfdKey{vrf: v.ID, prefix: fmt.Sprintf("%s/%d", prefix, plen), owner: s.Protocol})
+	err = v.Rib.Delete(prefix, plen, "static", s.Protocol)
+	if bfd && errors.Is(err, ErrRouteNotFound) {
+		// BFDがDownで経路が入っていなかった
+		return nil
 	}
+	return err
+}
 
-	netlink.LinkSetXdpFdWithFlags(link, -1, nl.XDP_FLAGS_SKB_MODE) // 解除
-	return nil
+// staticBfdKey はBFDで見ているstaticの経路、持ち主ごとに1つだけ登録する
+type staticBfdKey struct {
+	vrf    uint32
+	prefix string
+	owner  string
 }
 
-func NetlinkSendSegsAdd(data []byte) error {
+type staticBfdReg struct {
+	peer net.IP
+	id   int // Bfd.Registerが返したid
+	gen  int
+}
 
-	fmt.Printf("%v", data[4:20])
-	encapPrefix := prefixPadding(data[0:4])
-	segs := v6prefixPadding(data[4:20])
-	fmt.Printf("%s", encapPrefix.String())
-	fmt.Printf("%s", segs.String())
-	C.seg6_route_add(C.CString(encapPrefix.String()), C.CString(segs.String()))
-	return nil
+// staticBfdUnregister は登録があればBFDから外す
+func (ns *Nserver) staticBfdUnregister(key staticBfdKey) bool {
+	reg, ok := ns.staticBfd[key]
+	if !ok {
+		return false
+	}
+	delete(ns.staticBfd, key)
+	ns.Bfd.Unregister(reg.peer, reg.id)
+	return true
 }
 
-const EndDX4 uint8 = 6
+func (ns *Nserver) XdpSet(t tlvs) error {
+	prog, err := t.u8(tlvProType)
+	if err != nil {
+		return err
+	}
+	index, err := t.u32(tlvIfIndex)
+	if err != nil {
+		return err
+	}
 
-func NetlinkSendSrEndAction(data []byte) error {
+	return ns.Fib.XdpAttach(int(index), prog)
+}
 
-	fmt.Printf("data:%v", data[17:21])
-	endAction := uint8(data[0])
-	encapPrefix := v6prefixPadding(data[1:17])
-	dstPrefix := prefixPadding(data[17:21])
-	switch endAction {
-	case EndDX4: // TODO index
-		C.seg6_end_aciton(C.CString(encapPrefix.String()), C.CString(dstPrefix.String()))
+func (ns *Nserver) LsUpdate(t tlvs) error {
+	withdraw, err := t.u8(tlvWithdraw)
+	if err != nil {
+		return err
+	}
+	attr, err := t.get(tlvLsAttr)
+	if err != nil {
+		return err
+	}
+	data, err := t.get(tlvLsNLRI)
+	if err != nil {
+		return err
+	}
+
+	nlri, err := LsNLRISplit(data)
+	if err != nil {
+		log.Printf("%v", err)
+		return err
+	}
+
+	for _, l := range nlri {
+		if err := ns.LsGraph.Update(l, attr, withdraw == 1); err != nil {
+			log.Printf("%v", err)
+		}
 	}
 	return nil
 }
 
-func prefixPadding(data []byte) net.IP {
-	return net.IP(data).To4()
-}
+// LsGraphSend はグラフの要素ごとに1メッセージで送る、終わりはreplyで知らせる
+func (ns *Nserver) LsGraphSend(s *NservSession, req *ApiHeader) error {
+	g := ns.LsGraph.Snapshot()
+	bufs, err := g.encode()
+	if err != nil {
+		return err
+	}
 
-func v6prefixPadding(data []byte) net.IP {
-	return net.IP(data).To16()
+	for _, b := range bufs {
+		if err := s.write(req, lsGraphGet, &apiDataBody{Data: b}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (r *Rib) RibShow() {
+// seg6RouteParse は宛先がIPv4でもIPv6でもよい、segmentはIPv6
+func seg6RouteParse(s *NservSession, t tlvs) (Seg6Route, error) {
+	prefix, plen, err := t.prefix(tlvPrefix)
+	if err != nil {
+		return Seg6Route{}, err
+	}
 
-	fmt.Printf("RIB SHOW\n")
+	segs, err := t.ips(tlvSegs)
+	if err != nil {
+		return Seg6Route{}, err
+	}
+	for _, seg := range segs {
+		if seg.To4() != nil || seg.IsUnspecified() {
+			return Seg6Route{}, fmt.Errorf("seg6: bad segment %s", seg.String())
+		}
+	}
 
-	for _, v := range r.Preifx["BGP"] {
-		fmt.Printf("%s: %s/%d via %s\n", v.RoutingProtocol, v.Prefix.String(),
-			v.PrefixLen, v.Nexthop.String())
+	mode := Seg6ModeEncap
+	if t.has(tlvSeg6Mode) {
+		if mode, err = t.u8(tlvSeg6Mode); err != nil {
+			return Seg6Route{}, err
+		}
+	}
+	if err := seg6ModeValid(mode, prefix); err != nil {
+		return Seg6Route{}, err
+	}
+	if len(seg6Srh(segs, mode)) > seg6SegsMax {
+		return Seg6Route{}, fmt.Errorf("seg6: %d segments too many", len(segs))
 	}
 
+	return Seg6Route{
+		Prefix:    prefix,
+		PrefixLen: plen,
+		Segs:      segs,
+		Mode:      mode,
+		Owner:     s.Protocol,
+	}, nil
 }
 
-func (r *Rib) RibFind(prefix net.IP, routeType string) bool {
-	defer r.mu.Lock()
-	r.mu.Unlock()
-	var p bool
-	for _, v := range r.Preifx[routeType] {
-		p = v.Prefix.Equal(prefix)
+func (ns *Nserver) NetlinkSendSegsAdd(s *NservSession, t tlvs) error {
+	rt, err := seg6RouteParse(s, t)
+	if err != nil {
+		return err
 	}
-	return p
+	return ns.Seg6.Add(rt)
 }
 
-func (r *Rib) Add(addRoute RIBPrefix) error {
-
-	defer r.mu.Unlock()
-	r.mu.Lock()
-
-	if r.RibFind(addRoute.Prefix, "BGP") { // TODO: BGP以外も入る
-		log.Printf("RIB Already in prefix")
+func (ns *Nserver) NetlinkSendSegsReplace(s *NservSession, t tlvs) error {
+	rt, err := seg6RouteParse(s, t)
+	if err != nil {
+		return err
+	}
+	return ns.Seg6.Replace(rt)
+}
 
-		return nil
+func (ns *Nserver) NetlinkSendSegsDelete(t tlvs) error {
+	prefix, plen, err := t.prefix(tlvPrefix)
+	if err != nil {
+		return err
 	}
+	return ns.Seg6.Delete(prefix, plen)
+}
 
-	r.Preifx[addRoute.RoutingProtocol] = append(r.Preifx[addRoute.RoutingProtocol],
-		addRoute)
+const EndDX4 uint8 = 6
 
-	r.RibShow()
+func seg6LocalParse(s *NservSession, t tlvs) (Seg6LocalRoute, error) {
+	endAction, err := t.u8(tlvEndAction)
+	if err != nil {
+		return Seg6LocalRoute{}, err
+	}
+	sid, err := t.ip(tlvSid)
+	if err != nil {
+		return Seg6LocalRoute{}, err
+	}
+	nexthop, err := t.ip(tlvNexthop)
+	if err != nil {
+		return Seg6LocalRoute{}, err
+	}
 
-	RibCount++
-	return nil
+	return Seg6LocalRoute{
+		EndAction: endAction,
+		Sid:       sid,
+		Nexthop:   nexthop,
+		Owner:     s.Protocol,
+	}, nil
 }
 
-func Init() Rib {
-	return Rib{
-		mu:     new(sync.Mutex),
-		Preifx: make(map[string][]RIBPrefix, 1000),
+func (ns *Nserver) NetlinkSendSrEndAction(s *NservSession, t tlvs) error {
+	rt, err := seg6LocalParse(s, t)
+	if err != nil {
+		return err
 	}
+	return ns.Seg6.LocalAdd(rt)
 }
 
-func NetlinkSendTcNetem(data []byte) error {
-
-	s := fmt.Sprintf("%s", data[0:5])
-	index := uint8(data[5])
-
-	C.tc_netem_add(C.int(index), C.CString(s))
-	return nil
+func (ns *Nserver) NetlinkSendSrEndActionReplace(s *NservSession, t tlvs) error {
+	rt, err := seg6LocalParse(s, t)
+	if err != nil {
+		return err
+	}
+	return ns.Seg6.LocalReplace(rt)
 }
 
-func RouteFlag(f uint8) bool {
-	if f == 1 {
-		return false
+func (ns *Nserver) NetlinkSendSrEndActionDelete(t tlvs) error {
+	sid, err := t.ip(tlvSid)
+	if err != nil {
+		return err
 	}
+	return ns.Seg6.LocalDelete(sid)
+}
 
-	return true
+func prefixPadding(data []byte) net.IP {
+	return net.IP(data).To4()
 }
 
-func NetlinkSendRouteAdd(data []byte) error {
+func v6prefixPadding(data []byte) net.IP {
+	return net.IP(data).To16()
+}
 
-	dstPrefixLen := uint8(data[0])
-	dstPrefix := prefixPadding(data[1:5])
-	srcPrefix := prefixPadding(data[6:10])
-	flag := RouteFlag(uint8(data[10]))
+func (ns *Nserver) NetlinkSendTcNetem(t tlvs) error {
 
-	index, err := NexthopPrefixIndex(srcPrefix.String())
+	rate, err := t.get(tlvRate)
+	if err != nil {
+		return err
+	}
+	index, err := t.u32(tlvIfIndex)
+	if err != nil {
+		return err
+	}
 
-	if !flag {
-		C.ipv4_route_add(C.CString(dstPrefix.String()), C.CString(srcPrefix.String()),
-			C.int(index), C.int(dstPrefixLen), false)
-		return nil
+	return ns.Fib.NetemAdd(int(index), string(rate))
+}
 
+func ipv4RouteParse(s *NservSession, t tlvs) (RIBPrefix, error) {
+	dstPrefix, dstPrefixLen, err := t.prefix(tlvPrefix)
+	if err != nil {
+		return RIBPrefix{}, err
 	}
-
+	srcPrefix, err := t.ip(tlvNexthop)
 	if err != nil {
-		return nil
+		return RIBPrefix{}, err
+	}
+	if dstPrefix.To4() == nil || srcPrefix.To4() == nil {
+		return RIBPrefix{}, fmt.Errorf("ipv4 route: not ipv4")
+	}
+	multipath, err := multipathParse(t, true)
+	if err != nil {
+		return RIBPrefix{}, err
 	}
 
-	a := RIBPrefix{
+	return RIBPrefix{
 		Prefix:          dstPrefix,
-		PrefixLen:       uint8(data[0]),
+		PrefixLen:       dstPrefixLen,
 		Nexthop:         srcPrefix,
-		Index:           uint8(index),
-		RoutingProtocol: "BGP",
+		RoutingProtocol: s.routeProtocol(),
+		Owner:           s.Protocol,
+		Multipath:       multipath,
+	}, nil
+}
+
+// multipathParse はECMPで一緒に使うnexthopを読む
+func multipathParse(t tlvs, v4 bool) ([]RIBNexthop, error) {
+	if !t.has(tlvMultipath) {
+		return nil, nil
+	}
+	ips, err := t.ips(tlvMultipath)
+	if err != nil {
+		return nil, err
 	}
 
-	r.Add(a)
+	var multipath []RIBNexthop
+	for _, ip := range ips {
+		if v4 {
+			if ip = ip.To4(); ip == nil {
+				return nil, &tlvError{Type: tlvMultipath, Msg: "not ipv4"}
+			}
+		} else if ip.To4() != nil {
+			return nil, &tlvError{Type: tlvMultipath, Msg: "not ipv6"}
+		}
+		multipath = append(multipath, RIBNexthop{Nexthop: ip})
+	}
+	return multipath, nil
+}
 
-	C.ipv4_route_add(C.CString(dstPrefix.String()), C.CString(srcPrefix.String()),
-		C.int(index), C.int(dstPrefixLen), true)
+func NetlinkSendRouteAdd(v *Vrf, s *NservSession, t tlvs) error {
+	a, err := ipv4RouteParse(s, t)
+	if err != nil {
+		return err
+	}
+	return v.Rib.Add(a)
+}
 
-	return nil
+func NetlinkSendRouteReplace(v *Vrf, s *NservSession, t tlvs) error {
+	a, err := ipv4RouteParse(s, t)
+	if err != nil {
+		return err
+	}
+	return v.Rib.Replace(a)
+}
+
+func NetlinkSendRouteDelete(v *Vrf, s *NservSession, t tlvs) error {
+	prefix, plen, err := t.prefix(tlvPrefix)
+	if err != nil {
+		return err
+	}
+	return v.Rib.Delete(prefix, plen, s.routeProtocol(), s.Protocol)
 }
 
-func NetlinkSendIPv6RouteAdd(data []byte) error {
+func ipv6RouteParse(s *NservSession, t tlvs) (RIBPrefix, error) {
 
 	// TODO /64 /128 interfaceだけで入れたい場合を考える
 
-	dstPrefix := v6prefixPadding(data[0:16])
-
-	srcPrefix := v6prefixPadding(data[17:33])
-	fmt.Printf("prefix:%s", srcPrefix.String())
-	fmt.Printf("prefix:%s", dstPrefix.String())
-	C.ipv6_route_add(C.CString(srcPrefix.String()),
-		C.CString(dstPrefix.String()), C.int(40), C.int(128), true)
-	return nil
-}
+	dstPrefix, dstPrefixLen, err := t.prefix(tlvPrefix)
+	if err != nil {
+		return RIBPrefix{}, err
+	}
+	srcPrefix, err := t.ip(tlvNexthop)
+	if err != nil {
+		return RIBPrefix{}, err
+	}
+	if dstPrefix.To4() != nil {
+		return RIBPrefix{}, fmt.Errorf("ipv6 route: not ipv6")
+	}
+	multipath, err := multipathParse(t, false)
+	if err != nil {
+		return RIBPrefix{}, err
+	}
 
-func (b *ApiHeader) DecodeApiHdr(data []byte) error {
+	var index uint32 // 0ならkernelがnexthopから決める
+	if t.has(tlvIfIndex) {
+		if index, err = t.u32(tlvIfIndex); err != nil {
+			return RIBPrefix{}, err
+		}
+	}
 
-	b.Len = binary.BigEndian.Uint16(data[0:2])
-	b.Type = data[2]
-	return nil
+	return RIBPrefix{
+		Prefix:          dstPrefix,
+		PrefixLen:       dstPrefixLen,
+		Nexthop:         srcPrefix,
+		Index:           int(index),
+		RoutingProtocol: s.routeProtocol(),
+		Owner:           s.Protocol,
+		Multipath:       multipath,
+	}, nil
 }
 
-func (n *Nserver) NeburaRead() error {
+func NetlinkSendIPv6RouteAdd(v *Vrf, s *NservSession, t tlvs) error {
+	a, err := ipv6RouteParse(s, t)
+	if err != nil {
+		return err
+	}
+	return v.Rib.Add(a)
+}
 
-	log.Printf("Msg Read...\n")
-	var header [3]byte
-	_, err := io.ReadFull(n.Conn, header[:])
+func NetlinkSendIPv6RouteReplace(v *Vrf, s *NservSession, t tlvs) error {
+	a, err := ipv6RouteParse(s, t)
+	if err != nil {
+		return err
+	}
+	return v.Rib.Replace(a)
+}
 
+func NetlinkSendIPv6RouteDelete(v *Vrf, s *NservSession, t tlvs) error {
+	prefix, plen, err := t.prefix(tlvPrefix)
 	if err != nil {
-		log.Printf("err read")
-		return nil
+		return err
 	}
+	return v.Rib.Delete(prefix, plen, s.routeProtocol(), s.Protocol)
+}
 
-	nsize := binary.BigEndian.Uint16(header[0:2])
-	buf := make([]byte, nsize-3)
+// kernelとconnectedはカーネルが持っている経路なので入れない
+func fibManaged(rt *RIBPrefix) bool {
+	return rt.RoutingProtocol != "kernel" && rt.RoutingProtocol != "connected"
+}
 
-	if _, err := io.ReadFull(n.Conn, buf); err != nil {
-		return nil
+// routeChanged はRibのRouteHook、同じVRFの経路とクライアントだけに影響する
+func (n *Nserver) routeChanged(rt RIBPrefix, del bool) {
+	n.redistNotify(rt, del)
+	if v, ok := n.vrfs.get(rt.VrfID); ok {
+		v.Nexthop.Update(rt, del)
 	}
+	n.nhtNotify(rt)
+}
 
-	go n.ClientSendEvent()
-	n.ceventChan <- NservClientRead{header[:], buf}
+// RibのbestをFIBに反映する
+// FibAsyncなら結果はNservFibResultで返ってくる
+func (n *Nserver) FibUpdate(old, new *RIBPrefix) error {
+	if new != nil && fibManaged(new) {
+		log.Printf("FIB install %s %s/%d via %s\n", new.RoutingProtocol, new.Prefix.String(),
+			new.PrefixLen, new.Nexthop.String())
+		err := n.Fib.RouteAdd(new) // replaceなのでoldは消さなくてよい
+		if !n.fibAsync {
+			n.vrfRib(new).FibResult(*new, err)
+		}
+		return err
+	}
+	if new != nil {
+		// kernelとconnectedは最初からkernelにある
+		n.vrfRib(new).FibResult(*new, nil)
+	}
 
+	if old != nil && fibManaged(old) {
+		log.Printf("FIB remove %s %s/%d\n", old.RoutingProtocol, old.Prefix.String(), old.PrefixLen)
+		return n.Fib.RouteDelete(old)
+	}
 	return nil
 }
 
+// NservFibResult はFibAsyncが書き込んだ結果
+type NservFibResult struct {
+	route RIBPrefix
+	add   bool
+	err   error
+}
+
+func (n NservFibResult) NecliEvent(ns *Nserver) error {
+	if rib := ns.vrfRib(&n.route); rib != nil && n.add {
+		rib.FibResult(n.route, n.err)
+	}
+	return nil // エラーはBatchFibがログに出している
+}
+
 func signalNotify() {
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	go func() {
 		<-quit
@@ -388,28 +813,93 @@ func signalNotify() {
 
 }
 
-func NserverStart() {
-	listener, err := net.Listen("unix", "/tmp/nebura.sock")
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Printf("Nebura Server start...\n")
+// NeburaSock はクライアントが繋ぐunix socket
+const NeburaSock = "/tmp/nebura.sock"
 
-	go signalNotify()
+// NserverInit はlisで受け付けたクライアントの経路をfibに書き込むNserverを作る
+// MemFibを渡すとkernelを触らないので、kernelの監視もしない
+func NserverInit(fib Fib, lis net.Listener) (*Nserver, error) {
+	if fib == nil {
+		return nil, fmt.Errorf("nebura: no fib")
+	}
 
 	n := &Nserver{
-		lis:        listener,
-		ceventChan: make(chan ClientEvent, 10),
+		lis:        lis,
+		ceventChan: make(chan ClientEvent, 64),
+		sessions:   make(map[uint32]*NservSession),
+		owners:     make(map[string]*nservOwner),
+		Rib:        Init(),
+		Bfd:        BfdInit(BfdDefaultConf),
+		LsGraph:    LsGraphInit(),
+		Fib:        fib,
+		Seg6:       Seg6TableInit(fib),
+		Pbr:        PbrTableInit(fib),
+		Mpls:       MplsTableInit(fib),
+		staticBfd:  make(map[staticBfdKey]staticBfdReg),
+
+		KernelReinstall: true,
+	}
+	n.vrfs = vrfTableInit(vrfInit(VrfDefault, "", &n.Rib))
+
+	if a, ok := fib.(FibAsync); ok {
+		a.SetResultHook(func(rt RIBPrefix, add bool, err error) {
+			n.ceventChan <- NservFibResult{rt, add, err}
+		})
+		n.fibAsync = true
+	}
+
+	def, _ := n.vrfs.get(VrfDefault)
+	n.vrfStart(def)
+
+	if _, ok := fib.(*MemFib); !ok {
+		n.kernel = true
+	}
+	return n, nil
+}
+
+// Serve はイベントの処理とkernelの監視を始めてクライアントを受け付ける
+// lisが閉じられるとエラーを返す
+func (n *Nserver) Serve() error {
+	go n.ClientSendEvent()
+
+	if n.kernel {
+		if err := n.KernelMonitorStart(); err != nil {
+			log.Printf("kernel monitor: %v", err)
+		}
+		if err := n.FibReconcileStart(); err != nil {
+			log.Printf("fib reconcile: %v", err)
+		}
 	}
 
 	for {
-		var errr error
-		n.Conn, errr = n.lis.Accept()
+		conn, err := n.lis.Accept()
+		if err != nil {
+			return err
+		}
 		log.Printf("Nebura Accept...\n")
-		if errr != nil {
+		go n.NeburaRead(n.sessionAdd(conn))
+	}
+}
+
+// NserverStart はNeburaSockで待ち受けてfibに経路を書き込む、nilならBatchFibでkernelに書き込む
+func NserverStart(fib Fib) {
+	listener, err := net.Listen("unix", NeburaSock)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Nebura Server start...\n")
+
+	go signalNotify()
+
+	if fib == nil {
+		if fib, err = BatchFibInit(); err != nil {
 			log.Fatal(err)
 		}
-		n.NeburaRead()
 	}
 
+	n, err := NserverInit(fib, listener)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(n.Serve())
 }
@@ -0,0 +1,663 @@
+package nebura
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// nserverTest はMemFibに書き込むNserverをテスト用のsocketで動かす
+func nserverTest(t *testing.T) (*Nserver, *MemFib, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "nebura.sock")
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	fib := MemFibInit()
+	n, err := NserverInit(fib, lis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go n.Serve()
+	return n, fib, path
+}
+
+// nserverConnected はkernelからconnectedの経路が来たことにする
+func nserverConnected(n *Nserver, prefix string, index int) {
+	_, dst, _ := net.ParseCIDR(prefix)
+	n.ceventChan <- NservKernelRoute{netlink.RouteUpdate{
+		Type: syscall.RTM_NEWROUTE,
+		Route: netlink.Route{
+			Dst:       dst,
+			LinkIndex: index,
+			Table:     syscall.RT_TABLE_MAIN,
+			Protocol:  syscall.RTPROT_KERNEL,
+			Type:      syscall.RTN_UNICAST,
+		},
+	}}
+}
+
+func memRoute(fib *MemFib, key string) (RIBPrefix, bool) {
+	for _, rt := range fib.Routes() {
+		if memPrefix(&rt) == key {
+			return rt, true
+		}
+	}
+	return RIBPrefix{}, false
+}
+
+func TestNserverRouteMemFib(t *testing.T) {
+	n, fib, path := nserverTest(t)
+	nserverConnected(n, "10.0.0.0/24", 2)
+
+	c, err := NclientDial(path, "BGP", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	prefix := net.ParseIP("192.0.2.0").To4()
+	if err := c.SendNclientIPv4Route(prefix, net.ParseIP("10.0.0.1").To4(), 24); err != nil {
+		t.Fatal(err)
+	}
+
+	rt, ok := memRoute(fib, "192.0.2.0/24")
+	if !ok {
+		t.Fatalf("route not installed: %v", fib.Ops())
+	}
+	if !rt.Resolved.Equal(net.ParseIP("10.0.0.1")) || rt.Index != 2 {
+		t.Errorf("route via %s dev %d, want via 10.0.0.1 dev 2", rt.Resolved, rt.Index)
+	}
+
+	if err := c.SendNclientIPv4RouteDelete(prefix, 24); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := memRoute(fib, "192.0.2.0/24"); ok {
+		t.Errorf("route not removed")
+	}
+
+	want := []FibOp{
+		{Op: "route add", Key: "192.0.2.0/24", Value: "10.0.0.1"},
+		{Op: "route delete", Key: "192.0.2.0/24"},
+	}
+	ops := fib.Ops()
+	if len(ops) != len(want) {
+		t.Fatalf("ops %v, want %v", ops, want)
+	}
+	for i := range want {
+		if ops[i] != want[i] {
+			t.Errorf("op %d %v, want %v", i, ops[i], want[i])
+		}
+	}
+}
+
+func TestNserverOwnerFlush(t *testing.T) {
+	n, fib, path := nserverTest(t)
+	nserverConnected(n, "10.0.0.0/24", 2)
+
+	c, err := NclientDial(path, "BGP", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := net.ParseIP("198.51.100.0").To4()
+	if err := c.SendNclientIPv4Route(prefix, net.ParseIP("10.0.0.1").To4(), 24); err != nil {
+		t.Fatal(err)
+	}
+	c.Conn.Close()
+
+	// 切断したクライアントの経路はgrace後に消える
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := memRoute(fib, "198.51.100.0/24"); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("route of closed client not removed: %v", fib.Ops())
+}
+
+// 256以上のifindexが切り詰められずにFIBまで届く
+func TestNserverIfIndex(t *testing.T) {
+	n, fib, path := nserverTest(t)
+	nserverConnected(n, "10.0.1.0/24", 300)
+
+	c, err := NclientDial(path, "BGP", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	if err := c.SendNclientIPv4Route(net.ParseIP("192.0.2.0").To4(), net.ParseIP("10.0.1.1").To4(), 24); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendNclientIPv6Route("2001:db8::", "fe80::1", 32, 300); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"192.0.2.0/24", "2001:db8::/32"} {
+		rt, ok := memRoute(fib, key)
+		if !ok {
+			t.Fatalf("%s not installed: %v", key, fib.Ops())
+		}
+		if rt.Index != 300 {
+			t.Errorf("%s dev %d, want dev 300", key, rt.Index)
+		}
+	}
+}
+
+func staticRouteTlvs(t *testing.T, body Body) tlvs {
+	t.Helper()
+	buf, err := body.writeTo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlv, err := tlvDecode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tlv
+}
+
+// BFDで見るstaticの経路は1つだけ登録し、削除とflushでBFDから外す
+func bfdClients(b *Bfd, peer net.IP) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bs, ok := b.sessions[bfdKey(peer)]
+	if !ok {
+		return 0
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return len(bs.clients)
+}
+
+func TestNserverStaticBfd(t *testing.T) {
+	ns, err := NserverInit(MemFibInit(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := ns.vrfs.get(VrfDefault)
+	conn, _ := net.Pipe()
+	s := ns.sessionAdd(conn)
+	s.Protocol = "OSPF"
+	ns.ownerAttach(s.Protocol)
+
+	peer := net.ParseIP("127.0.0.1").To4()
+	add := staticRouteTlvs(t, &NclientStaticRoute{
+		Nexthop: peer,
+		NLRI:    Prefix{Prefix: net.ParseIP("192.0.2.0").To4(), PrefixLen: 24},
+		Bfd:     1,
+	})
+	del := staticRouteTlvs(t, &NclientRouteDelete{
+		NLRI: Prefix{Prefix: net.ParseIP("192.0.2.0").To4(), PrefixLen: 24},
+	})
+
+	clients := func() int { return bfdClients(ns.Bfd, peer) }
+
+	for i := 0; i < 2; i++ {
+		if err := ns.NetlinkSendStaticRouteAdd(v, s, add); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := clients(); n != 1 {
+		t.Fatalf("%d bfd registrations after sending the route twice, want 1", n)
+	}
+
+	if err := ns.NetlinkSendStaticRouteDelete(v, s, del); err != nil {
+		t.Fatal(err)
+	}
+	if n := clients(); n != 0 || len(ns.staticBfd) != 0 {
+		t.Fatalf("bfd registration left after delete: %d %v", n, ns.staticBfd)
+	}
+
+	if err := ns.NetlinkSendStaticRouteAdd(v, s, add); err != nil {
+		t.Fatal(err)
+	}
+	ns.sessionDelete(s)
+	if n := clients(); n != 0 || len(ns.staticBfd) != 0 {
+		t.Fatalf("bfd registration left after owner flush: %d %v", n, ns.staticBfd)
+	}
+}
+
+// クライアントはneburaのBFDに登録して遷移を受け取り、切断すると登録は消える
+func TestNserverBfdApi(t *testing.T) {
+	n, _, path := nserverTest(t)
+
+	c, err := NclientDial(path, "BGP", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer := net.ParseIP("127.0.0.1").To4()
+	ups := make(chan bool, 4)
+	b := c.Bfd(BfdDefaultConf)
+	id1, err := b.Register(peer, nil, func(up bool) { ups <- up })
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := b.Register(peer, nil, func(up bool) { ups <- up })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt := bfdClients(n.Bfd, peer); cnt != 1 {
+		t.Fatalf("%d registrations in nebura, want 1", cnt)
+	}
+
+	n.mu.Lock()
+	var s *NservSession
+	for _, v := range n.sessions {
+		s = v
+	}
+	n.mu.Unlock()
+	n.ceventChan <- NservBfdUpdate{s, peer, true}
+	for i := 0; i < 2; i++ {
+		select {
+		case up := <-ups:
+			if !up {
+				t.Errorf("got down, want up")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("bfd update not delivered to callback %d", i)
+		}
+	}
+
+	b.Unregister(peer, id1)
+	if cnt := bfdClients(n.Bfd, peer); cnt != 1 {
+		t.Fatalf("nebura registration removed while id %d remains", id2)
+	}
+
+	c.Conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for bfdClients(n.Bfd, peer) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("bfd registration of closed client not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// helloはイベント処理のgoroutineで通知とぶつからない、-raceで確かめる
+func TestNserverHelloRace(t *testing.T) {
+	n, _, path := nserverTest(t)
+	nserverConnected(n, "10.0.0.0/24", 2)
+
+	watch, err := NclientDial(path, "OSPF", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.Conn.Close()
+	if err := watch.Subscribe("BGP", 0, func(RouteEvent) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := watch.NexthopRegister(net.ParseIP("192.0.2.1").To4(), func(NexthopState) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NclientDial(path, "BGP", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		prefix := net.ParseIP("192.0.2.0").To4()
+		for i := 0; i < 50; i++ {
+			if err := c.SendNclientIPv4Route(prefix, net.ParseIP("10.0.0.1").To4(), 24); err != nil {
+				done <- err
+				return
+			}
+			if err := c.SendNclientIPv4RouteDelete(prefix, 24); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// 通知を受けているセッションと新しいセッションの両方でhelloする
+	for i := 0; i < 50; i++ {
+		if err := watch.hello("OSPF", 0); err != nil {
+			t.Fatal(err)
+		}
+		other, err := NclientDial(path, "RIP", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Conn.Close()
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 読まないクライアントへの書き込みはブロックせず、キューが溢れたら切断する
+func TestNserverSendQueue(t *testing.T) {
+	ns, err := NserverInit(MemFibInit(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	s := ns.sessionAdd(conn)
+
+	notify := &ApiHeader{Version: NeburaVersion}
+	body := &apiDataBody{Data: []byte{1}}
+
+	done := make(chan int, 1)
+	go func() {
+		for i := 0; i < nservQueueLen+2; i++ {
+			if err := s.write(notify, redistAdd, body); err != nil {
+				done <- i
+				return
+			}
+		}
+		done <- -1
+	}()
+
+	select {
+	case i := <-done:
+		// writeLoopが1つ持って止まっているので、キューの分まで入る
+		if i < nservQueueLen {
+			t.Errorf("write %d failed before the queue was full", i)
+		}
+		if i < 0 {
+			t.Fatalf("queue never overflowed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("write blocked on a client not reading")
+	}
+
+	if !s.closed {
+		t.Errorf("session not stopped after overflow")
+	}
+	if err := s.write(notify, redistAdd, body); err != errSessionClosed {
+		t.Errorf("write after stop: %v, want %v", err, errSessionClosed)
+	}
+
+	// クライアントからは切断されたように見える
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	for {
+		if _, err := peer.Read(buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Errorf("connection not closed")
+			}
+			break
+		}
+	}
+	ns.sessionDelete(s)
+}
+
+// NHTのcbはnexthopごとで、後から登録したnexthopのcbに置き換わらない
+func TestNclientNexthopCallbacks(t *testing.T) {
+	n, _, path := nserverTest(t)
+	nserverConnected(n, "10.0.0.0/24", 2)
+
+	c, err := NclientDial(path, "OSPF", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+
+	nh1 := net.ParseIP("172.16.1.1").To4()
+	nh2 := net.ParseIP("172.17.1.1").To4()
+	got1 := make(chan NexthopState, 4)
+	got2 := make(chan NexthopState, 4)
+	if err := c.NexthopRegister(nh1, func(st NexthopState) { got1 <- st }); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.NexthopRegister(nh2, func(st NexthopState) { got2 <- st }); err != nil {
+		t.Fatal(err)
+	}
+
+	// 登録した時の状態はそれぞれのcbに来る
+	for _, got := range []chan NexthopState{got1, got2} {
+		select {
+		case st := <-got:
+			if st.Reachable {
+				t.Errorf("%s reachable before any route", st.Nexthop)
+			}
+		default:
+			t.Errorf("initial state not delivered")
+		}
+	}
+
+	// 自分のプロトコルの経路では解決しないので別のクライアントから入れる
+	igp, err := NclientDial(path, "ISIS", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer igp.Conn.Close()
+	if err := igp.SendNclientIPv4Route(net.ParseIP("172.16.0.0").To4(), net.ParseIP("10.0.0.1").To4(), 16); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case st := <-got1:
+		if !st.Nexthop.Equal(nh1) || !st.Reachable || !st.Resolved.Equal(net.ParseIP("10.0.0.1")) {
+			t.Errorf("nh1 state %+v, want reachable via 10.0.0.1", st)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("nh1 update not delivered")
+	}
+	select {
+	case st := <-got2:
+		t.Errorf("nh2 callback got %+v", st)
+	default:
+	}
+
+	if err := c.NexthopUnregister(nh1); err != nil {
+		t.Fatal(err)
+	}
+	if err := igp.SendNclientIPv4RouteDelete(net.ParseIP("172.16.0.0").To4(), 16); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case st := <-got1:
+		t.Errorf("unregistered nh1 callback got %+v", st)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// nserverInspect はイベント処理のgoroutineでfを呼ぶ、セッションの状態を見るのに使う
+type nserverInspect struct {
+	f    func(*Nserver)
+	done chan struct{}
+}
+
+func (n nserverInspect) NecliEvent(ns *Nserver) error {
+	n.f(ns)
+	close(n.done)
+	return nil
+}
+
+func nserverDo(n *Nserver, f func(*Nserver)) {
+	done := make(chan struct{})
+	n.ceventChan <- nserverInspect{f, done}
+	<-done
+}
+
+// VRFを消すとそのVRFへのredistributeとNHTの登録も消える
+func TestNserverVrfDeleteSessions(t *testing.T) {
+	n, _, path := nserverTest(t)
+
+	c, err := NclientDial(path, "OSPF", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+	if err := c.SendNclientVrfAdd("red", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	nh := net.ParseIP("172.16.1.1").To4()
+	for _, vrf := range []uint32{VrfDefault, 10} {
+		c.Vrf = vrf
+		if err := c.Subscribe("", 0, func(RouteEvent) {}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.NexthopRegister(nh, func(NexthopState) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.Vrf = VrfDefault
+	if err := c.SendNclientVrfDelete("red"); err != nil {
+		t.Fatal(err)
+	}
+
+	nserverDo(n, func(ns *Nserver) {
+		for _, s := range ns.sessions {
+			if len(s.subs) != 1 || len(s.nhts) != 1 {
+				t.Errorf("session %d subs %v nhts %v, want only the default vrf", s.ID, s.subs, s.nhts)
+			}
+			for k := range s.subs {
+				if k.Vrf != VrfDefault {
+					t.Errorf("subscription %+v of deleted vrf left", k)
+				}
+			}
+			if _, ok := s.nhts[nhtKey(VrfDefault, nh)]; !ok {
+				t.Errorf("default vrf NHT registration removed")
+			}
+		}
+	})
+
+	// 同じtableで作り直したVRFには前の登録は残っていない
+	if err := c.SendNclientVrfAdd("red", 10); err != nil {
+		t.Fatal(err)
+	}
+	c.Vrf = 10
+	var apiErr *ApiError
+	if err := c.NexthopUnregister(nh); !errors.As(err, &apiErr) || apiErr.Code != ApiCodeNotFound {
+		t.Errorf("unregister in recreated vrf: %v, want not found", err)
+	}
+}
+
+// nserverRaw はNclientを使わずに1メッセージ送り、replyまでに来たメッセージを返す
+func nserverRaw(t *testing.T, conn net.Conn, api *ApiHeader) []nclientMsg {
+	t.Helper()
+	buf, err := api.writeTo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []nclientMsg
+	for {
+		hdr, data, err := ApiRead(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, nclientMsg{hdr, data})
+		if hdr.Type == apiReply {
+			return msgs
+		}
+	}
+}
+
+// rawU8 はメッセージのTLVを1つ読む、なければ0xff
+func rawU8(t *testing.T, m nclientMsg, typ uint8) uint8 {
+	t.Helper()
+	tlv, err := tlvDecode(m.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := tlv.u8(typ)
+	if err != nil {
+		return 0xff
+	}
+	return v
+}
+
+func TestNserverVersion(t *testing.T) {
+	n, _, path := nserverTest(t)
+	nserverConnected(n, "10.0.0.0/24", 2)
+
+	route := &NclientRouteAdd{
+		Nexthop: net.ParseIP("10.0.0.1").To4(),
+		NLRI:    Prefix{Prefix: net.ParseIP("192.0.2.0").To4(), PrefixLen: 24},
+	}
+
+	tests := []struct {
+		name    string
+		hello   uint8 // 0ならhelloしない
+		version uint8 // 経路を送るversion
+		agreed  uint8
+		code    uint8
+	}{
+		{"no hello", 0, 2, 0, ApiCodeBadMessage},
+		{"v1", 1, 1, 1, ApiCodeOK},
+		{"v1 sends v2", 1, 2, 1, ApiCodeUnsupportedVersion},
+		{"v2", 2, 2, 2, ApiCodeOK},
+		{"v3 down to v2", 3, 2, 2, ApiCodeOK},
+		{"v3 sends v3", 3, 3, 2, ApiCodeUnsupportedVersion},
+	}
+
+	for _, tt := range tests {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tt.hello != 0 {
+			msgs := nserverRaw(t, conn, &ApiHeader{Version: tt.hello, Type: apiHello, Seq: 1,
+				Body: &apiHelloBody{Version: tt.hello}})
+			if len(msgs) != 2 || msgs[0].hdr.Type != apiHello || rawU8(t, msgs[0], tlvVersion) != tt.agreed {
+				t.Errorf("%s: hello not answered with version %d", tt.name, tt.agreed)
+			}
+			reply := msgs[len(msgs)-1]
+			if code := rawU8(t, reply, tlvCode); code != ApiCodeOK || reply.hdr.Version != tt.agreed {
+				t.Errorf("%s: hello reply code %d version %d", tt.name, code, reply.hdr.Version)
+			}
+		}
+
+		msgs := nserverRaw(t, conn, &ApiHeader{Version: tt.version, Type: IPv4RouteReplace, Seq: 2, Body: route})
+		if code := rawU8(t, msgs[len(msgs)-1], tlvCode); code != tt.code {
+			t.Errorf("%s: route reply code %d, want %d", tt.name, code, tt.code)
+		}
+		conn.Close()
+	}
+}
+
+// 対応していないversionのhelloは断られ、helloしていないままになる
+func TestNserverVersionReject(t *testing.T) {
+	_, _, path := nserverTest(t)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msgs := nserverRaw(t, conn, &ApiHeader{Version: 0, Type: apiHello, Seq: 1, Body: &apiHelloBody{Version: 0}})
+	if len(msgs) != 1 || rawU8(t, msgs[0], tlvCode) != ApiCodeUnsupportedVersion {
+		t.Errorf("hello v0 not rejected as unsupported version")
+	}
+
+	msgs = nserverRaw(t, conn, &ApiHeader{Version: 1, Type: IPv4RouteDelete, Seq: 2,
+		Body: &NclientRouteDelete{NLRI: Prefix{Prefix: net.ParseIP("192.0.2.0").To4(), PrefixLen: 24}}})
+	if code := rawU8(t, msgs[0], tlvCode); code != ApiCodeBadMessage {
+		t.Errorf("request after rejected hello code %d, want %d", code, ApiCodeBadMessage)
+	}
+
+	// Nclientも同じサーバーとversion 2で話せる
+	c, err := NclientDial(path, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+	if c.Version != NeburaVersion {
+		t.Errorf("client version %d, want %d", c.Version, NeburaVersion)
+	}
+}
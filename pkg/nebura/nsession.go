@@ -0,0 +1,277 @@
+package nebura
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// NservSession はneburaに繋いでいるクライアント1つ分の状態
+type NservSession struct {
+	ID      uint32
+	Version uint8 // helloで決まったバージョン、0ならまだhelloしていない
+
+	// helloで登録した経路の持ち主、空なら切断しても経路は残る
+	// Versionとこれらはhelloを処理するイベント処理のgoroutineだけが触る
+	Protocol string
+	Grace    time.Duration
+
+	subs map[redistKey]bool      // イベント処理のgoroutineだけが触る
+	nhts map[string]NexthopState // 登録されたnexthopと最後に送った状態、これもイベント処理のgoroutineだけ
+	bfds map[string]int          // BFDに登録したpeerとBfdのid、これもイベント処理のgoroutineだけ
+	conn net.Conn
+
+	// 書き込みはwriteLoopがやるので、読まないクライアントがいてもイベント処理は止まらない
+	// outとclosedはイベント処理のgoroutineだけが触る
+	out    chan []byte
+	closed bool
+}
+
+// nservQueueLen を超えて溜まったら読んでいないクライアントとして切断する
+const nservQueueLen = 256
+
+var errSessionClosed = errors.New("nebura: session closed")
+
+// write はメッセージを送信キューに入れる、キューがいっぱいなら切断する
+func (s *NservSession) write(req *ApiHeader, rtype uint8, body Body) error {
+	api := &ApiHeader{
+		Version: req.Version,
+		Type:    rtype,
+		Seq:     req.Seq,
+		VrfID:   req.VrfID,
+		Body:    body,
+	}
+
+	buf, err := api.writeTo()
+	if err != nil {
+		return err
+	}
+
+	if s.closed {
+		return errSessionClosed
+	}
+	select {
+	case s.out <- buf:
+		return nil
+	default:
+		log.Printf("Nebura session %d send queue full, disconnect\n", s.ID)
+		s.stop()
+		return fmt.Errorf("nebura session %d: send queue full", s.ID)
+	}
+}
+
+// writeLoop は送信キューをクライアントに書く、stopでキューが閉じると終わる
+func (s *NservSession) writeLoop() {
+	for buf := range s.out {
+		if _, err := s.conn.Write(buf); err != nil {
+			log.Printf("nebura session %d write: %v", s.ID, err)
+			// 読み込み側もエラーになって切断の処理が始まる
+			s.conn.Close()
+			for range s.out {
+			}
+			return
+		}
+	}
+}
+
+// stop は送信キューを閉じて接続を切る、イベント処理のgoroutineから呼ぶ
+func (s *NservSession) stop() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.out)
+	s.conn.Close()
+}
+
+// reply はリクエストと同じSequenceで結果を返す
+func (s *NservSession) reply(req *ApiHeader, err error) error {
+	body := &apiReplyBody{Code: apiErrorCode(err)}
+	if err != nil {
+		body.Msg = err.Error()
+	}
+
+	return s.write(req, apiReply, body)
+}
+
+func (n *Nserver) sessionAdd(conn net.Conn) *NservSession {
+	defer n.mu.Unlock()
+	n.mu.Lock()
+
+	n.sessionID++
+	s := &NservSession{
+		ID:   n.sessionID,
+		subs: make(map[redistKey]bool),
+		nhts: make(map[string]NexthopState),
+		bfds: make(map[string]int),
+		conn: conn,
+		out:  make(chan []byte, nservQueueLen),
+	}
+	n.sessions[s.ID] = s
+	go s.writeLoop()
+
+	log.Printf("Nebura session %d open\n", s.ID)
+	return s
+}
+
+func (s *NservSession) routeProtocol() string {
+	if s.Protocol == "" {
+		return "static"
+	}
+	return s.Protocol
+}
+
+// nservOwner は同じプロトコルで繋いでいるセッションの数
+// 0になるとgrace後に経路を消す
+type nservOwner struct {
+	sessions int
+	timer    *time.Timer
+}
+
+func (n *Nserver) ownerAttach(proto string) {
+	defer n.mu.Unlock()
+	n.mu.Lock()
+
+	o, ok := n.owners[proto]
+	if !ok {
+		o = &nservOwner{}
+		n.owners[proto] = o
+	}
+	if o.timer != nil {
+		// grace中に戻ってきたので経路を残す
+		o.timer.Stop()
+		o.timer = nil
+		log.Printf("Nebura owner %s reconnected, keep routes\n", proto)
+	}
+	o.sessions++
+}
+
+func (n *Nserver) sessionDelete(s *NservSession) {
+	s.stop()
+
+	// BFDの登録は持ち主に関係なくセッションと一緒に消える
+	n.bfdFlush(s)
+
+	n.mu.Lock()
+
+	delete(n.sessions, s.ID)
+	log.Printf("Nebura session %d closed\n", s.ID)
+
+	o, ok := n.owners[s.Protocol]
+	if s.Protocol == "" || !ok {
+		n.mu.Unlock()
+		return
+	}
+
+	o.sessions--
+	if o.sessions > 0 {
+		n.mu.Unlock()
+		return
+	}
+
+	if s.Grace > 0 {
+		log.Printf("Nebura owner %s gone, routes kept for %v\n", s.Protocol, s.Grace)
+		proto := s.Protocol
+		o.timer = time.AfterFunc(s.Grace, func() {
+			n.ceventChan <- NservOwnerFlush{proto}
+		})
+		n.mu.Unlock()
+		return
+	}
+	n.mu.Unlock()
+
+	n.ownerFlush(s.Protocol)
+}
+
+// ownerFlush はイベント処理のgoroutineから呼ぶ
+func (n *Nserver) ownerFlush(proto string) {
+	n.mu.Lock()
+	o, ok := n.owners[proto]
+	if !ok || o.sessions > 0 {
+		// flushが来る前に戻ってきた
+		n.mu.Unlock()
+		return
+	}
+	delete(n.owners, proto)
+	n.mu.Unlock()
+
+	var cnt int
+	for _, v := range n.vrfs.list() {
+		cnt += v.Rib.DeleteOwner(proto)
+	}
+	cnt += n.Seg6.DeleteOwner(proto)
+	cnt += n.Mpls.DeleteOwner(proto)
+	cnt += n.Pbr.DeleteOwner(proto)
+	for key := range n.staticBfd {
+		if key.owner == proto {
+			n.staticBfdUnregister(key)
+		}
+	}
+	log.Printf("Nebura owner %s flushed %d routes\n", proto, cnt)
+}
+
+// hello はクライアントとバージョンを合わせて、経路の持ち主を登録する
+func (s *NservSession) hello(n *Nserver, hdr *ApiHeader, data []byte) error {
+	t, err := tlvDecode(data)
+	if err != nil {
+		return s.reply(hdr, err)
+	}
+	v, err := t.u8(tlvVersion)
+	if err != nil {
+		return s.reply(hdr, err)
+	}
+
+	if v < NeburaVersionMin {
+		return s.write(hdr, apiReply, &apiReplyBody{
+			Code: ApiCodeUnsupportedVersion,
+			Msg:  fmt.Sprintf("version %d not supported", v),
+		})
+	}
+	if v > NeburaVersion {
+		v = NeburaVersion
+	}
+	hdr.Version = v
+
+	if s.Version == 0 && t.has(tlvProtocol) {
+		grace, err := t.u32(tlvGraceTime)
+		if err != nil {
+			return s.reply(hdr, err)
+		}
+		s.Protocol = string(t[tlvProtocol])
+		s.Grace = time.Duration(grace) * time.Second
+		n.ownerAttach(s.Protocol)
+		log.Printf("Nebura session %d registered %s\n", s.ID, s.Protocol)
+	}
+
+	if err := s.write(hdr, apiHello, &apiHelloBody{Version: v}); err != nil {
+		return err
+	}
+	s.Version = v
+	return s.reply(hdr, nil)
+}
+
+// NeburaRead はクライアントが閉じるまでメッセージを読んで、イベントとして渡す
+// helloもイベント処理のgoroutineでやるので、Versionや持ち主は読み込み側から触らない
+// 切断したらNservClientCloseを送るので、それまでに読んだメッセージは全部処理される
+func (n *Nserver) NeburaRead(s *NservSession) error {
+
+	defer func() {
+		s.conn.Close()
+		n.ceventChan <- NservClientClose{s}
+	}()
+
+	for {
+		hdr, data, err := ApiRead(s.conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("nebura session %d read: %v", s.ID, err)
+			}
+			return err
+		}
+
+		n.ceventChan <- NservClientRead{s, hdr, data}
+	}
+}
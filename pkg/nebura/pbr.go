@@ -0,0 +1,651 @@
+package nebura
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// policy based routing
+// 送信元prefix, 宛先prefix, fwmark, 入ってきたinterface, DSCPで合うパケットを別のtableで引くrule
+// ruleはneburaのプロトコルを付けてkernelに入れ、kernelから消されたら入れ直す
+// priorityと条件が同じruleは1つだけ、Replaceでtableを変える
+
+// vishvananda/netlink v1.1.0のRuleAddはprotocolとDSCPを付けられないので自分で組み立てる
+// IPv4のTOSのフィールドにはDSCPを全部入れられないので、FRA_DSCP (kernel 6.13から) を使う
+// それより前のkernelはFRA_DSCPを黙って捨てるので、入れたruleを読み直して確かめる
+const (
+	fraProtocol = 21
+	fraDscp     = 25
+	dscpMax     = 63
+	pbrTosMask  = 0x1e // IPv4のruleのTOSに入れられるbit (IPTOS_TOS_MASK)
+)
+
+// PbrRule はpolicy routingのrule1つ
+type PbrRule struct {
+	Priority uint32 // 必須、kernelが決めるとneburaのruleと対応が取れない
+	Family   uint16 // AfiIPv4かAfiIPv6、prefixがあればprefixから決まる
+	Src      Prefix // PrefixLenが0なら見ない
+	Dst      Prefix
+	Mark     uint32
+	Mask     uint32 // Markだけなら全部のbitを見る
+	Iif      string
+	Dscp     uint8
+	Table    uint32 // Deleteでは見ない
+	Owner    string
+	tos      bool // FRA_DSCPを知らないkernelなのでDSCPをTOSのフィールドで入れた
+}
+
+// key はtable以外の条件
+func (p *PbrRule) key() string {
+	return fmt.Sprintf("%d %d %s/%d %s/%d %d/%d %s %d", p.Priority, p.Family,
+		p.Src.Prefix.String(), p.Src.PrefixLen, p.Dst.Prefix.String(), p.Dst.PrefixLen,
+		p.Mark, p.Mask, p.Iif, p.Dscp)
+}
+
+// String はip ruleと同じような形で返す
+func (p *PbrRule) String() string {
+	s := []string{fmt.Sprintf("pref %d", p.Priority)}
+	if p.Src.PrefixLen > 0 {
+		s = append(s, fmt.Sprintf("from %s/%d", p.Src.Prefix.String(), p.Src.PrefixLen))
+	}
+	if p.Dst.PrefixLen > 0 {
+		s = append(s, fmt.Sprintf("to %s/%d", p.Dst.Prefix.String(), p.Dst.PrefixLen))
+	}
+	if p.Mark != 0 {
+		s = append(s, fmt.Sprintf("fwmark 0x%x/0x%x", p.Mark, p.Mask))
+	}
+	if p.Iif != "" {
+		s = append(s, "iif "+p.Iif)
+	}
+	if p.Dscp != 0 {
+		s = append(s, fmt.Sprintf("dscp %d", p.Dscp))
+	}
+	s = append(s, fmt.Sprintf("table %d", p.Table))
+	return strings.Join(s, " ")
+}
+
+// normalize はkernelから読んだruleと同じ形にして、おかしな組み合わせをはじく
+func (p *PbrRule) normalize() error {
+	var family uint16
+	for _, pf := range []*Prefix{&p.Src, &p.Dst} {
+		if pf.PrefixLen == 0 {
+			*pf = Prefix{}
+			continue
+		}
+		f := AfiIPv6
+		if v4 := pf.Prefix.To4(); v4 != nil {
+			f = AfiIPv4
+			pf.Prefix = v4
+		}
+		if family != 0 && family != f {
+			return fmt.Errorf("pbr: src and dst family mismatch")
+		}
+		family = f
+		pf.Prefix = fibPrefix(pf.Prefix, pf.PrefixLen).IP
+	}
+
+	switch {
+	case family != 0 && p.Family != 0 && family != p.Family:
+		return fmt.Errorf("pbr: prefix not in family %d", p.Family)
+	case family != 0:
+		p.Family = family
+	case p.Family == 0:
+		p.Family = AfiIPv4
+	}
+
+	if p.Mark != 0 && p.Mask == 0 {
+		p.Mask = 0xffffffff
+	}
+	if p.Dscp > dscpMax {
+		return fmt.Errorf("pbr: bad dscp %d", p.Dscp)
+	}
+	if len(p.Iif) >= syscall.IFNAMSIZ {
+		return fmt.Errorf("pbr: bad interface name %q", p.Iif)
+	}
+	if p.Priority == 0 {
+		return fmt.Errorf("pbr: priority required")
+	}
+	return nil
+}
+
+// local, defaultのtableや0には向けない
+func pbrTableValid(table uint32) bool {
+	return !vrfTableReserved(table) || table == syscall.RT_TABLE_MAIN
+}
+
+func pbrFamily(afi uint16) uint8 {
+	if afi == AfiIPv6 {
+		return syscall.AF_INET6
+	}
+	return syscall.AF_INET
+}
+
+// pbrRuleRequest はruleを追加か削除するメッセージ、struct fib_rule_hdrはrtmsgと同じ並び
+func pbrRuleRequest(p *PbrRule, add bool) *nl.NetlinkRequest {
+	var req *nl.NetlinkRequest
+	if add {
+		req = nl.NewNetlinkRequest(syscall.RTM_NEWRULE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK)
+	} else {
+		req = nl.NewNetlinkRequest(syscall.RTM_DELRULE, syscall.NLM_F_ACK)
+	}
+
+	msg := &nl.RtMsg{}
+	msg.Family = pbrFamily(p.Family)
+	msg.Src_len = p.Src.PrefixLen
+	msg.Dst_len = p.Dst.PrefixLen
+	msg.Type = nl.FR_ACT_TO_TBL
+	if p.tos {
+		msg.Tos = p.Dscp << 2
+	}
+	if p.Table < 256 {
+		msg.Table = uint8(p.Table)
+	}
+	req.AddData(msg)
+
+	native := nl.NativeEndian()
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		native.PutUint32(b, v)
+		return b
+	}
+
+	req.AddData(nl.NewRtAttr(nl.FRA_PRIORITY, u32(p.Priority)))
+	req.AddData(nl.NewRtAttr(nl.FRA_TABLE, u32(p.Table)))
+	req.AddData(nl.NewRtAttr(fraProtocol, []byte{rtprotNebura}))
+	if p.Src.PrefixLen > 0 {
+		req.AddData(nl.NewRtAttr(nl.FRA_SRC, p.Src.Prefix))
+	}
+	if p.Dst.PrefixLen > 0 {
+		req.AddData(nl.NewRtAttr(nl.FRA_DST, p.Dst.Prefix))
+	}
+	if p.Mark != 0 {
+		req.AddData(nl.NewRtAttr(nl.FRA_FWMARK, u32(p.Mark)))
+		req.AddData(nl.NewRtAttr(nl.FRA_FWMASK, u32(p.Mask)))
+	}
+	if p.Iif != "" {
+		req.AddData(nl.NewRtAttr(nl.FRA_IIFNAME, nl.ZeroTerminated(p.Iif)))
+	}
+	if p.Dscp != 0 && !p.tos {
+		req.AddData(nl.NewRtAttr(fraDscp, []byte{p.Dscp}))
+	}
+	return req
+}
+
+// pbrRuleDecode はkernelのruleとそのprotocolを返す
+func pbrRuleDecode(data []byte) (PbrRule, uint8, error) {
+	var p PbrRule
+	var proto uint8
+
+	if len(data) < syscall.SizeofRtMsg {
+		return p, 0, fmt.Errorf("pbr: short rule message")
+	}
+	msg := nl.DeserializeRtMsg(data)
+	attrs, err := nl.ParseRouteAttr(data[syscall.SizeofRtMsg:])
+	if err != nil {
+		return p, 0, err
+	}
+
+	p.Family = AfiIPv4
+	if msg.Family == syscall.AF_INET6 {
+		p.Family = AfiIPv6
+	}
+	p.Dscp = msg.Tos >> 2
+	p.tos = msg.Tos != 0
+	p.Table = uint32(msg.Table)
+
+	native := nl.NativeEndian()
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case nl.FRA_PRIORITY:
+			p.Priority = native.Uint32(a.Value)
+		case nl.FRA_TABLE:
+			p.Table = native.Uint32(a.Value)
+		case nl.FRA_SRC:
+			p.Src = Prefix{Prefix: net.IP(a.Value), PrefixLen: msg.Src_len}
+		case nl.FRA_DST:
+			p.Dst = Prefix{Prefix: net.IP(a.Value), PrefixLen: msg.Dst_len}
+		case nl.FRA_FWMARK:
+			p.Mark = native.Uint32(a.Value)
+		case nl.FRA_FWMASK:
+			p.Mask = native.Uint32(a.Value)
+		case nl.FRA_IIFNAME:
+			p.Iif = strings.TrimRight(string(a.Value), "\x00")
+		case fraProtocol:
+			proto = a.Value[0]
+		case fraDscp:
+			p.Dscp = a.Value[0]
+			p.tos = false
+		}
+	}
+	if p.Mark == 0 {
+		p.Mask = 0
+	}
+	return p, proto, nil
+}
+
+func pbrRuleExecute(p *PbrRule, add bool) error {
+	_, err := pbrRuleRequest(p, add).Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+func (f *NetlinkFib) RuleAdd(p *PbrRule) error {
+	p.tos = false
+	if err := pbrRuleExecute(p, true); err != nil {
+		return fmt.Errorf("fib: rule add %s: %w", p.String(), err)
+	}
+	if p.Dscp == 0 {
+		return nil
+	}
+	if err := pbrRuleDscpCheck(p); err != nil {
+		return fmt.Errorf("fib: rule add %s: %w", p.String(), err)
+	}
+	return nil
+}
+
+// pbrRuleDscpCheck はFRA_DSCPで入れたruleにDSCPが付いているか読み直す
+// 付いていなければ全部のパケットに合うruleになっているので消して、TOSのフィールドで入れ直す
+// TOSで表せないDSCPならエラーにする
+func pbrRuleDscpCheck(p *PbrRule) error {
+	dscp, found, err := pbrRuleDscp(p)
+	switch {
+	case err != nil:
+		pbrRuleExecute(p, false)
+		return err
+	case found && dscp == p.Dscp:
+		return nil
+	}
+
+	// 入っているのはDSCPなしのrule
+	nodscp := *p
+	nodscp.Dscp = 0
+	if err := pbrRuleExecute(&nodscp, false); err != nil {
+		return fmt.Errorf("kernel ignored dscp, remove: %w", err)
+	}
+	if !pbrDscpTos(p) {
+		return fmt.Errorf("kernel does not support dscp %d (IPv4 needs kernel 6.13 or dscp 1-7)", p.Dscp)
+	}
+
+	log.Printf("PBR %s: kernel ignored FRA_DSCP, use tos\n", p.String())
+	p.tos = true
+	if err := pbrRuleExecute(p, true); err != nil {
+		p.tos = false
+		return err
+	}
+	return nil
+}
+
+// pbrDscpTos はDSCPをfib_rule_hdrのtosで表せるか
+// IPv6はtraffic classを全部見るが、IPv4はIPTOS_TOS_MASKのbitしか入れられない
+func pbrDscpTos(p *PbrRule) bool {
+	if p.Family == AfiIPv6 {
+		return true
+	}
+	return (p.Dscp<<2)&^pbrTosMask == 0
+}
+
+// pbrRuleDscp はDSCP以外の条件とtableがpと同じneburaのruleをkernelから探す
+// DSCPがpと同じものがあればそれを返す
+func pbrRuleDscp(p *PbrRule) (uint8, bool, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETRULE, syscall.NLM_F_DUMP)
+	msg := &nl.RtMsg{}
+	msg.Family = pbrFamily(p.Family)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWRULE)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var dscp uint8
+	var found bool
+	for _, m := range msgs {
+		r, proto, err := pbrRuleDecode(m)
+		if err != nil || proto != rtprotNebura || r.Table != p.Table {
+			continue
+		}
+		got := r.Dscp
+		r.Dscp = p.Dscp
+		if r.key() != p.key() {
+			continue
+		}
+		dscp, found = got, true
+		if got == p.Dscp {
+			break
+		}
+	}
+	return dscp, found, nil
+}
+
+func (f *NetlinkFib) RuleDelete(p *PbrRule) error {
+	if err := pbrRuleExecute(p, false); err != nil {
+		return fmt.Errorf("fib: rule delete %s: %w", p.String(), err)
+	}
+	return nil
+}
+
+// pbrStaleRules は前に動いていたneburaが入れてkernelに残っているruleを返す
+func pbrStaleRules() ([]PbrRule, error) {
+	req := nl.NewNetlinkRequest(syscall.RTM_GETRULE, syscall.NLM_F_DUMP)
+	req.AddData(&nl.RtMsg{})
+
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWRULE)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []PbrRule
+	for _, m := range msgs {
+		p, proto, err := pbrRuleDecode(m)
+		if err != nil || proto != rtprotNebura {
+			continue
+		}
+		rules = append(rules, p)
+	}
+	return rules, nil
+}
+
+// pbrRuleUpdate はkernelのruleの変更
+type pbrRuleUpdate struct {
+	Type  uint16
+	Rule  PbrRule
+	Proto uint8
+}
+
+// pbrRuleSubscribe はIPv4とIPv6のruleの変更をchに送る
+// doneが閉じられるか読めなくなったらchを閉じる
+func pbrRuleSubscribe(ch chan<- pbrRuleUpdate, done <-chan struct{}) error {
+	sock, err := nl.Subscribe(syscall.NETLINK_ROUTE, syscall.RTNLGRP_IPV4_RULE, syscall.RTNLGRP_IPV6_RULE)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-done
+		sock.Close()
+	}()
+	go func() {
+		defer close(ch)
+		for {
+			msgs, _, err := sock.Receive()
+			if err != nil {
+				return
+			}
+			for _, m := range msgs {
+				if m.Header.Type != syscall.RTM_NEWRULE && m.Header.Type != syscall.RTM_DELRULE {
+					continue
+				}
+				p, proto, err := pbrRuleDecode(m.Data)
+				if err != nil {
+					continue
+				}
+				select {
+				case ch <- pbrRuleUpdate{m.Header.Type, p, proto}:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// PbrTable はneburaが入れたruleを持ち、kernelと揃える
+type PbrTable struct {
+	mu    sync.Mutex
+	fib   Fib
+	rules map[string]*PbrRule
+}
+
+func PbrTableInit(fib Fib) *PbrTable {
+	return &PbrTable{
+		fib:   fib,
+		rules: make(map[string]*PbrRule),
+	}
+}
+
+func (t *PbrTable) Add(p PbrRule) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	if err := p.normalize(); err != nil {
+		return err
+	}
+	key := p.key()
+	if _, ok := t.rules[key]; ok {
+		return fmt.Errorf("pbr: %s: %w", p.String(), ErrRouteExists)
+	}
+
+	if err := t.fib.RuleAdd(&p); err != nil {
+		return err
+	}
+	t.rules[key] = &p
+	log.Printf("PBR Add %s\n", p.String())
+	return nil
+}
+
+// Replace は同じ条件のruleのtableを変える、なければ追加する
+func (t *PbrTable) Replace(p PbrRule) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	if err := p.normalize(); err != nil {
+		return err
+	}
+	key := p.key()
+	old, ok := t.rules[key]
+	if ok && old.Table == p.Table {
+		old.Owner = p.Owner
+		return nil
+	}
+
+	// kernelのruleは置き換えられないので、新しい方を入れてから古い方を消す
+	if err := t.fib.RuleAdd(&p); err != nil {
+		return err
+	}
+	if ok {
+		if err := t.fib.RuleDelete(old); err != nil {
+			log.Printf("PBR Replace %s: %v", old.String(), err)
+		}
+	}
+	t.rules[key] = &p
+	log.Printf("PBR Replace %s\n", p.String())
+	return nil
+}
+
+// Delete はtable以外の条件が同じruleを消す
+func (t *PbrTable) Delete(p PbrRule) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	if err := p.normalize(); err != nil {
+		return err
+	}
+	key := p.key()
+	old, ok := t.rules[key]
+	if !ok {
+		return fmt.Errorf("pbr: %s: %w", p.String(), ErrRouteNotFound)
+	}
+
+	delete(t.rules, key)
+	log.Printf("PBR Delete %s\n", old.String())
+	return t.fib.RuleDelete(old)
+}
+
+// get はkernelから読んだruleと同じものを返す
+func (t *PbrTable) get(p *PbrRule) (PbrRule, bool) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	v, ok := t.rules[p.key()]
+	if !ok || v.Table != p.Table {
+		return PbrRule{}, false
+	}
+	return *v, true
+}
+
+// DeleteOwner はownerが入れたruleを全部消す
+func (t *PbrTable) DeleteOwner(owner string) int {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	n := 0
+	for key, p := range t.rules {
+		if p.Owner != owner {
+			continue
+		}
+		delete(t.rules, key)
+		if err := t.fib.RuleDelete(p); err != nil {
+			log.Printf("PBR Delete %s: %v", p.String(), err)
+		}
+		n++
+	}
+	return n
+}
+
+// neburaのruleが消されたらまだ持っていれば入れ直す
+func (n NservKernelRule) NecliEvent(ns *Nserver) error {
+	if n.u.Proto != rtprotNebura || n.u.Type != syscall.RTM_DELRULE {
+		return nil
+	}
+	p, ok := ns.Pbr.get(&n.u.Rule)
+	if !ok {
+		// nebura自身が消した
+		return nil
+	}
+
+	if !ns.KernelReinstall {
+		log.Printf("Kernel removed rule %s, not reinstalled\n", p.String())
+		return nil
+	}
+	log.Printf("Kernel removed rule %s, reinstall\n", p.String())
+	return ns.Fib.RuleAdd(&p)
+}
+
+type pbrBody struct {
+	Rule *PbrRule
+}
+
+func (b *pbrBody) writeTo() ([]byte, error) {
+	p := b.Rule
+
+	var buf []byte
+	buf = appendTlvU32(buf, tlvPriority, p.Priority)
+	if p.Family != 0 {
+		buf = appendTlv(buf, tlvFamily, binary.BigEndian.AppendUint16(nil, p.Family))
+	}
+	if p.Src.PrefixLen > 0 {
+		buf = appendTlvPrefix(buf, tlvSrcPrefix, p.Src.Prefix, p.Src.PrefixLen)
+	}
+	if p.Dst.PrefixLen > 0 {
+		buf = appendTlvPrefix(buf, tlvPrefix, p.Dst.Prefix, p.Dst.PrefixLen)
+	}
+	if p.Mark != 0 {
+		buf = appendTlvU32(buf, tlvMark, p.Mark)
+		buf = appendTlvU32(buf, tlvMask, p.Mask)
+	}
+	if p.Iif != "" {
+		buf = appendTlv(buf, tlvIifName, []byte(p.Iif))
+	}
+	if p.Dscp != 0 {
+		buf = appendTlvU8(buf, tlvDscp, p.Dscp)
+	}
+	if p.Table != 0 {
+		buf = appendTlvU32(buf, tlvTable, p.Table)
+	}
+	return buf, nil
+}
+
+// pbrRuleParse はdeleteではtableがなくてもよい
+func pbrRuleParse(s *NservSession, t tlvs, del bool) (PbrRule, error) {
+	p := PbrRule{Owner: s.Protocol}
+	var err error
+
+	if p.Priority, err = t.u32(tlvPriority); err != nil {
+		return p, err
+	}
+	if t.has(tlvFamily) {
+		if p.Family, err = t.afi(tlvFamily); err != nil {
+			return p, err
+		}
+	}
+	if t.has(tlvSrcPrefix) {
+		if p.Src.Prefix, p.Src.PrefixLen, err = t.prefix(tlvSrcPrefix); err != nil {
+			return p, err
+		}
+	}
+	if t.has(tlvPrefix) {
+		if p.Dst.Prefix, p.Dst.PrefixLen, err = t.prefix(tlvPrefix); err != nil {
+			return p, err
+		}
+	}
+	if t.has(tlvMark) {
+		if p.Mark, err = t.u32(tlvMark); err != nil {
+			return p, err
+		}
+	}
+	if t.has(tlvMask) {
+		if p.Mask, err = t.u32(tlvMask); err != nil {
+			return p, err
+		}
+	}
+	p.Iif = string(t[tlvIifName])
+	if t.has(tlvDscp) {
+		if p.Dscp, err = t.u8(tlvDscp); err != nil {
+			return p, err
+		}
+	}
+	if del && !t.has(tlvTable) {
+		return p, nil
+	}
+	if p.Table, err = t.u32(tlvTable); err != nil {
+		return p, err
+	}
+	if !del && !pbrTableValid(p.Table) {
+		return p, &tlvError{Type: tlvTable, Msg: fmt.Sprintf("table %d reserved", p.Table)}
+	}
+	return p, nil
+}
+
+func (ns *Nserver) PbrRuleAdd(s *NservSession, t tlvs) error {
+	p, err := pbrRuleParse(s, t, false)
+	if err != nil {
+		return err
+	}
+	return ns.Pbr.Add(p)
+}
+
+func (ns *Nserver) PbrRuleReplace(s *NservSession, t tlvs) error {
+	p, err := pbrRuleParse(s, t, false)
+	if err != nil {
+		return err
+	}
+	return ns.Pbr.Replace(p)
+}
+
+func (ns *Nserver) PbrRuleDelete(s *NservSession, t tlvs) error {
+	p, err := pbrRuleParse(s, t, true)
+	if err != nil {
+		return err
+	}
+	return ns.Pbr.Delete(p)
+}
+
+func (n *Nclient) SendNclientRuleAdd(p PbrRule) error {
+	return n.sendNclientAPI(ruleAdd, &pbrBody{Rule: &p})
+}
+
+func (n *Nclient) SendNclientRuleReplace(p PbrRule) error {
+	return n.sendNclientAPI(ruleReplace, &pbrBody{Rule: &p})
+}
+
+// SendNclientRuleDelete はTable以外の条件が同じruleを消す
+func (n *Nclient) SendNclientRuleDelete(p PbrRule) error {
+	return n.sendNclientAPI(ruleDelete, &pbrBody{Rule: &p})
+}
@@ -0,0 +1,229 @@
+package nebura
+
+import (
+	"encoding/binary"
+	"log"
+)
+
+// redistribute
+// クライアントはプロトコルとアドレスファミリを指定してRibの経路の変更を受け取る
+// subscribeするとまず今ある経路がredistAddで送られ、そのあとは変更のたびに送られる
+// 送られるのはヘッダのVRFの経路だけ
+
+const (
+	AfiIPv4 uint16 = 1
+	AfiIPv6 uint16 = 2
+)
+
+// RouteEvent はredistributeで受け取る経路の変更
+type RouteEvent struct {
+	Delete bool
+	Route  RIBPrefix
+}
+
+// Protocolが空なら全部のプロトコル、Afiが0なら両方
+type redistKey struct {
+	Protocol string
+	Afi      uint16
+	Vrf      uint32
+}
+
+func ribAfi(rt *RIBPrefix) uint16 {
+	if rt.Prefix.To4() != nil {
+		return AfiIPv4
+	}
+	return AfiIPv6
+}
+
+func (k redistKey) match(rt *RIBPrefix) bool {
+	if k.Vrf != rt.VrfID {
+		return false
+	}
+	if k.Protocol != "" && k.Protocol != rt.RoutingProtocol {
+		return false
+	}
+	return k.Afi == 0 || k.Afi == ribAfi(rt)
+}
+
+type redistBody struct {
+	Key redistKey
+}
+
+func (b *redistBody) writeTo() ([]byte, error) {
+	var buf []byte
+
+	if b.Key.Protocol != "" {
+		buf = appendTlv(buf, tlvProtocol, []byte(b.Key.Protocol))
+	}
+	if b.Key.Afi != 0 {
+		buf = appendTlv(buf, tlvFamily, binary.BigEndian.AppendUint16(nil, b.Key.Afi))
+	}
+	return buf, nil
+}
+
+func redistKeyDecode(t tlvs) (redistKey, error) {
+	k := redistKey{
+		Protocol: string(t[tlvProtocol]),
+	}
+
+	if t.has(tlvFamily) {
+		var err error
+		if k.Afi, err = t.afi(tlvFamily); err != nil {
+			return k, err
+		}
+	}
+	return k, nil
+}
+
+type routeEventBody struct {
+	Route *RIBPrefix
+}
+
+func (b *routeEventBody) writeTo() ([]byte, error) {
+	rt := b.Route
+
+	var buf []byte
+	buf = appendTlvPrefix(buf, tlvPrefix, rt.Prefix, rt.PrefixLen)
+	if rt.Nexthop != nil {
+		buf = appendTlvIP(buf, tlvNexthop, rt.Nexthop)
+	}
+	buf = appendTlvU32(buf, tlvIfIndex, uint32(rt.Index))
+	buf = appendTlv(buf, tlvProtocol, []byte(rt.RoutingProtocol))
+	buf = appendTlvU8(buf, tlvDistance, rt.Distance)
+	buf = appendTlvU32(buf, tlvMetric, rt.Metric)
+	return buf, nil
+}
+
+func routeEventDecode(t tlvs) (RIBPrefix, error) {
+	var rt RIBPrefix
+	var err error
+
+	if rt.Prefix, rt.PrefixLen, err = t.prefix(tlvPrefix); err != nil {
+		return rt, err
+	}
+	if t.has(tlvNexthop) {
+		if rt.Nexthop, err = t.ip(tlvNexthop); err != nil {
+			return rt, err
+		}
+	}
+	index, err := t.u32(tlvIfIndex)
+	if err != nil {
+		return rt, err
+	}
+	rt.Index = int(index)
+	rt.RoutingProtocol = string(t[tlvProtocol])
+	if rt.Distance, err = t.u8(tlvDistance); err != nil {
+		return rt, err
+	}
+	if rt.Metric, err = t.u32(tlvMetric); err != nil {
+		return rt, err
+	}
+	return rt, nil
+}
+
+func redistType(del bool) uint8 {
+	if del {
+		return redistDelete
+	}
+	return redistAdd
+}
+
+// RedistSubscribe は今の経路を送ってから、以降の変更を送るように登録する
+func (ns *Nserver) RedistSubscribe(v *Vrf, s *NservSession, req *ApiHeader, t tlvs) error {
+	k, err := redistKeyDecode(t)
+	if err != nil {
+		return err
+	}
+	k.Vrf = v.ID
+
+	var routes []RIBPrefix
+	v.Rib.Walk(func(rt RIBPrefix, selected bool) {
+		if k.match(&rt) {
+			routes = append(routes, rt)
+		}
+	})
+
+	for i := range routes {
+		if err := s.write(req, redistAdd, &routeEventBody{Route: &routes[i]}); err != nil {
+			return err
+		}
+	}
+
+	s.subs[k] = true
+	log.Printf("Nebura session %d subscribe %q afi %d vrf %d, %d routes\n", s.ID, k.Protocol, k.Afi, k.Vrf, len(routes))
+	return nil
+}
+
+func (ns *Nserver) RedistUnsubscribe(v *Vrf, s *NservSession, t tlvs) error {
+	k, err := redistKeyDecode(t)
+	if err != nil {
+		return err
+	}
+	k.Vrf = v.ID
+	if !s.subs[k] {
+		return ErrRouteNotFound
+	}
+
+	delete(s.subs, k)
+	return nil
+}
+
+// redistNotify はRibのRouteHook、イベント処理のgoroutineから呼ばれる
+func (ns *Nserver) redistNotify(rt RIBPrefix, del bool) {
+	ns.mu.Lock()
+	var sessions []*NservSession
+	for _, s := range ns.sessions {
+		sessions = append(sessions, s)
+	}
+	ns.mu.Unlock()
+
+	for _, s := range sessions {
+		for k := range s.subs {
+			if !k.match(&rt) {
+				continue
+			}
+			// 通知はSequence 0で送る
+			notify := &ApiHeader{Version: s.Version, VrfID: rt.VrfID}
+			if err := s.write(notify, redistType(del), &routeEventBody{Route: &rt}); err != nil {
+				log.Printf("nebura session %d redistribute: %v", s.ID, err)
+			}
+			break
+		}
+	}
+}
+
+// Subscribe はnの今のVRFでprotoとafiの経路の変更をfで受け取る、protoが空なら全部、afiが0なら両方
+// fは受信のgoroutineから呼ばれるので、f内でneburaにリクエストを送らないこと
+func (n *Nclient) Subscribe(proto string, afi uint16, f func(RouteEvent)) error {
+	n.nmu.Lock()
+	n.notify = f
+	n.nmu.Unlock()
+
+	return n.sendNclientAPI(redistSubscribe, &redistBody{Key: redistKey{Protocol: proto, Afi: afi}})
+}
+
+func (n *Nclient) Unsubscribe(proto string, afi uint16) error {
+	return n.sendNclientAPI(redistUnsubscribe, &redistBody{Key: redistKey{Protocol: proto, Afi: afi}})
+}
+
+func (n *Nclient) routeEvent(hdr *ApiHeader, data []byte) {
+	t, err := tlvDecode(data)
+	if err != nil {
+		log.Printf("nebura redistribute: %v", err)
+		return
+	}
+	rt, err := routeEventDecode(t)
+	if err != nil {
+		log.Printf("nebura redistribute: %v", err)
+		return
+	}
+	rt.VrfID = hdr.VrfID
+
+	n.nmu.Lock()
+	f := n.notify
+	n.nmu.Unlock()
+
+	if f != nil {
+		f(RouteEvent{Delete: hdr.Type == redistDelete, Route: rt})
+	}
+}
@@ -0,0 +1,675 @@
+package nebura
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+)
+
+type RIBPrefix struct {
+	PrefixLen       uint8
+	Prefix          net.IP
+	Nexthop         net.IP
+	Index           int
+	RoutingProtocol string
+	Distance        uint8
+	Metric          uint32
+	Owner           string       // 経路を入れたクライアントのプロトコル、空なら消さない
+	Installed       bool         // FIBに書き込めたか
+	Resolved        net.IP       // 再帰で解決した直接つながっているnexthop
+	Inactive        bool         // nexthopが解決できないのでbestに選ばない
+	Multipath       []RIBNexthop // ECMPでNexthopと一緒に使うnexthop
+	VrfID           uint32       // 経路が入っているRibのVRF、RibがAddで決める
+}
+
+// RIBNexthop はECMPのnexthop1つ、Resolved, IndexはNexthopResolverが決める
+type RIBNexthop struct {
+	Nexthop  net.IP
+	Resolved net.IP // 届かなければnil
+	Index    int
+}
+
+// AdminDistance はプロトコルごとのAdministrative Distance (zebraと同じ値)
+var AdminDistance = map[string]uint8{
+	"connected": 0,
+	"kernel":    0,
+	"static":    1,
+	"BGP":       20,
+	"ospf":      110,
+	"isis":      115,
+	"rip":       120,
+	"iBGP":      200,
+}
+
+const distanceUnknown uint8 = 250
+
+func ribDistance(proto string) uint8 {
+	if d, ok := AdminDistance[proto]; ok {
+		return d
+	}
+	return distanceUnknown
+}
+
+// aがbより優先されるか
+func ribBetter(a, b *RIBPrefix) bool {
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	}
+	if a.Metric != b.Metric {
+		return a.Metric < b.Metric
+	}
+	if a.RoutingProtocol != b.RoutingProtocol {
+		return a.RoutingProtocol < b.RoutingProtocol
+	}
+	return a.Owner < b.Owner
+}
+
+// ribRouteID はprefixの中で経路を区別する、同じプロトコルでも持ち主が違えば別の経路
+func ribRouteID(proto, owner string) string {
+	if owner == "" {
+		return proto
+	}
+	return proto + " " + owner
+}
+
+func (rt *RIBPrefix) routeID() string {
+	return ribRouteID(rt.RoutingProtocol, rt.Owner)
+}
+
+// FibHook はprefixごとのbestが変わった時に呼ばれる
+// oldがnilなら追加、newがnilなら削除、両方あれば置き換え
+// FIBに書き込めなかった時はエラーを返す、Ribはそのまま
+type FibHook func(old, new *RIBPrefix) error
+
+// RouteHook はプロトコルごとの経路が追加、置き換え、削除された時に呼ばれる
+type RouteHook func(rt RIBPrefix, delete bool)
+
+// NexthopHook は経路を追加する前に呼ばれ、nexthopを解決してResolved, Index, Inactiveを決める
+type NexthopHook func(rt *RIBPrefix)
+
+// ribNode はPatricia trieのノード
+// routesが空のノードは分岐のためだけにある
+type ribNode struct {
+	key    []byte
+	plen   int
+	child  [2]*ribNode
+	routes map[string]*RIBPrefix // keyはribRouteID
+	fib    *RIBPrefix            // FIBに入っているbest
+}
+
+// Rib はIPv4とIPv6それぞれのtrieで経路を持ち、prefixとプロトコルと持ち主で引く
+type Rib struct {
+	mu      *sync.Mutex
+	v4      *ribNode
+	v6      *ribNode
+	fib     FibHook
+	notify  RouteHook
+	nexthop NexthopHook
+	vrf     uint32
+}
+
+func Init() Rib {
+	return Rib{
+		mu: new(sync.Mutex),
+	}
+}
+
+func ribKey(prefix net.IP, plen int) ([]byte, error) {
+	key := prefix.To4()
+	if key == nil {
+		key = prefix.To16()
+	}
+	if key == nil || plen > len(key)*8 {
+		return nil, fmt.Errorf("rib: bad prefix %s/%d", prefix, plen)
+	}
+	return maskKey(key, plen), nil
+}
+
+func maskKey(key []byte, plen int) []byte {
+	m := make([]byte, len(key))
+	copy(m, key)
+	for i := range m {
+		switch {
+		case plen >= (i+1)*8:
+		case plen <= i*8:
+			m[i] = 0
+		default:
+			m[i] &= ^byte(0xff >> uint(plen-i*8))
+		}
+	}
+	return m
+}
+
+func keyBit(key []byte, i int) int {
+	return int(key[i/8]>>(7-uint(i%8))) & 1
+}
+
+// aとbの先頭max bitのうち一致している長さ
+func commonLen(a, b []byte, max int) int {
+	n := 0
+	for n < max {
+		if n%8 == 0 && n+8 <= max && a[n/8] == b[n/8] {
+			n += 8
+			continue
+		}
+		if keyBit(a, n) != keyBit(b, n) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+func (r *Rib) root(key []byte) **ribNode {
+	if len(key) == net.IPv4len {
+		return &r.v4
+	}
+	return &r.v6
+}
+
+func ribInsert(root **ribNode, key []byte, plen int) *ribNode {
+	p := root
+	for {
+		n := *p
+		if n == nil {
+			n = &ribNode{key: key, plen: plen}
+			*p = n
+			return n
+		}
+
+		max := n.plen
+		if plen < max {
+			max = plen
+		}
+		c := commonLen(n.key, key, max)
+
+		if c == n.plen {
+			if plen == n.plen {
+				return n
+			}
+			p = &n.child[keyBit(key, n.plen)]
+			continue
+		}
+
+		m := &ribNode{key: key, plen: plen}
+		if c == plen {
+			// 新しいprefixがnを含む
+			m.child[keyBit(n.key, plen)] = n
+			*p = m
+			return m
+		}
+
+		glue := &ribNode{key: maskKey(key, c), plen: c}
+		glue.child[keyBit(n.key, c)] = n
+		glue.child[keyBit(key, c)] = m
+		*p = glue
+		return m
+	}
+}
+
+// 完全一致するノードと、そこまでの経路を返す
+func ribSearch(root **ribNode, key []byte, plen int) (*ribNode, []**ribNode) {
+	var path []**ribNode
+
+	p := root
+	for *p != nil {
+		n := *p
+		if n.plen > plen || commonLen(n.key, key, n.plen) < n.plen {
+			return nil, nil
+		}
+		path = append(path, p)
+		if n.plen == plen {
+			return n, path
+		}
+		p = &n.child[keyBit(key, n.plen)]
+	}
+	return nil, nil
+}
+
+// 経路がなくなったノードを消して、子が1つだけの分岐ノードを詰める
+func ribCompact(path []**ribNode) {
+	for i := len(path) - 1; i >= 0; i-- {
+		p := path[i]
+		n := *p
+		if len(n.routes) != 0 {
+			return
+		}
+
+		switch {
+		case n.child[0] != nil && n.child[1] != nil:
+			return
+		case n.child[0] != nil:
+			*p = n.child[0]
+		case n.child[1] != nil:
+			*p = n.child[1]
+		default:
+			*p = nil
+		}
+	}
+}
+
+func ribWalk(n *ribNode, f func(*ribNode)) {
+	if n == nil {
+		return
+	}
+	if len(n.routes) != 0 {
+		f(n)
+	}
+	ribWalk(n.child[0], f)
+	ribWalk(n.child[1], f)
+}
+
+func (n *ribNode) best() *RIBPrefix {
+	var best *RIBPrefix
+	for _, v := range n.routes {
+		if v.Inactive {
+			continue
+		}
+		if best == nil || ribBetter(v, best) {
+			best = v
+		}
+	}
+	return best
+}
+
+// bestを選び直して、変わっていればFIBに反映するための変更を返す
+func (n *ribNode) reselect() *ribChange {
+	best := n.best()
+	if best == n.fib {
+		return nil
+	}
+
+	c := &ribChange{old: n.fib, new: best}
+	if n.fib != nil {
+		n.fib.Installed = false
+	}
+	n.fib = best
+	return c
+}
+
+type ribChange struct {
+	old *RIBPrefix
+	new *RIBPrefix
+}
+
+// ロックを外してから呼ぶ
+func (r *Rib) fibUpdate(c *ribChange) error {
+	if c == nil || r.fib == nil {
+		return nil
+	}
+
+	var old, new *RIBPrefix
+	if c.old != nil {
+		o := *c.old
+		old = &o
+	}
+	if c.new != nil {
+		n := *c.new
+		new = &n
+	}
+	return r.fib(old, new)
+}
+
+// 優先度の高い順に並べる
+func (n *ribNode) sortedRoutes() []RIBPrefix {
+	var routes []RIBPrefix
+	for _, v := range n.routes {
+		routes = append(routes, *v)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return ribBetter(&routes[i], &routes[j])
+	})
+	return routes
+}
+
+func (r *Rib) SetFibHook(f FibHook) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	r.fib = f
+}
+
+func (r *Rib) SetRouteHook(f RouteHook) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	r.notify = f
+}
+
+func (r *Rib) SetNexthopHook(f NexthopHook) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	r.nexthop = f
+}
+
+func (r *Rib) resolve(rt *RIBPrefix) {
+	r.mu.Lock()
+	f := r.nexthop
+	r.mu.Unlock()
+
+	if f != nil {
+		f(rt)
+	}
+}
+
+func (r *Rib) routeUpdate(rt RIBPrefix, delete bool) {
+	if r.notify != nil {
+		r.notify(rt, delete)
+	}
+}
+
+func (r *Rib) RibShow() {
+
+	fmt.Printf("RIB SHOW\n")
+
+	r.Walk(func(v RIBPrefix, selected bool) {
+		mark := "  "
+		switch {
+		case selected && v.Installed:
+			mark = ">*"
+		case selected:
+			mark = "> "
+		}
+		var state string
+		switch {
+		case v.Inactive:
+			state = " inactive"
+		case v.Resolved != nil && !v.Resolved.Equal(v.Nexthop):
+			state = " (recursive via " + v.Resolved.String() + ")"
+		}
+		for _, m := range v.Multipath {
+			if m.Resolved == nil {
+				state += ", " + m.Nexthop.String() + " inactive"
+				continue
+			}
+			state += ", " + m.Nexthop.String()
+		}
+		fmt.Printf("%s%s: %s/%d [%d/%d] via %s%s\n", mark, v.RoutingProtocol, v.Prefix.String(),
+			v.PrefixLen, v.Distance, v.Metric, v.Nexthop.String(), state)
+	})
+}
+
+// Walk はロックを取った状態でfを呼ぶのでf内でRibを触らないこと
+// selectedはbestに選ばれた経路かどうか、FIBに書き込めたかはInstalledを見る
+func (r *Rib) Walk(f func(v RIBPrefix, selected bool)) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	for _, root := range []*ribNode{r.v4, r.v6} {
+		ribWalk(root, func(n *ribNode) {
+			for _, v := range n.sortedRoutes() {
+				f(v, n.fib != nil && n.fib.routeID() == v.routeID())
+			}
+		})
+	}
+}
+
+func (r *Rib) RibFind(prefix net.IP, len uint8, routeType string, owner string) bool {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	_, ok := r.get(prefix, len, ribRouteID(routeType, owner))
+	return ok
+}
+
+// Get はprefixのownerが入れたrouteTypeの経路を返す
+func (r *Rib) Get(prefix net.IP, len uint8, routeType string, owner string) (RIBPrefix, bool) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	v, ok := r.get(prefix, len, ribRouteID(routeType, owner))
+	if !ok {
+		return RIBPrefix{}, false
+	}
+	return *v, true
+}
+
+// FibResult はFIBに書き込んだ結果、rtがまだbestなら記録する
+func (r *Rib) FibResult(rt RIBPrefix, err error) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	key, kerr := ribKey(rt.Prefix, int(rt.PrefixLen))
+	if kerr != nil {
+		return
+	}
+	n, _ := ribSearch(r.root(key), key, int(rt.PrefixLen))
+	if n == nil || n.fib == nil {
+		return
+	}
+	if n.fib.routeID() != rt.routeID() || !n.fib.Nexthop.Equal(rt.Nexthop) {
+		// 結果が返ってくる前にbestが変わった
+		return
+	}
+	n.fib.Installed = err == nil
+}
+
+// Best はprefixのFIBに入っている経路を返す
+func (r *Rib) Best(prefix net.IP, len uint8) (RIBPrefix, bool) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	key, err := ribKey(prefix, int(len))
+	if err != nil {
+		return RIBPrefix{}, false
+	}
+	n, _ := ribSearch(r.root(key), key, int(len))
+	if n == nil || n.fib == nil {
+		return RIBPrefix{}, false
+	}
+	return *n.fib, true
+}
+
+// idはribRouteID
+func (r *Rib) get(prefix net.IP, len uint8, id string) (*RIBPrefix, bool) {
+	key, err := ribKey(prefix, int(len))
+	if err != nil {
+		return nil, false
+	}
+
+	n, _ := ribSearch(r.root(key), key, int(len))
+	if n == nil {
+		return nil, false
+	}
+	v, ok := n.routes[id]
+	return v, ok
+}
+
+// LookupBest はaddrを含むprefixのbestを長い順に見て、skipされなかった最初のものを返す
+func (r *Rib) LookupBest(addr net.IP, skip func(v *RIBPrefix) bool) (RIBPrefix, bool) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	key := addr.To4()
+	if key == nil {
+		key = addr.To16()
+	}
+	if key == nil {
+		return RIBPrefix{}, false
+	}
+
+	var match []*ribNode
+	n := *r.root(key)
+	for n != nil {
+		if commonLen(n.key, key, n.plen) < n.plen {
+			break
+		}
+		if n.fib != nil {
+			match = append(match, n)
+		}
+		if n.plen == len(key)*8 {
+			break
+		}
+		n = n.child[keyBit(key, n.plen)]
+	}
+
+	for i := len(match) - 1; i >= 0; i-- {
+		if !skip(match[i].fib) {
+			return *match[i].fib, true
+		}
+	}
+	return RIBPrefix{}, false
+}
+
+// Lookup はaddrを含む一番長いprefixの経路を優先度の高い順に返す
+func (r *Rib) Lookup(addr net.IP) []RIBPrefix {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	key := addr.To4()
+	if key == nil {
+		key = addr.To16()
+	}
+	if key == nil {
+		return nil
+	}
+
+	var match *ribNode
+	n := *r.root(key)
+	for n != nil {
+		if commonLen(n.key, key, n.plen) < n.plen {
+			break
+		}
+		if len(n.routes) != 0 {
+			match = n
+		}
+		if n.plen == len(key)*8 {
+			break
+		}
+		n = n.child[keyBit(key, n.plen)]
+	}
+
+	if match == nil {
+		return nil
+	}
+	return match.sortedRoutes()
+}
+
+// Add は同じプロトコルと持ち主の経路が既にあればエラーを返す
+func (r *Rib) Add(addRoute RIBPrefix) error {
+
+	addRoute.VrfID = r.vrf
+	r.resolve(&addRoute)
+	c, rt, err := r.add(addRoute, false)
+	if err != nil {
+		return err
+	}
+
+	err = r.fibUpdate(c)
+	r.routeUpdate(rt, false)
+	return err
+}
+
+// Replace は同じプロトコルと持ち主の経路を置き換える、なければ追加する
+func (r *Rib) Replace(addRoute RIBPrefix) error {
+
+	addRoute.VrfID = r.vrf
+	r.resolve(&addRoute)
+	c, rt, err := r.add(addRoute, true)
+	if err != nil {
+		return err
+	}
+
+	err = r.fibUpdate(c)
+	r.routeUpdate(rt, false)
+	return err
+}
+
+func (r *Rib) add(addRoute RIBPrefix, replace bool) (*ribChange, RIBPrefix, error) {
+
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	key, err := ribKey(addRoute.Prefix, int(addRoute.PrefixLen))
+	if err != nil {
+		return nil, addRoute, err
+	}
+
+	if addRoute.Distance == 0 {
+		addRoute.Distance = ribDistance(addRoute.RoutingProtocol)
+	}
+	addRoute.Installed = false
+
+	id := addRoute.routeID()
+	if old, ok := r.get(addRoute.Prefix, addRoute.PrefixLen, id); ok && !replace {
+		return nil, addRoute, fmt.Errorf("rib: %s %s/%d: %w", old.RoutingProtocol,
+			old.Prefix.String(), old.PrefixLen, ErrRouteExists)
+	}
+
+	n := ribInsert(r.root(key), key, int(addRoute.PrefixLen))
+	if n.routes == nil {
+		n.routes = make(map[string]*RIBPrefix)
+	}
+
+	if _, ok := n.routes[id]; ok {
+		log.Printf("RIB Already in prefix, replace")
+	} else {
+		RibCount++
+	}
+
+	addRoute.Prefix = net.IP(key)
+	n.routes[id] = &addRoute
+
+	log.Printf("RIB Add %s: %s/%d via %s\n", addRoute.RoutingProtocol, addRoute.Prefix.String(),
+		addRoute.PrefixLen, addRoute.Nexthop.String())
+
+	return n.reselect(), addRoute, nil
+}
+
+// Delete はownerが入れたrouteTypeの経路を消す、bestが消えた場合は次点の経路がFIBに入る
+func (r *Rib) Delete(prefix net.IP, len uint8, routeType string, owner string) error {
+
+	c, rt, err := r.delete(prefix, len, ribRouteID(routeType, owner))
+	if err != nil {
+		return err
+	}
+
+	err = r.fibUpdate(c)
+	r.routeUpdate(rt, true)
+	return err
+}
+
+func (r *Rib) delete(prefix net.IP, len uint8, id string) (*ribChange, RIBPrefix, error) {
+
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	key, err := ribKey(prefix, int(len))
+	if err != nil {
+		return nil, RIBPrefix{}, err
+	}
+
+	n, path := ribSearch(r.root(key), key, int(len))
+	if n == nil {
+		return nil, RIBPrefix{}, fmt.Errorf("rib: %s %s/%d: %w", id, prefix.String(), len, ErrRouteNotFound)
+	}
+	rt, ok := n.routes[id]
+	if !ok {
+		return nil, RIBPrefix{}, fmt.Errorf("rib: %s %s/%d: %w", id, prefix.String(), len, ErrRouteNotFound)
+	}
+
+	delete(n.routes, id)
+	RibCount--
+	c := n.reselect()
+	ribCompact(path)
+
+	return c, *rt, nil
+}
+
+// DeleteOwner はownerが入れた経路を全部消す
+func (r *Rib) DeleteOwner(owner string) int {
+	var routes []RIBPrefix
+	r.Walk(func(v RIBPrefix, selected bool) {
+		if v.Owner == owner {
+			routes = append(routes, v)
+		}
+	})
+
+	for _, v := range routes {
+		r.Delete(v.Prefix, v.PrefixLen, v.RoutingProtocol, v.Owner)
+	}
+	return len(routes)
+}
@@ -0,0 +1,260 @@
+package nebura
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func ribTestRoute(t *testing.T, prefix string, proto string) RIBPrefix {
+	t.Helper()
+	ip, n, err := net.ParseCIDR(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ones, _ := n.Mask.Size()
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+	return RIBPrefix{Prefix: ip, PrefixLen: uint8(ones), RoutingProtocol: proto}
+}
+
+// ribCheck はtrieの形を確かめる
+// 子は親のprefixに含まれて親の次のbitで分かれ、経路のないノードは必ず2つの子を持つ
+func ribCheck(t *testing.T, n *ribNode) {
+	t.Helper()
+	if n == nil {
+		return
+	}
+	if len(n.routes) == 0 && (n.child[0] == nil || n.child[1] == nil) {
+		t.Errorf("node %v/%d has no route and %v children", net.IP(n.key), n.plen, n.child)
+	}
+	for b, c := range n.child {
+		if c == nil {
+			continue
+		}
+		if c.plen <= n.plen || commonLen(n.key, c.key, n.plen) < n.plen || keyBit(c.key, n.plen) != b {
+			t.Errorf("node %v/%d is not child %d of %v/%d", net.IP(c.key), c.plen, b, net.IP(n.key), n.plen)
+		}
+		ribCheck(t, c)
+	}
+}
+
+func ribPrefixes(r *Rib) []string {
+	var out []string
+	r.Walk(func(v RIBPrefix, selected bool) {
+		out = append(out, fmt.Sprintf("%s/%d", v.Prefix, v.PrefixLen))
+	})
+	return out
+}
+
+func TestRibTrieInsertDelete(t *testing.T) {
+	prefixes := []string{
+		"10.1.1.0/24", "10.0.0.0/8", "10.1.0.0/16", "10.1.1.128/25", "10.2.0.0/16",
+		"192.168.0.0/24", "0.0.0.0/0", "10.1.1.1/32",
+		"2001:db8::/32", "2001:db8:1::/48", "2001:db8:2::/48", "::/0", "2001:db8:1::1/128",
+	}
+
+	r := Init()
+	for _, p := range prefixes {
+		if err := r.Add(ribTestRoute(t, p, "static")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ribCheck(t, r.v4)
+	ribCheck(t, r.v6)
+
+	for _, p := range prefixes {
+		rt := ribTestRoute(t, p, "static")
+		if _, ok := r.Get(rt.Prefix, rt.PrefixLen, "static", ""); !ok {
+			t.Errorf("%s not found", p)
+		}
+	}
+
+	// 分岐のノードは経路として見えない
+	if _, ok := r.Get(net.ParseIP("10.0.0.0").To4(), 14, "static", ""); ok {
+		t.Errorf("glue node returned as a route")
+	}
+	if err := r.Add(ribTestRoute(t, "10.1.0.0/16", "static")); err == nil {
+		t.Errorf("duplicate route added")
+	}
+
+	// 途中のノードを消すと詰められ、子は残る
+	for i, p := range []string{"10.1.0.0/16", "10.1.1.0/24", "2001:db8::/32", "0.0.0.0/0"} {
+		rt := ribTestRoute(t, p, "static")
+		if err := r.Delete(rt.Prefix, rt.PrefixLen, "static", ""); err != nil {
+			t.Fatal(err)
+		}
+		ribCheck(t, r.v4)
+		ribCheck(t, r.v6)
+		if _, ok := r.Get(rt.Prefix, rt.PrefixLen, "static", ""); ok {
+			t.Errorf("%s found after delete", p)
+		}
+		if n := len(ribPrefixes(&r)); n != len(prefixes)-i-1 {
+			t.Errorf("%d routes after deleting %s, want %d", n, p, len(prefixes)-i-1)
+		}
+	}
+	rt := ribTestRoute(t, "10.1.1.128/25", "static")
+	if _, ok := r.Get(rt.Prefix, rt.PrefixLen, "static", ""); !ok {
+		t.Errorf("child of deleted node lost")
+	}
+	if err := r.Delete(rt.Prefix, rt.PrefixLen, "static", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete(rt.Prefix, rt.PrefixLen, "static", ""); err == nil {
+		t.Errorf("deleted twice")
+	}
+
+	for _, p := range prefixes {
+		rt := ribTestRoute(t, p, "static")
+		r.Delete(rt.Prefix, rt.PrefixLen, "static", "")
+	}
+	if r.v4 != nil || r.v6 != nil {
+		t.Errorf("nodes left after deleting every route: %v %v", r.v4, r.v6)
+	}
+}
+
+func TestRibLongestMatch(t *testing.T) {
+	r := Init()
+	for _, p := range []string{
+		"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "10.1.1.128/25",
+		"::/0", "2001:db8::/32", "2001:db8:1::/48", "2001:db8:1:1::/64",
+	} {
+		if err := r.Add(ribTestRoute(t, p, "static")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"10.1.1.200", "10.1.1.128/25"},
+		{"10.1.1.1", "10.1.1.0/24"},
+		{"10.1.2.1", "10.1.0.0/16"},
+		{"10.2.0.1", "10.0.0.0/8"},
+		{"192.0.2.1", "0.0.0.0/0"},
+		{"2001:db8:1:1::1", "2001:db8:1:1::/64"},
+		{"2001:db8:1:2::1", "2001:db8:1::/48"},
+		{"2001:db8:2::1", "2001:db8::/32"},
+		{"2001:db9::1", "::/0"},
+	}
+
+	for _, tt := range tests {
+		addr := net.ParseIP(tt.addr)
+		routes := r.Lookup(addr)
+		if len(routes) != 1 || fmt.Sprintf("%s/%d", routes[0].Prefix, routes[0].PrefixLen) != tt.want {
+			t.Errorf("lookup %s: %v, want %s", tt.addr, routes, tt.want)
+		}
+		best, ok := r.LookupBest(addr, func(v *RIBPrefix) bool { return false })
+		if !ok || fmt.Sprintf("%s/%d", best.Prefix, best.PrefixLen) != tt.want {
+			t.Errorf("lookup best %s: %v, want %s", tt.addr, best, tt.want)
+		}
+	}
+
+	// skipした経路は飛ばして次に長いprefixを返す
+	best, ok := r.LookupBest(net.ParseIP("10.1.1.200"), func(v *RIBPrefix) bool { return v.PrefixLen >= 24 })
+	if !ok || best.PrefixLen != 16 {
+		t.Errorf("lookup best skipping /24 and longer: %v", best)
+	}
+	if _, ok := r.LookupBest(net.ParseIP("10.1.1.200"), func(v *RIBPrefix) bool { return true }); ok {
+		t.Errorf("lookup best returned a skipped route")
+	}
+
+	// デフォルトがなければ届かない
+	rt := ribTestRoute(t, "0.0.0.0/0", "static")
+	r.Delete(rt.Prefix, rt.PrefixLen, "static", "")
+	if routes := r.Lookup(net.ParseIP("192.0.2.1")); routes != nil {
+		t.Errorf("lookup without default: %v", routes)
+	}
+}
+
+// Walkは短いprefixから、同じ長さならアドレス順で、IPv4のあとにIPv6
+func TestRibWalkOrder(t *testing.T) {
+	r := Init()
+	for _, p := range []string{
+		"2001:db8::/32", "10.2.0.0/16", "10.1.1.0/24", "10.0.0.0/8", "10.1.0.0/16", "192.168.0.0/16", "::/0",
+	} {
+		if err := r.Add(ribTestRoute(t, p, "static")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.1.0/24", "10.2.0.0/16", "192.168.0.0/16", "::/0", "2001:db8::/32"}
+	got := ribPrefixes(&r)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("walk %v, want %v", got, want)
+	}
+}
+
+func TestRibBetter(t *testing.T) {
+	route := func(proto, owner string, distance uint8, metric uint32) RIBPrefix {
+		return RIBPrefix{RoutingProtocol: proto, Owner: owner, Distance: distance, Metric: metric}
+	}
+
+	tests := []struct {
+		name string
+		a, b RIBPrefix
+	}{
+		{"lower distance", route("static", "", 1, 100), route("BGP", "", 20, 0)},
+		{"distance before metric", route("ospf", "", 110, 1000), route("rip", "", 120, 1)},
+		{"lower metric on same distance", route("BGP", "", 20, 10), route("ospf", "", 20, 20)},
+		{"protocol name on tie", route("BGP", "", 20, 10), route("ospf", "", 20, 10)},
+		{"owner on tie", route("static", "BGP", 1, 0), route("static", "OSPF", 1, 0)},
+	}
+
+	for _, tt := range tests {
+		if !ribBetter(&tt.a, &tt.b) {
+			t.Errorf("%s: %v not better than %v", tt.name, tt.a, tt.b)
+		}
+		if ribBetter(&tt.b, &tt.a) {
+			t.Errorf("%s: %v better than %v", tt.name, tt.b, tt.a)
+		}
+	}
+}
+
+// 同じプロトコルでも持ち主が違えば別の経路で、bestが消えると次点がFIBに入る
+func TestRibRunnerUp(t *testing.T) {
+	r := Init()
+	var ops []string
+	r.SetFibHook(func(old, new *RIBPrefix) error {
+		op := "delete"
+		if new != nil {
+			op = new.routeID()
+		}
+		ops = append(ops, op)
+		return nil
+	})
+
+	add := func(proto, owner string, metric uint32) RIBPrefix {
+		rt := ribTestRoute(t, "192.0.2.0/24", proto)
+		rt.Owner = owner
+		rt.Metric = metric
+		if err := r.Add(rt); err != nil {
+			t.Fatal(err)
+		}
+		return rt
+	}
+	add("BGP", "BGP", 0)
+	add("static", "OSPF", 20)
+	add("static", "", 10)
+	add("ospf", "ospf", 0)
+
+	if routes := r.Lookup(net.ParseIP("192.0.2.1")); len(routes) != 4 {
+		t.Fatalf("%d routes, want 4: %v", len(routes), routes)
+	}
+
+	prefix := net.ParseIP("192.0.2.0").To4()
+	for _, del := range []struct{ proto, owner string }{
+		{"static", ""}, {"static", "OSPF"}, {"BGP", "BGP"}, {"ospf", "ospf"},
+	} {
+		if err := r.Delete(prefix, 24, del.proto, del.owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"BGP BGP", "static OSPF", "static", "static OSPF", "BGP BGP", "ospf ospf", "delete"}
+	if fmt.Sprint(ops) != fmt.Sprint(want) {
+		t.Errorf("fib ops %v, want %v", ops, want)
+	}
+}
@@ -0,0 +1,255 @@
+package nebura
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Seg6Route はSRv6でencapする経路、Segsは通る順に並べる
+type Seg6Route struct {
+	Prefix    net.IP
+	PrefixLen uint8
+	Segs      []net.IP
+	Mode      uint8
+	Owner     string
+}
+
+// encapのmode、値はkernelのSEG6_IPTUN_MODE_*
+// nlにはinlineとencapしかないのでl2encapとencap.redは自分で定義する
+const (
+	Seg6ModeInline   uint8 = nl.SEG6_IPTUN_MODE_INLINE // H.Insert、IPv6の宛先だけ
+	Seg6ModeEncap    uint8 = nl.SEG6_IPTUN_MODE_ENCAP  // H.Encaps
+	Seg6ModeL2Encap  uint8 = 2                         // H.Encaps.L2
+	Seg6ModeEncapRed uint8 = 3                         // H.Encaps.Red、kernel 5.19から
+)
+
+// seg6ModeNames はmodeの値の順に並べたip routeと同じ名前
+var seg6ModeNames = [...]string{
+	Seg6ModeInline:   "inline",
+	Seg6ModeEncap:    "encap",
+	Seg6ModeL2Encap:  "l2encap",
+	Seg6ModeEncapRed: "encap.red",
+}
+
+func seg6ModeString(mode uint8) string {
+	if int(mode) < len(seg6ModeNames) {
+		return seg6ModeNames[mode]
+	}
+	return fmt.Sprintf("mode %d", mode)
+}
+
+// Seg6ModeParse はip routeと同じ名前のmodeを返す、空ならencap
+func Seg6ModeParse(s string) (uint8, error) {
+	if s == "" {
+		return Seg6ModeEncap, nil
+	}
+	for mode, name := range seg6ModeNames {
+		if name == s {
+			return uint8(mode), nil
+		}
+	}
+	return 0, fmt.Errorf("seg6: unknown mode %q", s)
+}
+
+// seg6ModeValid はmodeが宛先のfamilyで使えるか見る
+// inlineは元のIPv6ヘッダにSRHを入れるのでIPv4の宛先には使えない
+func seg6ModeValid(mode uint8, prefix net.IP) error {
+	switch mode {
+	case Seg6ModeInline:
+		if prefix.To4() != nil {
+			return fmt.Errorf("seg6: inline mode for ipv4 prefix %s", prefix.String())
+		}
+	case Seg6ModeEncap, Seg6ModeL2Encap, Seg6ModeEncapRed:
+	default:
+		return fmt.Errorf("seg6: unknown mode %d", mode)
+	}
+	return nil
+}
+
+// SRHのHdr Ext Lenは1byteなので8byte単位で255まで
+const seg6SegsMax = 127
+
+func seg6SegsString(segs []net.IP) string {
+	s := make([]string, len(segs))
+	for i, seg := range segs {
+		s[i] = seg.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func seg6Key(prefix net.IP, plen uint8) string {
+	return fibPrefix(prefix, plen).String()
+}
+
+// Seg6LocalRoute はSIDに対するEnd actionの経路
+type Seg6LocalRoute struct {
+	Sid       net.IP
+	EndAction uint8
+	Nexthop   net.IP
+	Owner     string
+}
+
+// Seg6Table はneburaが入れたSRv6の経路を持ち、カーネルと揃える
+type Seg6Table struct {
+	mu    sync.Mutex
+	fib   Fib
+	encap map[string]*Seg6Route
+	local map[string]*Seg6LocalRoute
+}
+
+func Seg6TableInit(fib Fib) *Seg6Table {
+	return &Seg6Table{
+		fib:   fib,
+		encap: make(map[string]*Seg6Route),
+		local: make(map[string]*Seg6LocalRoute),
+	}
+}
+
+func (t *Seg6Table) Add(rt Seg6Route) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	key := seg6Key(rt.Prefix, rt.PrefixLen)
+	if _, ok := t.encap[key]; ok {
+		return fmt.Errorf("seg6: %s: %w", key, ErrRouteExists)
+	}
+
+	if err := t.fib.Seg6Add(&rt); err != nil {
+		return err
+	}
+	t.encap[key] = &rt
+	log.Printf("SEG6 Add %s %s segs %s\n", key, seg6ModeString(rt.Mode), seg6SegsString(rt.Segs))
+	return nil
+}
+
+// Replace は経路がなければ追加する
+func (t *Seg6Table) Replace(rt Seg6Route) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	key := seg6Key(rt.Prefix, rt.PrefixLen)
+	if err := t.fib.Seg6Add(&rt); err != nil { // replace
+		return err
+	}
+	t.encap[key] = &rt
+	log.Printf("SEG6 Replace %s %s segs %s\n", key, seg6ModeString(rt.Mode), seg6SegsString(rt.Segs))
+	return nil
+}
+
+func (t *Seg6Table) Delete(prefix net.IP, plen uint8) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	key := seg6Key(prefix, plen)
+	rt, ok := t.encap[key]
+	if !ok {
+		return fmt.Errorf("seg6: %s: %w", key, ErrRouteNotFound)
+	}
+
+	delete(t.encap, key)
+	log.Printf("SEG6 Delete %s\n", key)
+	return t.fib.Seg6Delete(rt)
+}
+
+func (t *Seg6Table) LocalAdd(rt Seg6LocalRoute) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	key := rt.Sid.String()
+	if _, ok := t.local[key]; ok {
+		return fmt.Errorf("seg6local: %s: %w", key, ErrRouteExists)
+	}
+
+	if err := t.fib.Seg6LocalAdd(&rt); err != nil {
+		return err
+	}
+	t.local[key] = &rt
+	log.Printf("SEG6LOCAL Add %s action %d\n", key, rt.EndAction)
+	return nil
+}
+
+func (t *Seg6Table) LocalReplace(rt Seg6LocalRoute) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	key := rt.Sid.String()
+	old, ok := t.local[key]
+	if ok && old.EndAction != rt.EndAction {
+		// actionが変わる場合は古い方を消してから入れる
+		if err := t.fib.Seg6LocalDelete(old); err != nil {
+			log.Printf("SEG6LOCAL Replace %s: %v", key, err)
+		}
+	}
+
+	if err := t.fib.Seg6LocalAdd(&rt); err != nil {
+		return err
+	}
+	t.local[key] = &rt
+	log.Printf("SEG6LOCAL Replace %s action %d\n", key, rt.EndAction)
+	return nil
+}
+
+func (t *Seg6Table) LocalDelete(sid net.IP) error {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	key := sid.String()
+	rt, ok := t.local[key]
+	if !ok {
+		return fmt.Errorf("seg6local: %s: %w", key, ErrRouteNotFound)
+	}
+
+	delete(t.local, key)
+	log.Printf("SEG6LOCAL Delete %s\n", key)
+	return t.fib.Seg6LocalDelete(rt)
+}
+
+func (t *Seg6Table) has(prefix net.IP, plen uint8) bool {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	_, ok := t.encap[seg6Key(prefix, plen)]
+	return ok
+}
+
+func (t *Seg6Table) hasLocal(sid net.IP) bool {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	_, ok := t.local[sid.String()]
+	return ok
+}
+
+// DeleteOwner はownerが入れた経路を全部消す
+func (t *Seg6Table) DeleteOwner(owner string) int {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	n := 0
+	for key, rt := range t.encap {
+		if rt.Owner != owner {
+			continue
+		}
+		delete(t.encap, key)
+		if err := t.fib.Seg6Delete(rt); err != nil {
+			log.Printf("SEG6 Delete %s: %v", key, err)
+		}
+		n++
+	}
+	for key, rt := range t.local {
+		if rt.Owner != owner {
+			continue
+		}
+		delete(t.local, key)
+		if err := t.fib.Seg6LocalDelete(rt); err != nil {
+			log.Printf("SEG6LOCAL Delete %s: %v", key, err)
+		}
+		n++
+	}
+	return n
+}
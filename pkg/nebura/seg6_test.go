@@ -0,0 +1,140 @@
+package nebura
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func seg6TestSegs(n int) []net.IP {
+	segs := make([]net.IP, n)
+	for i := range segs {
+		segs[i] = net.ParseIP(fmt.Sprintf("fc00:%x::1", i+1))
+	}
+	return segs
+}
+
+func TestSeg6Srh(t *testing.T) {
+	a := net.ParseIP("fc00:1::1")
+	b := net.ParseIP("fc00:2::1")
+	c := net.ParseIP("fc00:3::1")
+
+	tests := []struct {
+		name string
+		segs []net.IP
+		mode uint8
+		want []net.IP
+	}{
+		{"single", []net.IP{a}, Seg6ModeEncap, []net.IP{a}},
+		{"reversed", []net.IP{a, b, c}, Seg6ModeEncap, []net.IP{c, b, a}},
+		{"encap.red", []net.IP{a, b}, Seg6ModeEncapRed, []net.IP{b, a}},
+		// inlineはSegment List[0]を元の宛先のために空ける
+		{"inline", []net.IP{a, b}, Seg6ModeInline, []net.IP{net.IPv6zero, b, a}},
+	}
+	for _, tt := range tests {
+		got := seg6Srh(tt.segs, tt.mode)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: srh %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !got[i].Equal(tt.want[i]) || len(got[i]) != net.IPv6len {
+				t.Errorf("%s: srh %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+// SRHに入るsegmentは127まで、inlineは空ける分1つ少ない
+func TestSeg6RouteParseSegsMax(t *testing.T) {
+	s := &NservSession{Protocol: "ISIS"}
+
+	tests := []struct {
+		name string
+		segs int
+		mode uint8
+		ok   bool
+	}{
+		{"encap max", seg6SegsMax, Seg6ModeEncap, true},
+		{"encap over", seg6SegsMax + 1, Seg6ModeEncap, false},
+		{"inline max", seg6SegsMax - 1, Seg6ModeInline, true},
+		{"inline over", seg6SegsMax, Seg6ModeInline, false},
+	}
+	for _, tt := range tests {
+		msg := &NclientSeg6Add{
+			EncapPrefix: Prefix{Prefix: net.ParseIP("2001:db8::"), PrefixLen: 64},
+			Segs:        seg6TestSegs(tt.segs),
+			Mode:        tt.mode,
+		}
+		buf, err := msg.writeTo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlv, err := tlvDecode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rt, err := seg6RouteParse(s, tlv)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %d segments err %v, want ok %v", tt.name, tt.segs, err, tt.ok)
+			continue
+		}
+		if tt.ok && (len(rt.Segs) != tt.segs || rt.Mode != tt.mode || rt.Owner != "ISIS") {
+			t.Errorf("%s: parsed %d segments mode %d owner %s", tt.name, len(rt.Segs), rt.Mode, rt.Owner)
+		}
+	}
+}
+
+func TestSeg6ModeParse(t *testing.T) {
+	tests := []struct {
+		name string
+		mode uint8
+		ok   bool
+	}{
+		{"", Seg6ModeEncap, true},
+		{"inline", Seg6ModeInline, true},
+		{"encap", Seg6ModeEncap, true},
+		{"l2encap", Seg6ModeL2Encap, true},
+		{"encap.red", Seg6ModeEncapRed, true},
+		{"Encap", 0, false},
+		{"insert", 0, false},
+	}
+	for _, tt := range tests {
+		mode, err := Seg6ModeParse(tt.name)
+		if (err == nil) != tt.ok || (tt.ok && mode != tt.mode) {
+			t.Errorf("%q: mode %d err %v, want %d ok %v", tt.name, mode, err, tt.mode, tt.ok)
+		}
+		if tt.ok && tt.name != "" && seg6ModeString(mode) != tt.name {
+			t.Errorf("%q: string %q", tt.name, seg6ModeString(mode))
+		}
+	}
+}
+
+func TestSeg6ModeValid(t *testing.T) {
+	v4 := net.ParseIP("10.0.0.0").To4()
+	v6 := net.ParseIP("2001:db8::")
+
+	tests := []struct {
+		name   string
+		mode   uint8
+		prefix net.IP
+		ok     bool
+	}{
+		{"inline ipv6", Seg6ModeInline, v6, true},
+		// inlineは元のIPv6ヘッダにSRHを入れるのでIPv4には使えない
+		{"inline ipv4", Seg6ModeInline, v4, false},
+		{"inline ipv4 16byte", Seg6ModeInline, net.ParseIP("10.0.0.0"), false},
+		{"encap ipv4", Seg6ModeEncap, v4, true},
+		{"encap ipv6", Seg6ModeEncap, v6, true},
+		{"l2encap", Seg6ModeL2Encap, v6, true},
+		{"encap.red ipv4", Seg6ModeEncapRed, v4, true},
+		{"unknown", Seg6ModeEncapRed + 1, v6, false},
+	}
+	for _, tt := range tests {
+		if err := seg6ModeValid(tt.mode, tt.prefix); (err == nil) != tt.ok {
+			t.Errorf("%s: err %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package nebura
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// VRF
+// VRFごとにRibとNexthopResolverを持ち、kernelではVRFのデバイスとrouting tableに対応する
+// VRF IDはrouting tableのIDと同じにする、0はデフォルトのVRFでmain tableを使う
+// nebura APIのメッセージはヘッダのVRF IDのVRFに対して処理される
+
+const VrfDefault uint32 = 0
+
+var ErrVrfNotFound = errors.New("vrf not found")
+
+// fibTable はVRFの経路を書くrouting table
+func fibTable(vrf uint32) uint32 {
+	if vrf == VrfDefault {
+		return syscall.RT_TABLE_MAIN
+	}
+	return vrf
+}
+
+// tableVrf はrouting tableのVRF ID
+func tableVrf(table uint32) uint32 {
+	if table == syscall.RT_TABLE_MAIN {
+		return VrfDefault
+	}
+	return table
+}
+
+// VRFに使えないtable (unspec, default, main, local)
+func vrfTableReserved(table uint32) bool {
+	switch table {
+	case syscall.RT_TABLE_UNSPEC, syscall.RT_TABLE_DEFAULT, syscall.RT_TABLE_MAIN, syscall.RT_TABLE_LOCAL:
+		return true
+	}
+	return false
+}
+
+type Vrf struct {
+	ID      uint32
+	Name    string // デフォルトは空
+	Index   int    // VRFデバイスのindex、デフォルトは0
+	Rib     *Rib
+	Nexthop *NexthopResolver
+}
+
+func vrfInit(id uint32, name string, rib *Rib) *Vrf {
+	rib.vrf = id
+	return &Vrf{
+		ID:      id,
+		Name:    name,
+		Rib:     rib,
+		Nexthop: NexthopResolverInit(rib),
+	}
+}
+
+// vrfTable はイベント処理のgoroutineが変更する、kernelの監視からも引くのでロックを取る
+type vrfTable struct {
+	mu     sync.Mutex
+	byID   map[uint32]*Vrf
+	byName map[string]*Vrf
+}
+
+func vrfTableInit(def *Vrf) *vrfTable {
+	return &vrfTable{
+		byID:   map[uint32]*Vrf{def.ID: def},
+		byName: make(map[string]*Vrf),
+	}
+}
+
+func (t *vrfTable) add(v *Vrf) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	t.byID[v.ID] = v
+	t.byName[v.Name] = v
+}
+
+func (t *vrfTable) delete(v *Vrf) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	delete(t.byID, v.ID)
+	delete(t.byName, v.Name)
+}
+
+func (t *vrfTable) get(id uint32) (*Vrf, bool) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	v, ok := t.byID[id]
+	return v, ok
+}
+
+func (t *vrfTable) name(name string) (*Vrf, bool) {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	v, ok := t.byName[name]
+	return v, ok
+}
+
+// list はIDの順に返す、デフォルトが先頭
+func (t *vrfTable) list() []*Vrf {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	var vrfs []*Vrf
+	for _, v := range t.byID {
+		vrfs = append(vrfs, v)
+	}
+	sort.Slice(vrfs, func(i, j int) bool {
+		return vrfs[i].ID < vrfs[j].ID
+	})
+	return vrfs
+}
+
+// Vrf はVRF IDのVRFを返す
+func (ns *Nserver) Vrf(id uint32) (*Vrf, error) {
+	v, ok := ns.vrfs.get(id)
+	if !ok {
+		return nil, fmt.Errorf("vrf %d: %w", id, ErrVrfNotFound)
+	}
+	return v, nil
+}
+
+// vrfRib はrtが入っているVRFのRib、VRFが消えていればnil
+func (ns *Nserver) vrfRib(rt *RIBPrefix) *Rib {
+	v, ok := ns.vrfs.get(rt.VrfID)
+	if !ok {
+		return nil
+	}
+	return v.Rib
+}
+
+// vrfStart はVRFのRibの変更をFIBとクライアントに流す
+func (ns *Nserver) vrfStart(v *Vrf) {
+	v.Rib.SetFibHook(ns.FibUpdate)
+	v.Rib.SetRouteHook(ns.routeChanged)
+	v.Rib.SetNexthopHook(v.Nexthop.Resolve)
+}
+
+type vrfBody struct {
+	Name  string
+	Table uint32
+	Index uint32
+}
+
+func (b *vrfBody) writeTo() ([]byte, error) {
+	var buf []byte
+
+	buf = appendTlv(buf, tlvVrfName, []byte(b.Name))
+	if b.Table != 0 {
+		buf = appendTlvU32(buf, tlvTable, b.Table)
+	}
+	if b.Index != 0 {
+		buf = appendTlvU32(buf, tlvIfIndex, b.Index)
+	}
+	return buf, nil
+}
+
+// VrfAdd はVRFデバイスを作ってtableのVRFを登録する
+func (ns *Nserver) VrfAdd(t tlvs) error {
+	name := string(t[tlvVrfName])
+	if name == "" {
+		return &tlvError{Type: tlvVrfName, Msg: "empty"}
+	}
+	table, err := t.u32(tlvTable)
+	if err != nil {
+		return err
+	}
+	if vrfTableReserved(table) {
+		return &tlvError{Type: tlvTable, Msg: fmt.Sprintf("table %d reserved", table)}
+	}
+
+	if v, ok := ns.vrfs.get(table); ok {
+		return fmt.Errorf("vrf %s table %d: %w", v.Name, table, ErrRouteExists)
+	}
+	if _, ok := ns.vrfs.name(name); ok {
+		return fmt.Errorf("vrf %s: %w", name, ErrRouteExists)
+	}
+
+	index, err := ns.Fib.VrfAdd(name, table)
+	if err != nil {
+		return err
+	}
+
+	rib := Init()
+	v := vrfInit(table, name, &rib)
+	v.Index = index
+	ns.vrfStart(v)
+	ns.vrfs.add(v)
+	if ns.kernel {
+		if err := ns.kernelTableSync(v); err != nil {
+			log.Printf("VRF %s: %v", name, err)
+		}
+	}
+
+	log.Printf("VRF %s table %d add\n", name, table)
+	return nil
+}
+
+// VrfDelete はVRFの経路を全部消してからデバイスを消す
+func (ns *Nserver) VrfDelete(t tlvs) error {
+	name := string(t[tlvVrfName])
+	v, ok := ns.vrfs.name(name)
+	if !ok {
+		return fmt.Errorf("vrf %q: %w", name, ErrVrfNotFound)
+	}
+
+	// 経路を消した時の通知を送ってから、VRFへの登録を消す
+	cnt := vrfFlush(v)
+	ns.vrfSessionFlush(v.ID)
+	ns.vrfs.delete(v)
+	if err := ns.Fib.VrfDelete(name); err != nil {
+		return err
+	}
+
+	log.Printf("VRF %s delete, %d routes removed\n", name, cnt)
+	return nil
+}
+
+// vrfSessionFlush はセッションのredistributeとNHT、staticのBFDのうちidのVRFのものを消す
+func (ns *Nserver) vrfSessionFlush(id uint32) {
+	ns.mu.Lock()
+	var sessions []*NservSession
+	for _, s := range ns.sessions {
+		sessions = append(sessions, s)
+	}
+	ns.mu.Unlock()
+
+	for _, s := range sessions {
+		for k := range s.subs {
+			if k.Vrf == id {
+				delete(s.subs, k)
+			}
+		}
+		for key, st := range s.nhts {
+			if st.Vrf == id {
+				delete(s.nhts, key)
+			}
+		}
+	}
+	for key := range ns.staticBfd {
+		if key.vrf == id {
+			ns.staticBfdUnregister(key)
+		}
+	}
+}
+
+func vrfFlush(v *Vrf) int {
+	var routes []RIBPrefix
+	v.Rib.Walk(func(rt RIBPrefix, selected bool) {
+		routes = append(routes, rt)
+	})
+
+	for _, rt := range routes {
+		v.Rib.Delete(rt.Prefix, rt.PrefixLen, rt.RoutingProtocol, rt.Owner)
+	}
+	return len(routes)
+}
+
+// VrfBind はinterfaceをVRFに入れる、名前が空ならVRFから外す
+func (ns *Nserver) VrfBind(t tlvs) error {
+	index, err := t.u32(tlvIfIndex)
+	if err != nil {
+		return err
+	}
+
+	name := string(t[tlvVrfName])
+	if name == "" {
+		return ns.Fib.VrfBind(int(index), 0)
+	}
+
+	v, ok := ns.vrfs.name(name)
+	if !ok {
+		return fmt.Errorf("vrf %q: %w", name, ErrVrfNotFound)
+	}
+	return ns.Fib.VrfBind(int(index), v.Index)
+}
+
+func (n *Nclient) SendNclientVrfAdd(name string, table uint32) error {
+	return n.sendNclientAPI(vrfAdd, &vrfBody{Name: name, Table: table})
+}
+
+func (n *Nclient) SendNclientVrfDelete(name string) error {
+	return n.sendNclientAPI(vrfDelete, &vrfBody{Name: name})
+}
+
+// SendNclientVrfBind はinterをVRFのnameに入れる、nameが空ならVRFから外す
+func (n *Nclient) SendNclientVrfBind(name string, inter string) error {
+	i, err := net.InterfaceByName(inter)
+	if err != nil {
+		return err
+	}
+
+	return n.sendNclientAPI(vrfBind, &vrfBody{Name: name, Index: uint32(i.Index)})
+}
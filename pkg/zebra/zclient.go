@@ -171,6 +171,7 @@ type Zclient struct {
 	routeType RouteType
 	Conn      net.Conn
 	Version   uint8
+	VrfID     uint32 // 0ならdefault VRF
 }
 
 type helloBody struct {
@@ -351,7 +352,7 @@ func (c *Zclient) SendHello() error {
 			routeType: c.routeType,
 			instance:  0,
 		}
-		return c.sendCommand(hello, 0, body)
+		return c.sendCommand(hello, c.VrfID, body)
 	}
 	return nil
 }
@@ -370,17 +371,19 @@ func (c *Zclient) SendRouteAdd(prefix string, nexthop string) error {
 		},
 		Nexthops: []Nexthop{
 			{
-				Gate: net.ParseIP(nexthop),
+				VrfID: c.VrfID,
+				Gate:  net.ParseIP(nexthop),
 			},
 		},
 		Distance: uint8(0),
 		Metric:   uint32(0),
 		Mtu:      uint32(0),
 	}
-	return c.sendCommand(RouteAdd, 0, body) // body interface
+	return c.sendCommand(RouteAdd, c.VrfID, body) // body interface
 }
 
-func ZebraClientInit() (*Zclient, error) {
+// ZebraClientInit はvrfIDのVRFに経路を入れるクライアントを作る、0ならdefault VRF
+func ZebraClientInit(vrfID uint32) (*Zclient, error) {
 	conn, err := net.Dial("unix", "/var/run/frr/zserv.api")
 
 	if err != nil {
@@ -391,6 +394,7 @@ func ZebraClientInit() (*Zclient, error) {
 		routeType: RouteBGP,
 		Conn:      conn,
 		Version:   6,
+		VrfID:     vrfID,
 	}
 
 	return c, nil